@@ -0,0 +1,274 @@
+// Code generated by iproto-gen from spec.go. DO NOT EDIT.
+
+package api
+
+import (
+	"context"
+	"github.com/Bambelbl/iproto-server/packet/request_packet"
+)
+
+const (
+	ADM_STORAGE_SWITCH_READONLY_ID    = 0x00010001
+	ADM_STORAGE_SWITCH_READWRITE_ID   = 0x00010002
+	ADM_STORAGE_SWITCH_MAINTENANCE_ID = 0x00010003
+	ADM_STORAGE_SNAPSHOT_ID           = 0x00010004
+	STORAGE_REPLACE_ID                = 0x00020001
+	STORAGE_READ_ID                   = 0x00020002
+	STORAGE_CAS_ID                    = 0x00020003
+	STORAGE_REPLACE_IF_VERSION_ID     = 0x00020004
+	STORAGE_READ_MANY_ID              = 0x00020005
+	STORAGE_REPLACE_MANY_ID           = 0x00020006
+	STORAGE_SCAN_ID                   = 0x00020007
+	STORAGE_REPLACE_TTL_ID            = 0x00020008
+	STORAGE_TTL_ID                    = 0x00020009
+	STORAGE_WATCH_ID                  = 0x0002000a
+	STORAGE_UNWATCH_ID                = 0x0002000b
+)
+
+// UnmarshalBody from msgpack values to IndexRequest
+func (r *IndexRequest) UnmarshalBody(data []byte) error {
+	return request_packet.UnmarshalValues(data, &r.Idx)
+}
+
+// MarshalBody from IndexRequest to msgpack values
+func (r IndexRequest) MarshalBody() ([]byte, error) {
+	return request_packet.MarshalValues(r.Idx)
+}
+
+// UnmarshalBody from msgpack values to ReplaceRequest
+func (r *ReplaceRequest) UnmarshalBody(data []byte) error {
+	return request_packet.UnmarshalValues(data, &r.Idx, &r.Str)
+}
+
+// MarshalBody from ReplaceRequest to msgpack values
+func (r ReplaceRequest) MarshalBody() ([]byte, error) {
+	return request_packet.MarshalValues(r.Idx, r.Str)
+}
+
+// UnmarshalBody from msgpack values to CASRequest
+func (r *CASRequest) UnmarshalBody(data []byte) error {
+	return request_packet.UnmarshalValues(data, &r.Idx, &r.Expected, &r.New)
+}
+
+// MarshalBody from CASRequest to msgpack values
+func (r CASRequest) MarshalBody() ([]byte, error) {
+	return request_packet.MarshalValues(r.Idx, r.Expected, r.New)
+}
+
+// UnmarshalBody from msgpack values to VersionRequest
+func (r *VersionRequest) UnmarshalBody(data []byte) error {
+	return request_packet.UnmarshalValues(data, &r.Idx, &r.Version, &r.Str)
+}
+
+// MarshalBody from VersionRequest to msgpack values
+func (r VersionRequest) MarshalBody() ([]byte, error) {
+	return request_packet.MarshalValues(r.Idx, r.Version, r.Str)
+}
+
+// UnmarshalBody from msgpack values to ScanRequest
+func (r *ScanRequest) UnmarshalBody(data []byte) error {
+	return request_packet.UnmarshalValues(data, &r.From, &r.To, &r.Limit)
+}
+
+// MarshalBody from ScanRequest to msgpack values
+func (r ScanRequest) MarshalBody() ([]byte, error) {
+	return request_packet.MarshalValues(r.From, r.To, r.Limit)
+}
+
+// UnmarshalBody from msgpack values to TTLRequest
+func (r *TTLRequest) UnmarshalBody(data []byte) error {
+	return request_packet.UnmarshalValues(data, &r.Idx, &r.Str, &r.TTL)
+}
+
+// MarshalBody from TTLRequest to msgpack values
+func (r TTLRequest) MarshalBody() ([]byte, error) {
+	return request_packet.MarshalValues(r.Idx, r.Str, r.TTL)
+}
+
+// UnmarshalBody from msgpack values to UnwatchRequest
+func (r *UnwatchRequest) UnmarshalBody(data []byte) error {
+	return request_packet.UnmarshalValues(data, &r.Request_id)
+}
+
+// MarshalBody from UnwatchRequest to msgpack values
+func (r UnwatchRequest) MarshalBody() ([]byte, error) {
+	return request_packet.MarshalValues(r.Request_id)
+}
+
+// UnmarshalBody from msgpack values to Notification
+func (r *Notification) UnmarshalBody(data []byte) error {
+	return request_packet.UnmarshalValues(data, &r.Idx, &r.Str, &r.Version, &r.State, &r.Dropped)
+}
+
+// MarshalBody from Notification to msgpack values
+func (r Notification) MarshalBody() ([]byte, error) {
+	return request_packet.MarshalValues(r.Idx, r.Str, r.Version, r.State, r.Dropped)
+}
+
+// Handlers is implemented by handlers of functions declared in spec.go
+type Handlers interface {
+	ADM_STORAGE_SWITCH_READONLY(ctx context.Context, req Nil) (Nil, error)
+	ADM_STORAGE_SWITCH_READWRITE(ctx context.Context, req Nil) (Nil, error)
+	ADM_STORAGE_SWITCH_MAINTENANCE(ctx context.Context, req Nil) (Nil, error)
+	ADM_STORAGE_SNAPSHOT(ctx context.Context, req Nil) (string, error)
+	STORAGE_REPLACE(ctx context.Context, req ReplaceRequest) (Nil, error)
+	STORAGE_READ(ctx context.Context, req ReadRequest) (ReadResponse, error)
+	STORAGE_CAS(ctx context.Context, req CASRequest) (Nil, error)
+	STORAGE_REPLACE_IF_VERSION(ctx context.Context, req VersionRequest) (Nil, error)
+	STORAGE_READ_MANY(ctx context.Context, req Indexes) ([]Item, error)
+	STORAGE_REPLACE_MANY(ctx context.Context, req ReplaceManyRequest) ([]Item, error)
+	STORAGE_SCAN(ctx context.Context, req ScanRequest) (ScanResponse, error)
+	STORAGE_REPLACE_TTL(ctx context.Context, req TTLRequest) (Nil, error)
+	STORAGE_TTL(ctx context.Context, req IndexRequest) (int64, error)
+	STORAGE_WATCH(ctx context.Context, req WatchRequest) (Nil, error)
+	STORAGE_UNWATCH(ctx context.Context, req UnwatchRequest) (Nil, error)
+}
+
+// RegisterHandlers registers functions declared in spec.go in registry
+func RegisterHandlers(r *Registry, h Handlers) error {
+	if err := Register(r, ADM_STORAGE_SWITCH_READONLY_ID, "ADM_STORAGE_SWITCH_READONLY", h.ADM_STORAGE_SWITCH_READONLY); err != nil {
+		return err
+	}
+	if err := Register(r, ADM_STORAGE_SWITCH_READWRITE_ID, "ADM_STORAGE_SWITCH_READWRITE", h.ADM_STORAGE_SWITCH_READWRITE); err != nil {
+		return err
+	}
+	if err := Register(r, ADM_STORAGE_SWITCH_MAINTENANCE_ID, "ADM_STORAGE_SWITCH_MAINTENANCE", h.ADM_STORAGE_SWITCH_MAINTENANCE); err != nil {
+		return err
+	}
+	if err := Register(r, ADM_STORAGE_SNAPSHOT_ID, "ADM_STORAGE_SNAPSHOT", h.ADM_STORAGE_SNAPSHOT); err != nil {
+		return err
+	}
+	if err := Register(r, STORAGE_REPLACE_ID, "STORAGE_REPLACE", h.STORAGE_REPLACE); err != nil {
+		return err
+	}
+	if err := Register(r, STORAGE_READ_ID, "STORAGE_READ", h.STORAGE_READ); err != nil {
+		return err
+	}
+	if err := Register(r, STORAGE_CAS_ID, "STORAGE_CAS", h.STORAGE_CAS); err != nil {
+		return err
+	}
+	if err := Register(r, STORAGE_REPLACE_IF_VERSION_ID, "STORAGE_REPLACE_IF_VERSION", h.STORAGE_REPLACE_IF_VERSION); err != nil {
+		return err
+	}
+	if err := Register(r, STORAGE_READ_MANY_ID, "STORAGE_READ_MANY", h.STORAGE_READ_MANY); err != nil {
+		return err
+	}
+	if err := Register(r, STORAGE_REPLACE_MANY_ID, "STORAGE_REPLACE_MANY", h.STORAGE_REPLACE_MANY); err != nil {
+		return err
+	}
+	if err := Register(r, STORAGE_SCAN_ID, "STORAGE_SCAN", h.STORAGE_SCAN); err != nil {
+		return err
+	}
+	if err := Register(r, STORAGE_REPLACE_TTL_ID, "STORAGE_REPLACE_TTL", h.STORAGE_REPLACE_TTL); err != nil {
+		return err
+	}
+	if err := Register(r, STORAGE_TTL_ID, "STORAGE_TTL", h.STORAGE_TTL); err != nil {
+		return err
+	}
+	if err := Register(r, STORAGE_WATCH_ID, "STORAGE_WATCH", h.STORAGE_WATCH); err != nil {
+		return err
+	}
+	if err := Register(r, STORAGE_UNWATCH_ID, "STORAGE_UNWATCH", h.STORAGE_UNWATCH); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Client calls functions declared in spec.go through caller
+type Client struct {
+	caller Caller
+}
+
+func NewClient(caller Caller) *Client {
+	return &Client{caller: caller}
+}
+
+// ADM_STORAGE_SWITCH_READONLY calls function 0x00010001
+func (c *Client) ADM_STORAGE_SWITCH_READONLY(ctx context.Context, req Nil) (resp Nil, err error) {
+	err = Call(ctx, c.caller, ADM_STORAGE_SWITCH_READONLY_ID, req, &resp)
+	return
+}
+
+// ADM_STORAGE_SWITCH_READWRITE calls function 0x00010002
+func (c *Client) ADM_STORAGE_SWITCH_READWRITE(ctx context.Context, req Nil) (resp Nil, err error) {
+	err = Call(ctx, c.caller, ADM_STORAGE_SWITCH_READWRITE_ID, req, &resp)
+	return
+}
+
+// ADM_STORAGE_SWITCH_MAINTENANCE calls function 0x00010003
+func (c *Client) ADM_STORAGE_SWITCH_MAINTENANCE(ctx context.Context, req Nil) (resp Nil, err error) {
+	err = Call(ctx, c.caller, ADM_STORAGE_SWITCH_MAINTENANCE_ID, req, &resp)
+	return
+}
+
+// ADM_STORAGE_SNAPSHOT calls function 0x00010004
+func (c *Client) ADM_STORAGE_SNAPSHOT(ctx context.Context, req Nil) (resp string, err error) {
+	err = Call(ctx, c.caller, ADM_STORAGE_SNAPSHOT_ID, req, &resp)
+	return
+}
+
+// STORAGE_REPLACE calls function 0x00020001
+func (c *Client) STORAGE_REPLACE(ctx context.Context, req ReplaceRequest) (resp Nil, err error) {
+	err = Call(ctx, c.caller, STORAGE_REPLACE_ID, req, &resp)
+	return
+}
+
+// STORAGE_READ calls function 0x00020002
+func (c *Client) STORAGE_READ(ctx context.Context, req ReadRequest) (resp ReadResponse, err error) {
+	err = Call(ctx, c.caller, STORAGE_READ_ID, req, &resp)
+	return
+}
+
+// STORAGE_CAS calls function 0x00020003
+func (c *Client) STORAGE_CAS(ctx context.Context, req CASRequest) (resp Nil, err error) {
+	err = Call(ctx, c.caller, STORAGE_CAS_ID, req, &resp)
+	return
+}
+
+// STORAGE_REPLACE_IF_VERSION calls function 0x00020004
+func (c *Client) STORAGE_REPLACE_IF_VERSION(ctx context.Context, req VersionRequest) (resp Nil, err error) {
+	err = Call(ctx, c.caller, STORAGE_REPLACE_IF_VERSION_ID, req, &resp)
+	return
+}
+
+// STORAGE_READ_MANY calls function 0x00020005
+func (c *Client) STORAGE_READ_MANY(ctx context.Context, req Indexes) (resp []Item, err error) {
+	err = Call(ctx, c.caller, STORAGE_READ_MANY_ID, req, &resp)
+	return
+}
+
+// STORAGE_REPLACE_MANY calls function 0x00020006
+func (c *Client) STORAGE_REPLACE_MANY(ctx context.Context, req ReplaceManyRequest) (resp []Item, err error) {
+	err = Call(ctx, c.caller, STORAGE_REPLACE_MANY_ID, req, &resp)
+	return
+}
+
+// STORAGE_SCAN calls function 0x00020007
+func (c *Client) STORAGE_SCAN(ctx context.Context, req ScanRequest) (resp ScanResponse, err error) {
+	err = Call(ctx, c.caller, STORAGE_SCAN_ID, req, &resp)
+	return
+}
+
+// STORAGE_REPLACE_TTL calls function 0x00020008
+func (c *Client) STORAGE_REPLACE_TTL(ctx context.Context, req TTLRequest) (resp Nil, err error) {
+	err = Call(ctx, c.caller, STORAGE_REPLACE_TTL_ID, req, &resp)
+	return
+}
+
+// STORAGE_TTL calls function 0x00020009
+func (c *Client) STORAGE_TTL(ctx context.Context, req IndexRequest) (resp int64, err error) {
+	err = Call(ctx, c.caller, STORAGE_TTL_ID, req, &resp)
+	return
+}
+
+// STORAGE_WATCH calls function 0x0002000a
+func (c *Client) STORAGE_WATCH(ctx context.Context, req WatchRequest) (resp Nil, err error) {
+	err = Call(ctx, c.caller, STORAGE_WATCH_ID, req, &resp)
+	return
+}
+
+// STORAGE_UNWATCH calls function 0x0002000b
+func (c *Client) STORAGE_UNWATCH(ctx context.Context, req UnwatchRequest) (resp Nil, err error) {
+	err = Call(ctx, c.caller, STORAGE_UNWATCH_ID, req, &resp)
+	return
+}
@@ -0,0 +1,36 @@
+package api
+
+import (
+	"context"
+	"github.com/vmihailenco/msgpack"
+)
+
+// Caller sends msgpack body of request to function func_id and returns msgpack body of its response.
+// Non-zero return code is reported as error
+type Caller interface {
+	Call(ctx context.Context, func_id uint32, body []byte) ([]byte, error)
+}
+
+// Call encodes req, calls function func_id through caller and decodes its response to resp
+func Call(ctx context.Context, caller Caller, func_id uint32, req interface{}, resp interface{}) error {
+	body, err := marshalBody(req)
+	if err != nil {
+		return err
+	}
+	data, err := caller.Call(ctx, func_id, body)
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return unmarshalBody(data, resp)
+}
+
+// marshalBody from request v to msgpack body
+func marshalBody(v interface{}) ([]byte, error) {
+	if marshaler, ok := v.(BodyMarshaler); ok {
+		return marshaler.MarshalBody()
+	}
+	return msgpack.Marshal(v)
+}
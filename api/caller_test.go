@@ -0,0 +1,53 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"github.com/Bambelbl/iproto-server/packet/request_packet"
+	"testing"
+)
+
+// registryCaller calls functions of registry directly, without network
+type registryCaller struct {
+	registry *Registry
+}
+
+func (c registryCaller) Call(ctx context.Context, func_id uint32, body []byte) ([]byte, error) {
+	response, returnCode := c.registry.Handle(ctx, request_packet.IprotoPacketRequest{
+		Header: request_packet.IprotoHeader{Func_id: func_id, Body_length: uint32(len(body))},
+		Body:   body,
+	})
+	if returnCode != RETURN_OK {
+		return nil, fmt.Errorf("return code %d: %v", returnCode, response)
+	}
+	if _, isNil := response.(Nil); isNil {
+		return nil, nil
+	}
+	return marshalBody(response)
+}
+
+func TestClient(t *testing.T) {
+	client := NewClient(registryCaller{registry: newTestRegistry(t)})
+	ctx := context.Background()
+
+	if _, err := client.STORAGE_REPLACE(ctx, ReplaceRequest{Idx: 5, Str: "five"}); err != nil {
+		t.Fatalf("unexpected replace error: %v", err)
+	}
+	resp, err := client.STORAGE_READ(ctx, ReadRequest{Idx: 5})
+	if err != nil || resp != (ReadResponse{Str: "five"}) {
+		t.Fatalf("wrong read results: got %+v, %v", resp, err)
+	}
+	resp, err = client.STORAGE_READ(ctx, ReadRequest{Idx: 5, Version: true})
+	if err != nil || resp != (ReadResponse{Str: "five", Version: 1, HasVersion: true}) {
+		t.Fatalf("wrong read results: got %+v, %v", resp, err)
+	}
+	if _, err = client.STORAGE_REPLACE_IF_VERSION(ctx, VersionRequest{Idx: 5, Version: 1, Str: "5"}); err != nil {
+		t.Fatalf("unexpected replace error: %v", err)
+	}
+	if _, err = client.ADM_STORAGE_SWITCH_MAINTENANCE(ctx, Nil{}); err != nil {
+		t.Fatalf("unexpected switch error: %v", err)
+	}
+	if _, err = client.STORAGE_READ(ctx, ReadRequest{Idx: 5}); err == nil {
+		t.Fatalf("expected error in maintenance, got nil")
+	}
+}
@@ -1,23 +1,52 @@
 package api
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Bambelbl/iproto-server/codes"
 	"github.com/Bambelbl/iproto-server/packet/request_packet"
 	"github.com/Bambelbl/iproto-server/storage"
+	"github.com/Bambelbl/iproto-server/tracing"
+	"sort"
+	"time"
+)
+
+const (
+	// MAX_SCAN_LIMIT max number of cells in response of scan
+	MAX_SCAN_LIMIT = request_packet.MAX_BATCH_SIZE
+	// MAX_SCAN_BODY max length of cells in response of scan, so it fits in frame of any client
+	MAX_SCAN_BODY = 64 << 10
+	// SCAN_DONE cursor of scan that reached the end of range
+	SCAN_DONE = -1
+	// NO_TTL remaining time to live of value that doesn't expire
+	NO_TTL = -1
 )
 
 // ADM_STORAGE_SWITCH_READONLY Переводит сторадж в состояние READ_ONLY
-func ADM_STORAGE_SWITCH_READONLY(stor *storage.Storage) {
-	(*stor).SetState(storage.READ_ONLY)
+func ADM_STORAGE_SWITCH_READONLY(stor *storage.Storage) error {
+	return (*stor).SetState(storage.READ_ONLY)
 }
 
 // ADM_STORAGE_SWITCH_READWRITE Переводит сторадж в состояние READ_WRITE
-func ADM_STORAGE_SWITCH_READWRITE(stor *storage.Storage) {
-	(*stor).SetState(storage.READ_WRITE)
+func ADM_STORAGE_SWITCH_READWRITE(stor *storage.Storage) error {
+	return (*stor).SetState(storage.READ_WRITE)
 }
 
 // ADM_STORAGE_SWITCH_MAINTENANCE Переводит сторадж в состояние MAINTENANCE
-func ADM_STORAGE_SWITCH_MAINTENANCE(stor *storage.Storage) {
-	(*stor).SetState(storage.MAINTENANCE)
+func ADM_STORAGE_SWITCH_MAINTENANCE(stor *storage.Storage) error {
+	return (*stor).SetState(storage.MAINTENANCE)
+}
+
+// ADM_STORAGE_SNAPSHOT Сохраняет снимок стораджа в файл и возвращает путь к нему
+func ADM_STORAGE_SNAPSHOT(snapshotter *storage.Snapshotter) (string, error) {
+	if snapshotter == nil {
+		return "", errors.New("snapshots are not configured")
+	}
+	if err := snapshotter.Snapshot(); err != nil {
+		return "", err
+	}
+	return snapshotter.Path(), nil
 }
 
 // STORAGE_REPLACE Записывает в сторадж строку по индексу
@@ -30,31 +59,266 @@ func STORAGE_READ(stor *storage.Storage, idx int) (string, error) {
 	return (*stor).GetValue(idx)
 }
 
-// Handler Main handler that calls the handler that matches the value func_id
-func Handler(packet request_packet.IprotoPacketRequest, storage *storage.Storage) (string, uint32) {
-	switch packet.Header.Func_id {
-	case 0x00010001:
-		ADM_STORAGE_SWITCH_READONLY(storage)
-		return "", 0
-	case 0x00010002:
-		ADM_STORAGE_SWITCH_READWRITE(storage)
-		return "", 0
-	case 0x00010003:
-		ADM_STORAGE_SWITCH_MAINTENANCE(storage)
-		return "", 0
-	case 0x00020001:
-		err := STORAGE_REPLACE(storage, packet.Body.Idx, packet.Body.Str)
-		if err != nil {
-			return err.Error(), 1
+// STORAGE_READ_VERSION возвращает строку из стораджа по индексу вместе с версией ячейки
+func STORAGE_READ_VERSION(stor *storage.Storage, idx int) (string, uint64, error) {
+	versioned, ok := (*stor).(storage.Versioned)
+	if !ok {
+		return "", 0, errVersionsNotSupported
+	}
+	cell, err := versioned.GetCell(idx)
+	return cell.Value, cell.Version, err
+}
+
+// STORAGE_REPLACE_IF_VERSION Записывает в сторадж строку по индексу, если версия ячейки совпадает с ожидаемой
+func STORAGE_REPLACE_IF_VERSION(stor *storage.Storage, idx int, version uint64, str string) error {
+	versioned, ok := (*stor).(storage.Versioned)
+	if !ok {
+		return errVersionsNotSupported
+	}
+	return versioned.ReplaceIfVersion(idx, version, str)
+}
+
+// STORAGE_CAS Записывает в сторадж строку по индексу, если текущее значение совпадает с ожидаемым
+func STORAGE_CAS(stor *storage.Storage, idx int, expected string, str string) error {
+	return (*stor).CompareAndSwap(idx, expected, str)
+}
+
+// STORAGE_REPLACE_TTL Записывает в сторадж строку по индексу, через ttl ячейка читается пустой
+func STORAGE_REPLACE_TTL(stor *storage.Storage, idx int, str string, ttl time.Duration) error {
+	expiring, ok := (*stor).(storage.Expiring)
+	if !ok {
+		return errTTLNotSupported
+	}
+	return expiring.SetValueTTL(idx, str, ttl)
+}
+
+// STORAGE_TTL Возвращает оставшееся время жизни строки по индексу, NO_TTL если строка не истекает
+func STORAGE_TTL(stor *storage.Storage, idx int) (time.Duration, error) {
+	versioned, ok := (*stor).(storage.Versioned)
+	if !ok {
+		return 0, errTTLNotSupported
+	}
+	cell, err := versioned.GetCell(idx)
+	if err != nil || cell.Expires.IsZero() {
+		return NO_TTL, err
+	}
+	return time.Until(cell.Expires), nil
+}
+
+// STORAGE_WATCH Подписывает соединение на изменения ячеек по индексам (всех ячеек, если idxs равен nil)
+// и на смену состояния стораджа, изменения присылаются кадрами STORAGE_NOTIFY_ID с request_id подписки
+func STORAGE_WATCH(session Session, requestID uint32, idxs []int, state bool) error {
+	if err := checkBatchSize(len(idxs)); err != nil {
+		return err
+	}
+	return session.Watch(requestID, idxs, state)
+}
+
+// STORAGE_UNWATCH Отменяет подписку с request_id
+func STORAGE_UNWATCH(session Session, requestID uint32) error {
+	return session.Unwatch(requestID)
+}
+
+// STORAGE_READ_MANY Возвращает строки из стораджа по индексам, ошибки отдельных индексов возвращаются в их элементах
+func STORAGE_READ_MANY(stor *storage.Storage, idxs []int) ([]Item, error) {
+	if err := checkBatchSize(len(idxs)); err != nil {
+		return nil, err
+	}
+	values, errs, err := (*stor).GetValues(idxs)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]Item, len(idxs))
+	for i := range items {
+		if errs[i] != nil {
+			items[i] = Item{Return_code: codes.Code(errs[i]), Str: errs[i].Error()}
+			continue
+		}
+		items[i] = Item{Return_code: RETURN_OK, Str: values[i]}
+	}
+	return items, nil
+}
+
+// STORAGE_REPLACE_MANY Записывает в сторадж строки по индексам: либо все, либо ни одной.
+// С bestEffort каждая строка записывается отдельно, а для каждого индекса в порядке возрастания
+// возвращается код возврата и описание ошибки
+func STORAGE_REPLACE_MANY(stor *storage.Storage, values map[int]string, bestEffort bool) ([]Item, error) {
+	if err := checkBatchSize(len(values)); err != nil {
+		return nil, err
+	}
+	if !bestEffort {
+		return nil, (*stor).SetValues(values)
+	}
+	errs, err := (*stor).SetValuesEach(values)
+	if err != nil {
+		return nil, err
+	}
+	idxs := make([]int, 0, len(values))
+	for idx := range values {
+		idxs = append(idxs, idx)
+	}
+	sort.Ints(idxs)
+	items := make([]Item, len(idxs))
+	for i, idx := range idxs {
+		if errs[idx] != nil {
+			items[i] = Item{Return_code: codes.Code(errs[idx]), Str: errs[idx].Error()}
+			continue
 		}
-		return "", 0
-	case 0x00020002:
-		body, err := STORAGE_READ(storage, packet.Body.Idx)
-		if err != nil {
-			return err.Error(), 1
+		items[i] = Item{Return_code: RETURN_OK}
+	}
+	return items, nil
+}
+
+// STORAGE_SCAN Возвращает непустые ячейки из диапазона [from;to) и курсор для продолжения.
+// Ответ ограничен limit (не больше MAX_SCAN_LIMIT) ячейками и MAX_SCAN_BODY байтами
+func STORAGE_SCAN(stor *storage.Storage, from int, to int, limit int) (ScanResponse, error) {
+	if limit <= 0 || limit > MAX_SCAN_LIMIT {
+		limit = MAX_SCAN_LIMIT
+	}
+	resp := ScanResponse{Cells: []Pair{}, Cursor: SCAN_DONE}
+	size := 0
+	err := (*stor).Scan(from, to, func(idx int, str string) bool {
+		size += len(str) + request_packet.VALUE_OVERHEAD
+		if len(resp.Cells) == limit || size > MAX_SCAN_BODY {
+			resp.Cursor = idx
+			return false
 		}
-		return body, 0
-	default:
-		return "Incorrect func_id", 1
+		resp.Cells = append(resp.Cells, Pair{Idx: idx, Str: str})
+		return true
+	})
+	if err != nil {
+		return ScanResponse{}, err
+	}
+	return resp, nil
+}
+
+// checkBatchSize rejects batches longer than MAX_BATCH_SIZE items as invalid body
+func checkBatchSize(size int) error {
+	if size > request_packet.MAX_BATCH_SIZE {
+		return &invalidBodyError{err: fmt.Errorf("batch holds %d items, max is %d", size, request_packet.MAX_BATCH_SIZE)}
+	}
+	return nil
+}
+
+var (
+	// errVersionsNotSupported storage doesn't keep versions of cells
+	errVersionsNotSupported = errors.New("storage doesn't keep versions of cells")
+	// errTTLNotSupported storage doesn't expire values of cells
+	errTTLNotSupported = errors.New("storage doesn't expire values of cells")
+	// errNoSession function is called not from connection it could push frames to
+	errNoSession = errors.New("function needs connection to push notifications")
+)
+
+// storageHandlers implements Handlers of storage API
+type storageHandlers struct {
+	stor        *storage.Storage
+	snapshotter *storage.Snapshotter
+}
+
+func (h storageHandlers) ADM_STORAGE_SWITCH_READONLY(ctx context.Context, req Nil) (Nil, error) {
+	return Nil{}, ADM_STORAGE_SWITCH_READONLY(h.stor)
+}
+
+func (h storageHandlers) ADM_STORAGE_SWITCH_READWRITE(ctx context.Context, req Nil) (Nil, error) {
+	return Nil{}, ADM_STORAGE_SWITCH_READWRITE(h.stor)
+}
+
+func (h storageHandlers) ADM_STORAGE_SWITCH_MAINTENANCE(ctx context.Context, req Nil) (Nil, error) {
+	return Nil{}, ADM_STORAGE_SWITCH_MAINTENANCE(h.stor)
+}
+
+func (h storageHandlers) ADM_STORAGE_SNAPSHOT(ctx context.Context, req Nil) (string, error) {
+	return ADM_STORAGE_SNAPSHOT(h.snapshotter)
+}
+
+func (h storageHandlers) STORAGE_REPLACE(ctx context.Context, req ReplaceRequest) (Nil, error) {
+	return Nil{}, STORAGE_REPLACE(h.storage(ctx), req.Idx, req.Str)
+}
+
+func (h storageHandlers) STORAGE_CAS(ctx context.Context, req CASRequest) (Nil, error) {
+	return Nil{}, STORAGE_CAS(h.storage(ctx), req.Idx, req.Expected, req.New)
+}
+
+func (h storageHandlers) STORAGE_REPLACE_IF_VERSION(ctx context.Context, req VersionRequest) (Nil, error) {
+	return Nil{}, STORAGE_REPLACE_IF_VERSION(h.storage(ctx), req.Idx, req.Version, req.Str)
+}
+
+func (h storageHandlers) STORAGE_READ_MANY(ctx context.Context, req Indexes) ([]Item, error) {
+	return STORAGE_READ_MANY(h.storage(ctx), req)
+}
+
+func (h storageHandlers) STORAGE_REPLACE_MANY(ctx context.Context, req ReplaceManyRequest) ([]Item, error) {
+	return STORAGE_REPLACE_MANY(h.storage(ctx), req.Values, req.BestEffort)
+}
+
+func (h storageHandlers) STORAGE_SCAN(ctx context.Context, req ScanRequest) (ScanResponse, error) {
+	return STORAGE_SCAN(h.storage(ctx), req.From, req.To, req.Limit)
+}
+
+func (h storageHandlers) STORAGE_REPLACE_TTL(ctx context.Context, req TTLRequest) (Nil, error) {
+	return Nil{}, STORAGE_REPLACE_TTL(h.storage(ctx), req.Idx, req.Str, time.Duration(req.TTL)*time.Millisecond)
+}
+
+func (h storageHandlers) STORAGE_TTL(ctx context.Context, req IndexRequest) (int64, error) {
+	ttl, err := STORAGE_TTL(h.storage(ctx), req.Idx)
+	if ttl == NO_TTL {
+		return NO_TTL, err
+	}
+	// Value expiring in less than a millisecond still has time to live
+	return int64((ttl + time.Millisecond - 1) / time.Millisecond), err
+}
+
+func (h storageHandlers) STORAGE_WATCH(ctx context.Context, req WatchRequest) (Nil, error) {
+	session, exist := SessionFrom(ctx)
+	if !exist {
+		return Nil{}, errNoSession
+	}
+	idxs := req.Idxs
+	if req.All {
+		idxs = nil
+	} else if idxs == nil {
+		idxs = []int{}
+	}
+	return Nil{}, STORAGE_WATCH(session, RequestID(ctx), idxs, req.State)
+}
+
+func (h storageHandlers) STORAGE_UNWATCH(ctx context.Context, req UnwatchRequest) (Nil, error) {
+	session, exist := SessionFrom(ctx)
+	if !exist {
+		return Nil{}, errNoSession
+	}
+	return Nil{}, STORAGE_UNWATCH(session, req.Request_id)
+}
+
+func (h storageHandlers) STORAGE_READ(ctx context.Context, req ReadRequest) (resp ReadResponse, err error) {
+	if req.Version {
+		resp.HasVersion = true
+		resp.Str, resp.Version, err = STORAGE_READ_VERSION(h.storage(ctx), req.Idx)
+		return
+	}
+	resp.Str, err = STORAGE_READ(h.storage(ctx), req.Idx)
+	return
+}
+
+// storage returns storage of handlers, if request is traced in ctx and storage is storage.Traceable,
+// waits for its locks are traced as child spans of span of ctx
+func (h storageHandlers) storage(ctx context.Context) *storage.Storage {
+	span := tracing.SpanFromContext(ctx)
+	traceable, ok := (*h.stor).(storage.Traceable)
+	if span == nil || !ok {
+		return h.stor
+	}
+	stor := traceable.WithLockWait(func(start time.Time, end time.Time) {
+		_, wait := tracing.Start(ctx, "storage.lock_wait", tracing.WithStartTime(start))
+		wait.EndAt(end)
+	})
+	return &stor
+}
+
+// RegisterStorage registers handlers of storage API in registry,
+// snapshots are written by snapshotter, nil snapshotter means snapshots are not configured
+func RegisterStorage(r *Registry, stor *storage.Storage, snapshotter *storage.Snapshotter) {
+	if err := RegisterHandlers(r, storageHandlers{stor: stor, snapshotter: snapshotter}); err != nil {
+		panic(err)
 	}
 }
@@ -0,0 +1,220 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Bambelbl/iproto-server/codes"
+	"github.com/Bambelbl/iproto-server/packet/request_packet"
+	"github.com/Bambelbl/iproto-server/tracing"
+	"github.com/vmihailenco/msgpack"
+	"reflect"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Return codes of registry, the whole catalogue is in package codes
+const (
+	// RETURN_OK function succeeded, body holds its response
+	RETURN_OK = codes.OK
+	// HANDLER_ERROR function failed, body holds description of error
+	HANDLER_ERROR = codes.HANDLER_ERROR
+	// CLIENT_INVALID_BODY body of request doesn't match request schema of function
+	CLIENT_INVALID_BODY = codes.INVALID_BODY
+	// CLIENT_UNKNOWN_FUNC_ID no function is registered for func_id of request
+	CLIENT_UNKNOWN_FUNC_ID = codes.UNKNOWN_FUNC_ID
+	// CLIENT_VALUE_TOO_LARGE value is longer than storage allows
+	CLIENT_VALUE_TOO_LARGE = codes.VALUE_TOO_LARGE
+)
+
+// ReturnCoder is implemented by errors which are answered with their own return code
+type ReturnCoder = codes.ReturnCoder
+
+// BodyCarrier is implemented by errors which are answered with their own body
+// instead of description of error, e.g. current value of the cell on codes.MISMATCH
+type BodyCarrier interface {
+	ResponseBody() interface{}
+}
+
+// Function describes function registered in Registry
+type Function struct {
+	Func_id  uint32
+	Name     string
+	Request  reflect.Type
+	Response reflect.Type
+	call     func(ctx context.Context, body []byte) (interface{}, error)
+}
+
+// Observer is notified about every request handled by Registry, e.g. to collect metrics
+type Observer interface {
+	// ObserveRequest request to function is answered with returnCode in duration, function
+	// has only Func_id of request if no function is registered for it
+	ObserveRequest(function Function, returnCode uint32, duration time.Duration)
+}
+
+// Registry dispatches requests to functions registered by func_id
+type Registry struct {
+	mutex     sync.RWMutex
+	functions map[uint32]Function
+	onPanic   func(func_id uint32, recovered interface{}, stack []byte)
+	observer  Observer
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		functions: make(map[uint32]Function),
+	}
+}
+
+// Register adds handler of function func_id with typed request and response to registry.
+// Request body is decoded with UnmarshalBody if Req implements BodyUnmarshaler,
+// otherwise as a single msgpack value
+func Register[Req any, Resp any](r *Registry, func_id uint32, name string,
+	handler func(ctx context.Context, req Req) (Resp, error)) error {
+	function := Function{
+		Func_id:  func_id,
+		Name:     name,
+		Request:  reflect.TypeOf((*Req)(nil)).Elem(),
+		Response: reflect.TypeOf((*Resp)(nil)).Elem(),
+		call: func(ctx context.Context, body []byte) (interface{}, error) {
+			var req Req
+			if err := unmarshalBody(body, &req); err != nil {
+				return nil, &invalidBodyError{err: err}
+			}
+			return handler(ctx, req)
+		},
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if registered, exist := r.functions[func_id]; exist {
+		return fmt.Errorf("func_id 0x%08x is already registered for %s", func_id, registered.Name)
+	}
+	r.functions[func_id] = function
+	return nil
+}
+
+// Observe makes registry notify observer about every handled request
+func (r *Registry) Observe(observer Observer) {
+	r.mutex.Lock()
+	r.observer = observer
+	r.mutex.Unlock()
+}
+
+// Lookup returns function registered for func_id
+func (r *Registry) Lookup(func_id uint32) (function Function, exist bool) {
+	r.mutex.RLock()
+	function, exist = r.functions[func_id]
+	r.mutex.RUnlock()
+	return
+}
+
+// Functions returns all registered functions sorted by func_id
+func (r *Registry) Functions() []Function {
+	r.mutex.RLock()
+	functions := make([]Function, 0, len(r.functions))
+	for _, function := range r.functions {
+		functions = append(functions, function)
+	}
+	r.mutex.RUnlock()
+	sort.Slice(functions, func(i, j int) bool {
+		return functions[i].Func_id < functions[j].Func_id
+	})
+	return functions
+}
+
+// OnPanic makes registry call fn with func_id, recovered value and stack of every panic of handler,
+// the request is answered with codes.ErrHandler, so one broken handler doesn't take the server down
+func (r *Registry) OnPanic(fn func(func_id uint32, recovered interface{}, stack []byte)) {
+	r.mutex.Lock()
+	r.onPanic = fn
+	r.mutex.Unlock()
+}
+
+// Handle calls the function that matches func_id of the packet, returns its response
+// or description of error together with return code. If request is traced in ctx,
+// the call is traced as its child span
+func (r *Registry) Handle(ctx context.Context, packet request_packet.IprotoPacketRequest) (body interface{}, returnCode uint32) {
+	r.mutex.RLock()
+	function, exist := r.functions[packet.Header.Func_id]
+	observer := r.observer
+	r.mutex.RUnlock()
+	ctx, span := tracing.Start(ctx, "api.handler", tracing.WithAttributes(tracing.ATTR_FUNCTION, function.Name))
+	if span != nil {
+		defer func() {
+			span.SetAttributes(tracing.ATTR_RETURN_CODE, returnCode)
+			if returnCode != RETURN_OK {
+				span.SetError(fmt.Errorf("return code %d", returnCode))
+			}
+			span.End()
+		}()
+	}
+	if observer != nil {
+		start := time.Now()
+		function.Func_id = packet.Header.Func_id
+		defer func() {
+			observer.ObserveRequest(function, returnCode, time.Since(start))
+		}()
+	}
+	if !exist {
+		return codes.ErrUnknownFunc.Error(), codes.ErrUnknownFunc.Code
+	}
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			r.mutex.RLock()
+			onPanic := r.onPanic
+			r.mutex.RUnlock()
+			if onPanic != nil {
+				onPanic(packet.Header.Func_id, recovered, debug.Stack())
+			}
+			body, returnCode = codes.ErrHandler.Error(), codes.ErrHandler.Code
+		}
+	}()
+	response, err := function.call(context.WithValue(ctx, requestIDKey{}, packet.Header.Request_id), packet.Body)
+	if err != nil {
+		var carrier BodyCarrier
+		if errors.As(err, &carrier) {
+			return carrier.ResponseBody(), codes.Code(err)
+		}
+		return err.Error(), codes.Code(err)
+	}
+	return response, RETURN_OK
+}
+
+// invalidBodyError body of request can't be decoded to request of function
+type invalidBodyError struct {
+	err error
+}
+
+func (e *invalidBodyError) Error() string {
+	return codes.ErrBadBody.Error() + ": " + e.err.Error()
+}
+
+func (e *invalidBodyError) Unwrap() error {
+	return e.err
+}
+
+func (e *invalidBodyError) Is(target error) bool {
+	return target == codes.ErrBadBody
+}
+
+func (e *invalidBodyError) ReturnCode() uint32 {
+	return codes.INVALID_BODY
+}
+
+// unmarshalBody from msgpack body to request v
+func unmarshalBody(data []byte, v interface{}) error {
+	if unmarshaler, ok := v.(BodyUnmarshaler); ok {
+		return unmarshaler.UnmarshalBody(data)
+	}
+	reader := bytes.NewReader(data)
+	if err := msgpack.NewDecoder(reader).Decode(v); err != nil {
+		return err
+	}
+	if reader.Len() != 0 {
+		return fmt.Errorf("%d unexpected bytes after body", reader.Len())
+	}
+	return nil
+}
@@ -0,0 +1,331 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Bambelbl/iproto-server/codes"
+	"github.com/Bambelbl/iproto-server/packet/request_packet"
+	"github.com/Bambelbl/iproto-server/storage"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type TestCase struct {
+	Packet     request_packet.IprotoPacketRequest
+	Body       interface{}
+	ReturnCode uint32
+}
+
+type codedError struct{}
+
+func (e codedError) Error() string {
+	return "coded error"
+}
+
+func (e codedError) ReturnCode() uint32 {
+	return 42
+}
+
+// packet builds request packet for func_id with msgpack values as body
+func packet(func_id uint32, values ...interface{}) request_packet.IprotoPacketRequest {
+	var body []byte
+	if len(values) > 0 {
+		var err error
+		if body, err = request_packet.MarshalValues(values...); err != nil {
+			panic(err)
+		}
+	}
+	return request_packet.IprotoPacketRequest{
+		Header: request_packet.IprotoHeader{Func_id: func_id, Body_length: uint32(len(body))},
+		Body:   body,
+	}
+}
+
+func newTestRegistry(t *testing.T) *Registry {
+	stor := storage.NewSimpleStorageRepo(storage.DefaultConfig())
+	registry := NewRegistry()
+	RegisterStorage(registry, &stor, nil)
+	err := Register(registry, 0x00030001, "ECHO", func(ctx context.Context, req ReplaceRequest) (string, error) {
+		return req.Str, nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected register error: %v", err)
+	}
+	err = Register(registry, 0x00030002, "FAIL", func(ctx context.Context, req Nil) (Nil, error) {
+		return Nil{}, codedError{}
+	})
+	if err != nil {
+		t.Fatalf("unexpected register error: %v", err)
+	}
+	return registry
+}
+
+func TestRegistry_Handle(t *testing.T) {
+	registry := newTestRegistry(t)
+	tooMany := make(map[int]string)
+	for idx := 0; idx <= request_packet.MAX_BATCH_SIZE; idx++ {
+		tooMany[idx] = "many"
+	}
+	// Batch bodies are accepted without wrapping array as well
+	readMany := packet(STORAGE_READ_MANY_ID)
+	readMany.Body = []byte{0x92, 0x03, 0x02}
+	cases := []TestCase{
+		{Packet: packet(STORAGE_REPLACE_ID, 1, "one"), Body: Nil{}, ReturnCode: RETURN_OK},
+		{Packet: packet(STORAGE_READ_ID, 1), Body: ReadResponse{Str: "one"}, ReturnCode: RETURN_OK},
+		{Packet: packet(STORAGE_READ_ID, 1, true), Body: ReadResponse{Str: "one", Version: 1, HasVersion: true}, ReturnCode: RETURN_OK},
+		{Packet: packet(STORAGE_REPLACE_IF_VERSION_ID, 1, 0, "uno"), Body: uint64(1), ReturnCode: codes.MISMATCH},
+		{Packet: packet(STORAGE_REPLACE_IF_VERSION_ID, 1, 1, "one"), Body: Nil{}, ReturnCode: RETURN_OK},
+		{Packet: packet(STORAGE_READ_ID, 1000), ReturnCode: codes.OUT_OF_RANGE},
+		{Packet: packet(STORAGE_CAS_ID, 1, "one", "uno"), Body: Nil{}, ReturnCode: RETURN_OK},
+		{Packet: packet(STORAGE_CAS_ID, 1, "one", "eins"), Body: "uno", ReturnCode: codes.MISMATCH},
+		{Packet: packet(STORAGE_CAS_ID, 1, "one"), ReturnCode: CLIENT_INVALID_BODY},
+		{Packet: packet(STORAGE_REPLACE_MANY_ID, map[int]string{2: "two", 3: "three"}), Body: []Item(nil), ReturnCode: RETURN_OK},
+		{Packet: packet(STORAGE_REPLACE_MANY_ID, map[int]string{2: "dos", 1000: "mil"}), ReturnCode: codes.OUT_OF_RANGE},
+		{Packet: packet(STORAGE_REPLACE_MANY_ID, tooMany), ReturnCode: CLIENT_INVALID_BODY},
+		{Packet: readMany, Body: []Item{{Return_code: RETURN_OK, Str: "three"}, {Return_code: RETURN_OK, Str: "two"}}, ReturnCode: RETURN_OK},
+		{Packet: packet(STORAGE_READ_MANY_ID, []int{3, 1000, 2}), Body: []Item{
+			{Return_code: RETURN_OK, Str: "three"},
+			{Return_code: codes.OUT_OF_RANGE, Str: "index is out of range: valid index is in [0;999]"},
+			{Return_code: RETURN_OK, Str: "two"},
+		}, ReturnCode: RETURN_OK},
+		{Packet: packet(STORAGE_READ_MANY_ID, make([]int, 101)), ReturnCode: CLIENT_INVALID_BODY},
+		{Packet: packet(STORAGE_READ_MANY_ID, "one"), ReturnCode: CLIENT_INVALID_BODY},
+		{Packet: packet(STORAGE_SCAN_ID, 0, 1000, 0), Body: ScanResponse{
+			Cells:  []Pair{{Idx: 1, Str: "uno"}, {Idx: 2, Str: "two"}, {Idx: 3, Str: "three"}},
+			Cursor: SCAN_DONE,
+		}, ReturnCode: RETURN_OK},
+		{Packet: packet(STORAGE_SCAN_ID, 2, 1000, 1), Body: ScanResponse{Cells: []Pair{{Idx: 2, Str: "two"}}, Cursor: 3}, ReturnCode: RETURN_OK},
+		{Packet: packet(STORAGE_SCAN_ID, 4, 1000, 1), Body: ScanResponse{Cells: []Pair{}, Cursor: SCAN_DONE}, ReturnCode: RETURN_OK},
+		{Packet: packet(STORAGE_SCAN_ID, 0, 1001, 1), ReturnCode: codes.OUT_OF_RANGE},
+		{Packet: packet(STORAGE_SCAN_ID, 0, 1000), ReturnCode: CLIENT_INVALID_BODY},
+		{Packet: packet(STORAGE_REPLACE_MANY_ID, map[int]string{6: "six", 1000: "mil", 7: string(make([]byte, 257))}, true),
+			Body: []Item{
+				{Return_code: RETURN_OK},
+				{Return_code: codes.VALUE_TOO_LARGE, Str: codes.ErrValueTooLarge.Error() + ": max length of string is 256 bytes"},
+				{Return_code: codes.OUT_OF_RANGE, Str: codes.ErrOutOfRange.Error() + ": valid index is in [0;999]"},
+			}, ReturnCode: RETURN_OK},
+		{Packet: packet(STORAGE_REPLACE_MANY_ID, map[int]string{6: "seis"}, false), Body: []Item(nil), ReturnCode: RETURN_OK},
+		{Packet: packet(STORAGE_READ_ID, 6), Body: ReadResponse{Str: "seis"}, ReturnCode: RETURN_OK},
+		{Packet: packet(STORAGE_REPLACE_MANY_ID, tooMany, true), ReturnCode: CLIENT_INVALID_BODY},
+		{Packet: packet(STORAGE_TTL_ID, 1), Body: int64(NO_TTL), ReturnCode: RETURN_OK},
+		{Packet: packet(STORAGE_REPLACE_TTL_ID, 5, "token", 0), ReturnCode: CLIENT_INVALID_BODY},
+		{Packet: packet(STORAGE_REPLACE_TTL_ID, 5, "token"), ReturnCode: CLIENT_INVALID_BODY},
+		{Packet: packet(STORAGE_REPLACE_TTL_ID, 1000, "token", 1000), ReturnCode: codes.OUT_OF_RANGE},
+		{Packet: packet(STORAGE_REPLACE_TTL_ID, 5, "token", 60000), Body: Nil{}, ReturnCode: RETURN_OK},
+		{Packet: packet(STORAGE_READ_ID, 5), Body: ReadResponse{Str: "token"}, ReturnCode: RETURN_OK},
+		{Packet: packet(STORAGE_WATCH_ID, nil, true), ReturnCode: HANDLER_ERROR},
+		{Packet: packet(STORAGE_REPLACE_ID, 1, string(make([]byte, 257))), ReturnCode: CLIENT_VALUE_TOO_LARGE},
+		{Packet: packet(STORAGE_READ_ID), ReturnCode: CLIENT_INVALID_BODY},
+		{Packet: packet(STORAGE_READ_ID, "one"), ReturnCode: CLIENT_INVALID_BODY},
+		{Packet: packet(STORAGE_REPLACE_ID, 1), ReturnCode: CLIENT_INVALID_BODY},
+		{Packet: packet(ADM_STORAGE_SWITCH_READONLY_ID, 1), ReturnCode: CLIENT_INVALID_BODY},
+		{Packet: packet(ADM_STORAGE_SWITCH_READONLY_ID), Body: Nil{}, ReturnCode: RETURN_OK},
+		{Packet: packet(STORAGE_REPLACE_ID, 1, "two"), ReturnCode: codes.WRONG_STATE},
+		{Packet: packet(0x00030001, 2, "echo"), Body: "echo", ReturnCode: RETURN_OK},
+		{Packet: packet(0x00030002), ReturnCode: 42},
+		{Packet: packet(0x00040001), ReturnCode: CLIENT_UNKNOWN_FUNC_ID},
+	}
+	for caseNum, item := range cases {
+		body, returnCode := registry.Handle(context.Background(), item.Packet)
+
+		if returnCode != item.ReturnCode {
+			t.Errorf("[%d] wrong return code: got %d, expected %d (%v)",
+				caseNum, returnCode, item.ReturnCode, body)
+		}
+
+		if item.Body != nil && !reflect.DeepEqual(body, item.Body) {
+			t.Errorf("[%d] wrong results: got %+v, expected %+v",
+				caseNum, body, item.Body)
+		}
+
+		if _, isString := body.(string); item.ReturnCode != RETURN_OK && item.Body == nil && !isString {
+			t.Errorf("[%d] expected description of error, got %+v", caseNum, body)
+		}
+	}
+}
+
+// recordingObserver Observer remembering return codes of functions
+type recordingObserver struct {
+	codes map[string]uint32
+}
+
+func (o *recordingObserver) ObserveRequest(function Function, returnCode uint32, duration time.Duration) {
+	o.codes[fmt.Sprintf("0x%08x %s", function.Func_id, function.Name)] = returnCode
+}
+
+func TestRegistry_Observe(t *testing.T) {
+	registry := newTestRegistry(t)
+	observer := &recordingObserver{codes: make(map[string]uint32)}
+	registry.Observe(observer)
+	registry.Handle(context.Background(), packet(STORAGE_READ_ID, 1000))
+	registry.Handle(context.Background(), packet(0x00040001))
+	expected := map[string]uint32{
+		"0x00020002 STORAGE_READ": codes.OUT_OF_RANGE,
+		"0x00040001 ":             CLIENT_UNKNOWN_FUNC_ID,
+	}
+	if !reflect.DeepEqual(observer.codes, expected) {
+		t.Errorf("wrong results: got %+v, expected %+v", observer.codes, expected)
+	}
+}
+
+func TestRegister_Duplicate(t *testing.T) {
+	registry := newTestRegistry(t)
+	err := Register(registry, STORAGE_READ_ID, "READ_AGAIN", func(ctx context.Context, req IndexRequest) (string, error) {
+		return "", errors.New("never called")
+	})
+	if err == nil {
+		t.Errorf("expected error, got nil")
+	}
+	if function, _ := registry.Lookup(STORAGE_READ_ID); function.Name != "STORAGE_READ" {
+		t.Errorf("registered function was replaced by %s", function.Name)
+	}
+}
+
+func TestSTORAGE_TTL(t *testing.T) {
+	stor := storage.NewSimpleStorageRepo(storage.DefaultConfig())
+	if err := STORAGE_REPLACE_TTL(&stor, 1, "token", time.Minute); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ttl, err := STORAGE_TTL(&stor, 1)
+	if err != nil || ttl <= 0 || ttl > time.Minute {
+		t.Errorf("wrong results: got %v %v, expected in (0;1m]", ttl, err)
+	}
+	if ttl, err = STORAGE_TTL(&stor, 2); err != nil || ttl != NO_TTL {
+		t.Errorf("wrong results: got %v %v, expected %v", ttl, err, NO_TTL)
+	}
+}
+
+// recordingSession Session remembering subscriptions
+type recordingSession struct {
+	watches map[uint32]WatchRequest
+}
+
+func (s *recordingSession) Watch(requestID uint32, idxs []int, state bool) error {
+	s.watches[requestID] = WatchRequest{Idxs: idxs, All: idxs == nil, State: state}
+	return nil
+}
+
+func (s *recordingSession) Unwatch(requestID uint32) error {
+	if _, exist := s.watches[requestID]; !exist {
+		return errors.New("not watching")
+	}
+	delete(s.watches, requestID)
+	return nil
+}
+
+type WatchTestCase struct {
+	Packet     request_packet.IprotoPacketRequest
+	ReturnCode uint32
+	Watches    map[uint32]WatchRequest
+}
+
+func TestSTORAGE_WATCH(t *testing.T) {
+	registry := newTestRegistry(t)
+	session := &recordingSession{watches: make(map[uint32]WatchRequest)}
+	ctx := WithSession(context.Background(), session)
+	withRequestID := func(packet request_packet.IprotoPacketRequest, requestID uint32) request_packet.IprotoPacketRequest {
+		packet.Header.Request_id = requestID
+		return packet
+	}
+	cases := []WatchTestCase{
+		{Packet: withRequestID(packet(STORAGE_WATCH_ID, nil, true), 1), ReturnCode: RETURN_OK,
+			Watches: map[uint32]WatchRequest{1: {All: true, State: true}}},
+		{Packet: withRequestID(packet(STORAGE_WATCH_ID, []int{3, 5}, false), 2), ReturnCode: RETURN_OK,
+			Watches: map[uint32]WatchRequest{1: {All: true, State: true}, 2: {Idxs: []int{3, 5}}}},
+		{Packet: withRequestID(packet(STORAGE_WATCH_ID, []int{}, true), 3), ReturnCode: RETURN_OK,
+			Watches: map[uint32]WatchRequest{1: {All: true, State: true}, 2: {Idxs: []int{3, 5}}, 3: {Idxs: []int{}, State: true}}},
+		{Packet: packet(STORAGE_UNWATCH_ID, 2), ReturnCode: RETURN_OK,
+			Watches: map[uint32]WatchRequest{1: {All: true, State: true}, 3: {Idxs: []int{}, State: true}}},
+		{Packet: packet(STORAGE_UNWATCH_ID, 2), ReturnCode: HANDLER_ERROR,
+			Watches: map[uint32]WatchRequest{1: {All: true, State: true}, 3: {Idxs: []int{}, State: true}}},
+		{Packet: packet(STORAGE_WATCH_ID, make([]int, 101), false), ReturnCode: CLIENT_INVALID_BODY,
+			Watches: map[uint32]WatchRequest{1: {All: true, State: true}, 3: {Idxs: []int{}, State: true}}},
+		{Packet: packet(STORAGE_WATCH_ID, []int{1}), ReturnCode: CLIENT_INVALID_BODY,
+			Watches: map[uint32]WatchRequest{1: {All: true, State: true}, 3: {Idxs: []int{}, State: true}}},
+	}
+	for caseNum, item := range cases {
+		body, returnCode := registry.Handle(ctx, item.Packet)
+		if returnCode != item.ReturnCode {
+			t.Errorf("[%d] wrong return code: got %d, expected %d (%v)", caseNum, returnCode, item.ReturnCode, body)
+		}
+		if !reflect.DeepEqual(session.watches, item.Watches) {
+			t.Errorf("[%d] wrong results: got %+v, expected %+v", caseNum, session.watches, item.Watches)
+		}
+	}
+}
+
+func TestSTORAGE_SCAN_ResponseSize(t *testing.T) {
+	stor := storage.NewSimpleStorageRepo(storage.Config{Size: 10, MaxValueSize: 20000})
+	for idx := 0; idx < 10; idx++ {
+		_ = stor.SetValue(idx, strings.Repeat("x", 20000))
+	}
+	resp, err := STORAGE_SCAN(&stor, 0, 10, 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(resp.Cells) != 3 || resp.Cursor != 3 {
+		t.Errorf("wrong results: got %d cells and cursor %d, expected %d and %d", len(resp.Cells), resp.Cursor, 3, 3)
+	}
+}
+
+func TestRegistry_Functions(t *testing.T) {
+	registry := newTestRegistry(t)
+	expected := []struct {
+		Func_id  uint32
+		Name     string
+		Request  reflect.Type
+		Response reflect.Type
+	}{
+		{ADM_STORAGE_SWITCH_READONLY_ID, "ADM_STORAGE_SWITCH_READONLY", reflect.TypeOf(Nil{}), reflect.TypeOf(Nil{})},
+		{ADM_STORAGE_SWITCH_READWRITE_ID, "ADM_STORAGE_SWITCH_READWRITE", reflect.TypeOf(Nil{}), reflect.TypeOf(Nil{})},
+		{ADM_STORAGE_SWITCH_MAINTENANCE_ID, "ADM_STORAGE_SWITCH_MAINTENANCE", reflect.TypeOf(Nil{}), reflect.TypeOf(Nil{})},
+		{ADM_STORAGE_SNAPSHOT_ID, "ADM_STORAGE_SNAPSHOT", reflect.TypeOf(Nil{}), reflect.TypeOf("")},
+		{STORAGE_REPLACE_ID, "STORAGE_REPLACE", reflect.TypeOf(ReplaceRequest{}), reflect.TypeOf(Nil{})},
+		{STORAGE_READ_ID, "STORAGE_READ", reflect.TypeOf(ReadRequest{}), reflect.TypeOf(ReadResponse{})},
+		{STORAGE_CAS_ID, "STORAGE_CAS", reflect.TypeOf(CASRequest{}), reflect.TypeOf(Nil{})},
+		{STORAGE_REPLACE_IF_VERSION_ID, "STORAGE_REPLACE_IF_VERSION", reflect.TypeOf(VersionRequest{}), reflect.TypeOf(Nil{})},
+		{STORAGE_READ_MANY_ID, "STORAGE_READ_MANY", reflect.TypeOf(Indexes{}), reflect.TypeOf([]Item{})},
+		{STORAGE_REPLACE_MANY_ID, "STORAGE_REPLACE_MANY", reflect.TypeOf(ReplaceManyRequest{}), reflect.TypeOf([]Item{})},
+		{STORAGE_SCAN_ID, "STORAGE_SCAN", reflect.TypeOf(ScanRequest{}), reflect.TypeOf(ScanResponse{})},
+		{STORAGE_REPLACE_TTL_ID, "STORAGE_REPLACE_TTL", reflect.TypeOf(TTLRequest{}), reflect.TypeOf(Nil{})},
+		{STORAGE_TTL_ID, "STORAGE_TTL", reflect.TypeOf(IndexRequest{}), reflect.TypeOf(int64(0))},
+		{STORAGE_WATCH_ID, "STORAGE_WATCH", reflect.TypeOf(WatchRequest{}), reflect.TypeOf(Nil{})},
+		{STORAGE_UNWATCH_ID, "STORAGE_UNWATCH", reflect.TypeOf(UnwatchRequest{}), reflect.TypeOf(Nil{})},
+		{0x00030001, "ECHO", reflect.TypeOf(ReplaceRequest{}), reflect.TypeOf("")},
+		{0x00030002, "FAIL", reflect.TypeOf(Nil{}), reflect.TypeOf(Nil{})},
+	}
+	functions := registry.Functions()
+	if len(functions) != len(expected) {
+		t.Fatalf("wrong number of functions: got %d, expected %d", len(functions), len(expected))
+	}
+	for i, function := range functions {
+		if function.Func_id != expected[i].Func_id || function.Name != expected[i].Name ||
+			function.Request != expected[i].Request || function.Response != expected[i].Response {
+			t.Errorf("[%d] wrong results: got %+v, expected %+v", i, function, expected[i])
+		}
+	}
+}
+
+func TestRegistry_Panic(t *testing.T) {
+	registry := NewRegistry()
+	err := Register(registry, 0x00030003, "PANIC", func(ctx context.Context, req Nil) (Nil, error) {
+		panic("broken handler")
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var panics []interface{}
+	registry.OnPanic(func(func_id uint32, recovered interface{}, stack []byte) {
+		panics = append(panics, recovered)
+	})
+	body, returnCode := registry.Handle(context.Background(), packet(0x00030003))
+	if returnCode != codes.ErrHandler.Code || body != codes.ErrHandler.Error() {
+		t.Errorf("wrong results: got %v with return code %d, expected %v", body, returnCode, codes.ErrHandler)
+	}
+	if len(panics) != 1 || panics[0] != "broken handler" {
+		t.Errorf("wrong results: got panics %v, expected one of handler", panics)
+	}
+}
@@ -0,0 +1,206 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/Bambelbl/iproto-server/packet/request_packet"
+	"github.com/vmihailenco/msgpack"
+	"github.com/vmihailenco/msgpack/codes"
+)
+
+// BodyUnmarshaler is implemented by request types which decode msgpack body themselves
+type BodyUnmarshaler interface {
+	UnmarshalBody(data []byte) error
+}
+
+// BodyMarshaler is implemented by request types which encode msgpack body themselves
+type BodyMarshaler interface {
+	MarshalBody() ([]byte, error)
+}
+
+// Nil schema <nil>: empty body or msgpack nil
+type Nil struct{}
+
+// UnmarshalBody accepts empty body or msgpack nil
+func (n *Nil) UnmarshalBody(data []byte) error {
+	if len(data) == 0 || len(data) == 1 && codes.Code(data[0]) == codes.Nil {
+		return nil
+	}
+	return errors.New("body must be empty")
+}
+
+// MarshalBody encodes Nil as msgpack nil
+func (n Nil) MarshalBody() ([]byte, error) {
+	return []byte{byte(codes.Nil)}, nil
+}
+
+// ReadRequest schema <int> or <int><bool>, response has version of the cell if Version is true
+type ReadRequest struct {
+	Idx     int
+	Version bool
+}
+
+// UnmarshalBody accepts index alone or followed by flag of version
+func (r *ReadRequest) UnmarshalBody(data []byte) error {
+	if err := request_packet.UnmarshalValues(data, &r.Idx); err == nil {
+		return nil
+	}
+	return request_packet.UnmarshalValues(data, &r.Idx, &r.Version)
+}
+
+// MarshalBody encodes flag of version only if it's set
+func (r ReadRequest) MarshalBody() ([]byte, error) {
+	if r.Version {
+		return request_packet.MarshalValues(r.Idx, r.Version)
+	}
+	return request_packet.MarshalValues(r.Idx)
+}
+
+// ReadResponse schema <string>, or <string><version> if HasVersion is true
+type ReadResponse struct {
+	Str        string
+	Version    uint64
+	HasVersion bool
+}
+
+// UnmarshalBody accepts string alone or array of string and version
+func (r *ReadResponse) UnmarshalBody(data []byte) error {
+	if len(data) > 0 && codes.IsFixedArray(codes.Code(data[0])) {
+		r.HasVersion = true
+		return request_packet.UnmarshalValues(data, &r.Str, &r.Version)
+	}
+	return msgpack.Unmarshal(data, &r.Str)
+}
+
+// MarshalBody encodes version only if HasVersion is true
+func (r ReadResponse) MarshalBody() ([]byte, error) {
+	if r.HasVersion {
+		return request_packet.MarshalValues(r.Str, r.Version)
+	}
+	return msgpack.Marshal(r.Str)
+}
+
+// Item schema <uint return_code><string> of one item of batch response:
+// string is value if return_code is RETURN_OK and description of error otherwise
+type Item struct {
+	_msgpack    struct{} `msgpack:",asArray"`
+	Return_code uint32
+	Str         string
+}
+
+// Indexes schema <array of int>, like other bodies it may be wrapped in array
+type Indexes []int
+
+// UnmarshalBody accepts array of indexes alone or wrapped in array
+func (r *Indexes) UnmarshalBody(data []byte) error {
+	if err := msgpack.Unmarshal(data, (*[]int)(r)); err == nil {
+		return nil
+	}
+	return request_packet.UnmarshalValues(data, (*[]int)(r))
+}
+
+// Values schema <map of int to string>, like other bodies it may be wrapped in array
+type Values map[int]string
+
+// UnmarshalBody accepts map of values alone or wrapped in array
+func (r *Values) UnmarshalBody(data []byte) error {
+	if len(data) > 0 && codes.IsFixedArray(codes.Code(data[0])) {
+		return request_packet.UnmarshalValues(data, (*map[int]string)(r))
+	}
+	return msgpack.Unmarshal(data, (*map[int]string)(r))
+}
+
+// ReplaceManyRequest schema <map of int to string> or <map of int to string><bool best_effort>:
+// values are written all at once unless BestEffort is set, then every value is written on its own
+type ReplaceManyRequest struct {
+	Values     Values
+	BestEffort bool
+}
+
+// UnmarshalBody accepts map of values alone, wrapped in array or followed by flag of best effort
+func (r *ReplaceManyRequest) UnmarshalBody(data []byte) error {
+	if err := r.Values.UnmarshalBody(data); err == nil {
+		return nil
+	}
+	return request_packet.UnmarshalValues(data, (*map[int]string)(&r.Values), &r.BestEffort)
+}
+
+// MarshalBody encodes flag of best effort only if it's set
+func (r ReplaceManyRequest) MarshalBody() ([]byte, error) {
+	if r.BestEffort {
+		return request_packet.MarshalValues(map[int]string(r.Values), r.BestEffort)
+	}
+	return msgpack.Marshal(map[int]string(r.Values))
+}
+
+// Pair schema <int idx><string> of one cell in response of scan
+type Pair struct {
+	_msgpack struct{} `msgpack:",asArray"`
+	Idx      int
+	Str      string
+}
+
+// ScanResponse schema <array of [<int idx><string>]><int cursor>: non-empty cells in index order
+// and index to continue scan from, SCAN_DONE if the range is scanned
+type ScanResponse struct {
+	Cells  []Pair
+	Cursor int
+}
+
+// UnmarshalBody from msgpack values to ScanResponse
+func (r *ScanResponse) UnmarshalBody(data []byte) error {
+	return request_packet.UnmarshalValues(data, &r.Cells, &r.Cursor)
+}
+
+// MarshalBody from ScanResponse to msgpack values
+func (r ScanResponse) MarshalBody() ([]byte, error) {
+	return request_packet.MarshalValues(r.Cells, r.Cursor)
+}
+
+// WatchRequest schema <array of int or nil><bool state>: indexes of watched cells, nil watches all cells
+type WatchRequest struct {
+	Idxs  []int
+	All   bool
+	State bool
+}
+
+// UnmarshalBody accepts nil instead of array of indexes, which sets All
+func (r *WatchRequest) UnmarshalBody(data []byte) error {
+	reader := bytes.NewReader(data)
+	decoder := msgpack.NewDecoder(reader)
+	if length, err := decoder.DecodeArrayLen(); err != nil || length != 2 {
+		return errors.New("expected array of indexes or nil and state flag")
+	}
+	code, err := decoder.PeekCode()
+	if err != nil {
+		return err
+	}
+	if code == codes.Nil {
+		r.All = true
+		err = decoder.DecodeNil()
+	} else {
+		err = decoder.Decode(&r.Idxs)
+	}
+	if err != nil {
+		return err
+	}
+	if r.State, err = decoder.DecodeBool(); err != nil {
+		return err
+	}
+	if reader.Len() != 0 {
+		return fmt.Errorf("%d unexpected bytes after body", reader.Len())
+	}
+	return nil
+}
+
+// MarshalBody encodes nil instead of indexes if All is set
+func (r WatchRequest) MarshalBody() ([]byte, error) {
+	if r.All {
+		return request_packet.MarshalValues(nil, r.State)
+	}
+	if r.Idxs == nil {
+		return request_packet.MarshalValues([]int{}, r.State)
+	}
+	return request_packet.MarshalValues(r.Idxs, r.State)
+}
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"context"
+)
+
+// STORAGE_NOTIFY_ID func_id of frames server pushes to watching client without request:
+// request_id of the frame is request_id of STORAGE_WATCH, return code is RETURN_OK, body is Notification
+const STORAGE_NOTIFY_ID = 0x0002000C
+
+// Session connection requests come from. Server puts it into context of every request,
+// so functions may push frames to the client beyond their responses
+type Session interface {
+
+	// Watch Subscribe connection to changes of cells idxs, all cells if idxs is nil, and to transitions
+	// of state if state is set. Changes are pushed as STORAGE_NOTIFY_ID frames with requestID
+	Watch(requestID uint32, idxs []int, state bool) error
+
+	// Unwatch Cancel subscription made by request with requestID
+	Unwatch(requestID uint32) error
+}
+
+type sessionKey struct{}
+
+type requestIDKey struct{}
+
+// WithSession returns context of requests coming from session
+func WithSession(ctx context.Context, session Session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, session)
+}
+
+// SessionFrom returns session the request with context ctx comes from
+func SessionFrom(ctx context.Context) (session Session, exist bool) {
+	session, exist = ctx.Value(sessionKey{}).(Session)
+	return
+}
+
+// RequestID returns request_id of the request with context ctx, Registry.Handle sets it
+func RequestID(ctx context.Context) uint32 {
+	requestID, _ := ctx.Value(requestIDKey{}).(uint32)
+	return requestID
+}
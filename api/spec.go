@@ -0,0 +1,76 @@
+package api
+
+//go:generate go run ../cmd/iproto-gen -spec spec.go -out api_gen.go
+
+// IndexRequest schema <int>
+type IndexRequest struct {
+	Idx int
+}
+
+// ReplaceRequest schema <int><string>
+type ReplaceRequest struct {
+	Idx int
+	Str string
+}
+
+// CASRequest schema <int><string><string>
+type CASRequest struct {
+	Idx      int
+	Expected string
+	New      string
+}
+
+// VersionRequest schema <int><uint><string>
+type VersionRequest struct {
+	Idx     int
+	Version uint64
+	Str     string
+}
+
+// ScanRequest schema <int from><int to><int limit>
+type ScanRequest struct {
+	From  int
+	To    int
+	Limit int
+}
+
+// TTLRequest schema <int><string><int ttl in milliseconds>
+type TTLRequest struct {
+	Idx int
+	Str string
+	TTL int64
+}
+
+// UnwatchRequest schema <uint request_id of STORAGE_WATCH>
+type UnwatchRequest struct {
+	Request_id uint32
+}
+
+// Notification schema <int idx><string><uint version><int state><uint dropped> of frame pushed to watching client:
+// idx is storage.STATE_EVENT for transition of state, dropped counts notifications dropped right before this one
+type Notification struct {
+	Idx     int
+	Str     string
+	Version uint64
+	State   int
+	Dropped uint64
+}
+
+// functions API of storage: func_id, name, request and response schema of each function
+type functions struct {
+	ADM_STORAGE_SWITCH_READONLY    func(Nil) Nil                   `iproto:"0x00010001"`
+	ADM_STORAGE_SWITCH_READWRITE   func(Nil) Nil                   `iproto:"0x00010002"`
+	ADM_STORAGE_SWITCH_MAINTENANCE func(Nil) Nil                   `iproto:"0x00010003"`
+	ADM_STORAGE_SNAPSHOT           func(Nil) string                `iproto:"0x00010004"`
+	STORAGE_REPLACE                func(ReplaceRequest) Nil        `iproto:"0x00020001"`
+	STORAGE_READ                   func(ReadRequest) ReadResponse  `iproto:"0x00020002"`
+	STORAGE_CAS                    func(CASRequest) Nil            `iproto:"0x00020003"`
+	STORAGE_REPLACE_IF_VERSION     func(VersionRequest) Nil        `iproto:"0x00020004"`
+	STORAGE_READ_MANY              func(Indexes) []Item            `iproto:"0x00020005"`
+	STORAGE_REPLACE_MANY           func(ReplaceManyRequest) []Item `iproto:"0x00020006"`
+	STORAGE_SCAN                   func(ScanRequest) ScanResponse  `iproto:"0x00020007"`
+	STORAGE_REPLACE_TTL            func(TTLRequest) Nil            `iproto:"0x00020008"`
+	STORAGE_TTL                    func(IndexRequest) int64        `iproto:"0x00020009"`
+	STORAGE_WATCH                  func(WatchRequest) Nil          `iproto:"0x0002000A"`
+	STORAGE_UNWATCH                func(UnwatchRequest) Nil        `iproto:"0x0002000B"`
+}
@@ -0,0 +1,415 @@
+// Package client is a Go client of iproto server. Client keeps a pool of connections,
+// pipelines requests over them and matches responses by request_id
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/Bambelbl/iproto-server/api"
+	"github.com/Bambelbl/iproto-server/packet/request_packet"
+	"github.com/Bambelbl/iproto-server/packet/response_packet"
+	"github.com/Bambelbl/iproto-server/tracing"
+	"github.com/vmihailenco/msgpack"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	POOL_SIZE       = 4
+	TIMEOUT         = 2 * time.Second
+	DIAL_TIMEOUT    = time.Second
+	MIN_BACKOFF     = 50 * time.Millisecond
+	MAX_BACKOFF     = 5 * time.Second
+	MAX_BODY_LENGTH = 1 << 20
+)
+
+// Client of iproto server, safe for concurrent use
+type Client struct {
+	addr          string
+	poolSize      int
+	timeout       time.Duration
+	dialTimeout   time.Duration
+	minBackoff    time.Duration
+	maxBackoff    time.Duration
+	maxBodyLength uint32
+
+	api       *api.Client
+	slots     []slot
+	next      uint32
+	requestID uint32
+
+	mutex    sync.Mutex
+	backoff  time.Duration
+	nextDial time.Time
+	closed   bool
+	watches  map[*connection]struct{}
+}
+
+// slot place for one connection of the pool
+type slot struct {
+	mutex sync.Mutex
+	conn  *connection
+}
+
+// Option configures optional behaviour of Client
+type Option func(c *Client)
+
+// WithPoolSize sets number of connections to server
+func WithPoolSize(size int) Option {
+	return func(c *Client) {
+		if size > 0 {
+			c.poolSize = size
+		}
+	}
+}
+
+// WithTimeout sets timeout of calls made with context without deadline
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = timeout
+	}
+}
+
+// WithDialTimeout sets timeout of one connection attempt
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.dialTimeout = timeout
+	}
+}
+
+// WithBackoff sets bounds of exponential delay between failed connection attempts
+func WithBackoff(min time.Duration, max time.Duration) Option {
+	return func(c *Client) {
+		c.minBackoff = min
+		c.maxBackoff = max
+	}
+}
+
+// NewClient initializes Client of server at addr, connections are opened on demand
+func NewClient(addr string, opts ...Option) *Client {
+	c := &Client{
+		addr:          addr,
+		poolSize:      POOL_SIZE,
+		timeout:       TIMEOUT,
+		dialTimeout:   DIAL_TIMEOUT,
+		minBackoff:    MIN_BACKOFF,
+		maxBackoff:    MAX_BACKOFF,
+		maxBodyLength: MAX_BODY_LENGTH,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.slots = make([]slot, c.poolSize)
+	c.api = api.NewClient(c)
+	return c
+}
+
+// Read returns string from storage by index
+func (c *Client) Read(ctx context.Context, idx int) (string, error) {
+	resp, err := c.api.STORAGE_READ(ctx, api.ReadRequest{Idx: idx})
+	return resp.Str, err
+}
+
+// ReadVersion returns string from storage by index together with version of the cell
+func (c *Client) ReadVersion(ctx context.Context, idx int) (string, uint64, error) {
+	resp, err := c.api.STORAGE_READ(ctx, api.ReadRequest{Idx: idx, Version: true})
+	return resp.Str, resp.Version, err
+}
+
+// Replace writes string to storage by index
+func (c *Client) Replace(ctx context.Context, idx int, str string) error {
+	_, err := c.api.STORAGE_REPLACE(ctx, api.ReplaceRequest{Idx: idx, Str: str})
+	return err
+}
+
+// ReadMany returns strings from storage by indexes read at one moment. Errors of single indexes
+// are returned in errs as *ServerError, err fails the whole batch
+func (c *Client) ReadMany(ctx context.Context, idxs []int) (values []string, errs []error, err error) {
+	items, err := c.api.STORAGE_READ_MANY(ctx, idxs)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(items) != len(idxs) {
+		return nil, nil, fmt.Errorf("got %d items for %d indexes", len(items), len(idxs))
+	}
+	values = make([]string, len(items))
+	errs = make([]error, len(items))
+	for i, item := range items {
+		if item.Return_code != api.RETURN_OK {
+			errs[i] = &ServerError{Return_code: item.Return_code, Message: item.Str}
+			continue
+		}
+		values[i] = item.Str
+	}
+	return
+}
+
+// ReplaceMany writes strings to storage by indexes all at once: either every string is written or none
+func (c *Client) ReplaceMany(ctx context.Context, values map[int]string) error {
+	_, err := c.api.STORAGE_REPLACE_MANY(ctx, api.ReplaceManyRequest{Values: values})
+	return err
+}
+
+// ReplaceEach writes strings to storage by indexes one by one: every string is written or fails on its own.
+// Errors of single indexes which failed are returned in errs as *ServerError, err fails the whole batch
+func (c *Client) ReplaceEach(ctx context.Context, values map[int]string) (errs map[int]error, err error) {
+	items, err := c.api.STORAGE_REPLACE_MANY(ctx, api.ReplaceManyRequest{Values: values, BestEffort: true})
+	if err != nil {
+		return nil, err
+	}
+	if len(items) != len(values) {
+		return nil, fmt.Errorf("got %d items for %d indexes", len(items), len(values))
+	}
+	// Items follow indexes in ascending order
+	idxs := make([]int, 0, len(values))
+	for idx := range values {
+		idxs = append(idxs, idx)
+	}
+	sort.Ints(idxs)
+	errs = make(map[int]error)
+	for i, item := range items {
+		if item.Return_code != api.RETURN_OK {
+			errs[idxs[i]] = &ServerError{Return_code: item.Return_code, Message: item.Str}
+		}
+	}
+	return errs, nil
+}
+
+// Scan returns up to limit non-empty cells with indexes in [from;to) and index to continue scan from,
+// api.SCAN_DONE if the range is scanned. Server may return less cells than limit
+func (c *Client) Scan(ctx context.Context, from int, to int, limit int) ([]api.Pair, int, error) {
+	resp, err := c.api.STORAGE_SCAN(ctx, api.ScanRequest{From: from, To: to, Limit: limit})
+	return resp.Cells, resp.Cursor, err
+}
+
+// CompareAndSwap writes string to storage by index if current value of the cell is expected.
+// On mismatch it returns *ServerError matching codes.ErrMismatch with current value as Message
+func (c *Client) CompareAndSwap(ctx context.Context, idx int, expected string, str string) error {
+	_, err := c.api.STORAGE_CAS(ctx, api.CASRequest{Idx: idx, Expected: expected, New: str})
+	return err
+}
+
+// ReplaceIfVersion writes string to storage by index if current version of the cell is version.
+// On mismatch it returns *ServerError matching codes.ErrMismatch with current version as Message
+func (c *Client) ReplaceIfVersion(ctx context.Context, idx int, version uint64, str string) error {
+	_, err := c.api.STORAGE_REPLACE_IF_VERSION(ctx, api.VersionRequest{Idx: idx, Version: version, Str: str})
+	return err
+}
+
+// ReplaceTTL writes string to storage by index, the cell reads empty after ttl.
+// Server counts ttl in milliseconds, so positive ttl is rounded up to the next millisecond
+func (c *Client) ReplaceTTL(ctx context.Context, idx int, str string, ttl time.Duration) error {
+	ms := ttl.Milliseconds()
+	if ttl > 0 && ttl%time.Millisecond != 0 {
+		ms++
+	}
+	_, err := c.api.STORAGE_REPLACE_TTL(ctx, api.TTLRequest{Idx: idx, Str: str, TTL: ms})
+	return err
+}
+
+// TTL returns remaining time to live of value by index, negative if the value doesn't expire
+func (c *Client) TTL(ctx context.Context, idx int) (time.Duration, error) {
+	ttl, err := c.api.STORAGE_TTL(ctx, api.IndexRequest{Idx: idx})
+	if ttl < 0 {
+		return -1, err
+	}
+	return time.Duration(ttl) * time.Millisecond, err
+}
+
+// SwitchReadOnly switches storage to READ_ONLY state
+func (c *Client) SwitchReadOnly(ctx context.Context) error {
+	_, err := c.api.ADM_STORAGE_SWITCH_READONLY(ctx, api.Nil{})
+	return err
+}
+
+// SwitchReadWrite switches storage to READ_WRITE state
+func (c *Client) SwitchReadWrite(ctx context.Context) error {
+	_, err := c.api.ADM_STORAGE_SWITCH_READWRITE(ctx, api.Nil{})
+	return err
+}
+
+// SwitchMaintenance switches storage to MAINTENANCE state
+func (c *Client) SwitchMaintenance(ctx context.Context) error {
+	_, err := c.api.ADM_STORAGE_SWITCH_MAINTENANCE(ctx, api.Nil{})
+	return err
+}
+
+// Snapshot makes server write snapshot of storage and returns path of snapshot file
+func (c *Client) Snapshot(ctx context.Context) (string, error) {
+	return c.api.ADM_STORAGE_SNAPSHOT(ctx, api.Nil{})
+}
+
+// Call sends msgpack body to function func_id and returns msgpack body of its response.
+// Non-zero return code is returned as *ServerError, Call implements api.Caller
+func (c *Client) Call(ctx context.Context, func_id uint32, body []byte) ([]byte, error) {
+	response, err := c.Do(ctx, func_id, body)
+	if err != nil {
+		return nil, err
+	}
+	return responseData(response)
+}
+
+// responseData returns msgpack body of response, non-zero return code is returned as *ServerError
+func responseData(response response_packet.IprotoPacketResponse) ([]byte, error) {
+	data := response.Body.([]byte)
+	if response.Return_code != api.RETURN_OK {
+		serverErr := &ServerError{Return_code: response.Return_code}
+		var message interface{}
+		if err := msgpack.Unmarshal(data, &message); err != nil {
+			serverErr.Message = fmt.Sprintf("undecodable description of error: %x", data)
+		} else {
+			// Some errors carry value instead of description, e.g. current version on mismatch
+			serverErr.Message = fmt.Sprint(message)
+		}
+		return nil, serverErr
+	}
+	return data, nil
+}
+
+// Do sends msgpack body to function func_id and returns response as it came from server:
+// return code is not checked and Body holds msgpack-encoded []byte
+func (c *Client) Do(ctx context.Context, func_id uint32, body []byte) (response_packet.IprotoPacketResponse, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	conn, err := c.connection(ctx)
+	if err != nil {
+		return response_packet.IprotoPacketResponse{}, err
+	}
+	return c.roundTrip(ctx, conn, atomic.AddUint32(&c.requestID, 1), func_id, body)
+}
+
+// withTimeout returns ctx with timeout of Client unless ctx has deadline already
+func (c *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); !ok && c.timeout > 0 {
+		return context.WithTimeout(ctx, c.timeout)
+	}
+	return ctx, func() {}
+}
+
+// roundTrip sends request with requestID over conn and waits for its response until ctx is done.
+// Context of span kept in ctx is sent with the request, so server continues its trace
+func (c *Client) roundTrip(ctx context.Context, conn *connection, requestID uint32,
+	func_id uint32, body []byte) (response_packet.IprotoPacketResponse, error) {
+	request := request_packet.IprotoPacketRequest{
+		Header: request_packet.IprotoHeader{Func_id: func_id, Request_id: requestID},
+		Body:   body,
+	}
+	if sc := tracing.SpanContextFromContext(ctx); sc.IsValid() {
+		request.Trace = sc.Bytes()
+	}
+	ch, err := conn.send(ctx, request)
+	if err != nil {
+		return response_packet.IprotoPacketResponse{}, err
+	}
+	select {
+	case res := <-ch:
+		return res.packet, res.err
+	case <-ctx.Done():
+		conn.cancel(requestID)
+		return response_packet.IprotoPacketResponse{}, fmt.Errorf("%w: %s", ErrTimeout, ctx.Err().Error())
+	}
+}
+
+// connection returns connection of the next slot of the pool, reconnecting if it is broken
+func (c *Client) connection(ctx context.Context) (*connection, error) {
+	s := &c.slots[atomic.AddUint32(&c.next, 1)%uint32(len(c.slots))]
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.conn != nil && !s.conn.broken() {
+		return s.conn, nil
+	}
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		conn.close()
+		return nil, ErrClosed
+	}
+	s.conn = conn
+	return conn, nil
+}
+
+// dial connects to server. After failed attempt the next one is delayed
+// with exponential backoff, the delay is waited for until ctx is done
+func (c *Client) dial(ctx context.Context) (*connection, error) {
+	c.mutex.Lock()
+	closed, wait := c.closed, time.Until(c.nextDial)
+	c.mutex.Unlock()
+	if closed {
+		return nil, ErrClosed
+	}
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("%w: waiting to reconnect: %s", ErrTimeout, ctx.Err().Error())
+		}
+	}
+	dialer := net.Dialer{Timeout: c.dialTimeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", c.addr)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err != nil {
+		if c.backoff == 0 {
+			c.backoff = c.minBackoff
+		} else if c.backoff *= 2; c.backoff > c.maxBackoff {
+			c.backoff = c.maxBackoff
+		}
+		c.nextDial = time.Now().Add(c.backoff)
+		return nil, fmt.Errorf("%w: dial: %s", ErrConnection, err.Error())
+	}
+	c.backoff = 0
+	c.nextDial = time.Time{}
+	return newConnection(netConn, c.maxBodyLength), nil
+}
+
+// track keeps connection of watch to close it on Close, false if Client is closed already
+func (c *Client) track(conn *connection) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return false
+	}
+	if c.watches == nil {
+		c.watches = make(map[*connection]struct{})
+	}
+	c.watches[conn] = struct{}{}
+	return true
+}
+
+// untrack forgets connection of closed watch
+func (c *Client) untrack(conn *connection) {
+	c.mutex.Lock()
+	delete(c.watches, conn)
+	c.mutex.Unlock()
+}
+
+// Close closes all connections, calls waiting for response get ErrConnection
+// and channels of watches are closed
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	c.closed = true
+	watches := c.watches
+	c.watches = nil
+	c.mutex.Unlock()
+	for conn := range watches {
+		conn.close()
+	}
+	for i := range c.slots {
+		s := &c.slots[i]
+		s.mutex.Lock()
+		if s.conn != nil {
+			s.conn.close()
+		}
+		s.mutex.Unlock()
+	}
+	return nil
+}
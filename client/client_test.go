@@ -0,0 +1,419 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/Bambelbl/iproto-server/api"
+	"github.com/Bambelbl/iproto-server/logging"
+	"github.com/Bambelbl/iproto-server/server"
+	"github.com/Bambelbl/iproto-server/tracing"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startServer starts IprotoServer on addr, empty addr means a free local port
+func startServer(t *testing.T, addr string) *server.IprotoServer {
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	iprotoServer := server.NewIprotoServer(addr, logging.Nop(), 100, 1000, 1000)
+	iprotoServer.Serve()
+	return iprotoServer
+}
+
+// stopServer stops IprotoServer reporting errors to t
+func stopServer(t *testing.T, iprotoServer *server.IprotoServer) {
+	if err := iprotoServer.Stop(); err != nil {
+		t.Errorf("server stop error: %v", err)
+	}
+}
+
+type ErrorTestCase struct {
+	Call func(c *Client) error
+	Err  error
+}
+
+func TestClient(t *testing.T) {
+	iprotoServer := startServer(t, "")
+	defer stopServer(t, iprotoServer)
+	c := NewClient(iprotoServer.Addr().String())
+	defer c.Close()
+	ctx := context.Background()
+
+	if err := c.Replace(ctx, 5, "five"); err != nil {
+		t.Fatalf("unexpected replace error: %v", err)
+	}
+	if str, err := c.Read(ctx, 5); err != nil || str != "five" {
+		t.Fatalf("wrong read results: got %q %v, expected %q", str, err, "five")
+	}
+
+	cases := []ErrorTestCase{
+		{Call: func(c *Client) error { _, err := c.Read(ctx, 1000); return err }, Err: ErrOutOfRange},
+		{Call: func(c *Client) error { return c.Replace(ctx, -1, "x") }, Err: ErrOutOfRange},
+		{Call: func(c *Client) error { return c.Replace(ctx, 1, strings.Repeat("x", 257)) }, Err: ErrValueTooLarge},
+		{Call: func(c *Client) error { _, err := c.Call(ctx, 0x00020002, []byte{0xa1, 'x'}); return err }, Err: ErrInvalidBody},
+		{Call: func(c *Client) error { _, err := c.Call(ctx, 0x00030001, nil); return err }, Err: ErrUnknownFunc},
+		{Call: func(c *Client) error { return c.CompareAndSwap(ctx, 5, "five", "5") }, Err: nil},
+		{Call: func(c *Client) error { return c.CompareAndSwap(ctx, 5, "five", "6") }, Err: ErrMismatch},
+		{Call: func(c *Client) error { return c.SwitchMaintenance(ctx) }, Err: nil},
+		{Call: func(c *Client) error { _, err := c.Read(ctx, 5); return err }, Err: ErrWrongState},
+		{Call: func(c *Client) error { return c.SwitchReadWrite(ctx) }, Err: nil},
+	}
+	for caseNum, item := range cases {
+		err := item.Call(c)
+		if item.Err == nil && err != nil {
+			t.Errorf("[%d] unexpected error: %v", caseNum, err)
+		}
+		if item.Err != nil && !errors.Is(err, item.Err) {
+			t.Errorf("[%d] wrong results: got %v, expected %v", caseNum, err, item.Err)
+		}
+		var serverErr *ServerError
+		if item.Err != nil && (!errors.As(err, &serverErr) || serverErr.Message == "") {
+			t.Errorf("[%d] expected ServerError with message, got %v", caseNum, err)
+		}
+	}
+
+	var serverErr *ServerError
+	if err := c.CompareAndSwap(ctx, 5, "five", "6"); !errors.As(err, &serverErr) || serverErr.Message != "5" {
+		t.Errorf("wrong results: got %v, expected mismatch with current value %q", err, "5")
+	}
+	str, version, err := c.ReadVersion(ctx, 5)
+	if err != nil || str != "5" || version == 0 {
+		t.Fatalf("wrong results: got %q of version %d, %v", str, version, err)
+	}
+	if err = c.ReplaceIfVersion(ctx, 5, version, "five"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	err = c.ReplaceIfVersion(ctx, 5, version, "5")
+	if !errors.Is(err, ErrMismatch) || !errors.As(err, &serverErr) || serverErr.Message != strconv.FormatUint(version+1, 10) {
+		t.Errorf("wrong results: got %v, expected mismatch with current version %d", err, version+1)
+	}
+}
+
+func TestClient_Batch(t *testing.T) {
+	iprotoServer := startServer(t, "")
+	defer stopServer(t, iprotoServer)
+	c := NewClient(iprotoServer.Addr().String())
+	defer c.Close()
+	ctx := context.Background()
+
+	// The whole batch of the longest values fits in one request
+	values := make(map[int]string)
+	for idx := 0; idx < 100; idx++ {
+		values[idx] = strings.Repeat(strconv.Itoa(idx%10), 256)
+	}
+	if err := c.ReplaceMany(ctx, values); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.ReplaceMany(ctx, map[int]string{0: "zero", 1000: "out"}); !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("wrong results: got %v, expected %v", err, ErrOutOfRange)
+	}
+	read, errs, err := c.ReadMany(ctx, []int{99, 1000, 0})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if read[0] != values[99] || read[2] != values[0] || errs[0] != nil || errs[2] != nil {
+		t.Errorf("wrong results: got %q %v", read, errs)
+	}
+	if !errors.Is(errs[1], ErrOutOfRange) {
+		t.Errorf("wrong results: got %v, expected %v", errs[1], ErrOutOfRange)
+	}
+
+	// Best effort batch of the longest values fits in one request too, every value which fits is written
+	each := map[int]string{0: "zero", 1: strings.Repeat("1", 257), 1000: "out"}
+	for idx := 2; idx < 99; idx++ {
+		each[idx] = values[idx]
+	}
+	writeErrs, err := c.ReplaceEach(ctx, each)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(writeErrs) != 2 || !errors.Is(writeErrs[1000], ErrOutOfRange) || !errors.Is(writeErrs[1], ErrValueTooLarge) {
+		t.Errorf("wrong results: got %v, expected errors of indexes 1 and 1000", writeErrs)
+	}
+	if read, _ := c.Read(ctx, 0); read != "zero" {
+		t.Errorf("wrong results: got %q, expected %q", read, "zero")
+	}
+
+	// Scan goes on from cursor until the range is scanned
+	scanned := 0
+	for cursor := 50; cursor != api.SCAN_DONE; {
+		var cells []api.Pair
+		if cells, cursor, err = c.Scan(ctx, cursor, 1000, 20); err != nil {
+			t.Fatalf("unexpected scan error: %v", err)
+		}
+		for _, cell := range cells {
+			if cell.Idx != 50+scanned || cell.Str != values[cell.Idx] {
+				t.Fatalf("wrong results: got cell %d %q, expected cell %d", cell.Idx, cell.Str, 50+scanned)
+			}
+			scanned++
+		}
+	}
+	if scanned != 50 {
+		t.Errorf("wrong results: scanned %d cells, expected %d", scanned, 50)
+	}
+}
+
+func TestClient_TTL(t *testing.T) {
+	iprotoServer := startServer(t, "")
+	defer stopServer(t, iprotoServer)
+	c := NewClient(iprotoServer.Addr().String())
+	defer c.Close()
+	ctx := context.Background()
+
+	if err := c.ReplaceTTL(ctx, 1, "token", 50*time.Millisecond); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ttl, err := c.TTL(ctx, 1); err != nil || ttl <= 0 || ttl > 50*time.Millisecond {
+		t.Errorf("wrong results: got ttl %v %v, expected in (0;50ms]", ttl, err)
+	}
+	if ttl, err := c.TTL(ctx, 2); err != nil || ttl >= 0 {
+		t.Errorf("wrong results: got ttl %v %v, expected negative", ttl, err)
+	}
+	if err := c.ReplaceTTL(ctx, 1, "token", 0); !errors.Is(err, ErrInvalidBody) {
+		t.Errorf("wrong results: got %v, expected %v", err, ErrInvalidBody)
+	}
+	// Ttl shorter than millisecond isn't truncated to invalid 0
+	if err := c.ReplaceTTL(ctx, 2, "token", time.Microsecond); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := c.ReplaceTTL(ctx, 3, "token", 1500*time.Microsecond); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if ttl, err := c.TTL(ctx, 3); err != nil || ttl > 2*time.Millisecond {
+		t.Errorf("wrong results: got ttl %v %v, expected up to 2ms", ttl, err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if str, err := c.Read(ctx, 1); err != nil || str != "" {
+		t.Errorf("wrong results: got %q %v, expected expired value", str, err)
+	}
+}
+
+// nextNotification waits for notification of watch
+func nextNotification(t *testing.T, w *Watch) (api.Notification, bool) {
+	select {
+	case notification, ok := <-w.Notifications():
+		return notification, ok
+	case <-time.After(time.Second):
+		t.Fatalf("no notification in time")
+		return api.Notification{}, false
+	}
+}
+
+func TestClient_Watch(t *testing.T) {
+	iprotoServer := startServer(t, "")
+	defer stopServer(t, iprotoServer)
+	c := NewClient(iprotoServer.Addr().String())
+	defer c.Close()
+	ctx := context.Background()
+
+	cells, err := c.Watch(ctx, []int{1}, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	all, err := c.Watch(ctx, nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err = c.Watch(ctx, []int{1000}, false); !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("wrong results: got %v, expected %v", err, ErrOutOfRange)
+	}
+
+	if err = c.Replace(ctx, 2, "two"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err = c.Replace(ctx, 1, "one"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err = c.SwitchReadOnly(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []api.Notification{{Idx: 1, Str: "one", Version: 1}, {Idx: -1, State: 1}}
+	for i, item := range expected {
+		if notification, _ := nextNotification(t, cells); notification != item {
+			t.Errorf("[%d] wrong results: got %+v, expected %+v", i, notification, item)
+		}
+	}
+	expected = []api.Notification{{Idx: 2, Str: "two", Version: 1}, {Idx: 1, Str: "one", Version: 1}}
+	for i, item := range expected {
+		if notification, _ := nextNotification(t, all); notification != item {
+			t.Errorf("[%d] wrong results: got %+v, expected %+v", i, notification, item)
+		}
+	}
+
+	// Closed watch doesn't hold connections of the pool
+	if err = cells.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := nextNotification(t, cells); ok || !errors.Is(cells.Err(), ErrConnection) {
+		t.Errorf("wrong results: expected closed watch, got %v", cells.Err())
+	}
+	if err = c.SwitchReadWrite(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = c.Close()
+	if _, ok := nextNotification(t, all); ok {
+		t.Errorf("wrong results: expected watch to be closed with client")
+	}
+}
+
+func TestClient_Concurrent(t *testing.T) {
+	iprotoServer := startServer(t, "")
+	defer stopServer(t, iprotoServer)
+	c := NewClient(iprotoServer.Addr().String(), WithPoolSize(2))
+	defer c.Close()
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			str := string(rune('a' + idx%26))
+			if err := c.Replace(ctx, idx, str); err != nil {
+				t.Errorf("[%d] unexpected replace error: %v", idx, err)
+				return
+			}
+			if got, err := c.Read(ctx, idx); err != nil || got != str {
+				t.Errorf("[%d] wrong results: got %q %v, expected %q", idx, got, err, str)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// spanRecorder exporter of tracing keeping names of exported spans by trace id
+type spanRecorder struct {
+	mutex sync.Mutex
+	names map[string][]string
+}
+
+func (r *spanRecorder) Export(payload []byte) error {
+	var request struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID string `json:"traceId"`
+					Name    string `json:"name"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, resource := range request.ResourceSpans {
+		for _, scope := range resource.ScopeSpans {
+			for _, span := range scope.Spans {
+				r.names[span.TraceID] = append(r.names[span.TraceID], span.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *spanRecorder) Close() error {
+	return nil
+}
+
+func TestClient_Trace(t *testing.T) {
+	recorder := &spanRecorder{names: make(map[string][]string)}
+	tracer := tracing.NewTracer(recorder, tracing.WithSampleRatio(0))
+	iprotoServer := server.NewIprotoServer("127.0.0.1:0", logging.Nop(), 100, 1000, 1000, server.WithTracer(tracer))
+	iprotoServer.Serve()
+	c := NewClient(iprotoServer.Addr().String())
+
+	parent := tracing.SpanContext{TraceID: tracing.TraceID{1, 2, 3}, SpanID: tracing.SpanID{4, 5, 6}, Sampled: true}
+	ctx := tracing.ContextWithRemote(context.Background(), parent)
+	if err := c.Replace(ctx, 5, "five"); err != nil {
+		t.Fatalf("unexpected replace error: %v", err)
+	}
+	// Traces which are not sampled by client and new traces of server are not recorded with ratio 0
+	parent.Sampled = false
+	if _, err := c.Read(tracing.ContextWithRemote(context.Background(), parent), 5); err != nil {
+		t.Fatalf("unexpected read error: %v", err)
+	}
+	if _, err := c.Read(context.Background(), 5); err != nil {
+		t.Fatalf("unexpected read error: %v", err)
+	}
+	c.Close()
+	stopServer(t, iprotoServer)
+	if err := tracer.Close(); err != nil {
+		t.Fatalf("unexpected tracer close error: %v", err)
+	}
+
+	expected := []string{"iproto.decode", "rate_limiter.check", "api.handler", "iproto.write", "iproto.request"}
+	names := recorder.names[parent.TraceID.String()]
+	if len(recorder.names) != 1 || strings.Join(names, " ") != strings.Join(expected, " ") {
+		t.Errorf("wrong results: got %v, expected %v in trace %s", recorder.names, expected, parent.TraceID)
+	}
+}
+
+func TestClient_Timeout(t *testing.T) {
+	// Server that accepts connections and never answers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+
+	c := NewClient(listener.Addr().String(), WithTimeout(50*time.Millisecond))
+	defer c.Close()
+	if _, err = c.Read(context.Background(), 1); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("wrong results: got %v, expected %v", err, ErrTimeout)
+	}
+}
+
+func TestClient_Reconnect(t *testing.T) {
+	iprotoServer := startServer(t, "")
+	addr := iprotoServer.Addr().String()
+	c := NewClient(addr, WithPoolSize(1), WithBackoff(10*time.Millisecond, 50*time.Millisecond))
+	defer c.Close()
+	ctx := context.Background()
+
+	if err := c.Replace(ctx, 1, "one"); err != nil {
+		t.Fatalf("unexpected replace error: %v", err)
+	}
+	stopServer(t, iprotoServer)
+	if _, err := c.Read(ctx, 1); !errors.Is(err, ErrConnection) {
+		t.Fatalf("wrong results: got %v, expected %v", err, ErrConnection)
+	}
+
+	iprotoServer = startServer(t, addr)
+	defer stopServer(t, iprotoServer)
+	// Calls fail until backoff lets the client dial again
+	deadline := time.Now().Add(2 * time.Second)
+	err := c.Replace(ctx, 1, "again")
+	for err != nil && errors.Is(err, ErrConnection) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		err = c.Replace(ctx, 1, "again")
+	}
+	if err != nil {
+		t.Fatalf("unexpected replace error after reconnect: %v", err)
+	}
+}
+
+func TestClient_Closed(t *testing.T) {
+	c := NewClient("127.0.0.1:1")
+	_ = c.Close()
+	if _, err := c.Read(context.Background(), 1); !errors.Is(err, ErrClosed) {
+		t.Fatalf("wrong results: got %v, expected %v", err, ErrClosed)
+	}
+}
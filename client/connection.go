@@ -0,0 +1,176 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/Bambelbl/iproto-server/api"
+	"github.com/Bambelbl/iproto-server/packet/request_packet"
+	"github.com/Bambelbl/iproto-server/packet/response_packet"
+	"net"
+	"sync"
+)
+
+// result response or error delivered to the caller waiting for request_id
+type result struct {
+	packet response_packet.IprotoPacketResponse
+	err    error
+}
+
+// connection one pipelined connection to server, responses are matched to callers by request_id
+// and notifications pushed by server to watches by request_id of STORAGE_WATCH
+type connection struct {
+	netConn    net.Conn
+	writeMutex sync.Mutex
+	mutex      sync.Mutex
+	pending    map[uint32]chan result
+	watches    map[uint32]chan<- api.Notification
+	err        error
+	done       chan struct{}
+}
+
+// newConnection starts reading responses from netConn
+func newConnection(netConn net.Conn, maxBodyLength uint32) *connection {
+	c := &connection{
+		netConn: netConn,
+		pending: make(map[uint32]chan result),
+		watches: make(map[uint32]chan<- api.Notification),
+		done:    make(chan struct{}),
+	}
+	go c.readResponses(response_packet.NewDecoder(bufio.NewReader(netConn), maxBodyLength))
+	return c
+}
+
+// readResponses delivers responses to waiting callers and notifications to watches until connection breaks.
+// Channels of watches are closed by it, so nothing is sent to them after that
+func (c *connection) readResponses(decoder *response_packet.Decoder) {
+	defer c.closeWatches()
+	for {
+		packet, err := decoder.Decode()
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		if packet.Header.Func_id == api.STORAGE_NOTIFY_ID {
+			if err = c.notify(packet); err != nil {
+				c.fail(err)
+				return
+			}
+			continue
+		}
+		c.mutex.Lock()
+		ch, exist := c.pending[packet.Header.Request_id]
+		delete(c.pending, packet.Header.Request_id)
+		c.mutex.Unlock()
+		// Responses to requests that already timed out are dropped
+		if exist {
+			ch <- result{packet: packet}
+		}
+	}
+}
+
+// notify delivers notification to its watch, waiting while the watch is full
+func (c *connection) notify(packet response_packet.IprotoPacketResponse) error {
+	c.mutex.Lock()
+	ch, exist := c.watches[packet.Header.Request_id]
+	c.mutex.Unlock()
+	if !exist {
+		return nil
+	}
+	var notification api.Notification
+	if err := notification.UnmarshalBody(packet.Body.([]byte)); err != nil {
+		return fmt.Errorf("notification: %w", err)
+	}
+	select {
+	case ch <- notification:
+	case <-c.done:
+	}
+	return nil
+}
+
+// watch delivers notifications with requestID to ch until connection breaks, then ch is closed
+func (c *connection) watch(requestID uint32, ch chan<- api.Notification) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err != nil {
+		close(ch)
+		return
+	}
+	c.watches[requestID] = ch
+}
+
+// closeWatches closes channels of all watches
+func (c *connection) closeWatches() {
+	c.mutex.Lock()
+	watches := c.watches
+	c.watches = make(map[uint32]chan<- api.Notification)
+	c.mutex.Unlock()
+	for _, ch := range watches {
+		close(ch)
+	}
+}
+
+// fail breaks connection and reports err to all waiting callers
+func (c *connection) fail(err error) {
+	c.mutex.Lock()
+	if c.err != nil {
+		c.mutex.Unlock()
+		return
+	}
+	c.err = fmt.Errorf("%w: %s", ErrConnection, err.Error())
+	pending := c.pending
+	c.pending = make(map[uint32]chan result)
+	close(c.done)
+	c.mutex.Unlock()
+	_ = c.netConn.Close()
+	for _, ch := range pending {
+		ch <- result{err: c.err}
+	}
+}
+
+// broken reports whether connection can't be used anymore
+func (c *connection) broken() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// send writes request and returns channel its response will be delivered to
+func (c *connection) send(ctx context.Context, packet request_packet.IprotoPacketRequest) (<-chan result, error) {
+	ch := make(chan result, 1)
+	c.mutex.Lock()
+	if c.err != nil {
+		c.mutex.Unlock()
+		return nil, c.err
+	}
+	c.pending[packet.Header.Request_id] = ch
+	c.mutex.Unlock()
+
+	deadline, _ := ctx.Deadline()
+	c.writeMutex.Lock()
+	err := c.netConn.SetWriteDeadline(deadline)
+	if err == nil {
+		_, err = c.netConn.Write(request_packet.Marshal(packet))
+	}
+	c.writeMutex.Unlock()
+	if err != nil {
+		// A partially written frame breaks the stream for everybody
+		c.fail(err)
+	}
+	return ch, nil
+}
+
+// cancel forgets the caller waiting for request_id
+func (c *connection) cancel(requestID uint32) {
+	c.mutex.Lock()
+	delete(c.pending, requestID)
+	c.mutex.Unlock()
+}
+
+// close closes connection, waiting callers get ErrConnection
+func (c *connection) close() {
+	c.fail(ErrClosed)
+}
@@ -0,0 +1,55 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Bambelbl/iproto-server/codes"
+)
+
+var (
+	// ErrHandler function failed on server for reason that has no own return code
+	ErrHandler = codes.ErrHandler
+	// ErrInvalidBody server can't decode body of request
+	ErrInvalidBody = codes.ErrBadBody
+	// ErrTooManyRequests client exceeded rate limit of server
+	ErrTooManyRequests = codes.ErrRateLimited
+	// ErrUnknownFunc server has no function for func_id
+	ErrUnknownFunc = codes.ErrUnknownFunc
+	// ErrWrongState state of storage doesn't allow the operation
+	ErrWrongState = codes.ErrWrongState
+	// ErrMismatch condition of conditional write failed, Message of ServerError holds current value
+	ErrMismatch = codes.ErrMismatch
+	// ErrValueTooLarge value is longer than storage of server allows
+	ErrValueTooLarge = codes.ErrValueTooLarge
+	// ErrOutOfRange index is out of range of storage
+	ErrOutOfRange = codes.ErrOutOfRange
+	// ErrOverloaded server has no capacity for the request
+	ErrOverloaded = codes.ErrOverloaded
+	// ErrTimeout no response came before deadline, or server didn't handle request in time
+	ErrTimeout = codes.ErrTimeout
+	// ErrClosed Client is closed
+	ErrClosed = errors.New("client is closed")
+	// ErrConnection connection to server was lost before response came
+	ErrConnection = errors.New("connection error")
+)
+
+// ServerError non-zero return code with description of error sent by server,
+// errors.Is matches it with sentinel error of its return code from package codes
+type ServerError struct {
+	Return_code uint32
+	Message     string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("iproto: return code %d: %s", e.Return_code, e.Message)
+}
+
+func (e *ServerError) Is(target error) bool {
+	sentinel, exist := codes.Lookup(e.Return_code)
+	return exist && sentinel == target
+}
+
+// ReturnCode returns return code the error came with
+func (e *ServerError) ReturnCode() uint32 {
+	return e.Return_code
+}
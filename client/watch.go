@@ -0,0 +1,70 @@
+package client
+
+import (
+	"context"
+	"github.com/Bambelbl/iproto-server/api"
+	"sync/atomic"
+)
+
+// WATCH_BUFFER number of notifications buffered for a watch before the connection stops reading
+const WATCH_BUFFER = 64
+
+// Watch subscription to changes of storage made by Client.Watch
+type Watch struct {
+	client        *Client
+	conn          *connection
+	notifications chan api.Notification
+}
+
+// Watch subscribes to changes of cells idxs, all cells if idxs is nil, and to transitions of state
+// if state is set. Watch has its own connection, so a watch that isn't read in time holds back
+// only itself: the server drops its notifications or closes its connection
+func (c *Client) Watch(ctx context.Context, idxs []int, state bool) (*Watch, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	w := &Watch{client: c, conn: conn, notifications: make(chan api.Notification, WATCH_BUFFER)}
+	requestID := atomic.AddUint32(&c.requestID, 1)
+	conn.watch(requestID, w.notifications)
+	body, err := api.WatchRequest{Idxs: idxs, All: idxs == nil, State: state}.MarshalBody()
+	if err != nil {
+		conn.close()
+		return nil, err
+	}
+	response, err := c.roundTrip(ctx, conn, requestID, api.STORAGE_WATCH_ID, body)
+	if err == nil {
+		_, err = responseData(response)
+	}
+	if err != nil {
+		conn.close()
+		return nil, err
+	}
+	if !c.track(conn) {
+		conn.close()
+		return nil, ErrClosed
+	}
+	return w, nil
+}
+
+// Notifications returns channel of notifications, it's closed when the watch is closed
+// or its connection breaks, the reason is returned by Err then
+func (w *Watch) Notifications() <-chan api.Notification {
+	return w.notifications
+}
+
+// Err returns why the watch is closed, nil while it's open
+func (w *Watch) Err() error {
+	w.conn.mutex.Lock()
+	defer w.conn.mutex.Unlock()
+	return w.conn.err
+}
+
+// Close closes the watch together with its connection
+func (w *Watch) Close() error {
+	w.client.untrack(w.conn)
+	w.conn.close()
+	return nil
+}
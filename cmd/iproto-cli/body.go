@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/vmihailenco/msgpack"
+	"strconv"
+	"strings"
+)
+
+// json2Msgpack encodes value described in JSON as msgpack, integral numbers become msgpack integers
+func json2Msgpack(data string) ([]byte, error) {
+	decoder := json.NewDecoder(strings.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("trailing data after JSON value")
+	}
+	var buf bytes.Buffer
+	if err := msgpack.NewEncoder(&buf).UseCompactEncoding(true).Encode(jsonNumbers(value)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// jsonNumbers replaces json.Number in value with int64 or float64
+func jsonNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case []interface{}:
+		for i := range v {
+			v[i] = jsonNumbers(v[i])
+		}
+	case map[string]interface{}:
+		for key := range v {
+			v[key] = jsonNumbers(v[key])
+		}
+	}
+	return value
+}
+
+// msgpack2JSON describes msgpack data in JSON, data that is not a single msgpack value is marked as such
+func msgpack2JSON(data []byte) string {
+	var value interface{}
+	decoder := msgpack.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&value); err != nil {
+		return fmt.Sprintf("<not msgpack: %s>", err.Error())
+	}
+	if _, err := decoder.PeekCode(); err == nil {
+		return "<trailing data after msgpack value>"
+	}
+	out, err := json.Marshal(jsonValue(value))
+	if err != nil {
+		return fmt.Sprintf("<%v>", value)
+	}
+	return string(out)
+}
+
+// jsonValue converts decoded msgpack value to value accepted by json.Marshal
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		for i := range v {
+			v[i] = jsonValue(v[i])
+		}
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[fmt.Sprint(key)] = jsonValue(item)
+		}
+		return m
+	case []byte:
+		return string(v)
+	}
+	return value
+}
+
+// splitLine splits command line to arguments by spaces, double-quoted
+// arguments may contain spaces and Go escape sequences
+func splitLine(line string) ([]string, error) {
+	var args []string
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			return args, nil
+		}
+		if line[0] != '"' {
+			end := strings.IndexAny(line, " \t")
+			if end < 0 {
+				end = len(line)
+			}
+			args = append(args, line[:end])
+			line = line[end:]
+			continue
+		}
+		end := 1
+		for ; end < len(line) && line[end] != '"'; end++ {
+			if line[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(line) {
+			return nil, fmt.Errorf("unterminated quoted argument")
+		}
+		arg, err := strconv.Unquote(line[:end+1])
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		line = line[end+1:]
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"github.com/Bambelbl/iproto-server/client"
+	"github.com/Bambelbl/iproto-server/logging"
+	"github.com/Bambelbl/iproto-server/server"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// startCli starts IprotoServer on a free local port and returns cli connected to it
+func startCli(t *testing.T) (*cli, *bytes.Buffer) {
+	iprotoServer := server.NewIprotoServer("127.0.0.1:0", logging.Nop(), 100, 1000, 1000)
+	iprotoServer.Serve()
+	iprotoClient := client.NewClient(iprotoServer.Addr().String())
+	t.Cleanup(func() {
+		_ = iprotoClient.Close()
+		if err := iprotoServer.Stop(); err != nil {
+			t.Errorf("server stop error: %v", err)
+		}
+	})
+	out := &bytes.Buffer{}
+	return &cli{client: iprotoClient, out: out}, out
+}
+
+type CommandTestCase struct {
+	Args    []string
+	Output  string
+	IsError bool
+}
+
+func TestCli_Execute(t *testing.T) {
+	c, out := startCli(t)
+	cases := []CommandTestCase{
+		{Args: []string{"replace", "5", "foo bar"}, Output: "OK\n"},
+		{Args: []string{"read", "5"}, Output: "\"foo bar\"\n"},
+		{Args: []string{"cas", "6", "", "six"}, Output: "OK\n"},
+		{Args: []string{"cas", "6", "", "seven"}, IsError: true},
+		{Args: []string{"read", "-v", "6"}, Output: "\"six\" version 1\n"},
+		{Args: []string{"replace-if-version", "6", "1", "seven"}, Output: "OK\n"},
+		{Args: []string{"replace-if-version", "6", "1", "eight"}, IsError: true},
+		{Args: []string{"replace-if-version", "6", "x", "eight"}, IsError: true},
+		{Args: []string{"replace-many", "7", "seven", "8", "eight"}, Output: "OK\n"},
+		{Args: []string{"replace-many", "7", "seven", "8"}, IsError: true},
+		{Args: []string{"replace-many", "-e", "9", "nine", "1000", "mil"},
+			Output: "9: OK\n1000: error: iproto: return code 416: index is out of range: valid index is in [0;999]\n"},
+		{Args: []string{"replace-many", "-e", "9"}, IsError: true},
+		{Args: []string{"read-many", "8", "1000", "7"},
+			Output: "8: \"eight\"\n1000: error: iproto: return code 416: index is out of range: valid index is in [0;999]\n7: \"seven\"\n"},
+		{Args: []string{"scan", "6", "9", "1"}, Output: "6: \"seven\"\ncursor: 7\n"},
+		{Args: []string{"scan", "7", "9"}, Output: "7: \"seven\"\n8: \"eight\"\n"},
+		{Args: []string{"scan", "7", "1001"}, IsError: true},
+		{Args: []string{"ttl", "8"}, Output: "no ttl\n"},
+		{Args: []string{"replace-ttl", "9", "token", "1h"}, Output: "OK\n"},
+		{Args: []string{"replace-ttl", "9", "token", "0s"}, IsError: true},
+		{Args: []string{"replace-ttl", "9", "token", "hour"}, IsError: true},
+		{Args: []string{"ttl", "x"}, IsError: true},
+		{Args: []string{"read", "1000"}, IsError: true},
+		{Args: []string{"read", "x"}, IsError: true},
+		{Args: []string{"replace", "5"}, IsError: true},
+		{Args: []string{"state", "maintenance"}, Output: "OK\n"},
+		{Args: []string{"read", "5"}, IsError: true},
+		{Args: []string{"state", "READWRITE"}, Output: "OK\n"},
+		{Args: []string{"state", "broken"}, IsError: true},
+		{Args: []string{"unknown"}, IsError: true},
+		{Args: []string{"snapshot"}, IsError: true},
+		{Args: []string{"raw", "0x00020002", "json", "[5]"},
+			Output: "return_code: 0 (OK)\nbody hex: a7666f6f20626172\nbody: \"foo bar\"\n"},
+		{Args: []string{"raw", "0x00020002", "hex", "05"}, Output: "body: \"foo bar\"\n"},
+		{Args: []string{"raw", "0x00030001"}, Output: "return_code: 404 (Incorrect func_id)\n"},
+		{Args: []string{"raw", "0x00020002", "hex", "zz"}, IsError: true},
+		{Args: []string{"raw", "0x00020002", "yaml", "5"}, IsError: true},
+	}
+	for caseNum, item := range cases {
+		out.Reset()
+		err := c.execute(item.Args)
+		if item.IsError && err == nil {
+			t.Errorf("[%d] expected error, got nil", caseNum)
+		}
+		if !item.IsError && err != nil {
+			t.Errorf("[%d] unexpected error: %v", caseNum, err)
+		}
+		if !strings.Contains(out.String(), item.Output) {
+			t.Errorf("[%d] wrong results: got %q, expected %q", caseNum, out.String(), item.Output)
+		}
+	}
+}
+
+func TestCli_Repl(t *testing.T) {
+	c, out := startCli(t)
+	historyFile := filepath.Join(t.TempDir(), "history")
+	in := strings.NewReader("replace 1 \"a \\\"b\\\"\"\nread 1\n!!\nhistory\nexit\nread 1\n")
+	if err := c.repl(in, historyFile); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "iproto> OK\n" +
+		"iproto> \"a \\\"b\\\"\"\n" +
+		"iproto> read 1\n\"a \\\"b\\\"\"\n" +
+		"iproto>     1  replace 1 \"a \\\"b\\\"\"\n    2  read 1\n    3  history\n" +
+		"iproto> "
+	if out.String() != expected {
+		t.Errorf("wrong results: got %q, expected %q", out.String(), expected)
+	}
+	history := []string{"replace 1 \"a \\\"b\\\"\"", "read 1", "history", "exit"}
+	if got := loadHistory(historyFile); !reflect.DeepEqual(got, history) {
+		t.Errorf("wrong history: got %q, expected %q", got, history)
+	}
+}
+
+type SplitTestCase struct {
+	Line    string
+	Args    []string
+	IsError bool
+}
+
+func TestSplitLine(t *testing.T) {
+	cases := []SplitTestCase{
+		{Line: "read 5", Args: []string{"read", "5"}},
+		{Line: "  replace\t5  \"foo bar\" ", Args: []string{"replace", "5", "foo bar"}},
+		{Line: `replace 5 "п\n\""`, Args: []string{"replace", "5", "п\n\""}},
+		{Line: "", Args: nil},
+		{Line: `replace 5 "foo`, IsError: true},
+	}
+	for caseNum, item := range cases {
+		args, err := splitLine(item.Line)
+		if item.IsError && err == nil {
+			t.Errorf("[%d] expected error, got nil", caseNum)
+		}
+		if !item.IsError && (err != nil || !reflect.DeepEqual(args, item.Args)) {
+			t.Errorf("[%d] wrong results: got %q %v, expected %q", caseNum, args, err, item.Args)
+		}
+	}
+}
+
+type BodyTestCase struct {
+	JSON    string
+	Msgpack []byte
+	IsError bool
+}
+
+func TestJson2Msgpack(t *testing.T) {
+	cases := []BodyTestCase{
+		{JSON: "[5, \"hi\"]", Msgpack: []byte{0x92, 0x05, 0xa2, 'h', 'i'}},
+		{JSON: "null", Msgpack: []byte{0xc0}},
+		{JSON: "[1000, -1]", Msgpack: []byte{0x92, 0xcd, 0x03, 0xe8, 0xff}},
+		{JSON: "1.5", Msgpack: []byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{JSON: "[5", IsError: true},
+		{JSON: "5 6", IsError: true},
+	}
+	for caseNum, item := range cases {
+		data, err := json2Msgpack(item.JSON)
+		if item.IsError && err == nil {
+			t.Errorf("[%d] expected error, got nil", caseNum)
+		}
+		if !item.IsError && (err != nil || !bytes.Equal(data, item.Msgpack)) {
+			t.Errorf("[%d] wrong results: got %x %v, expected %x", caseNum, data, err, item.Msgpack)
+		}
+	}
+}
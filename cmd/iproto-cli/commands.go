@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/Bambelbl/iproto-server/api"
+	"github.com/Bambelbl/iproto-server/client"
+	"github.com/Bambelbl/iproto-server/codes"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const USAGE = `  read [-v] <idx>               print string from storage by index, with -v and version of the cell
+  replace <idx> <str>           write string to storage by index
+  read-many <idx>...            print strings from storage by indexes, one per line
+  replace-many [-e] <idx> <str> [<idx> <str>]...
+                                write strings to storage by indexes, all or none,
+                                with -e each string on its own printing result of every index
+  replace-ttl <idx> <str> <ttl> write string to storage by index for ttl like 30s
+  ttl <idx>                     print remaining time to live of value by index
+  scan <from> <to> [limit]      print non-empty cells with indexes in [from;to) and cursor to go on from
+  cas <idx> <expected> <str>    write string if current value is expected
+  replace-if-version <idx> <version> <str>
+                                write string if current version of the cell is version
+  state readonly|readwrite|maintenance
+                                switch state of storage
+  snapshot                      write snapshot of storage on server
+  raw <func_id> [hex|json <body>]
+                                send msgpack body given as hex or JSON to func_id
+                                and print decoded response
+  help                          print this help
+`
+
+// errUsage command or its arguments are wrong
+var errUsage = errors.New("wrong usage, try help")
+
+// cli executes commands with client and writes their output to out
+type cli struct {
+	client *client.Client
+	out    io.Writer
+}
+
+// execute runs one command given as its arguments
+func (c *cli) execute(args []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+	ctx := context.Background()
+	switch args[0] {
+	case "read":
+		withVersion := len(args) == 3 && args[1] == "-v"
+		if withVersion {
+			args = args[1:]
+		}
+		if len(args) != 2 {
+			return errUsage
+		}
+		idx, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("wrong index: %w", err)
+		}
+		if withVersion {
+			str, version, err := c.client.ReadVersion(ctx, idx)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(c.out, "%q version %d\n", str, version)
+			return nil
+		}
+		str, err := c.client.Read(ctx, idx)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.out, "%q\n", str)
+	case "replace":
+		if len(args) != 3 {
+			return errUsage
+		}
+		idx, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("wrong index: %w", err)
+		}
+		if err = c.client.Replace(ctx, idx, args[2]); err != nil {
+			return err
+		}
+		fmt.Fprintln(c.out, "OK")
+	case "read-many":
+		if len(args) < 2 {
+			return errUsage
+		}
+		idxs := make([]int, len(args)-1)
+		for i, arg := range args[1:] {
+			idx, err := strconv.Atoi(arg)
+			if err != nil {
+				return fmt.Errorf("wrong index: %w", err)
+			}
+			idxs[i] = idx
+		}
+		values, errs, err := c.client.ReadMany(ctx, idxs)
+		if err != nil {
+			return err
+		}
+		for i, idx := range idxs {
+			if errs[i] != nil {
+				fmt.Fprintf(c.out, "%d: error: %s\n", idx, errs[i].Error())
+				continue
+			}
+			fmt.Fprintf(c.out, "%d: %q\n", idx, values[i])
+		}
+	case "replace-many":
+		each := len(args) > 1 && args[1] == "-e"
+		pairs := args[1:]
+		if each {
+			pairs = args[2:]
+		}
+		if len(pairs) < 2 || len(pairs)%2 != 0 {
+			return errUsage
+		}
+		values := make(map[int]string, len(pairs)/2)
+		idxs := make([]int, 0, len(pairs)/2)
+		for i := 0; i < len(pairs); i += 2 {
+			idx, err := strconv.Atoi(pairs[i])
+			if err != nil {
+				return fmt.Errorf("wrong index: %w", err)
+			}
+			if _, exist := values[idx]; !exist {
+				idxs = append(idxs, idx)
+			}
+			values[idx] = pairs[i+1]
+		}
+		if !each {
+			if err := c.client.ReplaceMany(ctx, values); err != nil {
+				return err
+			}
+			fmt.Fprintln(c.out, "OK")
+			break
+		}
+		errs, err := c.client.ReplaceEach(ctx, values)
+		if err != nil {
+			return err
+		}
+		for _, idx := range idxs {
+			if errs[idx] != nil {
+				fmt.Fprintf(c.out, "%d: error: %s\n", idx, errs[idx].Error())
+				continue
+			}
+			fmt.Fprintf(c.out, "%d: OK\n", idx)
+		}
+	case "scan":
+		if len(args) != 3 && len(args) != 4 {
+			return errUsage
+		}
+		bounds := make([]int, len(args)-1)
+		for i, arg := range args[1:] {
+			n, err := strconv.Atoi(arg)
+			if err != nil {
+				return fmt.Errorf("wrong number: %w", err)
+			}
+			bounds[i] = n
+		}
+		if len(bounds) == 2 {
+			bounds = append(bounds, 0)
+		}
+		cells, cursor, err := c.client.Scan(ctx, bounds[0], bounds[1], bounds[2])
+		if err != nil {
+			return err
+		}
+		for _, cell := range cells {
+			fmt.Fprintf(c.out, "%d: %q\n", cell.Idx, cell.Str)
+		}
+		if cursor != api.SCAN_DONE {
+			fmt.Fprintf(c.out, "cursor: %d\n", cursor)
+		}
+	case "replace-ttl":
+		if len(args) != 4 {
+			return errUsage
+		}
+		idx, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("wrong index: %w", err)
+		}
+		ttl, err := time.ParseDuration(args[3])
+		if err != nil {
+			return fmt.Errorf("wrong ttl: %w", err)
+		}
+		if err = c.client.ReplaceTTL(ctx, idx, args[2], ttl); err != nil {
+			return err
+		}
+		fmt.Fprintln(c.out, "OK")
+	case "ttl":
+		if len(args) != 2 {
+			return errUsage
+		}
+		idx, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("wrong index: %w", err)
+		}
+		ttl, err := c.client.TTL(ctx, idx)
+		if err != nil {
+			return err
+		}
+		if ttl < 0 {
+			fmt.Fprintln(c.out, "no ttl")
+		} else {
+			fmt.Fprintln(c.out, ttl)
+		}
+	case "cas":
+		if len(args) != 4 {
+			return errUsage
+		}
+		idx, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("wrong index: %w", err)
+		}
+		err = c.client.CompareAndSwap(ctx, idx, args[2], args[3])
+		var serverErr *client.ServerError
+		if errors.Is(err, codes.ErrMismatch) && errors.As(err, &serverErr) {
+			return fmt.Errorf("current value %q doesn't match expected", serverErr.Message)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(c.out, "OK")
+	case "replace-if-version":
+		if len(args) != 4 {
+			return errUsage
+		}
+		idx, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("wrong index: %w", err)
+		}
+		version, err := strconv.ParseUint(args[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("wrong version: %w", err)
+		}
+		err = c.client.ReplaceIfVersion(ctx, idx, version, args[3])
+		var serverErr *client.ServerError
+		if errors.Is(err, codes.ErrMismatch) && errors.As(err, &serverErr) {
+			return fmt.Errorf("current version %s doesn't match expected", serverErr.Message)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(c.out, "OK")
+	case "state":
+		if len(args) != 2 {
+			return errUsage
+		}
+		var err error
+		switch strings.ToLower(args[1]) {
+		case "readonly":
+			err = c.client.SwitchReadOnly(ctx)
+		case "readwrite":
+			err = c.client.SwitchReadWrite(ctx)
+		case "maintenance":
+			err = c.client.SwitchMaintenance(ctx)
+		default:
+			return fmt.Errorf("unknown state %q: %w", args[1], errUsage)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(c.out, "OK")
+	case "snapshot":
+		if len(args) != 1 {
+			return errUsage
+		}
+		path, err := c.client.Snapshot(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.out, "snapshot is written to %s\n", path)
+	case "raw":
+		return c.raw(ctx, args[1:])
+	case "help":
+		fmt.Fprint(c.out, USAGE)
+	default:
+		return fmt.Errorf("unknown command %q: %w", args[0], errUsage)
+	}
+	return nil
+}
+
+// raw sends body to func_id and prints response as it came from server
+func (c *cli) raw(ctx context.Context, args []string) error {
+	if len(args) != 1 && len(args) != 3 {
+		return errUsage
+	}
+	func_id, err := strconv.ParseUint(args[0], 0, 32)
+	if err != nil {
+		return fmt.Errorf("wrong func_id: %w", err)
+	}
+	var body []byte
+	if len(args) == 3 {
+		switch args[1] {
+		case "hex":
+			body, err = hex.DecodeString(strings.Join(strings.Fields(args[2]), ""))
+		case "json":
+			body, err = json2Msgpack(args[2])
+		default:
+			return fmt.Errorf("unknown body format %q: %w", args[1], errUsage)
+		}
+		if err != nil {
+			return fmt.Errorf("wrong body: %w", err)
+		}
+	}
+	response, err := c.client.Do(ctx, uint32(func_id), body)
+	if err != nil {
+		return err
+	}
+	data := response.Body.([]byte)
+	fmt.Fprintf(c.out, "func_id: %#08x\nbody_length: %d\nrequest_id: %d\nreturn_code: %d (%s)\n",
+		response.Header.Func_id, response.Header.Body_length, response.Header.Request_id,
+		response.Return_code, returnCodeName(response.Return_code))
+	fmt.Fprintf(c.out, "body hex: %s\nbody: %s\n", hex.EncodeToString(data), msgpack2JSON(data))
+	return nil
+}
+
+// returnCodeName human-readable meaning of return code
+func returnCodeName(code uint32) string {
+	if text := codes.Text(code); text != "" {
+		return text
+	}
+	return "unknown return code"
+}
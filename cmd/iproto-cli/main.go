@@ -0,0 +1,64 @@
+// Command iproto-cli sends requests to running iproto server.
+//
+// One-shot usage:
+//
+//	iproto-cli -addr 127.0.0.1:8080 read 5
+//	iproto-cli replace 5 "foo"
+//	iproto-cli state readonly
+//	iproto-cli raw 0x00020002 json '[5]'
+//	iproto-cli raw 0x00020002 hex 05
+//
+// Without command it starts interactive shell with history.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/Bambelbl/iproto-server/client"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	ADDR         = "127.0.0.1:8080"
+	TIMEOUT      = 2 * time.Second
+	HISTORY_FILE = ".iproto_cli_history"
+)
+
+func main() {
+	addr := flag.String("addr", ADDR, "address of iproto server")
+	timeout := flag.Duration("timeout", TIMEOUT, "timeout of one request")
+	historyFile := flag.String("history", defaultHistoryFile(), "file to keep history of interactive shell in")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command [args...]]\n\nCommands:\n%s\nFlags:\n",
+			os.Args[0], USAGE)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	iprotoClient := client.NewClient(*addr, client.WithPoolSize(1), client.WithTimeout(*timeout))
+	defer iprotoClient.Close()
+	c := &cli{client: iprotoClient, out: os.Stdout}
+
+	if flag.NArg() == 0 {
+		if err := c.repl(os.Stdin, *historyFile); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	if err := c.execute(flag.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
+
+// defaultHistoryFile history file in home directory of user, empty if there is no home
+func defaultHistoryFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, HISTORY_FILE)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	PROMPT       = "iproto> "
+	HISTORY_SIZE = 1000
+)
+
+// repl reads commands line by line from in until EOF or exit.
+// Lines are kept in history: history prints it, !N repeats N-th line and !! the last one.
+// History is loaded from and appended to historyFile unless it is empty
+func (c *cli) repl(in io.Reader, historyFile string) error {
+	history := loadHistory(historyFile)
+	var file *os.File
+	if historyFile != "" {
+		var err error
+		file, err = os.OpenFile(historyFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			fmt.Fprintf(c.out, "history won't be saved: %s\n", err.Error())
+		} else {
+			defer file.Close()
+		}
+	}
+
+	scanner := bufio.NewScanner(in)
+	fmt.Fprint(c.out, PROMPT)
+	for scanner.Scan() {
+		input := strings.TrimSpace(scanner.Text())
+		line, err := expandHistory(input, history)
+		if err != nil {
+			fmt.Fprintln(c.out, err.Error())
+			fmt.Fprint(c.out, PROMPT)
+			continue
+		}
+		if line != input {
+			fmt.Fprintln(c.out, line)
+		}
+		if line != "" && (len(history) == 0 || history[len(history)-1] != line) {
+			history = append(history, line)
+			if file != nil {
+				fmt.Fprintln(file, line)
+			}
+		}
+
+		switch line {
+		case "exit", "quit":
+			return nil
+		case "history":
+			for i, item := range history {
+				fmt.Fprintf(c.out, "%5d  %s\n", i+1, item)
+			}
+		default:
+			args, err := splitLine(line)
+			if err == nil {
+				err = c.execute(args)
+			}
+			if err != nil {
+				fmt.Fprintln(c.out, err.Error())
+			}
+		}
+		fmt.Fprint(c.out, PROMPT)
+	}
+	fmt.Fprintln(c.out)
+	return scanner.Err()
+}
+
+// expandHistory replaces !! and !N lines with lines from history, the expanded line is echoed
+func expandHistory(line string, history []string) (string, error) {
+	if !strings.HasPrefix(line, "!") {
+		return line, nil
+	}
+	if line == "!!" {
+		if len(history) == 0 {
+			return "", fmt.Errorf("history is empty")
+		}
+		return history[len(history)-1], nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 1 || n > len(history) {
+		return "", fmt.Errorf("%s: event not found", line)
+	}
+	return history[n-1], nil
+}
+
+// loadHistory reads last HISTORY_SIZE lines of historyFile
+func loadHistory(historyFile string) []string {
+	if historyFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(historyFile)
+	if err != nil {
+		return nil
+	}
+	history := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(history) == 1 && history[0] == "" {
+		return nil
+	}
+	if len(history) > HISTORY_SIZE {
+		history = history[len(history)-HISTORY_SIZE:]
+	}
+	return history
+}
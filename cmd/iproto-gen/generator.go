@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"reflect"
+	"sort"
+	"strconv"
+	"text/template"
+)
+
+const (
+	API_PACKAGE = "github.com/Bambelbl/iproto-server/api"
+	TAG         = "iproto"
+)
+
+// Function one function of API declared in spec
+type Function struct {
+	Func_id  uint32
+	Name     string
+	Request  string
+	Response string
+}
+
+// Schema struct type declared in spec, it's encoded as msgpack values of its fields in order
+type Schema struct {
+	Name   string
+	Fields []string
+}
+
+// Spec functions and schemas parsed from spec file
+type Spec struct {
+	File      string
+	Package   string
+	Functions []Function
+	Schemas   []Schema
+}
+
+// ParseSpec reads spec from Go source. Functions are fields of func type
+// with func_id in iproto tag, e.g.
+//
+//	STORAGE_READ func(IndexRequest) string `iproto:"0x00020002"`
+//
+// every other struct type of the file is a schema
+func ParseSpec(filename string, src []byte) (spec Spec, err error) {
+	file, err := parser.ParseFile(token.NewFileSet(), filename, src, parser.ParseComments)
+	if err != nil {
+		return
+	}
+	spec.File = filename
+	spec.Package = file.Name.Name
+	seen := make(map[uint32]string)
+	for _, decl := range file.Decls {
+		genDecl, ok := decl.(*ast.GenDecl)
+		if !ok || genDecl.Tok != token.TYPE {
+			continue
+		}
+		for _, s := range genDecl.Specs {
+			typeSpec := s.(*ast.TypeSpec)
+			structType, ok := typeSpec.Type.(*ast.StructType)
+			if !ok {
+				continue
+			}
+			functions, err := parseFunctions(structType)
+			if err != nil {
+				return spec, fmt.Errorf("%s: %w", typeSpec.Name.Name, err)
+			}
+			if len(functions) == 0 {
+				spec.Schemas = append(spec.Schemas, parseSchema(typeSpec.Name.Name, structType))
+				continue
+			}
+			for _, function := range functions {
+				if name, exist := seen[function.Func_id]; exist {
+					return spec, fmt.Errorf("func_id 0x%08x is declared for %s and %s", function.Func_id, name, function.Name)
+				}
+				seen[function.Func_id] = function.Name
+				spec.Functions = append(spec.Functions, function)
+			}
+		}
+	}
+	if len(spec.Functions) == 0 {
+		return spec, errors.New("no functions declared")
+	}
+	sort.Slice(spec.Functions, func(i, j int) bool {
+		return spec.Functions[i].Func_id < spec.Functions[j].Func_id
+	})
+	return spec, nil
+}
+
+// parseFunctions from fields of func type with iproto tag to functions
+func parseFunctions(structType *ast.StructType) (functions []Function, err error) {
+	for _, field := range structType.Fields.List {
+		if field.Tag == nil {
+			continue
+		}
+		tag, err := strconv.Unquote(field.Tag.Value)
+		if err != nil {
+			return nil, err
+		}
+		value, ok := reflect.StructTag(tag).Lookup(TAG)
+		if !ok {
+			continue
+		}
+		funcType, ok := field.Type.(*ast.FuncType)
+		if !ok {
+			continue
+		}
+		if len(field.Names) != 1 {
+			return nil, fmt.Errorf("iproto tag must be set on a single field of func type")
+		}
+		name := field.Names[0].Name
+		if funcType.Params.NumFields() != 1 || funcType.Results.NumFields() != 1 {
+			return nil, fmt.Errorf("%s: function must take one request and return one response", name)
+		}
+		func_id, err := strconv.ParseUint(value, 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s: func_id: %w", name, err)
+		}
+		functions = append(functions, Function{
+			Func_id:  uint32(func_id),
+			Name:     name,
+			Request:  types.ExprString(funcType.Params.List[0].Type),
+			Response: types.ExprString(funcType.Results.List[0].Type),
+		})
+	}
+	return functions, nil
+}
+
+// parseSchema from struct type to its fields in order, fields tagged with iproto:"-" are skipped
+func parseSchema(name string, structType *ast.StructType) Schema {
+	schema := Schema{Name: name}
+	for _, field := range structType.Fields.List {
+		if field.Tag != nil {
+			if tag, err := strconv.Unquote(field.Tag.Value); err == nil && reflect.StructTag(tag).Get(TAG) == "-" {
+				continue
+			}
+		}
+		for _, fieldName := range field.Names {
+			if fieldName.IsExported() {
+				schema.Fields = append(schema.Fields, fieldName.Name)
+			}
+		}
+	}
+	return schema
+}
+
+var generated = template.Must(template.New("generated").Parse(`// Code generated by iproto-gen from {{.Spec.File}}. DO NOT EDIT.
+
+package {{.Spec.Package}}
+
+import (
+	"context"
+	"github.com/Bambelbl/iproto-server/packet/request_packet"
+{{- if .Qualifier}}
+	"{{.APIPackage}}"
+{{- end}}
+)
+
+const (
+{{- range .Spec.Functions}}
+	{{.Name}}_ID = {{printf "0x%08x" .Func_id}}
+{{- end}}
+)
+{{range .Spec.Schemas}}
+// UnmarshalBody from msgpack values to {{.Name}}
+func (r *{{.Name}}) UnmarshalBody(data []byte) error {
+	return request_packet.UnmarshalValues(data{{range .Fields}}, &r.{{.}}{{end}})
+}
+
+// MarshalBody from {{.Name}} to msgpack values
+func (r {{.Name}}) MarshalBody() ([]byte, error) {
+	return request_packet.MarshalValues({{range $i, $f := .Fields}}{{if $i}}, {{end}}r.{{$f}}{{end}})
+}
+{{end}}
+// Handlers is implemented by handlers of functions declared in {{.Spec.File}}
+type Handlers interface {
+{{- range .Spec.Functions}}
+	{{.Name}}(ctx context.Context, req {{.Request}}) ({{.Response}}, error)
+{{- end}}
+}
+
+// RegisterHandlers registers functions declared in {{.Spec.File}} in registry
+func RegisterHandlers(r *{{.Qualifier}}Registry, h Handlers) error {
+{{- range .Spec.Functions}}
+	if err := {{$.Qualifier}}Register(r, {{.Name}}_ID, "{{.Name}}", h.{{.Name}}); err != nil {
+		return err
+	}
+{{- end}}
+	return nil
+}
+
+// Client calls functions declared in {{.Spec.File}} through caller
+type Client struct {
+	caller {{.Qualifier}}Caller
+}
+
+func NewClient(caller {{.Qualifier}}Caller) *Client {
+	return &Client{caller: caller}
+}
+{{range .Spec.Functions}}
+// {{.Name}} calls function {{printf "0x%08x" .Func_id}}
+func (c *Client) {{.Name}}(ctx context.Context, req {{.Request}}) (resp {{.Response}}, err error) {
+	err = {{$.Qualifier}}Call(ctx, c.caller, {{.Name}}_ID, req, &resp)
+	return
+}
+{{end}}`))
+
+// Generate renders Go source for spec
+func Generate(spec Spec) ([]byte, error) {
+	qualifier := ""
+	if spec.Package != "api" {
+		qualifier = "api."
+	}
+	var buf bytes.Buffer
+	err := generated.Execute(&buf, struct {
+		Spec       Spec
+		Qualifier  string
+		APIPackage string
+	}{spec, qualifier, API_PACKAGE})
+	if err != nil {
+		return nil, err
+	}
+	return format.Source(buf.Bytes())
+}
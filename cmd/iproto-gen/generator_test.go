@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+type TestCase struct {
+	Src     string
+	Expects []string
+	IsError bool
+}
+
+func TestGenerate_UpToDate(t *testing.T) {
+	src, err := os.ReadFile("../../api/spec.go")
+	if err != nil {
+		t.Fatalf("read spec error: %v", err)
+	}
+	spec, err := ParseSpec("spec.go", src)
+	if err != nil {
+		t.Fatalf("parse spec error: %v", err)
+	}
+	code, err := Generate(spec)
+	if err != nil {
+		t.Fatalf("generate error: %v", err)
+	}
+	expected, err := os.ReadFile("../../api/api_gen.go")
+	if err != nil {
+		t.Fatalf("read generated code error: %v", err)
+	}
+	if !bytes.Equal(code, expected) {
+		t.Errorf("api/api_gen.go is out of date, run go generate ./api")
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	cases := []TestCase{
+		{
+			Src: `package custom
+
+import "github.com/Bambelbl/iproto-server/api"
+
+type SumRequest struct {
+	A       int
+	B       int
+	comment string
+	Skipped string ` + "`iproto:\"-\"`" + `
+}
+
+type spec struct {
+	SUM  func(SumRequest) int ` + "`iproto:\"0x00030002\"`" + `
+	PING func(api.Nil) api.Nil ` + "`iproto:\"0x00030001\"`" + `
+}
+`,
+			Expects: []string{
+				"package custom",
+				`"github.com/Bambelbl/iproto-server/api"`,
+				"PING_ID = 0x00030001",
+				"SUM_ID  = 0x00030002",
+				"request_packet.UnmarshalValues(data, &r.A, &r.B)",
+				"request_packet.MarshalValues(r.A, r.B)",
+				"SUM(ctx context.Context, req SumRequest) (int, error)",
+				"func RegisterHandlers(r *api.Registry, h Handlers) error",
+				`api.Register(r, PING_ID, "PING", h.PING)`,
+				"func (c *Client) SUM(ctx context.Context, req SumRequest) (resp int, err error)",
+				"api.Call(ctx, c.caller, SUM_ID, req, &resp)",
+			},
+		},
+		{
+			Src: `package custom
+
+type spec struct {
+	A func(int) int ` + "`iproto:\"1\"`" + `
+	B func(int) int ` + "`iproto:\"0x1\"`" + `
+}
+`,
+			IsError: true,
+		},
+		{
+			Src: `package custom
+
+type spec struct {
+	A func(int) int ` + "`iproto:\"func\"`" + `
+}
+`,
+			IsError: true,
+		},
+		{
+			Src: `package custom
+
+type spec struct {
+	A func(int, int) int ` + "`iproto:\"1\"`" + `
+}
+`,
+			IsError: true,
+		},
+		{
+			Src:     "package custom\n\ntype Request struct {\n\tA int\n}\n",
+			IsError: true,
+		},
+	}
+	for caseNum, item := range cases {
+		spec, err := ParseSpec("spec.go", []byte(item.Src))
+		var code []byte
+		if err == nil {
+			code, err = Generate(spec)
+		}
+
+		if item.IsError && err == nil {
+			t.Errorf("[%d] expected error, got nil", caseNum)
+		}
+
+		if !item.IsError && err != nil {
+			t.Errorf("[%d] unexpected error: %v", caseNum, err)
+		}
+
+		for _, expect := range item.Expects {
+			if !strings.Contains(string(code), expect) {
+				t.Errorf("[%d] generated code doesn't contain %q:\n%s", caseNum, expect, code)
+			}
+		}
+	}
+}
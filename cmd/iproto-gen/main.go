@@ -0,0 +1,37 @@
+// Command iproto-gen generates msgpack codecs of schemas, typed handler interface,
+// registry wiring and typed client stub from iproto API spec.
+//
+// Usage in the package with spec:
+//
+//	//go:generate go run github.com/Bambelbl/iproto-server/cmd/iproto-gen -spec spec.go -out api_gen.go
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+func main() {
+	specFile := flag.String("spec", "spec.go", "Go file with API spec")
+	outFile := flag.String("out", "api_gen.go", "file to write generated code to")
+	flag.Parse()
+	logger := log.New(os.Stderr, "iproto-gen: ", 0)
+
+	src, err := os.ReadFile(*specFile)
+	if err != nil {
+		logger.Fatalf("read spec error: %s", err.Error())
+	}
+	spec, err := ParseSpec(filepath.Base(*specFile), src)
+	if err != nil {
+		logger.Fatalf("parse spec error: %s", err.Error())
+	}
+	code, err := Generate(spec)
+	if err != nil {
+		logger.Fatalf("generate error: %s", err.Error())
+	}
+	if err = os.WriteFile(*outFile, code, 0644); err != nil {
+		logger.Fatalf("write error: %s", err.Error())
+	}
+}
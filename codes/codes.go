@@ -0,0 +1,118 @@
+// Package codes is the catalogue of return codes of iproto server and errors matching them.
+// Return codes are stable: clients may switch on them, new errors get new codes.
+//
+// Server side errors wrap sentinel errors of this package, so return code of any error
+// is found by Code. Clients find sentinel error of received return code by Lookup
+package codes
+
+import (
+	"errors"
+)
+
+const (
+	// OK function succeeded, body holds its response
+	OK = 0
+	// HANDLER_ERROR function failed for reason that has no own code, body holds description of error
+	HANDLER_ERROR = 1
+	// INVALID_BODY body of request doesn't match request schema of function
+	INVALID_BODY = 401
+	// TOO_MANY_REQUESTS client exceeded rate limit
+	TOO_MANY_REQUESTS = 402
+	// UNKNOWN_FUNC_ID no function is registered for func_id of request
+	UNKNOWN_FUNC_ID = 404
+	// WRONG_STATE state of storage doesn't allow the operation
+	WRONG_STATE = 409
+	// MISMATCH condition of conditional write failed, body holds current value of the cell
+	MISMATCH = 412
+	// VALUE_TOO_LARGE value is longer than storage allows
+	VALUE_TOO_LARGE = 413
+	// OUT_OF_RANGE index is out of range of storage
+	OUT_OF_RANGE = 416
+	// OVERLOADED server has no capacity for the request
+	OVERLOADED = 503
+	// TIMEOUT request wasn't handled in time
+	TIMEOUT = 504
+)
+
+// Error sentinel error of return code
+type Error struct {
+	Code    uint32
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// ReturnCode returns return code the error is answered with
+func (e *Error) ReturnCode() uint32 {
+	return e.Code
+}
+
+var (
+	// ErrHandler function failed for reason that has no own code
+	ErrHandler = &Error{Code: HANDLER_ERROR, Message: "handler error"}
+	// ErrBadBody body of request can't be decoded
+	ErrBadBody = &Error{Code: INVALID_BODY, Message: "Invalid body in request packet"}
+	// ErrRateLimited client exceeded rate limit
+	ErrRateLimited = &Error{Code: TOO_MANY_REQUESTS, Message: "Too many requests"}
+	// ErrUnknownFunc no function is registered for func_id
+	ErrUnknownFunc = &Error{Code: UNKNOWN_FUNC_ID, Message: "Incorrect func_id"}
+	// ErrWrongState state of storage doesn't allow the operation
+	ErrWrongState = &Error{Code: WRONG_STATE, Message: "storage state doesn't allow this operation"}
+	// ErrMismatch condition of conditional write failed
+	ErrMismatch = &Error{Code: MISMATCH, Message: "value doesn't match expected"}
+	// ErrValueTooLarge value is longer than storage allows
+	ErrValueTooLarge = &Error{Code: VALUE_TOO_LARGE, Message: "value is too large"}
+	// ErrOutOfRange index is out of range of storage
+	ErrOutOfRange = &Error{Code: OUT_OF_RANGE, Message: "index is out of range"}
+	// ErrOverloaded server has no capacity for the request
+	ErrOverloaded = &Error{Code: OVERLOADED, Message: "server is overloaded"}
+	// ErrTimeout request wasn't handled in time
+	ErrTimeout = &Error{Code: TIMEOUT, Message: "timeout"}
+)
+
+// catalogue sentinel errors by return code
+var catalogue = map[uint32]*Error{}
+
+func init() {
+	for _, err := range []*Error{ErrHandler, ErrBadBody, ErrRateLimited, ErrUnknownFunc,
+		ErrWrongState, ErrMismatch, ErrValueTooLarge, ErrOutOfRange, ErrOverloaded, ErrTimeout} {
+		catalogue[err.Code] = err
+	}
+}
+
+// ReturnCoder is implemented by errors which are answered with their own return code
+type ReturnCoder interface {
+	ReturnCode() uint32
+}
+
+// Code returns return code of err: OK for nil, code of the first ReturnCoder
+// in the chain of err, HANDLER_ERROR if there is none
+func Code(err error) uint32 {
+	if err == nil {
+		return OK
+	}
+	var coder ReturnCoder
+	if errors.As(err, &coder) {
+		return coder.ReturnCode()
+	}
+	return HANDLER_ERROR
+}
+
+// Lookup returns sentinel error of return code
+func Lookup(code uint32) (err *Error, exist bool) {
+	err, exist = catalogue[code]
+	return
+}
+
+// Text returns description of return code, empty for unknown code
+func Text(code uint32) string {
+	if code == OK {
+		return "OK"
+	}
+	if err, exist := catalogue[code]; exist {
+		return err.Message
+	}
+	return ""
+}
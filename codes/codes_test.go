@@ -0,0 +1,66 @@
+package codes
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+type TestCase struct {
+	Err  error
+	Code uint32
+}
+
+type coded struct{}
+
+func (c coded) Error() string {
+	return "coded"
+}
+
+func (c coded) ReturnCode() uint32 {
+	return 42
+}
+
+func TestCode(t *testing.T) {
+	cases := []TestCase{
+		{Err: nil, Code: OK},
+		{Err: errors.New("plain"), Code: HANDLER_ERROR},
+		{Err: ErrOutOfRange, Code: OUT_OF_RANGE},
+		{Err: fmt.Errorf("%w: valid index is in [0;999]", ErrOutOfRange), Code: OUT_OF_RANGE},
+		{Err: fmt.Errorf("replace: %w", fmt.Errorf("%w: 256 bytes", ErrValueTooLarge)), Code: VALUE_TOO_LARGE},
+		{Err: fmt.Errorf("custom: %w", coded{}), Code: 42},
+	}
+	for caseNum, item := range cases {
+		if code := Code(item.Err); code != item.Code {
+			t.Errorf("[%d] wrong results: got %d, expected %d", caseNum, code, item.Code)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	// Return codes are part of the protocol and must never change
+	cases := []TestCase{
+		{Err: ErrHandler, Code: 1},
+		{Err: ErrBadBody, Code: 401},
+		{Err: ErrRateLimited, Code: 402},
+		{Err: ErrUnknownFunc, Code: 404},
+		{Err: ErrWrongState, Code: 409},
+		{Err: ErrMismatch, Code: 412},
+		{Err: ErrValueTooLarge, Code: 413},
+		{Err: ErrOutOfRange, Code: 416},
+		{Err: ErrOverloaded, Code: 503},
+		{Err: ErrTimeout, Code: 504},
+	}
+	for caseNum, item := range cases {
+		sentinel, exist := Lookup(item.Code)
+		if !exist || sentinel != item.Err || Text(item.Code) != item.Err.Error() {
+			t.Errorf("[%d] wrong results: got %v %v, expected %v", caseNum, sentinel, exist, item.Err)
+		}
+	}
+	if _, exist := Lookup(OK); exist || Text(OK) != "OK" {
+		t.Errorf("wrong results for OK")
+	}
+	if _, exist := Lookup(42); exist || Text(42) != "" {
+		t.Errorf("wrong results for unknown code")
+	}
+}
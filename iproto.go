@@ -1,11 +1,19 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"github.com/Bambelbl/iproto-server/logging"
+	"github.com/Bambelbl/iproto-server/metrics"
+	"github.com/Bambelbl/iproto-server/rate_limiter"
 	"github.com/Bambelbl/iproto-server/server"
-	"log"
+	"github.com/Bambelbl/iproto-server/storage"
+	"github.com/Bambelbl/iproto-server/tracing"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
+	"time"
 )
 
 const (
@@ -14,23 +22,154 @@ const (
 	LIMIT_RPS   = 100
 	ADDR        = ":8080"
 	PROCS_COUNT = 4
+	// LOG_SAMPLE_INTERVAL interval in which -log-sample records with the same message are written
+	LOG_SAMPLE_INTERVAL = time.Second
 )
 
 func main() {
-	logger := log.New(os.Stdout, "iproto: ", log.LstdFlags)
+	legacyBody := flag.Bool("legacy-body", false, "accept request bodies in legacy encoding")
+	walPath := flag.String("wal", "", "keep storage in write-ahead log at this path, in memory only if empty")
+	walSync := flag.String("wal-sync", "always", "when writes to write-ahead log are durable: always, batched or interval")
+	walSyncInterval := flag.Duration("wal-sync-interval", storage.WAL_SYNC_INTERVAL, "fsync period of write-ahead log for interval policy")
+	snapshotPath := flag.String("snapshot", "", "file to write snapshots of storage to, snapshots are disabled if empty")
+	snapshotInterval := flag.Duration("snapshot-interval", 0, "period of snapshots, 0 means on ADM_STORAGE_SNAPSHOT only")
+	restore := flag.Bool("restore", false, "restore storage from -snapshot file at startup, always done with -wal")
+	cells := flag.Int("cells", storage.SIZE, "number of cells of storage")
+	maxValueSize := flag.Int("max-value-size", storage.MAX_VALUE_SIZE, "max length of value of storage in bytes")
+	countRunes := flag.Bool("count-runes", false, "measure -max-value-size in UTF-8 runes instead of bytes")
+	sweepInterval := flag.Duration("sweep-interval", storage.SWEEP_INTERVAL, "period of clearing expired cells, 0 disables it")
+	watchBuffer := flag.Int("watch-buffer", storage.WATCH_BUFFER, "number of notifications buffered for every STORAGE_WATCH")
+	watchPolicy := flag.String("watch-policy", "close", "what to do when watching client is slow: drop notifications or close connection")
+	metricsAddr := flag.String("metrics-addr", "", "address of HTTP server of /metrics and /log/level endpoints, disabled if empty")
+	logLevel := flag.String("log-level", "info", "min level of logged records: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "format of log records: text or json")
+	logSample := flag.Int("log-sample", 100, "number N of debug and info records with the same message logged per second, then every N-th of them is, 0 disables sampling")
+	rateLimitAlgorithm := flag.String("rate-limit-algorithm", "gcra", "algorithm limiting requests of every client: token-bucket, sliding-window or gcra")
+	rateLimitBy := flag.String("rate-limit-by", "ip", "what identifies client for rate limits: ip, cidr (network of -rate-limit-ipv4-prefix or -rate-limit-ipv6-prefix bits) or client-id (authenticated by proxy)")
+	ipv4Prefix := flag.Int("rate-limit-ipv4-prefix", rate_limiter.DEFAULT_IPV4_PREFIX, "length of prefix of IPv4 networks of -rate-limit-by cidr")
+	ipv6Prefix := flag.Int("rate-limit-ipv6-prefix", rate_limiter.DEFAULT_IPV6_PREFIX, "length of prefix of IPv6 networks of -rate-limit-by cidr")
+	rateLimitPolicy := flag.String("rate-limit-policy", "", "JSON file with allow and deny lists and custom limits of clients")
+	proxyProtocol := flag.Bool("proxy-protocol", false, "expect PROXY protocol header on every connection and rate-limit clients by address behind proxy")
+	traceEndpoint := flag.String("trace-endpoint", "", "where to export spans of requests as OTLP/JSON: URL of collector, e.g. http://localhost:4318/v1/traces, or file path, tracing is disabled if empty")
+	traceSample := flag.Float64("trace-sample", 1, "ratio of traces started by server which are recorded, from 0 to 1")
+	flag.Parse()
+
+	level, levelErr := logging.ParseLevel(*logLevel)
+	format, formatErr := logging.ParseFormat(*logFormat)
+	levelVar := logging.NewLevelVar(level)
+	logger := logging.New(os.Stdout, logging.WithFormat(format), logging.WithLevel(levelVar),
+		logging.WithSampling(*logSample, *logSample, LOG_SAMPLE_INTERVAL))
+	if levelErr != nil {
+		logging.Fatal(logger, "wrong -log-level", logging.KEY_ERROR, levelErr)
+	}
+	if formatErr != nil {
+		logging.Fatal(logger, "wrong -log-format", logging.KEY_ERROR, formatErr)
+	}
 	runtime.GOMAXPROCS(PROCS_COUNT)
 
 	done := make(chan bool)
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, os.Kill)
 
-	iprotoServer := server.NewIprotoServer(ADDR, logger, MAX_CLIENTS, SCALE_RPS, LIMIT_RPS)
+	config := storage.Config{Size: *cells, MaxValueSize: *maxValueSize, CountRunes: *countRunes}
+	if config.Size <= 0 || config.MaxValueSize <= 0 {
+		logging.Fatal(logger, "wrong geometry of storage", "cells", config.Size, "max_value_size", config.MaxValueSize)
+	}
+	slowPolicy, err := storage.ParseSlowPolicy(*watchPolicy)
+	if err != nil {
+		logging.Fatal(logger, "wrong -watch-policy", logging.KEY_ERROR, err)
+	}
+	algorithm, err := rate_limiter.ParseAlgorithm(*rateLimitAlgorithm)
+	if err != nil {
+		logging.Fatal(logger, "wrong -rate-limit-algorithm", logging.KEY_ERROR, err)
+	}
+	policy, err := loadRateLimitPolicy(*rateLimitPolicy)
+	if err != nil {
+		logging.Fatal(logger, "wrong -rate-limit-policy", "path", *rateLimitPolicy, logging.KEY_ERROR, err)
+	}
+	identityKind, err := rate_limiter.ParseIdentityKind(*rateLimitBy)
+	if err != nil {
+		logging.Fatal(logger, "wrong -rate-limit-by", logging.KEY_ERROR, err)
+	}
+	if *ipv4Prefix <= 0 || *ipv4Prefix > 32 || *ipv6Prefix <= 0 || *ipv6Prefix > 128 {
+		logging.Fatal(logger, "wrong prefix of networks of clients", "ipv4_prefix", *ipv4Prefix, "ipv6_prefix", *ipv6Prefix)
+	}
+	if identityKind == rate_limiter.BY_CLIENT_ID && !*proxyProtocol {
+		logging.Fatal(logger, "-rate-limit-by client-id requires -proxy-protocol")
+	}
+	policy.Identity = rate_limiter.Identity{Kind: identityKind, ProxySource: *proxyProtocol, IPv4Prefix: *ipv4Prefix, IPv6Prefix: *ipv6Prefix}
+	opts := []server.Option{server.WithGeometry(config), server.WithSweepInterval(*sweepInterval),
+		server.WithWatchBuffer(*watchBuffer, slowPolicy), server.WithRateLimitAlgorithm(algorithm),
+		server.WithRateLimitPolicy(policy)}
+	if *proxyProtocol {
+		opts = append(opts, server.WithProxyProtocol())
+	}
+	if *legacyBody {
+		opts = append(opts, server.WithLegacyBody())
+	}
+	if *walPath != "" {
+		policy, err := storage.ParseSyncPolicy(*walSync)
+		if err != nil {
+			logging.Fatal(logger, "wrong -wal-sync", logging.KEY_ERROR, err)
+		}
+		walOpts := []storage.WALOption{storage.WithSyncPolicy(policy), storage.WithSyncInterval(*walSyncInterval),
+			storage.WithLogger(logger.With(logging.KEY_COMPONENT, "storage"))}
+		if *snapshotPath != "" {
+			// Snapshots are checkpoints of the log, storage is always loaded from the snapshot and the log
+			walOpts = append(walOpts, storage.WithSnapshot(*snapshotPath))
+		}
+		stor, err := storage.NewWALStorageRepo(config, *walPath, walOpts...)
+		if err != nil {
+			logging.Fatal(logger, "could not open write-ahead log", "path", *walPath, logging.KEY_ERROR, err)
+		}
+		opts = append(opts, server.WithStorage(stor))
+	}
+	if *snapshotPath != "" {
+		opts = append(opts, server.WithSnapshots(*snapshotPath, *snapshotInterval, *restore && *walPath == ""))
+	} else if *restore {
+		logging.Fatal(logger, "-restore requires -snapshot")
+	}
+	var metricsServer *http.Server
+	if *metricsAddr != "" {
+		m := metrics.New()
+		opts = append(opts, server.WithObserver(m))
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", m)
+		mux.Handle("/log/level", levelVar)
+		metricsServer = &http.Server{Addr: *metricsAddr, Handler: mux}
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logging.Fatal(logger, "metrics server error", logging.KEY_ERROR, err)
+			}
+		}()
+	}
+	var tracer *tracing.Tracer
+	if *traceEndpoint != "" {
+		exporter, err := tracing.ParseExporter(*traceEndpoint)
+		if err != nil {
+			logging.Fatal(logger, "could not open -trace-endpoint", "endpoint", *traceEndpoint, logging.KEY_ERROR, err)
+		}
+		tracerLogger := logger.With(logging.KEY_COMPONENT, "tracing")
+		tracer = tracing.NewTracer(exporter, tracing.WithSampleRatio(*traceSample), tracing.WithErrorHandler(func(err error) {
+			tracerLogger.Warn("export of spans error", logging.KEY_ERROR, err)
+		}))
+		opts = append(opts, server.WithTracer(tracer))
+	}
+	iprotoServer := server.NewIprotoServer(ADDR, logger, MAX_CLIENTS, SCALE_RPS, LIMIT_RPS, opts...)
 
 	go func() {
 		<-quit
-		logger.Println("Server is shutting down...")
+		logger.Info("server is shutting down")
+		if metricsServer != nil {
+			if err := metricsServer.Close(); err != nil {
+				logger.Warn("could not close metrics server", logging.KEY_ERROR, err)
+			}
+		}
 		if err := iprotoServer.Stop(); err != nil {
-			logger.Fatalf("Could not gracefully shutdown the server: %s", err.Error())
+			logging.Fatal(logger, "could not gracefully shutdown the server", logging.KEY_ERROR, err)
+		}
+		if err := tracer.Close(); err != nil {
+			logger.Warn("could not close tracer", logging.KEY_ERROR, err)
 		}
 		close(done)
 	}()
@@ -38,5 +177,18 @@ func main() {
 	iprotoServer.Serve()
 
 	<-done
-	logger.Println("Server stopped")
+	logger.Info("server stopped")
+}
+
+// loadRateLimitPolicy reads rate_limiter.Policy from file at path, empty policy if path is empty
+func loadRateLimitPolicy(path string) (rate_limiter.Policy, error) {
+	if path == "" {
+		return rate_limiter.Policy{}, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return rate_limiter.Policy{}, err
+	}
+	defer file.Close()
+	return rate_limiter.ParsePolicy(file)
 }
@@ -3,25 +3,128 @@ package main
 import (
 	"bufio"
 	"encoding/binary"
+	"github.com/Bambelbl/iproto-server/codes"
+	"github.com/Bambelbl/iproto-server/logging"
 	"github.com/Bambelbl/iproto-server/packet/request_packet"
 	"github.com/Bambelbl/iproto-server/packet/response_packet"
+	"github.com/Bambelbl/iproto-server/rate_limiter"
+	"github.com/Bambelbl/iproto-server/server"
+	"github.com/Bambelbl/iproto-server/storage"
 	"github.com/vmihailenco/msgpack"
+	"io"
 	"log"
 	"net"
+	"os"
 	"reflect"
+	"strings"
 	"testing"
 )
 
+// Limits of test server, tests run as a single file without iproto.go
+const (
+	TEST_MAX_CLIENTS = 100
+	TEST_SCALE_RPS   = 1000
+	TEST_LIMIT_RPS   = 100
+)
+
+// testRequest request as the client knows it before encoding
+type testRequest struct {
+	Header request_packet.IprotoHeader
+	Body   request_packet.IprotoBody
+}
+
 type TestCase struct {
-	input  request_packet.IprotoPacketRequest
+	input  testRequest
 	output response_packet.IprotoPacketResponse
 }
 
-// Need to start server before testing
+// startServer starts IprotoServer on a free local port
+func startServer(t *testing.T, opts ...server.Option) string {
+	logger := logging.New(os.Stdout)
+	iprotoServer := server.NewIprotoServer("127.0.0.1:0", logger, TEST_MAX_CLIENTS, TEST_SCALE_RPS, TEST_LIMIT_RPS, opts...)
+	iprotoServer.Serve()
+	t.Cleanup(func() {
+		if err := iprotoServer.Stop(); err != nil {
+			t.Errorf("server stop error: %v", err)
+		}
+	})
+	return iprotoServer.Addr().String()
+}
+
+// marshalRequest from testRequest to []byte with body encoded as msgpack values
+func marshalRequest(t *testing.T, packet testRequest) []byte {
+	input := make([]byte, 12)
+	binary.LittleEndian.PutUint32(input[:4], packet.Header.Func_id)
+	binary.LittleEndian.PutUint32(input[8:12], packet.Header.Request_id)
+	var msgBody []byte
+	var err error
+	if packet.Header.Func_id == 0x00020001 {
+		msgBody, err = msgpack.Marshal([]interface{}{packet.Body.Idx, packet.Body.Str})
+	} else if packet.Header.Func_id == 0x00020002 {
+		msgBody, err = msgpack.Marshal(packet.Body.Idx)
+	}
+	if err != nil {
+		t.Fatalf("Msgpack.marshal error in prepare for test")
+	}
+	binary.LittleEndian.PutUint32(input[4:8], uint32(len(msgBody)))
+	return append(input, msgBody...)
+}
+
+// marshalLegacyRequest from testRequest to []byte with body in legacy encoding
+func marshalLegacyRequest(t *testing.T, packet testRequest) []byte {
+	input := make([]byte, 12)
+	binary.LittleEndian.PutUint32(input[:4], packet.Header.Func_id)
+	binary.LittleEndian.PutUint32(input[8:12], packet.Header.Request_id)
+	var bodyBytes []byte
+	if packet.Header.Func_id == 0x00020001 {
+		bodyBytes = make([]byte, 4)
+		binary.LittleEndian.PutUint32(bodyBytes[:4], uint32(packet.Body.Idx))
+		bodyBytes = append(bodyBytes, []byte(packet.Body.Str)...)
+	} else if packet.Header.Func_id == 0x00020002 {
+		bodyBytes = make([]byte, 4)
+		binary.LittleEndian.PutUint32(bodyBytes[:4], uint32(packet.Body.Idx))
+	} else {
+		return input
+	}
+	msgBody, err := msgpack.Marshal(&bodyBytes)
+	if err != nil {
+		t.Fatalf("Msgpack.marshal error in prepare for test")
+	}
+	binary.LittleEndian.PutUint32(input[4:8], uint32(len(msgBody)))
+	return append(input, msgBody...)
+}
+
+// readResponse reads exactly one response packet from reader
+func readResponse(t *testing.T, reader io.Reader) response_packet.IprotoPacketResponse {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		t.Fatalf("Client: read response error: %s", err.Error())
+	}
+	packet := response_packet.IprotoPacketResponse{
+		Header: response_packet.IprotoHeader{
+			Func_id:     binary.LittleEndian.Uint32(header[:4]),
+			Body_length: binary.LittleEndian.Uint32(header[4:8]),
+			Request_id:  binary.LittleEndian.Uint32(header[8:12]),
+		},
+		Return_code: binary.LittleEndian.Uint32(header[12:16]),
+	}
+	body := make([]byte, packet.Header.Body_length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		t.Fatalf("Client: read response body error: %s", err.Error())
+	}
+	if len(body) > 0 {
+		if err := msgpack.Unmarshal(body, &packet.Body); err != nil {
+			t.Fatalf("Client: msgpack unmarshal response error: %s", err.Error())
+		}
+	}
+	return packet
+}
+
 func TestServer(t *testing.T) {
+	addr := startServer(t)
 	cases := []TestCase{
 		{
-			input: request_packet.IprotoPacketRequest{
+			input: testRequest{
 				Header: request_packet.IprotoHeader{
 					Func_id:    0x00010001,
 					Request_id: 0,
@@ -31,15 +134,15 @@ func TestServer(t *testing.T) {
 			output: response_packet.IprotoPacketResponse{
 				Header: response_packet.IprotoHeader{
 					Func_id:     0x00010001,
-					Body_length: 0,
+					Body_length: 1,
 					Request_id:  0,
 				},
 				Return_code: 0,
-				Body:        "",
+				Body:        nil,
 			},
 		},
 		{
-			input: request_packet.IprotoPacketRequest{
+			input: testRequest{
 				Header: request_packet.IprotoHeader{
 					Func_id:    0x00020001,
 					Request_id: 1,
@@ -55,12 +158,12 @@ func TestServer(t *testing.T) {
 					Body_length: 44,
 					Request_id:  1,
 				},
-				Return_code: 1,
+				Return_code: codes.WRONG_STATE,
 				Body:        "storage state doesn't allow this operation",
 			},
 		},
 		{
-			input: request_packet.IprotoPacketRequest{
+			input: testRequest{
 				Header: request_packet.IprotoHeader{
 					Func_id:    0x00010002,
 					Request_id: 2,
@@ -70,15 +173,15 @@ func TestServer(t *testing.T) {
 			output: response_packet.IprotoPacketResponse{
 				Header: response_packet.IprotoHeader{
 					Func_id:     0x00010002,
-					Body_length: 0,
+					Body_length: 1,
 					Request_id:  2,
 				},
 				Return_code: 0,
-				Body:        "",
+				Body:        nil,
 			},
 		},
 		{
-			input: request_packet.IprotoPacketRequest{
+			input: testRequest{
 				Header: request_packet.IprotoHeader{
 					Func_id:     0x00020001,
 					Body_length: 0,
@@ -92,15 +195,15 @@ func TestServer(t *testing.T) {
 			output: response_packet.IprotoPacketResponse{
 				Header: response_packet.IprotoHeader{
 					Func_id:     0x00020001,
-					Body_length: 0,
+					Body_length: 1,
 					Request_id:  3,
 				},
 				Return_code: 0,
-				Body:        "",
+				Body:        nil,
 			},
 		},
 		{
-			input: request_packet.IprotoPacketRequest{
+			input: testRequest{
 				Header: request_packet.IprotoHeader{
 					Func_id:     0x00020002,
 					Body_length: 0,
@@ -121,7 +224,7 @@ func TestServer(t *testing.T) {
 			},
 		},
 		{
-			input: request_packet.IprotoPacketRequest{
+			input: testRequest{
 				Header: request_packet.IprotoHeader{
 					Func_id:    0x00010003,
 					Request_id: 5,
@@ -131,15 +234,15 @@ func TestServer(t *testing.T) {
 			output: response_packet.IprotoPacketResponse{
 				Header: response_packet.IprotoHeader{
 					Func_id:     0x00010003,
-					Body_length: 0,
+					Body_length: 1,
 					Request_id:  5,
 				},
 				Return_code: 0,
-				Body:        "",
+				Body:        nil,
 			},
 		},
 		{
-			input: request_packet.IprotoPacketRequest{
+			input: testRequest{
 				Header: request_packet.IprotoHeader{
 					Func_id:     0x00020002,
 					Body_length: 0,
@@ -155,76 +258,23 @@ func TestServer(t *testing.T) {
 					Body_length: 44,
 					Request_id:  6,
 				},
-				Return_code: 1,
+				Return_code: codes.WRONG_STATE,
 				Body:        "storage state doesn't allow this operation",
 			},
 		},
 	}
 	for caseNum, item := range cases {
-		input := make([]byte, 12)
-		binary.LittleEndian.PutUint32(input[:4], item.input.Header.Func_id)
-		binary.LittleEndian.PutUint32(input[4:8], item.input.Header.Body_length)
-		binary.LittleEndian.PutUint32(input[8:12], item.input.Header.Request_id)
-		if item.input.Header.Func_id == 0x00020001 {
-			bodyBytes := make([]byte, 4)
-			binary.LittleEndian.PutUint32(bodyBytes[:4], uint32(item.input.Body.Idx))
-			bodyBytes = append(bodyBytes, []byte(item.input.Body.Str)...)
-			msgBody, err := msgpack.Marshal(&bodyBytes)
-			if err != nil {
-				log.Fatalf("Msgpack.marshal error in prepare for test")
-			}
-			binary.LittleEndian.PutUint32(input[4:8], uint32(len(bodyBytes)))
-			input = append(input, msgBody...)
-		} else if item.input.Header.Func_id == 0x00020002 {
-			bodyBytes := make([]byte, 4)
-			binary.LittleEndian.PutUint32(bodyBytes[:4], uint32(item.input.Body.Idx))
-			msgBody, err := msgpack.Marshal(&bodyBytes)
-			if err != nil {
-				log.Printf("Client: msgpack marshal request error: %s\n", err.Error())
-				return
-			}
-			binary.LittleEndian.PutUint32(input[4:8], uint32(len(bodyBytes)))
-			input = append(input, msgBody...)
-		}
-		conn, err := net.Dial("tcp", ":8080")
-		defer func(conn net.Conn) {
-			err = conn.Close()
-			if err != nil {
-				log.Printf("Client: connection close error: %s\n", err.Error())
-			}
-		}(conn)
-		if err != nil {
-			log.Printf("Client: dial error: %s\n", err.Error())
-			return
-		}
-		_, err = conn.Write(input)
+		conn, err := net.Dial("tcp", addr)
 		if err != nil {
-			log.Printf("Client: request error: %s\n", err.Error())
-			return
+			t.Fatalf("Client: dial error: %s", err.Error())
 		}
-		output := make([]byte, 1000)
-		_, err = bufio.NewReader(conn).Read(output)
+		_, err = conn.Write(marshalRequest(t, item.input))
 		if err != nil {
-			log.Printf("Client: read response error: %s\n", err.Error())
-			return
-		}
-		packet := response_packet.IprotoPacketResponse{
-			Header: response_packet.IprotoHeader{
-				Func_id:     binary.LittleEndian.Uint32(output[:4]),
-				Body_length: binary.LittleEndian.Uint32(output[4:8]),
-				Request_id:  binary.LittleEndian.Uint32(output[8:12]),
-			},
-			Return_code: binary.LittleEndian.Uint32(output[12:16]),
+			t.Fatalf("Client: request error: %s", err.Error())
 		}
-		if packet.Header.Func_id == 0x00020002 ||
-			(item.input.Header.Func_id == 0x00020001 && packet.Return_code == 1) {
-			bodyBytes := make([]byte, packet.Header.Body_length)
-			err = msgpack.Unmarshal(output[16:16+packet.Header.Body_length], &bodyBytes)
-			if err != nil {
-				log.Printf("Client: msgpack unmarshal response error: %s\n", err.Error())
-				return
-			}
-			packet.Body = string(bodyBytes)
+		packet := readResponse(t, bufio.NewReader(conn))
+		if err = conn.Close(); err != nil {
+			log.Printf("Client: connection close error: %s\n", err.Error())
 		}
 
 		if !reflect.DeepEqual(packet, item.output) {
@@ -233,3 +283,241 @@ func TestServer(t *testing.T) {
 		}
 	}
 }
+
+func TestServer_PersistentConnection(t *testing.T) {
+	addr := startServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Client: dial error: %s", err.Error())
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	for i := 0; i < 10; i++ {
+		str := "value " + string(rune('0'+i))
+		_, err = conn.Write(marshalRequest(t, testRequest{
+			Header: request_packet.IprotoHeader{Func_id: 0x00020001, Request_id: uint32(2 * i)},
+			Body:   request_packet.IprotoBody{Idx: i, Str: str},
+		}))
+		if err != nil {
+			t.Fatalf("Client: request error: %s", err.Error())
+		}
+		replace := readResponse(t, reader)
+		if replace.Return_code != 0 || replace.Header.Request_id != uint32(2*i) {
+			t.Fatalf("[%d] unexpected replace response: %+v", i, replace)
+		}
+
+		_, err = conn.Write(marshalRequest(t, testRequest{
+			Header: request_packet.IprotoHeader{Func_id: 0x00020002, Request_id: uint32(2*i + 1)},
+			Body:   request_packet.IprotoBody{Idx: i},
+		}))
+		if err != nil {
+			t.Fatalf("Client: request error: %s", err.Error())
+		}
+		read := readResponse(t, reader)
+		if read.Return_code != 0 || read.Header.Request_id != uint32(2*i+1) || read.Body != str {
+			t.Fatalf("[%d] unexpected read response: %+v", i, read)
+		}
+	}
+}
+
+func TestServer_Pipelining(t *testing.T) {
+	addr := startServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Client: dial error: %s", err.Error())
+	}
+	defer conn.Close()
+
+	const count = 50
+	var input []byte
+	for i := 0; i < count; i++ {
+		input = append(input, marshalRequest(t, testRequest{
+			Header: request_packet.IprotoHeader{Func_id: 0x00020001, Request_id: uint32(i)},
+			Body:   request_packet.IprotoBody{Idx: i, Str: "pipelined"},
+		})...)
+	}
+	if _, err = conn.Write(input); err != nil {
+		t.Fatalf("Client: request error: %s", err.Error())
+	}
+
+	reader := bufio.NewReader(conn)
+	seen := make(map[uint32]bool, count)
+	for i := 0; i < count; i++ {
+		packet := readResponse(t, reader)
+		if packet.Return_code != 0 || packet.Header.Func_id != 0x00020001 {
+			t.Errorf("[%d] unexpected response: %+v", i, packet)
+		}
+		if seen[packet.Header.Request_id] {
+			t.Errorf("[%d] duplicate response for request %d", i, packet.Header.Request_id)
+		}
+		seen[packet.Header.Request_id] = true
+	}
+	for i := 0; i < count; i++ {
+		if !seen[uint32(i)] {
+			t.Errorf("no response for request %d", i)
+		}
+	}
+}
+
+func TestServer_LegacyBody(t *testing.T) {
+	addr := startServer(t, server.WithLegacyBody())
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Client: dial error: %s", err.Error())
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	_, err = conn.Write(marshalLegacyRequest(t, testRequest{
+		Header: request_packet.IprotoHeader{Func_id: 0x00020001, Request_id: 1},
+		Body:   request_packet.IprotoBody{Idx: 42, Str: "legacy"},
+	}))
+	if err != nil {
+		t.Fatalf("Client: request error: %s", err.Error())
+	}
+	if replace := readResponse(t, reader); replace.Return_code != 0 {
+		t.Fatalf("unexpected replace response: %+v", replace)
+	}
+
+	_, err = conn.Write(marshalLegacyRequest(t, testRequest{
+		Header: request_packet.IprotoHeader{Func_id: 0x00020002, Request_id: 2},
+		Body:   request_packet.IprotoBody{Idx: 42},
+	}))
+	if err != nil {
+		t.Fatalf("Client: request error: %s", err.Error())
+	}
+	if read := readResponse(t, reader); read.Return_code != 0 || read.Body != "legacy" {
+		t.Fatalf("unexpected read response: %+v", read)
+	}
+
+	_, err = conn.Write(marshalRequest(t, testRequest{
+		Header: request_packet.IprotoHeader{Func_id: 0x00020002, Request_id: 3},
+		Body:   request_packet.IprotoBody{Idx: 42},
+	}))
+	if err != nil {
+		t.Fatalf("Client: request error: %s", err.Error())
+	}
+	if read := readResponse(t, reader); read.Return_code != server.CLIENT_INVALID_BODY {
+		t.Fatalf("expected invalid body response, got %+v", read)
+	}
+}
+
+func TestServer_EmptyCellIsNotNil(t *testing.T) {
+	addr := startServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Client: dial error: %s", err.Error())
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(marshalRequest(t, testRequest{
+		Header: request_packet.IprotoHeader{Func_id: 0x00020002, Request_id: 1},
+		Body:   request_packet.IprotoBody{Idx: 10},
+	}))
+	if err != nil {
+		t.Fatalf("Client: request error: %s", err.Error())
+	}
+	read := readResponse(t, bufio.NewReader(conn))
+	if read.Return_code != 0 || read.Header.Body_length != 1 || read.Body != "" {
+		t.Fatalf("expected empty string, got %+v", read)
+	}
+}
+
+type GeometryTestCase struct {
+	input testRequest
+	code  uint32
+	body  interface{}
+}
+
+func TestServer_Geometry(t *testing.T) {
+	addr := startServer(t, server.WithGeometry(storage.Config{Size: 10, MaxValueSize: 4}))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Client: dial error: %s", err.Error())
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	cases := []GeometryTestCase{
+		{input: testRequest{Header: request_packet.IprotoHeader{Func_id: 0x00020001, Request_id: 1},
+			Body: request_packet.IprotoBody{Idx: 9, Str: "1234"}}},
+		{input: testRequest{Header: request_packet.IprotoHeader{Func_id: 0x00020002, Request_id: 2},
+			Body: request_packet.IprotoBody{Idx: 10}},
+			code: codes.OUT_OF_RANGE, body: "index is out of range: valid index is in [0;9]"},
+		{input: testRequest{Header: request_packet.IprotoHeader{Func_id: 0x00020001, Request_id: 3},
+			Body: request_packet.IprotoBody{Idx: 0, Str: "12345"}},
+			code: codes.VALUE_TOO_LARGE, body: "value is too large: max length of string is 4 bytes"},
+		{input: testRequest{Header: request_packet.IprotoHeader{Func_id: 0x00020001, Request_id: 4},
+			Body: request_packet.IprotoBody{Idx: 0, Str: strings.Repeat("1234567890", 4)}},
+			code: server.CLIENT_INVALID_BODY, body: "Invalid body in request packet"},
+	}
+	for caseNum, item := range cases {
+		if _, err = conn.Write(marshalRequest(t, item.input)); err != nil {
+			t.Fatalf("Client: request error: %s", err.Error())
+		}
+		response := readResponse(t, reader)
+		if response.Return_code != item.code || item.body != nil && response.Body != item.body {
+			t.Errorf("[%d] wrong results: got %+v, expected %d %v", caseNum, response, item.code, item.body)
+		}
+	}
+}
+
+type ProxyTestCase struct {
+	header []byte
+	code   uint32
+}
+
+func TestServer_ProxyProtocol(t *testing.T) {
+	// One request per second for every client behind proxy
+	policy := rate_limiter.Policy{Identity: rate_limiter.Identity{ProxySource: true}}
+	iprotoServer := server.NewIprotoServer("127.0.0.1:0", logging.New(os.Stdout), TEST_MAX_CLIENTS, TEST_SCALE_RPS, 1,
+		server.WithProxyProtocol(), server.WithRateLimitPolicy(policy))
+	iprotoServer.Serve()
+	defer func() {
+		if err := iprotoServer.Stop(); err != nil {
+			t.Errorf("server stop error: %v", err)
+		}
+	}()
+
+	cases := []ProxyTestCase{
+		{header: []byte("PROXY TCP4 192.0.2.10 10.0.0.1 50001 8080\r\n"), code: 0},
+		// The next connection of the same client shares its limit
+		{header: []byte("PROXY TCP4 192.0.2.10 10.0.0.1 50002 8080\r\n"), code: codes.TOO_MANY_REQUESTS},
+		{header: []byte("PROXY TCP4 192.0.2.11 10.0.0.1 50003 8080\r\n"), code: 0},
+	}
+	for caseNum, item := range cases {
+		conn, err := net.Dial("tcp", iprotoServer.Addr().String())
+		if err != nil {
+			t.Fatalf("Client: dial error: %s", err.Error())
+		}
+		_, err = conn.Write(append(item.header, marshalRequest(t, testRequest{
+			Header: request_packet.IprotoHeader{Func_id: 0x00020002, Request_id: uint32(caseNum)},
+			Body:   request_packet.IprotoBody{Idx: 1},
+		})...))
+		if err != nil {
+			t.Fatalf("Client: request error: %s", err.Error())
+		}
+		if response := readResponse(t, conn); response.Return_code != item.code {
+			t.Errorf("[%d] wrong results: got %+v, expected code %d", caseNum, response, item.code)
+		}
+		conn.Close()
+	}
+
+	// Connection without header is closed
+	conn, err := net.Dial("tcp", iprotoServer.Addr().String())
+	if err != nil {
+		t.Fatalf("Client: dial error: %s", err.Error())
+	}
+	defer conn.Close()
+	_, err = conn.Write(marshalRequest(t, testRequest{
+		Header: request_packet.IprotoHeader{Func_id: 0x00020002, Request_id: 10},
+		Body:   request_packet.IprotoBody{Idx: 1},
+	}))
+	if err != nil {
+		t.Fatalf("Client: request error: %s", err.Error())
+	}
+	if n, err := conn.Read(make([]byte, 16)); err == nil {
+		t.Errorf("wrong results: got %d bytes of response, expected connection to be closed", n)
+	}
+}
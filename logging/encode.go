@@ -0,0 +1,149 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// TIME_FORMAT format of time of records
+const TIME_FORMAT = "2006-01-02T15:04:05.000Z07:00"
+
+// appendText appends record as line of time, level, message and key=value fields,
+// message and values containing spaces, quotes or control characters are quoted
+func appendText(buf []byte, now time.Time, level Level, msg string, fields []interface{}) []byte {
+	buf = now.AppendFormat(buf, TIME_FORMAT)
+	buf = append(buf, ' ')
+	buf = append(buf, level.String()...)
+	buf = append(buf, ' ')
+	buf = appendTextString(buf, msg)
+	for i := 0; i < len(fields); i += 2 {
+		buf = append(buf, ' ')
+		buf = append(buf, fields[i].(string)...)
+		buf = append(buf, '=')
+		buf = appendTextString(buf, textValue(fields[i+1]))
+	}
+	return append(buf, '\n')
+}
+
+// textValue formats value of field for text output
+func textValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	case nil:
+		return "<nil>"
+	}
+	return fmt.Sprint(value)
+}
+
+// appendTextString appends s quoted if it's empty or would break key=value format
+func appendTextString(buf []byte, s string) []byte {
+	if s != "" && !strings.ContainsAny(s, " =\"\\") && strings.IndexFunc(s, needsQuote) < 0 {
+		return append(buf, s...)
+	}
+	return strconv.AppendQuote(buf, s)
+}
+
+func needsQuote(r rune) bool {
+	return r < ' ' || r == utf8.RuneError || r == 0x7f
+}
+
+// appendJSON appends record as JSON object with members time, level, msg and fields
+func appendJSON(buf []byte, now time.Time, level Level, msg string, fields []interface{}) []byte {
+	buf = append(buf, `{"time":"`...)
+	buf = now.AppendFormat(buf, TIME_FORMAT)
+	buf = append(buf, `","level":"`...)
+	buf = append(buf, level.String()...)
+	buf = append(buf, `","msg":`...)
+	buf = appendJSONString(buf, msg)
+	for i := 0; i < len(fields); i += 2 {
+		buf = append(buf, ',')
+		buf = appendJSONString(buf, fields[i].(string))
+		buf = append(buf, ':')
+		buf = appendJSONValue(buf, fields[i+1])
+	}
+	return append(buf, "}\n"...)
+}
+
+// appendJSONValue appends value of field, numbers and booleans as they are,
+// errors and fmt.Stringer as strings, other values as encoding/json marshals them
+func appendJSONValue(buf []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case string:
+		return appendJSONString(buf, v)
+	case bool:
+		return strconv.AppendBool(buf, v)
+	case int:
+		return strconv.AppendInt(buf, int64(v), 10)
+	case int32:
+		return strconv.AppendInt(buf, int64(v), 10)
+	case int64:
+		return strconv.AppendInt(buf, v, 10)
+	case uint:
+		return strconv.AppendUint(buf, uint64(v), 10)
+	case uint32:
+		return strconv.AppendUint(buf, uint64(v), 10)
+	case uint64:
+		return strconv.AppendUint(buf, v, 10)
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return appendJSONString(buf, strconv.FormatFloat(v, 'g', -1, 64))
+		}
+		return strconv.AppendFloat(buf, v, 'g', -1, 64)
+	case error:
+		return appendJSONString(buf, v.Error())
+	case fmt.Stringer:
+		return appendJSONString(buf, v.String())
+	case nil:
+		return append(buf, "null"...)
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return appendJSONString(buf, fmt.Sprint(value))
+	}
+	return append(buf, data...)
+}
+
+// appendJSONString appends s as JSON string, invalid UTF-8 is replaced with \ufffd like encoding/json does
+func appendJSONString(buf []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	buf = append(buf, '"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\':
+				buf = append(buf, '\\', c)
+			case c == '\n':
+				buf = append(buf, '\\', 'n')
+			case c == '\r':
+				buf = append(buf, '\\', 'r')
+			case c == '\t':
+				buf = append(buf, '\\', 't')
+			case c < ' ':
+				buf = append(buf, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+			default:
+				buf = append(buf, c)
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			buf = append(buf, `\ufffd`...)
+		} else {
+			buf = append(buf, s[i:i+size]...)
+		}
+		i += size
+	}
+	return append(buf, '"')
+}
@@ -0,0 +1,308 @@
+// Package logging writes leveled records with key/value fields as text or JSON lines.
+//
+// Loggers made by With share level, output and sampling of the logger made by New,
+// level is kept in LevelVar, so it may be changed while server is running
+package logging
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level severity of record, records below level of logger are skipped
+type Level int32
+
+const (
+	DEBUG Level = iota
+	INFO
+	WARN
+	ERROR
+)
+
+// Keys of fields of records of iproto server
+const (
+	KEY_COMPONENT   = "component"
+	KEY_REMOTE_ADDR = "remote_addr"
+	// KEY_SOURCE_ADDR address of client behind proxy from header of PROXY protocol
+	KEY_SOURCE_ADDR = "source_addr"
+	// KEY_CLIENT_ID id of client authenticated by proxy
+	KEY_CLIENT_ID   = "client_id"
+	KEY_FUNC_ID     = "func_id"
+	KEY_REQUEST_ID  = "request_id"
+	KEY_RETURN_CODE = "return_code"
+	KEY_DURATION    = "duration"
+	KEY_ERROR       = "error"
+	// KEY_SAMPLED number of records with the same message skipped by sampling before this one
+	KEY_SAMPLED = "sampled"
+)
+
+var levelNames = [...]string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+func (l Level) String() string {
+	if l >= DEBUG && l <= ERROR {
+		return levelNames[l]
+	}
+	return "LEVEL(" + strconv.Itoa(int(l)) + ")"
+}
+
+// ParseLevel returns Level by its name: debug, info, warn or error
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "debug":
+		return DEBUG, nil
+	case "info":
+		return INFO, nil
+	case "warn", "warning":
+		return WARN, nil
+	case "error":
+		return ERROR, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q: expected debug, info, warn or error", name)
+}
+
+// LevelVar level of loggers that may be changed at runtime, safe for concurrent use
+type LevelVar struct {
+	level atomic.Int32
+}
+
+// NewLevelVar initializes LevelVar with level
+func NewLevelVar(level Level) *LevelVar {
+	v := &LevelVar{}
+	v.Set(level)
+	return v
+}
+
+// Level returns current level
+func (v *LevelVar) Level() Level {
+	return Level(v.level.Load())
+}
+
+// Set changes level of all loggers sharing v
+func (v *LevelVar) Set(level Level) {
+	v.level.Store(int32(level))
+}
+
+// ServeHTTP returns current level on GET and sets level named in body of PUT or POST,
+// so level may be changed without restart of server
+func (v *LevelVar) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPut, http.MethodPost:
+		body, err := io.ReadAll(io.LimitReader(req.Body, 64))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		level, err := ParseLevel(string(body))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		v.Set(level)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = io.WriteString(w, v.Level().String()+"\n")
+}
+
+// Format encoding of records
+type Format int
+
+const (
+	// TEXT time, level, message and key=value fields separated by spaces
+	TEXT Format = iota
+	// JSON one JSON object per record with time, level, msg and fields as its members
+	JSON
+)
+
+// ParseFormat returns Format by its name: text or json
+func ParseFormat(name string) (Format, error) {
+	switch name {
+	case "text":
+		return TEXT, nil
+	case "json":
+		return JSON, nil
+	}
+	return 0, fmt.Errorf("unknown log format %q: expected text or json", name)
+}
+
+// Logger writes records of message and fields given as alternating keys and values,
+// e.g. logger.Warn("decode error", KEY_REMOTE_ADDR, addr, KEY_ERROR, err).
+// Implementations are safe for concurrent use
+type Logger interface {
+	Debug(msg string, kv ...interface{})
+	Info(msg string, kv ...interface{})
+	Warn(msg string, kv ...interface{})
+	Error(msg string, kv ...interface{})
+
+	// With returns logger adding fields kv to every record
+	With(kv ...interface{}) Logger
+
+	// Enabled reports whether records of level are written, so costly fields may be skipped
+	Enabled(level Level) bool
+}
+
+// Option configures optional behaviour of logger made by New
+type Option func(s *sink)
+
+// WithFormat sets encoding of records, TEXT by default
+func WithFormat(format Format) Option {
+	return func(s *sink) {
+		s.format = format
+	}
+}
+
+// WithLevel makes logger skip records below level kept in v, INFO by default
+func WithLevel(v *LevelVar) Option {
+	return func(s *sink) {
+		s.level = v
+	}
+}
+
+// WithSampling makes logger write only first records of DEBUG and INFO level with the same message
+// every interval and then every thereafter-th of them, the next written record counts skipped ones.
+// Warnings and errors are never sampled, first <= 0 disables sampling
+func WithSampling(first int, thereafter int, interval time.Duration) Option {
+	return func(s *sink) {
+		if first <= 0 || interval <= 0 {
+			s.sampler = nil
+			return
+		}
+		s.sampler = newSampler(first, thereafter, interval)
+	}
+}
+
+// WithClock sets source of time of records, time.Now by default
+func WithClock(now func() time.Time) Option {
+	return func(s *sink) {
+		s.now = now
+	}
+}
+
+// New initializes Logger writing records to w
+func New(w io.Writer, opts ...Option) Logger {
+	s := &sink{w: w, level: NewLevelVar(INFO), now: time.Now}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return &logger{sink: s}
+}
+
+// Nop returns Logger skipping all records
+func Nop() Logger {
+	return nopLogger{}
+}
+
+// Fatal writes record of ERROR level and exits with status 1 like log.Fatal
+func Fatal(logger Logger, msg string, kv ...interface{}) {
+	logger.Error(msg, kv...)
+	os.Exit(1)
+}
+
+// sink output shared by logger and loggers made from it by With
+type sink struct {
+	mutex   sync.Mutex
+	w       io.Writer
+	format  Format
+	level   *LevelVar
+	sampler *sampler
+	now     func() time.Time
+	buf     []byte
+}
+
+// logger Logger with fields added by With
+type logger struct {
+	sink   *sink
+	fields []interface{}
+}
+
+func (l *logger) Debug(msg string, kv ...interface{}) {
+	l.log(DEBUG, msg, kv)
+}
+
+func (l *logger) Info(msg string, kv ...interface{}) {
+	l.log(INFO, msg, kv)
+}
+
+func (l *logger) Warn(msg string, kv ...interface{}) {
+	l.log(WARN, msg, kv)
+}
+
+func (l *logger) Error(msg string, kv ...interface{}) {
+	l.log(ERROR, msg, kv)
+}
+
+func (l *logger) With(kv ...interface{}) Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv)+1)
+	fields = appendPairs(append(fields, l.fields...), kv)
+	return &logger{sink: l.sink, fields: fields}
+}
+
+func (l *logger) Enabled(level Level) bool {
+	return level >= l.sink.level.Level()
+}
+
+// log writes record unless it's below level or skipped by sampling
+func (l *logger) log(level Level, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	s := l.sink
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := s.now()
+	var skipped uint64
+	if s.sampler != nil && level < WARN {
+		var ok bool
+		if ok, skipped = s.sampler.allow(msg, now); !ok {
+			return
+		}
+	}
+	fields := appendPairs(append(make([]interface{}, 0, len(l.fields)+len(kv)+3), l.fields...), kv)
+	if skipped > 0 {
+		fields = append(fields, KEY_SAMPLED, skipped)
+	}
+	if s.format == JSON {
+		s.buf = appendJSON(s.buf[:0], now, level, msg, fields)
+	} else {
+		s.buf = appendText(s.buf[:0], now, level, msg, fields)
+	}
+	_, _ = s.w.Write(s.buf)
+}
+
+// appendPairs appends kv to fields as pairs of string key and value,
+// value of odd key is missing and keys of other types are formatted
+func appendPairs(fields []interface{}, kv []interface{}) []interface{} {
+	for i := 0; i < len(kv); i += 2 {
+		key, ok := kv[i].(string)
+		if !ok {
+			key = fmt.Sprint(kv[i])
+		}
+		var value interface{} = "(MISSING)"
+		if i+1 < len(kv) {
+			value = kv[i+1]
+		}
+		fields = append(fields, key, value)
+	}
+	return fields
+}
+
+// nopLogger Logger made by Nop
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+func (n nopLogger) With(...interface{}) Logger { return n }
+func (nopLogger) Enabled(Level) bool           { return false }
@@ -0,0 +1,209 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testTime = time.Date(2024, 3, 1, 12, 30, 45, 123456789, time.UTC)
+
+// newTestLogger makes logger writing records of testTime to buf
+func newTestLogger(buf *bytes.Buffer, opts ...Option) Logger {
+	return New(buf, append([]Option{WithClock(func() time.Time { return testTime })}, opts...)...)
+}
+
+type FormatTestCase struct {
+	Format Format
+	Log    func(logger Logger)
+	Output string
+}
+
+func TestLogger_Format(t *testing.T) {
+	cases := []FormatTestCase{
+		{
+			Format: TEXT,
+			Log: func(logger Logger) {
+				logger.Info("server starts to serve", "addr", ":8080")
+			},
+			Output: "2024-03-01T12:30:45.123Z INFO \"server starts to serve\" addr=:8080\n",
+		},
+		{
+			Format: TEXT,
+			Log: func(logger Logger) {
+				logger.With(KEY_COMPONENT, "server", KEY_REMOTE_ADDR, "127.0.0.1:5000").
+					Warn("decode", KEY_FUNC_ID, "0x00020001", KEY_REQUEST_ID, uint32(7),
+						KEY_ERROR, errors.New("bad body"), KEY_DURATION, 1500*time.Microsecond)
+			},
+			Output: "2024-03-01T12:30:45.123Z WARN decode component=server remote_addr=127.0.0.1:5000 " +
+				"func_id=0x00020001 request_id=7 error=\"bad body\" duration=1.5ms\n",
+		},
+		{
+			Format: TEXT,
+			Log: func(logger Logger) {
+				logger.Error("odd", "empty", "", "quote", "a=\"b\"", 42, true, "key")
+			},
+			Output: "2024-03-01T12:30:45.123Z ERROR odd empty=\"\" quote=\"a=\\\"b\\\"\" 42=true key=(MISSING)\n",
+		},
+		{
+			Format: JSON,
+			Log: func(logger Logger) {
+				logger.With(KEY_COMPONENT, "server").Info("request handled", KEY_REQUEST_ID, uint32(7),
+					KEY_RETURN_CODE, uint32(0), KEY_DURATION, time.Millisecond, "ok", true, "ratio", 0.5)
+			},
+			Output: `{"time":"2024-03-01T12:30:45.123Z","level":"INFO","msg":"request handled","component":"server",` +
+				`"request_id":7,"return_code":0,"duration":"1ms","ok":true,"ratio":0.5}` + "\n",
+		},
+		{
+			Format: JSON,
+			Log: func(logger Logger) {
+				logger.Warn("line\n\"quoted\"", KEY_ERROR, errors.New("tab\there"), "bad", "\xff\x01", "list", []int{1, 2}, "nil", nil)
+			},
+			Output: `{"time":"2024-03-01T12:30:45.123Z","level":"WARN","msg":"line\n\"quoted\"","error":"tab\there",` +
+				`"bad":"\ufffd\u0001","list":[1,2],"nil":null}` + "\n",
+		},
+	}
+	for caseNum, item := range cases {
+		var buf bytes.Buffer
+		item.Log(newTestLogger(&buf, WithFormat(item.Format)))
+		if buf.String() != item.Output {
+			t.Errorf("[%d] wrong results: got %q, expected %q", caseNum, buf.String(), item.Output)
+		}
+		if item.Format == JSON && !json.Valid(buf.Bytes()) {
+			t.Errorf("[%d] invalid JSON: %q", caseNum, buf.String())
+		}
+	}
+}
+
+func TestLogger_Level(t *testing.T) {
+	var buf bytes.Buffer
+	level := NewLevelVar(WARN)
+	logger := newTestLogger(&buf, WithLevel(level)).With(KEY_COMPONENT, "server")
+	logger.Debug("debug")
+	logger.Info("info")
+	logger.Warn("warn")
+	if logger.Enabled(INFO) || !logger.Enabled(ERROR) {
+		t.Errorf("wrong results: INFO enabled %v, ERROR enabled %v", logger.Enabled(INFO), logger.Enabled(ERROR))
+	}
+	// Level is changed for loggers made by With too
+	level.Set(DEBUG)
+	logger.Debug("debug")
+	expected := "2024-03-01T12:30:45.123Z WARN warn component=server\n" +
+		"2024-03-01T12:30:45.123Z DEBUG debug component=server\n"
+	if buf.String() != expected {
+		t.Errorf("wrong results: got %q, expected %q", buf.String(), expected)
+	}
+}
+
+type SamplingTestCase struct {
+	Level   Level
+	Records int
+	Written int
+	Sampled string
+}
+
+func TestLogger_Sampling(t *testing.T) {
+	cases := []SamplingTestCase{
+		// first 3 records, then every 5th of the next ones
+		{Level: INFO, Records: 20, Written: 6, Sampled: "sampled=4"},
+		{Level: DEBUG, Records: 3, Written: 3},
+		// warnings and errors are never sampled
+		{Level: WARN, Records: 20, Written: 20},
+		{Level: ERROR, Records: 20, Written: 20},
+	}
+	for caseNum, item := range cases {
+		var buf bytes.Buffer
+		now := testTime
+		logger := New(&buf, WithLevel(NewLevelVar(DEBUG)), WithSampling(3, 5, time.Second),
+			WithClock(func() time.Time { return now }))
+		logFn := map[Level]func(string, ...interface{}){DEBUG: logger.Debug, INFO: logger.Info, WARN: logger.Warn, ERROR: logger.Error}[item.Level]
+		for i := 0; i < item.Records; i++ {
+			logFn("handler finished")
+			logFn("other message")
+		}
+		written := strings.Count(buf.String(), "handler finished")
+		if written != item.Written || strings.Count(buf.String(), "other message") != item.Written {
+			t.Errorf("[%d] wrong results: got %d records, expected %d", caseNum, written, item.Written)
+		}
+		if item.Sampled != "" && !strings.Contains(buf.String(), item.Sampled) {
+			t.Errorf("[%d] wrong results: %q not found in %q", caseNum, item.Sampled, buf.String())
+		}
+	}
+
+	// Counting starts over every interval and skipped records are reported by the next written one
+	var buf bytes.Buffer
+	now := testTime
+	logger := New(&buf, WithSampling(1, 0, time.Second), WithClock(func() time.Time { return now }))
+	for i := 0; i < 5; i++ {
+		logger.Info("handler finished")
+	}
+	now = now.Add(time.Second)
+	logger.Info("handler finished")
+	expected := "2024-03-01T12:30:45.123Z INFO \"handler finished\"\n" +
+		"2024-03-01T12:30:46.123Z INFO \"handler finished\" sampled=4\n"
+	if buf.String() != expected {
+		t.Errorf("wrong results: got %q, expected %q", buf.String(), expected)
+	}
+}
+
+type ParseLevelTestCase struct {
+	Name    string
+	Level   Level
+	IsError bool
+}
+
+func TestParseLevel(t *testing.T) {
+	cases := []ParseLevelTestCase{
+		{Name: "debug", Level: DEBUG},
+		{Name: "INFO", Level: INFO},
+		{Name: "warning", Level: WARN},
+		{Name: "error\n", Level: ERROR},
+		{Name: "fatal", IsError: true},
+	}
+	for caseNum, item := range cases {
+		level, err := ParseLevel(item.Name)
+		if (err != nil) != item.IsError || level != item.Level {
+			t.Errorf("[%d] wrong results: got %v, %v, expected %v", caseNum, level, err, item.Level)
+		}
+	}
+}
+
+type LevelHTTPTestCase struct {
+	Method string
+	Body   string
+	Code   int
+	Level  Level
+}
+
+func TestLevelVar_ServeHTTP(t *testing.T) {
+	cases := []LevelHTTPTestCase{
+		{Method: "GET", Code: 200, Level: INFO},
+		{Method: "PUT", Body: "debug", Code: 200, Level: DEBUG},
+		{Method: "POST", Body: "verbose", Code: 400, Level: DEBUG},
+		{Method: "DELETE", Code: 405, Level: DEBUG},
+		{Method: "POST", Body: "warn\n", Code: 200, Level: WARN},
+	}
+	level := NewLevelVar(INFO)
+	for caseNum, item := range cases {
+		recorder := httptest.NewRecorder()
+		level.ServeHTTP(recorder, httptest.NewRequest(item.Method, "/log/level", strings.NewReader(item.Body)))
+		if recorder.Code != item.Code || level.Level() != item.Level {
+			t.Errorf("[%d] wrong results: got %d %v, expected %d %v", caseNum, recorder.Code, level.Level(), item.Code, item.Level)
+		}
+		if item.Code == 200 && recorder.Body.String() != item.Level.String()+"\n" {
+			t.Errorf("[%d] wrong results: got body %q, expected %q", caseNum, recorder.Body.String(), item.Level.String()+"\n")
+		}
+	}
+}
+
+func TestNop(t *testing.T) {
+	logger := Nop().With(KEY_COMPONENT, "server")
+	logger.Error("error")
+	if logger.Enabled(ERROR) {
+		t.Errorf("wrong results: Nop logger is enabled")
+	}
+}
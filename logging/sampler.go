@@ -0,0 +1,60 @@
+package logging
+
+import "time"
+
+// MAX_SAMPLED_MESSAGES number of messages counted by sampler,
+// counters are reset when messages made at runtime exceed it
+const MAX_SAMPLED_MESSAGES = 1024
+
+// sampler passes first records with the same message every interval and then every thereafter-th of them
+type sampler struct {
+	first      uint64
+	thereafter uint64
+	interval   time.Duration
+	counters   map[string]*sampleCounter
+}
+
+// sampleCounter records with one message in current interval
+type sampleCounter struct {
+	window  int64
+	count   uint64
+	skipped uint64
+}
+
+func newSampler(first int, thereafter int, interval time.Duration) *sampler {
+	if thereafter < 0 {
+		thereafter = 0
+	}
+	return &sampler{
+		first:      uint64(first),
+		thereafter: uint64(thereafter),
+		interval:   interval,
+		counters:   make(map[string]*sampleCounter),
+	}
+}
+
+// allow reports whether record with msg is written and how many of them were skipped before it.
+// Zero thereafter skips all records after first ones until the next interval
+func (s *sampler) allow(msg string, now time.Time) (bool, uint64) {
+	window := now.UnixNano() / int64(s.interval)
+	c, exist := s.counters[msg]
+	if !exist {
+		if len(s.counters) >= MAX_SAMPLED_MESSAGES {
+			s.counters = make(map[string]*sampleCounter)
+		}
+		c = &sampleCounter{window: window}
+		s.counters[msg] = c
+	}
+	if c.window != window {
+		c.window = window
+		c.count = 0
+	}
+	c.count++
+	if c.count <= s.first || s.thereafter > 0 && (c.count-s.first)%s.thereafter == 0 {
+		skipped := c.skipped
+		c.skipped = 0
+		return true, skipped
+	}
+	c.skipped++
+	return false, 0
+}
@@ -0,0 +1,112 @@
+// Package metrics collects metrics of iproto server through observer hooks of packages server, api and rate_limiter
+// with Prometheus client library and exposes them in Prometheus text format
+package metrics
+
+import (
+	"fmt"
+	"github.com/Bambelbl/iproto-server/api"
+	"github.com/Bambelbl/iproto-server/server"
+	"github.com/Bambelbl/iproto-server/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// UNKNOWN_FUNC_ID func_id label of requests to functions that are not registered,
+// so clients can't make labels of their own
+const UNKNOWN_FUNC_ID = "unknown"
+
+// DURATION_BUCKETS upper bounds of buckets of request latency in seconds
+var DURATION_BUCKETS = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// Metrics metrics of iproto server, it's server.Observer of the server and handler of /metrics endpoint
+type Metrics struct {
+	registry      *prometheus.Registry
+	handler       http.Handler
+	requests      *prometheus.CounterVec
+	duration      *prometheus.HistogramVec
+	connections   prometheus.Gauge
+	queueLength   prometheus.Gauge
+	queueCapacity prometheus.Gauge
+	rateLimited   prometheus.Counter
+	decodeErrors  prometheus.Counter
+	stateChanges  *prometheus.CounterVec
+}
+
+var _ server.Observer = (*Metrics)(nil)
+
+// New registers metrics of iproto server in new prometheus.Registry
+func New() *Metrics {
+	r := prometheus.NewRegistry()
+	m := &Metrics{
+		registry: r,
+		handler:  promhttp.HandlerFor(r, promhttp.HandlerOpts{}),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "iproto_requests_total",
+			Help: "Number of handled requests by func_id and return code."}, []string{"func_id", "return_code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "iproto_request_duration_seconds",
+			Help:    "Time of handling of requests by func_id and return code.",
+			Buckets: DURATION_BUCKETS}, []string{"func_id", "return_code"}),
+		connections: prometheus.NewGauge(prometheus.GaugeOpts{Name: "iproto_connections_active",
+			Help: "Number of open connections of clients."}),
+		queueLength: prometheus.NewGauge(prometheus.GaugeOpts{Name: "iproto_clients_queue_length",
+			Help: "Number of clients holding places in queue of clients."}),
+		queueCapacity: prometheus.NewGauge(prometheus.GaugeOpts{Name: "iproto_clients_queue_capacity",
+			Help: "Max number of clients served at once."}),
+		rateLimited: prometheus.NewCounter(prometheus.CounterOpts{Name: "iproto_rate_limited_total",
+			Help: "Number of requests rejected by rate limiter."}),
+		decodeErrors: prometheus.NewCounter(prometheus.CounterOpts{Name: "iproto_decode_errors_total",
+			Help: "Number of requests that can't be decoded."}),
+		stateChanges: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "iproto_storage_state_changes_total",
+			Help: "Number of switches of storage by new state."}, []string{"state"}),
+	}
+	r.MustRegister(m.requests, m.duration, m.connections, m.queueLength, m.queueCapacity, m.rateLimited,
+		m.decodeErrors, m.stateChanges)
+	return m
+}
+
+// Registry returns registry of metrics, own collectors may be registered in it
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
+// ServeHTTP writes metrics in Prometheus text format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	m.handler.ServeHTTP(w, req)
+}
+
+func (m *Metrics) ObserveRequest(function api.Function, returnCode uint32, duration time.Duration) {
+	funcID := UNKNOWN_FUNC_ID
+	if function.Name != "" {
+		funcID = fmt.Sprintf("0x%08x", function.Func_id)
+	}
+	code := strconv.FormatUint(uint64(returnCode), 10)
+	m.requests.WithLabelValues(funcID, code).Inc()
+	m.duration.WithLabelValues(funcID, code).Observe(duration.Seconds())
+}
+
+func (m *Metrics) ConnectionOpened() {
+	m.connections.Inc()
+}
+
+func (m *Metrics) ConnectionClosed() {
+	m.connections.Dec()
+}
+
+func (m *Metrics) QueueLength(length int, capacity int) {
+	m.queueLength.Set(float64(length))
+	m.queueCapacity.Set(float64(capacity))
+}
+
+func (m *Metrics) DecodeError() {
+	m.decodeErrors.Inc()
+}
+
+func (m *Metrics) RateLimited() {
+	m.rateLimited.Inc()
+}
+
+func (m *Metrics) StateChanged(state int) {
+	m.stateChanges.WithLabelValues(storage.StateName(state)).Inc()
+}
@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"context"
+	"github.com/Bambelbl/iproto-server/client"
+	"github.com/Bambelbl/iproto-server/logging"
+	"github.com/Bambelbl/iproto-server/server"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	m := New()
+	// Three requests per second pass rate limiter
+	iprotoServer := server.NewIprotoServer("127.0.0.1:0", logging.Nop(), 10, 1000, 3,
+		server.WithObserver(m))
+	iprotoServer.Serve()
+	c := client.NewClient(iprotoServer.Addr().String(), client.WithPoolSize(1))
+	ctx := context.Background()
+
+	// Limit of client is restored fully after a second without requests
+	nextSecond := func() {
+		time.Sleep(time.Second)
+	}
+	_ = c.Replace(ctx, 1, "one")
+	_, _ = c.Read(ctx, 1000)
+	_, _ = c.Read(ctx, 1)
+	_, _ = c.Read(ctx, 1)
+	nextSecond()
+	_ = c.SwitchReadOnly(ctx)
+	_, _ = c.Call(ctx, 0x00020002, []byte{0xa1, 'x'})
+	_, _ = c.Call(ctx, 0x00030001, nil)
+	nextSecond()
+	// Body too long for STORAGE_REPLACE is rejected by decoder
+	_, _ = c.Call(ctx, 0x00020001, make([]byte, 1000))
+	_ = c.Close()
+	if err := iprotoServer.Stop(); err != nil {
+		t.Fatalf("server stop error: %v", err)
+	}
+
+	recorder := httptest.NewRecorder()
+	m.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	output := recorder.Body.String()
+	expected := []string{
+		"iproto_requests_total{func_id=\"0x00020001\",return_code=\"0\"} 1\n",
+		"iproto_requests_total{func_id=\"0x00020002\",return_code=\"416\"} 1\n",
+		"iproto_requests_total{func_id=\"0x00020002\",return_code=\"401\"} 1\n",
+		"iproto_requests_total{func_id=\"0x00020002\",return_code=\"402\"} 1\n",
+		"iproto_requests_total{func_id=\"0x00020001\",return_code=\"401\"} 1\n",
+		"iproto_requests_total{func_id=\"0x00010001\",return_code=\"0\"} 1\n",
+		"iproto_requests_total{func_id=\"unknown\",return_code=\"404\"} 1\n",
+		"iproto_request_duration_seconds_count{func_id=\"0x00020001\",return_code=\"0\"} 1\n",
+		"iproto_connections_active 0\n",
+		"iproto_clients_queue_length 0\n",
+		"iproto_clients_queue_capacity 10\n",
+		"iproto_rate_limited_total 1\n",
+		"iproto_decode_errors_total 1\n",
+		"iproto_storage_state_changes_total{state=\"READ_ONLY\"} 1\n",
+	}
+	for caseNum, item := range expected {
+		if !strings.Contains(output, item) {
+			t.Errorf("[%d] wrong results: %q not found in\n%s", caseNum, item, output)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package request_packet
+
+import (
+	"errors"
+	"fmt"
+	"github.com/vmihailenco/msgpack/codes"
+	"io"
+	"math"
+)
+
+const (
+	HEADER_SIZE = 12
+	// MAX_VALUE_SIZE default max length of string value in bytes
+	MAX_VALUE_SIZE = 256
+	// VALUE_OVERHEAD max length of msgpack body besides string value: array, index and string headers
+	VALUE_OVERHEAD = 1 + 9 + 5
+	// MAX_BODY_LENGTH upper bound of body lengths computed from value size, low enough to add slack to it in uint32
+	MAX_BODY_LENGTH = math.MaxInt32
+	// MAX_BODY_VALUES max number of string values in body, e.g. expected and new value of STORAGE_CAS
+	MAX_BODY_VALUES = 2
+	// MAX_BATCH_SIZE max number of items in body of batch function
+	MAX_BATCH_SIZE = 100
+	// TRACE_EXT_TYPE msgpack extension type of trace context prefixed to body
+	TRACE_EXT_TYPE = 0x54
+	// TRACE_CONTEXT_SIZE length of trace context: trace id, span id and trace flags
+	TRACE_CONTEXT_SIZE = 16 + 8 + 1
+	// TRACE_EXT_SIZE length of extension holding trace context: ext 8 code, length, type and the context
+	TRACE_EXT_SIZE = 3 + TRACE_CONTEXT_SIZE
+)
+
+var (
+	// ErrTruncatedFrame the stream ended in the middle of a frame
+	ErrTruncatedFrame = errors.New("truncated frame")
+	// ErrFrameTooLarge body_length of the frame exceeds the limit, the body is left unread
+	ErrFrameTooLarge = errors.New("frame is too large")
+	// ErrMalformedBody the frame was read completely, but its body is not acceptable
+	ErrMalformedBody = errors.New("malformed body")
+)
+
+// Decoder reads request packets one by one from a stream
+type Decoder struct {
+	reader        io.Reader
+	maxBodyLength uint32
+	maxValueSize  int
+	legacyBody    bool
+	batch         map[uint32]bool
+	header        [HEADER_SIZE]byte
+}
+
+// MaxBodyLength returns max length of body holding index and MAX_BODY_VALUES strings of maxValueSize bytes
+func MaxBodyLength(maxValueSize int) uint32 {
+	return bodyLength(MAX_BODY_VALUES, maxValueSize)
+}
+
+// bodyLength returns max length of body holding values strings of maxValueSize bytes with their indexes,
+// computed in uint64 and clamped to MAX_BODY_LENGTH, so huge value sizes don't wrap around to small limits
+func bodyLength(values, maxValueSize int) uint32 {
+	length := uint64(values) * (uint64(maxValueSize) + VALUE_OVERHEAD)
+	if length > MAX_BODY_LENGTH {
+		return MAX_BODY_LENGTH
+	}
+	return uint32(length)
+}
+
+// MaxBatchBodyLength returns max length of body holding MAX_BATCH_SIZE indexes and strings of maxValueSize bytes
+func MaxBatchBodyLength(maxValueSize int) uint32 {
+	return bodyLength(MAX_BATCH_SIZE, maxValueSize)
+}
+
+// NewDecoder initializes Decoder that reads from reader and rejects bodies longer than maxBodyLength
+func NewDecoder(reader io.Reader, maxBodyLength uint32) *Decoder {
+	return &Decoder{
+		reader:        reader,
+		maxBodyLength: maxBodyLength,
+		maxValueSize:  MAX_VALUE_SIZE,
+	}
+}
+
+// LimitValueSize makes Decoder reject with ErrMalformedBody bodies that can't hold
+// string value of size bytes, MAX_VALUE_SIZE by default
+func (d *Decoder) LimitValueSize(size int) *Decoder {
+	d.maxValueSize = size
+	return d
+}
+
+// AllowBatch makes Decoder accept bodies of functions func_ids up to MaxBatchBodyLength
+func (d *Decoder) AllowBatch(func_ids ...uint32) *Decoder {
+	if d.batch == nil {
+		d.batch = make(map[uint32]bool, len(func_ids))
+	}
+	for _, func_id := range func_ids {
+		d.batch[func_id] = true
+	}
+	return d
+}
+
+// UseLegacyBody makes Decoder expect bodies in legacy encoding: msgpack bin
+// holding little-endian uint32 index followed by raw bytes of string
+func (d *Decoder) UseLegacyBody(flag bool) *Decoder {
+	d.legacyBody = flag
+	return d
+}
+
+// Decode reads exactly one frame from the stream and decodes it to IprotoPacketRequest.
+// Body is left msgpack-encoded, its values are decoded by the handler of Func_id.
+// It returns io.EOF if the stream ended between frames. Header of the packet is filled
+// whenever it was read completely, so the caller can answer to broken requests.
+// After ErrMalformedBody the stream stays in sync and decoding may go on,
+// after any other error the rest of the stream must not be trusted
+func (d *Decoder) Decode() (packet IprotoPacketRequest, err error) {
+	if _, err = io.ReadFull(d.reader, d.header[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			err = fmt.Errorf("%w: header: %s", ErrTruncatedFrame, err.Error())
+		}
+		return
+	}
+	packet.Header = bytes2Header(d.header[:])
+	if packet.Header.Body_length > d.maxBodyLength {
+		err = fmt.Errorf("%w: body length %d exceeds %d", ErrFrameTooLarge,
+			packet.Header.Body_length, d.maxBodyLength)
+		return
+	}
+	data := make([]byte, packet.Header.Body_length)
+	if _, err = io.ReadFull(d.reader, data); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			err = fmt.Errorf("%w: body: %s", ErrTruncatedFrame, err.Error())
+		}
+		return
+	}
+	data, packet.Trace = splitTrace(data)
+	maxBodyLength := MaxBodyLength(d.maxValueSize)
+	if d.batch[packet.Header.Func_id] {
+		maxBodyLength = MaxBatchBodyLength(d.maxValueSize)
+	}
+	packet.Body, err = bytes2Body(packet.Header.Func_id, data, d.legacyBody, maxBodyLength, d.maxValueSize)
+	if err != nil {
+		err = fmt.Errorf("%w: %s", ErrMalformedBody, err.Error())
+	}
+	return
+}
+
+// splitTrace cuts extension holding trace context off the body if the body starts with it
+func splitTrace(data []byte) (body []byte, trace []byte) {
+	if len(data) >= TRACE_EXT_SIZE && codes.Code(data[0]) == codes.Ext8 && data[1] == TRACE_CONTEXT_SIZE && data[2] == TRACE_EXT_TYPE {
+		return data[TRACE_EXT_SIZE:], data[3:TRACE_EXT_SIZE]
+	}
+	return data, nil
+}
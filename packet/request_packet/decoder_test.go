@@ -0,0 +1,218 @@
+package request_packet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+	"testing/iotest"
+)
+
+type DecoderTestCase struct {
+	Input   []byte
+	Packets []IprotoPacketRequest
+	Err     error
+}
+
+// frame builds request frame from header fields and raw body
+func frame(funcID uint32, requestID uint32, body []byte) []byte {
+	data := make([]byte, HEADER_SIZE, HEADER_SIZE+len(body))
+	binary.LittleEndian.PutUint32(data[:4], funcID)
+	binary.LittleEndian.PutUint32(data[4:8], uint32(len(body)))
+	binary.LittleEndian.PutUint32(data[8:12], requestID)
+	return append(data, body...)
+}
+
+func TestDecoder_Decode(t *testing.T) {
+	// msgpack fixint 7 and fixstr "abc"
+	replaceBody := []byte{0x07, 0xa3, 'a', 'b', 'c'}
+	readBody := []byte{0x07}
+	longBody := bytes.Repeat([]byte{0xc0}, int(MaxBodyLength(MAX_VALUE_SIZE))+1)
+	oversized := frame(0x00020001, 3, nil)
+	binary.LittleEndian.PutUint32(oversized[4:8], 1<<31)
+	trace := bytes.Repeat([]byte{0x01}, TRACE_CONTEXT_SIZE)
+	tracedBody := append([]byte{0xc7, TRACE_CONTEXT_SIZE, TRACE_EXT_TYPE}, trace...)
+
+	cases := []DecoderTestCase{
+		{
+			Input: append(frame(0x00010001, 1, nil), frame(0x00020001, 2, replaceBody)...),
+			Packets: []IprotoPacketRequest{
+				{Header: IprotoHeader{Func_id: 0x00010001, Request_id: 1}, Body: []byte{}},
+				{Header: IprotoHeader{Func_id: 0x00020001, Body_length: 5, Request_id: 2}, Body: replaceBody},
+			},
+			Err: io.EOF,
+		},
+		{
+			Input:   frame(0x00020002, 1, readBody)[:5],
+			Packets: []IprotoPacketRequest{},
+			Err:     ErrTruncatedFrame,
+		},
+		{
+			Input: frame(0x00020001, 1, replaceBody)[:15],
+			Packets: []IprotoPacketRequest{
+				{Header: IprotoHeader{Func_id: 0x00020001, Body_length: 5, Request_id: 1}},
+			},
+			Err: ErrTruncatedFrame,
+		},
+		{
+			Input: oversized,
+			Packets: []IprotoPacketRequest{
+				{Header: IprotoHeader{Func_id: 0x00020001, Body_length: 1 << 31, Request_id: 3}},
+			},
+			Err: ErrFrameTooLarge,
+		},
+		{
+			Input: append(frame(0x00020001, 4, longBody), frame(0x00020002, 5, readBody)...),
+			Packets: []IprotoPacketRequest{
+				{Header: IprotoHeader{Func_id: 0x00020001, Body_length: MaxBodyLength(MAX_VALUE_SIZE) + 1, Request_id: 4}},
+			},
+			Err: ErrMalformedBody,
+		},
+		{
+			Input: frame(0x00020002, 6, append(tracedBody, readBody...)),
+			Packets: []IprotoPacketRequest{
+				{Header: IprotoHeader{Func_id: 0x00020002, Body_length: TRACE_EXT_SIZE + 1, Request_id: 6}, Body: readBody, Trace: trace},
+			},
+			Err: io.EOF,
+		},
+	}
+	readers := map[string]func(io.Reader) io.Reader{
+		"whole":    func(r io.Reader) io.Reader { return r },
+		"one byte": iotest.OneByteReader,
+		"half":     iotest.HalfReader,
+	}
+	for name, wrap := range readers {
+		for caseNum, item := range cases {
+			decoder := NewDecoder(wrap(bytes.NewReader(item.Input)), MaxBodyLength(MAX_VALUE_SIZE)+64)
+			var err error
+			for packetNum := 0; err == nil; packetNum++ {
+				var packet IprotoPacketRequest
+				packet, err = decoder.Decode()
+				if packetNum < len(item.Packets) && !reflect.DeepEqual(packet, item.Packets[packetNum]) {
+					t.Errorf("[%s %d.%d] wrong results: got %+v, expected %+v",
+						name, caseNum, packetNum, packet, item.Packets[packetNum])
+				}
+			}
+			if !errors.Is(err, item.Err) {
+				t.Errorf("[%s %d] wrong error: got %v, expected %v", name, caseNum, err, item.Err)
+			}
+		}
+	}
+}
+
+func TestDecoder_DecodeAfterMalformedBody(t *testing.T) {
+	input := append(frame(0x00020002, 1, bytes.Repeat([]byte{0xc0}, int(MaxBodyLength(MAX_VALUE_SIZE))+1)), frame(0x00020002, 2, []byte{0x09})...)
+	decoder := NewDecoder(bytes.NewReader(input), MaxBodyLength(MAX_VALUE_SIZE)+64)
+	if _, err := decoder.Decode(); !errors.Is(err, ErrMalformedBody) {
+		t.Fatalf("expected malformed body error, got %v", err)
+	}
+	packet, err := decoder.Decode()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if packet.Header.Request_id != 2 || !bytes.Equal(packet.Body, []byte{0x09}) {
+		t.Errorf("wrong results: got %+v", packet)
+	}
+}
+
+type LegacyTestCase struct {
+	Func_id uint32
+	Data    []byte
+	Body    []byte
+	IsError bool
+}
+
+func TestDecoder_UseLegacyBody(t *testing.T) {
+	cases := []LegacyTestCase{
+		{Func_id: 0x00020001, Data: []byte{0xc4, 7, 7, 0, 0, 0, 'a', 'b', 'c'}, Body: mustMarshalValues(7, "abc")},
+		{Func_id: 0x00020002, Data: []byte{0xc4, 4, 7, 0, 0, 0}, Body: mustMarshalValues(7)},
+		{Func_id: 0x00010001, Data: []byte{}, Body: []byte{}},
+		{Func_id: 0x00020002, Data: []byte{0xc4, 2, 7, 0}, IsError: true},
+		{Func_id: 0x00020002, Data: []byte{0x07}, IsError: true},
+	}
+	for caseNum, item := range cases {
+		decoder := NewDecoder(bytes.NewReader(frame(item.Func_id, 1, item.Data)), 300).UseLegacyBody(true)
+		packet, err := decoder.Decode()
+
+		if item.IsError && !errors.Is(err, ErrMalformedBody) {
+			t.Errorf("[%d] expected malformed body error, got %v", caseNum, err)
+		}
+
+		if !item.IsError && err != nil {
+			t.Errorf("[%d] unexpected error: %v", caseNum, err)
+		}
+
+		if err == nil && !reflect.DeepEqual(packet.Body, item.Body) {
+			t.Errorf("[%d] wrong results: got %+v, expected %+v",
+				caseNum, packet.Body, item.Body)
+		}
+	}
+}
+
+func FuzzDecoder_Decode(f *testing.F) {
+	f.Add(frame(0x00020001, 1, []byte{0x07, 0xa3, 'a', 'b', 'c'}))
+	f.Add(frame(0x00020002, 1, []byte{0xc4, 4, 7, 0, 0, 0}))
+	f.Add(frame(0x00010001, 1, nil))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, legacy := range []bool{false, true} {
+			decoder := NewDecoder(bytes.NewReader(data), 300).UseLegacyBody(legacy)
+			for {
+				if _, err := decoder.Decode(); err != nil && !errors.Is(err, ErrMalformedBody) {
+					break
+				}
+			}
+		}
+	})
+}
+
+func TestDecoder_LimitValueSize(t *testing.T) {
+	body := mustMarshalValues(999, string(bytes.Repeat([]byte{'x'}, 40)))
+	input := append(frame(0x00020001, 1, body), frame(0x00020001, 2, body)...)
+	decoder := NewDecoder(bytes.NewReader(input), 1024).LimitValueSize(40)
+	if _, err := decoder.Decode(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	decoder.LimitValueSize(1)
+	if _, err := decoder.Decode(); !errors.Is(err, ErrMalformedBody) {
+		t.Fatalf("wrong results: got %v, expected %v", err, ErrMalformedBody)
+	}
+}
+
+func TestMaxBodyLength(t *testing.T) {
+	cases := []struct {
+		MaxValueSize  int
+		Expected      uint32
+		ExpectedBatch uint32
+	}{
+		{MaxValueSize: MAX_VALUE_SIZE, Expected: MAX_BODY_VALUES * (MAX_VALUE_SIZE + VALUE_OVERHEAD),
+			ExpectedBatch: MAX_BATCH_SIZE * (MAX_VALUE_SIZE + VALUE_OVERHEAD)},
+		// Batch of values of 43 MB doesn't fit in uint32 anymore
+		{MaxValueSize: 43 << 20, Expected: MAX_BODY_VALUES * (43<<20 + VALUE_OVERHEAD), ExpectedBatch: MAX_BODY_LENGTH},
+		{MaxValueSize: MAX_BODY_LENGTH / MAX_BODY_VALUES, Expected: MAX_BODY_LENGTH, ExpectedBatch: MAX_BODY_LENGTH},
+		{MaxValueSize: MAX_BODY_LENGTH, Expected: MAX_BODY_LENGTH, ExpectedBatch: MAX_BODY_LENGTH},
+		{MaxValueSize: math.MaxUint32, Expected: MAX_BODY_LENGTH, ExpectedBatch: MAX_BODY_LENGTH},
+	}
+	for num, c := range cases {
+		if got := MaxBodyLength(c.MaxValueSize); got != c.Expected {
+			t.Errorf("[%d] wrong results: got %d, expected %d", num, got, c.Expected)
+		}
+		if got := MaxBatchBodyLength(c.MaxValueSize); got != c.ExpectedBatch {
+			t.Errorf("[%d] wrong results: got %d of batch, expected %d", num, got, c.ExpectedBatch)
+		}
+	}
+}
+
+func TestDecoder_AllowBatch(t *testing.T) {
+	body := bytes.Repeat([]byte{0xc0}, int(MaxBodyLength(MAX_VALUE_SIZE))+1)
+	input := append(frame(0x00020005, 1, body), frame(0x00020002, 2, body)...)
+	decoder := NewDecoder(bytes.NewReader(input), MaxBatchBodyLength(MAX_VALUE_SIZE)).AllowBatch(0x00020005)
+	if _, err := decoder.Decode(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := decoder.Decode(); !errors.Is(err, ErrMalformedBody) {
+		t.Fatalf("wrong results: got %v, expected %v", err, ErrMalformedBody)
+	}
+}
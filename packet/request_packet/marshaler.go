@@ -0,0 +1,29 @@
+package request_packet
+
+import (
+	"encoding/binary"
+	"github.com/vmihailenco/msgpack/codes"
+)
+
+// Header2Bytes from IprotoHeader to []byte of HEADER_SIZE length
+func Header2Bytes(header IprotoHeader) []byte {
+	res := make([]byte, HEADER_SIZE)
+	binary.LittleEndian.PutUint32(res[:4], header.Func_id)
+	binary.LittleEndian.PutUint32(res[4:8], header.Body_length)
+	binary.LittleEndian.PutUint32(res[8:12], header.Request_id)
+	return res
+}
+
+// Marshal from IprotoPacketRequest to []byte, Body_length is taken from length of Body
+// and extension holding Trace, if Trace is set
+func Marshal(packet IprotoPacketRequest) []byte {
+	var ext []byte
+	if len(packet.Trace) == TRACE_CONTEXT_SIZE {
+		ext = append([]byte{byte(codes.Ext8), TRACE_CONTEXT_SIZE, TRACE_EXT_TYPE}, packet.Trace...)
+	}
+	packet.Header.Body_length = uint32(len(ext) + len(packet.Body))
+	data := make([]byte, 0, HEADER_SIZE+len(ext)+len(packet.Body))
+	data = append(data, Header2Bytes(packet.Header)...)
+	data = append(data, ext...)
+	return append(data, packet.Body...)
+}
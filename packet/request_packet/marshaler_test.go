@@ -0,0 +1,39 @@
+package request_packet
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestMarshal(t *testing.T) {
+	cases := []IprotoPacketRequest{
+		{
+			Header: IprotoHeader{Func_id: 0x00020001, Body_length: 7, Request_id: 1},
+			Body:   mustMarshalValues(1, "one"),
+		},
+		{
+			Header: IprotoHeader{Func_id: 0x00010001, Request_id: 2},
+			Body:   []byte{},
+		},
+		{
+			Header: IprotoHeader{Func_id: 0x00020002, Request_id: 3},
+			Body:   mustMarshalValues(1),
+			Trace:  bytes.Repeat([]byte{0xab}, TRACE_CONTEXT_SIZE),
+		},
+	}
+	for caseNum, item := range cases {
+		packet, err := NewDecoder(bytes.NewReader(Marshal(item)), 300).Decode()
+		if err != nil {
+			t.Errorf("[%d] unexpected error: %v", caseNum, err)
+		}
+		item.Header.Body_length = uint32(len(item.Body))
+		if item.Trace != nil {
+			item.Header.Body_length += TRACE_EXT_SIZE
+		}
+		if !reflect.DeepEqual(packet, item) {
+			t.Errorf("[%d] wrong results: got %+v, expected %+v",
+				caseNum, packet, item)
+		}
+	}
+}
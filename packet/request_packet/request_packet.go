@@ -1,5 +1,6 @@
 package request_packet
 
+// IprotoBody body of STORAGE_REPLACE and STORAGE_READ requests in legacy encoding
 type IprotoBody struct {
 	Idx int
 	Str string
@@ -13,5 +14,9 @@ type IprotoHeader struct {
 
 type IprotoPacketRequest struct {
 	Header IprotoHeader
-	Body   IprotoBody
+	// Body msgpack-encoded body, its schema depends on Func_id
+	Body []byte
+	// Trace context of span of client, TRACE_CONTEXT_SIZE bytes or nil. It's sent as extension
+	// prefixed to the body: msgpack ext 8 of TRACE_EXT_TYPE, so bodies of all functions may carry it
+	Trace []byte
 }
@@ -1,9 +1,12 @@
 package request_packet
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"github.com/vmihailenco/msgpack"
+	"github.com/vmihailenco/msgpack/codes"
 )
 
 // bytes2FuncID from []byte to uint32
@@ -21,36 +24,109 @@ func bytes2RequestID(data []byte) uint32 {
 	return binary.LittleEndian.Uint32(data)
 }
 
-// bytes2Body from []byte to IprotoBody
-func bytes2Body(func_id uint32, body_length uint32, data []byte) (body IprotoBody, err error) {
-	if func_id == 0x00020001 {
-		buf := make([]byte, body_length)
-		err = msgpack.Unmarshal(data, &buf)
+// bytes2Header from []byte of HEADER_SIZE length to IprotoHeader
+func bytes2Header(data []byte) IprotoHeader {
+	return IprotoHeader{
+		Func_id:     bytes2FuncID(data[:4]),
+		Body_length: bytes2BodyLength(data[4:8]),
+		Request_id:  bytes2RequestID(data[8:12]),
+	}
+}
+
+// bytes2Body checks body limits and converts body in legacy encoding to msgpack values
+func bytes2Body(func_id uint32, data []byte, legacy bool, maxBodyLength uint32, maxValueSize int) ([]byte, error) {
+	if uint64(len(data)) > uint64(maxBodyLength) {
+		return nil, fmt.Errorf("max length of string is %d bytes", maxValueSize)
+	}
+	if legacy {
+		return legacy2Msgpack(func_id, data)
+	}
+	return data, nil
+}
+
+// UnmarshalValues decodes msgpack body into values. Values may go one after another
+// or be wrapped in a msgpack array, nil values and trailing bytes are not allowed
+func UnmarshalValues(data []byte, values ...interface{}) error {
+	reader := bytes.NewReader(data)
+	decoder := msgpack.NewDecoder(reader)
+	code, err := decoder.PeekCode()
+	if err != nil {
+		return errors.New("body is empty")
+	}
+	if codes.IsFixedArray(code) || code == codes.Array16 || code == codes.Array32 {
+		length, err := decoder.DecodeArrayLen()
 		if err != nil {
-			return
+			return err
 		}
-		body.Idx = int(binary.LittleEndian.Uint32(buf[:4]))
-		body.Str = string(buf[4:])
-	} else if func_id == 0x00020002 {
-		buf := make([]byte, body_length)
+		if length != len(values) {
+			return fmt.Errorf("expected array of %d values, got %d", len(values), length)
+		}
+	}
+	for i, value := range values {
+		if code, err = decoder.PeekCode(); err != nil {
+			return fmt.Errorf("body ends before value %d", i)
+		}
+		if code == codes.Nil {
+			return fmt.Errorf("value %d is nil", i)
+		}
+		if err = decoder.Decode(value); err != nil {
+			return err
+		}
+	}
+	if reader.Len() != 0 {
+		return fmt.Errorf("%d unexpected bytes after body", reader.Len())
+	}
+	return nil
+}
+
+// MarshalValues encodes values to msgpack body as an array
+func MarshalValues(values ...interface{}) ([]byte, error) {
+	return msgpack.Marshal(values)
+}
+
+// legacy2Msgpack from body in legacy encoding to msgpack values
+func legacy2Msgpack(func_id uint32, data []byte) ([]byte, error) {
+	body, err := legacy2Body(func_id, data)
+	if err != nil {
+		return nil, err
+	}
+	switch func_id {
+	case 0x00020001:
+		return MarshalValues(body.Idx, body.Str)
+	case 0x00020002:
+		return MarshalValues(body.Idx)
+	}
+	return data, nil
+}
+
+// legacy2Body from msgpack bin holding little-endian uint32 index followed by raw string to IprotoBody
+func legacy2Body(func_id uint32, data []byte) (body IprotoBody, err error) {
+	if func_id == 0x00020001 || func_id == 0x00020002 {
+		var buf []byte
 		err = msgpack.Unmarshal(data, &buf)
 		if err != nil {
 			return
 		}
+		if len(buf) < 4 {
+			return body, errors.New("body is too short for index")
+		}
 		body.Idx = int(binary.LittleEndian.Uint32(buf[:4]))
+		if func_id == 0x00020001 {
+			body.Str = string(buf[4:])
+		}
 	}
 	return body, nil
 }
 
-// Unmarshal from []byte to IprotoPacketRequest
+// Unmarshal from []byte holding one whole frame to IprotoPacketRequest
 func Unmarshal(data []byte) (requestPacket IprotoPacketRequest, err error) {
-	requestPacket.Header.Func_id = bytes2FuncID(data[:4])
-	requestPacket.Header.Body_length = bytes2BodyLength(data[4:8])
-	requestPacket.Header.Request_id = bytes2RequestID(data[8:12])
-	if requestPacket.Header.Body_length > 260 {
-		err = errors.New("max length of string is 256 bytes")
-	} else {
-		requestPacket.Body, err = bytes2Body(requestPacket.Header.Func_id, requestPacket.Header.Body_length, data[12:])
-	}
-	return
+	if len(data) < HEADER_SIZE {
+		return requestPacket, fmt.Errorf("%w: header: %d of %d bytes", ErrTruncatedFrame, len(data), HEADER_SIZE)
+	}
+	requestPacket.Header = bytes2Header(data)
+	if available := len(data) - HEADER_SIZE; uint64(requestPacket.Header.Body_length) > uint64(available) {
+		return requestPacket, fmt.Errorf("%w: body: %d of %d bytes", ErrTruncatedFrame,
+			available, requestPacket.Header.Body_length)
+	}
+	return NewDecoder(bytes.NewReader(data), requestPacket.Header.Body_length).Decode()
 }
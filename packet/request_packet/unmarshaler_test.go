@@ -1,8 +1,8 @@
 package request_packet
 
 import (
+	"bytes"
 	"encoding/binary"
-	"github.com/vmihailenco/msgpack"
 	"log"
 	"reflect"
 	"testing"
@@ -13,6 +13,15 @@ type TestCase struct {
 	IsError bool
 }
 
+// mustMarshalValues from values to msgpack body for test cases
+func mustMarshalValues(values ...interface{}) []byte {
+	data, err := MarshalValues(values...)
+	if err != nil {
+		log.Fatalf("Msgpack.marshal error in prepare for test")
+	}
+	return data
+}
+
 func TestUnmarshal(t *testing.T) {
 	longText := `В поезде едут 3 юзера и 3 программиста. У юзеров 3 билета, у программистов 1. Заходит контроллер.
 	Юзеры показывают билеты, программисты прячутся в туалет. Контроллер стучится в туалет,
@@ -27,13 +36,10 @@ func TestUnmarshal(t *testing.T) {
 			Packet: IprotoPacketRequest{
 				Header: IprotoHeader{
 					Func_id:     0x00020001,
-					Body_length: 116,
+					Body_length: 124,
 					Request_id:  1,
 				},
-				Body: IprotoBody{
-					Idx: 1,
-					Str: "Идет медведь по лесу, видит — машина горит. Сел в нее и сгорел.",
-				},
+				Body: mustMarshalValues(1, "Идет медведь по лесу, видит — машина горит. Сел в нее и сгорел."),
 			},
 			IsError: false,
 		},
@@ -44,10 +50,7 @@ func TestUnmarshal(t *testing.T) {
 					Body_length: 1056,
 					Request_id:  1,
 				},
-				Body: IprotoBody{
-					Idx: 0,
-					Str: longText,
-				},
+				Body: mustMarshalValues(0, longText),
 			},
 			IsError: true,
 		},
@@ -55,12 +58,10 @@ func TestUnmarshal(t *testing.T) {
 			Packet: IprotoPacketRequest{
 				Header: IprotoHeader{
 					Func_id:     0x00020002,
-					Body_length: 4,
+					Body_length: 10,
 					Request_id:  1,
 				},
-				Body: IprotoBody{
-					Idx: 7,
-				},
+				Body: mustMarshalValues(7),
 			},
 			IsError: false,
 		},
@@ -68,29 +69,9 @@ func TestUnmarshal(t *testing.T) {
 	for caseNum, item := range cases {
 		input := make([]byte, 12)
 		binary.LittleEndian.PutUint32(input[:4], item.Packet.Header.Func_id)
-		binary.LittleEndian.PutUint32(input[4:8], item.Packet.Header.Body_length)
 		binary.LittleEndian.PutUint32(input[8:12], item.Packet.Header.Request_id)
-		if item.Packet.Header.Func_id == 0x00020001 {
-			bodyBytes := make([]byte, 4)
-			binary.LittleEndian.PutUint32(bodyBytes[:4], uint32(item.Packet.Body.Idx))
-			bodyBytes = append(bodyBytes, []byte(item.Packet.Body.Str)...)
-			msgBody, err := msgpack.Marshal(&bodyBytes)
-			if err != nil {
-				log.Fatalf("Msgpack.marshal error in prepare for test")
-			}
-			binary.LittleEndian.PutUint32(input[4:8], uint32(len(bodyBytes)))
-			input = append(input, msgBody...)
-		} else if item.Packet.Header.Func_id == 0x00020002 {
-			bodyBytes := make([]byte, 4)
-			binary.LittleEndian.PutUint32(bodyBytes[:4], uint32(item.Packet.Body.Idx))
-			msgBody, err := msgpack.Marshal(&bodyBytes)
-			if err != nil {
-				log.Printf("Client: msgpack marshal request error: %s\n", err.Error())
-				return
-			}
-			binary.LittleEndian.PutUint32(input[4:8], uint32(len(bodyBytes)))
-			input = append(input, msgBody...)
-		}
+		binary.LittleEndian.PutUint32(input[4:8], uint32(len(item.Packet.Body)))
+		input = append(input, item.Packet.Body...)
 		packet, err := Unmarshal(input)
 		if item.IsError && err == nil {
 			t.Errorf("[%d] expected error, got nil", caseNum)
@@ -106,3 +87,62 @@ func TestUnmarshal(t *testing.T) {
 		}
 	}
 }
+
+type ValuesTestCase struct {
+	Data    []byte
+	Idx     int
+	Str     string
+	WithStr bool
+	IsError bool
+}
+
+func TestUnmarshalValues(t *testing.T) {
+	longStr := string(bytes.Repeat([]byte{'x'}, 250))
+	cases := []ValuesTestCase{
+		// sequence of positive fixint and fixstr
+		{Data: []byte{0x05, 0xa2, 'h', 'i'}, Idx: 5, Str: "hi", WithStr: true},
+		// array of uint16 and str8
+		{Data: []byte{0x92, 0xcd, 0x03, 0xe7, 0xd9, 2, 'h', 'i'}, Idx: 999, Str: "hi", WithStr: true},
+		// int32 and str16
+		{Data: []byte{0xd2, 0, 0, 0, 3, 0xda, 0, 2, 'h', 'i'}, Idx: 3, Str: "hi", WithStr: true},
+		// int64 and str32
+		{Data: []byte{0xd3, 0, 0, 0, 0, 0, 0, 0, 4, 0xdb, 0, 0, 0, 2, 'h', 'i'}, Idx: 4, Str: "hi", WithStr: true},
+		{Data: append([]byte{0x01, 0xd9, 250}, longStr...), Idx: 1, Str: longStr, WithStr: true},
+		// negative fixint
+		{Data: []byte{0xff}, Idx: -1},
+		// array of uint8
+		{Data: []byte{0x91, 0xcc, 200}, Idx: 200},
+		{Data: []byte{}, IsError: true},
+		{Data: []byte{0xc0}, IsError: true},
+		{Data: []byte{0x01, 0x02}, IsError: true},
+		{Data: []byte{0xa1, 'x'}, IsError: true},
+		{Data: []byte{0x92, 0x01, 0x02}, IsError: true},
+		{Data: []byte{0x01}, WithStr: true, IsError: true},
+		{Data: []byte{0x91, 0x01, 0xa1, 'x'}, WithStr: true, IsError: true},
+		{Data: []byte{0x01, 0xa3, 'x'}, WithStr: true, IsError: true},
+		{Data: []byte{0x01, 0xc0}, WithStr: true, IsError: true},
+	}
+	for caseNum, item := range cases {
+		var idx int
+		var str string
+		var err error
+		if item.WithStr {
+			err = UnmarshalValues(item.Data, &idx, &str)
+		} else {
+			err = UnmarshalValues(item.Data, &idx)
+		}
+
+		if item.IsError && err == nil {
+			t.Errorf("[%d] expected error, got nil", caseNum)
+		}
+
+		if !item.IsError && err != nil {
+			t.Errorf("[%d] unexpected error: %v", caseNum, err)
+		}
+
+		if err == nil && (idx != item.Idx || str != item.Str) {
+			t.Errorf("[%d] wrong results: got %d %q, expected %d %q",
+				caseNum, idx, str, item.Idx, item.Str)
+		}
+	}
+}
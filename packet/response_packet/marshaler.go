@@ -2,6 +2,7 @@ package response_packet
 
 import (
 	"encoding/binary"
+	"fmt"
 	"github.com/vmihailenco/msgpack"
 )
 
@@ -33,24 +34,44 @@ func RequestID2Bytes(data uint32) []byte {
 	return res
 }
 
-// Body2Bytes from string to []byte
-func Body2Bytes(data string) (res []byte, err error) {
-	if data != "" {
-		res, err = msgpack.Marshal(&data)
-		if err != nil {
-			return
-		}
+// BodyMarshaler is implemented by bodies which encode themselves to msgpack
+type BodyMarshaler interface {
+	MarshalBody() ([]byte, error)
+}
+
+// Body2Bytes from any msgpack-encodable value to []byte
+func Body2Bytes(data interface{}) (res []byte, err error) {
+	if marshaler, ok := data.(BodyMarshaler); ok {
+		return marshaler.MarshalBody()
 	}
-	return res, nil
+	return msgpack.Marshal(data)
+}
+
+// Error2Bytes from description of error to []byte, non-string descriptions are formatted
+func Error2Bytes(data interface{}) ([]byte, error) {
+	str, ok := data.(string)
+	if !ok {
+		str = fmt.Sprint(data)
+	}
+	return msgpack.Marshal(str)
 }
 
 // Marshal from IprotoPacketResponse to []byte
 func Marshal(packet IprotoPacketResponse) (data []byte, err error) {
+	var bodyBytes []byte
+	if packet.Return_code == 0 {
+		bodyBytes, err = Body2Bytes(packet.Body)
+	} else {
+		bodyBytes, err = Error2Bytes(packet.Body)
+	}
+	if err != nil {
+		return nil, err
+	}
+	data = make([]byte, 0, 16+len(bodyBytes))
 	data = append(data, FuncID2Bytes(packet.Header.Func_id)...)
-	bodyBytes, err := Body2Bytes(packet.Body)
 	data = append(data, BodyLength2Bytes(uint32(len(bodyBytes)))...)
 	data = append(data, RequestID2Bytes(packet.Header.Request_id)...)
 	data = append(data, ReturnCode2Bytes(packet.Return_code)...)
 	data = append(data, bodyBytes...)
-	return data, err
+	return data, nil
 }
@@ -1,6 +1,7 @@
 package response_packet
 
 import (
+	"errors"
 	"reflect"
 	"testing"
 )
@@ -10,6 +11,13 @@ type TestCase struct {
 	Res    []byte
 }
 
+// nilBody encodes itself as msgpack nil
+type nilBody struct{}
+
+func (n nilBody) MarshalBody() ([]byte, error) {
+	return []byte{0xc0}, nil
+}
+
 func TestMarshal(t *testing.T) {
 	cases := []TestCase{
 		{
@@ -28,10 +36,50 @@ func TestMarshal(t *testing.T) {
 				209, 128, 208, 184, 209, 130, 46, 32, 208, 161, 208, 181, 208, 187, 32, 208, 178, 32, 208, 189, 208, 181,
 				208, 181, 32, 208, 184, 32, 209, 129, 208, 179, 208, 190, 209, 128, 208, 181, 208, 187, 46},
 		},
+		{
+			Packet: IprotoPacketResponse{
+				Header:      IprotoHeader{Func_id: 0x00010001, Request_id: 2},
+				Return_code: 0,
+				Body:        nil,
+			},
+			Res: []byte{1, 0, 1, 0, 1, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0xc0},
+		},
+		{
+			Packet: IprotoPacketResponse{
+				Header:      IprotoHeader{Func_id: 0x00020002, Request_id: 3},
+				Return_code: 0,
+				Body:        "",
+			},
+			Res: []byte{2, 0, 2, 0, 1, 0, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0, 0xa0},
+		},
+		{
+			Packet: IprotoPacketResponse{
+				Header:      IprotoHeader{Func_id: 0x00030001, Request_id: 4},
+				Return_code: 0,
+				Body:        []interface{}{int8(1), "a"},
+			},
+			Res: []byte{1, 0, 3, 0, 5, 0, 0, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0x92, 0xd0, 1, 0xa1, 'a'},
+		},
+		{
+			Packet: IprotoPacketResponse{
+				Header:      IprotoHeader{Func_id: 0x00030001, Request_id: 5},
+				Return_code: 0,
+				Body:        nilBody{},
+			},
+			Res: []byte{1, 0, 3, 0, 1, 0, 0, 0, 5, 0, 0, 0, 0, 0, 0, 0, 0xc0},
+		},
+		{
+			Packet: IprotoPacketResponse{
+				Header:      IprotoHeader{Func_id: 0x00020002, Request_id: 6},
+				Return_code: 1,
+				Body:        errors.New("oops"),
+			},
+			Res: []byte{2, 0, 2, 0, 5, 0, 0, 0, 6, 0, 0, 0, 1, 0, 0, 0, 0xa4, 'o', 'o', 'p', 's'},
+		},
 	}
 	for caseNum, item := range cases {
 		res, err := Marshal(item.Packet)
-		if err != nil && !reflect.DeepEqual(res, item.Res) {
+		if err != nil || !reflect.DeepEqual(res, item.Res) {
 			t.Errorf("[%d] wrong results: got %+v, expected %+v",
 				caseNum, res, item.Res)
 		}
@@ -9,5 +9,7 @@ type IprotoHeader struct {
 type IprotoPacketResponse struct {
 	Header      IprotoHeader
 	Return_code uint32
-	Body        string
+	// Body any msgpack-encodable value, nil is encoded as msgpack nil.
+	// Body of response with non-zero Return_code is always encoded as string
+	Body interface{}
 }
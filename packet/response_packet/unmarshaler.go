@@ -0,0 +1,70 @@
+package response_packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// HEADER_SIZE size of header together with return code
+	HEADER_SIZE = 16
+)
+
+var (
+	// ErrTruncatedFrame the stream ended in the middle of a frame
+	ErrTruncatedFrame = errors.New("truncated frame")
+	// ErrFrameTooLarge body_length of the frame exceeds the limit, the body is left unread
+	ErrFrameTooLarge = errors.New("frame is too large")
+)
+
+// bytes2Header from []byte of HEADER_SIZE length to IprotoHeader and return code
+func bytes2Header(data []byte) (IprotoHeader, uint32) {
+	return IprotoHeader{
+		Func_id:     binary.LittleEndian.Uint32(data[:4]),
+		Body_length: binary.LittleEndian.Uint32(data[4:8]),
+		Request_id:  binary.LittleEndian.Uint32(data[8:12]),
+	}, binary.LittleEndian.Uint32(data[12:16])
+}
+
+// Decoder reads response packets one by one from a stream
+type Decoder struct {
+	reader        io.Reader
+	maxBodyLength uint32
+	header        [HEADER_SIZE]byte
+}
+
+// NewDecoder initializes Decoder that reads from reader and rejects bodies longer than maxBodyLength
+func NewDecoder(reader io.Reader, maxBodyLength uint32) *Decoder {
+	return &Decoder{
+		reader:        reader,
+		maxBodyLength: maxBodyLength,
+	}
+}
+
+// Decode reads exactly one frame from the stream. Body of the packet is left
+// msgpack-encoded as []byte. It returns io.EOF if the stream ended between frames
+func (d *Decoder) Decode() (packet IprotoPacketResponse, err error) {
+	if _, err = io.ReadFull(d.reader, d.header[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			err = fmt.Errorf("%w: header: %s", ErrTruncatedFrame, err.Error())
+		}
+		return
+	}
+	packet.Header, packet.Return_code = bytes2Header(d.header[:])
+	if packet.Header.Body_length > d.maxBodyLength {
+		err = fmt.Errorf("%w: body length %d exceeds %d", ErrFrameTooLarge,
+			packet.Header.Body_length, d.maxBodyLength)
+		return
+	}
+	data := make([]byte, packet.Header.Body_length)
+	if _, err = io.ReadFull(d.reader, data); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			err = fmt.Errorf("%w: body: %s", ErrTruncatedFrame, err.Error())
+		}
+		return
+	}
+	packet.Body = data
+	return packet, nil
+}
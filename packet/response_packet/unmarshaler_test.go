@@ -0,0 +1,55 @@
+package response_packet
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"testing/iotest"
+)
+
+func TestDecoder_Decode(t *testing.T) {
+	first, _ := Marshal(IprotoPacketResponse{
+		Header: IprotoHeader{Func_id: 0x00020002, Request_id: 7},
+		Body:   "seven",
+	})
+	second, _ := Marshal(IprotoPacketResponse{
+		Header:      IprotoHeader{Func_id: 0x00020002, Request_id: 8},
+		Return_code: 1,
+		Body:        "failed",
+	})
+	expected := []IprotoPacketResponse{
+		{
+			Header: IprotoHeader{Func_id: 0x00020002, Body_length: 6, Request_id: 7},
+			Body:   []byte{0xa5, 's', 'e', 'v', 'e', 'n'},
+		},
+		{
+			Header:      IprotoHeader{Func_id: 0x00020002, Body_length: 7, Request_id: 8},
+			Return_code: 1,
+			Body:        []byte{0xa6, 'f', 'a', 'i', 'l', 'e', 'd'},
+		},
+	}
+	input := append(append([]byte{}, first...), second...)
+
+	decoder := NewDecoder(iotest.OneByteReader(bytes.NewReader(input)), 100)
+	for i, item := range expected {
+		packet, err := decoder.Decode()
+		if err != nil {
+			t.Fatalf("[%d] unexpected error: %v", i, err)
+		}
+		if !reflect.DeepEqual(packet, item) {
+			t.Errorf("[%d] wrong results: got %+v, expected %+v", i, packet, item)
+		}
+	}
+	if _, err := decoder.Decode(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+
+	if _, err := NewDecoder(bytes.NewReader(first[:20]), 100).Decode(); !errors.Is(err, ErrTruncatedFrame) {
+		t.Errorf("expected truncated frame error, got %v", err)
+	}
+	if _, err := NewDecoder(bytes.NewReader(first), 5).Decode(); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("expected frame too large error, got %v", err)
+	}
+}
@@ -0,0 +1,224 @@
+// Package proxy_protocol reads header of PROXY protocol (versions 1 and 2) a proxy or load balancer
+// sends at the start of connection, so server knows the real address of client behind it
+package proxy_protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MAX_V1_LENGTH max length of header of version 1 including CRLF
+	MAX_V1_LENGTH = 107
+	// MAX_V2_LENGTH max length of addresses and TLVs of header of version 2 accepted
+	MAX_V2_LENGTH = 4096
+)
+
+// Types of TLVs of header of version 2
+const (
+	PP2_TYPE_SSL       = 0x20
+	PP2_SUBTYPE_SSL_CN = 0x22
+	// PP2_CLIENT_SSL client connected over TLS
+	PP2_CLIENT_SSL = 0x01
+	// PP2_CLIENT_CERT_CONN client presented certificate in this connection
+	PP2_CLIENT_CERT_CONN = 0x02
+)
+
+var (
+	// V2_SIGNATURE first bytes of header of version 2
+	V2_SIGNATURE = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	// V1_SIGNATURE first bytes of header of version 1
+	V1_SIGNATURE = []byte("PROXY ")
+)
+
+var (
+	// ErrNoHeader connection doesn't start with header of PROXY protocol
+	ErrNoHeader = errors.New("no PROXY protocol header")
+	// ErrBadHeader header of PROXY protocol is malformed
+	ErrBadHeader = errors.New("malformed PROXY protocol header")
+)
+
+// Header what proxy tells about connection of client
+type Header struct {
+	// Source address of client, nil for connections proxy makes on its own (LOCAL, UNKNOWN)
+	// and for protocols other than TCP over IPv4 and IPv6
+	Source net.Addr
+	// Destination address client connected to
+	Destination net.Addr
+	// ClientID common name of certificate of client verified by proxy terminating TLS, empty if there is none
+	ClientID string
+}
+
+// ReadHeader reads header of PROXY protocol of any version from the start of connection
+func ReadHeader(r *bufio.Reader) (Header, error) {
+	signature, err := r.Peek(len(V1_SIGNATURE))
+	if err != nil {
+		return Header{}, err
+	}
+	if bytes.Equal(signature, V1_SIGNATURE) {
+		return readV1(r)
+	}
+	signature, err = r.Peek(len(V2_SIGNATURE))
+	if err != nil {
+		return Header{}, err
+	}
+	if bytes.Equal(signature, V2_SIGNATURE) {
+		return readV2(r)
+	}
+	return Header{}, ErrNoHeader
+}
+
+// readV1 reads header of version 1: PROXY TCP4|TCP6|UNKNOWN source destination source_port destination_port\r\n
+func readV1(r *bufio.Reader) (Header, error) {
+	var line []byte
+	for len(line) < MAX_V1_LENGTH {
+		b, err := r.ReadByte()
+		if err != nil {
+			return Header{}, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return Header{}, fmt.Errorf("%w: line of version 1 isn't terminated by CRLF", ErrBadHeader)
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return Header{}, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return Header{}, fmt.Errorf("%w: %q", ErrBadHeader, line)
+	}
+	source, err := tcpAddr(fields[2], fields[4], fields[1] == "TCP4")
+	if err != nil {
+		return Header{}, err
+	}
+	destination, err := tcpAddr(fields[3], fields[5], fields[1] == "TCP4")
+	if err != nil {
+		return Header{}, err
+	}
+	return Header{Source: source, Destination: destination}, nil
+}
+
+// tcpAddr parses address of header of version 1
+func tcpAddr(host string, port string, v4 bool) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || (ip.To4() != nil) != v4 {
+		return nil, fmt.Errorf("%w: bad address %q", ErrBadHeader, host)
+	}
+	number, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad port %q", ErrBadHeader, port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(number)}, nil
+}
+
+// readV2 reads binary header of version 2: signature, version and command, family and protocol,
+// big-endian length of the rest, addresses and TLVs
+func readV2(r *bufio.Reader) (Header, error) {
+	fixed := make([]byte, len(V2_SIGNATURE)+4)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return Header{}, err
+	}
+	versionCommand, familyProtocol := fixed[12], fixed[13]
+	length := int(binary.BigEndian.Uint16(fixed[14:16]))
+	if versionCommand>>4 != 2 {
+		return Header{}, fmt.Errorf("%w: version %d", ErrBadHeader, versionCommand>>4)
+	}
+	if length > MAX_V2_LENGTH {
+		return Header{}, fmt.Errorf("%w: length %d", ErrBadHeader, length)
+	}
+	rest := make([]byte, length)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return Header{}, err
+	}
+	switch versionCommand & 0x0f {
+	case 0x0:
+		// LOCAL: connection made by proxy itself, e.g. health check
+		return Header{}, nil
+	case 0x1:
+		// PROXY: connection of client
+	default:
+		return Header{}, fmt.Errorf("%w: command %d", ErrBadHeader, versionCommand&0x0f)
+	}
+	var header Header
+	var addressLength int
+	switch familyProtocol {
+	case 0x11:
+		addressLength = 4
+	case 0x21:
+		addressLength = 16
+	default:
+		// Addresses of other families and protocols are skipped
+		return header, nil
+	}
+	if len(rest) < 2*addressLength+4 {
+		return Header{}, fmt.Errorf("%w: addresses are cut off", ErrBadHeader)
+	}
+	header.Source = &net.TCPAddr{
+		IP:   net.IP(rest[:addressLength]),
+		Port: int(binary.BigEndian.Uint16(rest[2*addressLength:])),
+	}
+	header.Destination = &net.TCPAddr{
+		IP:   net.IP(rest[addressLength : 2*addressLength]),
+		Port: int(binary.BigEndian.Uint16(rest[2*addressLength+2:])),
+	}
+	clientID, err := sslClientID(rest[2*addressLength+4:])
+	if err != nil {
+		return Header{}, err
+	}
+	header.ClientID = clientID
+	return header, nil
+}
+
+// sslClientID finds common name of certificate of client in TLVs, only certificate verified
+// by proxy in this connection counts
+func sslClientID(tlvs []byte) (string, error) {
+	var clientID string
+	err := walkTLVs(tlvs, func(kind byte, value []byte) error {
+		if kind != PP2_TYPE_SSL {
+			return nil
+		}
+		if len(value) < 5 {
+			return fmt.Errorf("%w: SSL TLV is cut off", ErrBadHeader)
+		}
+		client, verify := value[0], binary.BigEndian.Uint32(value[1:5])
+		if client&PP2_CLIENT_SSL == 0 || client&PP2_CLIENT_CERT_CONN == 0 || verify != 0 {
+			return nil
+		}
+		return walkTLVs(value[5:], func(kind byte, value []byte) error {
+			if kind == PP2_SUBTYPE_SSL_CN {
+				clientID = string(value)
+			}
+			return nil
+		})
+	})
+	return clientID, err
+}
+
+// walkTLVs calls fn with type and value of every TLV
+func walkTLVs(tlvs []byte, fn func(kind byte, value []byte) error) error {
+	for len(tlvs) > 0 {
+		if len(tlvs) < 3 {
+			return fmt.Errorf("%w: TLV is cut off", ErrBadHeader)
+		}
+		length := int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+length {
+			return fmt.Errorf("%w: TLV is cut off", ErrBadHeader)
+		}
+		if err := fn(tlvs[0], tlvs[3:3+length]); err != nil {
+			return err
+		}
+		tlvs = tlvs[3+length:]
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package proxy_protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// v2Header makes header of version 2 with command, family and protocol, addresses and TLVs
+func v2Header(command byte, familyProtocol byte, addresses []byte, tlvs ...[]byte) []byte {
+	rest := append([]byte{}, addresses...)
+	for _, tlv := range tlvs {
+		rest = append(rest, tlv...)
+	}
+	header := append(append([]byte{}, V2_SIGNATURE...), 0x20|command, familyProtocol, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(rest)))
+	return append(header, rest...)
+}
+
+// tlv makes TLV of kind with value
+func tlv(kind byte, value []byte) []byte {
+	return append([]byte{kind, byte(len(value) >> 8), byte(len(value))}, value...)
+}
+
+// sslTLV makes PP2_TYPE_SSL TLV with client flags, result of verification and common name of certificate
+func sslTLV(client byte, verify uint32, cn string) []byte {
+	value := []byte{client, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(value[1:], verify)
+	return tlv(PP2_TYPE_SSL, append(append(value, tlv(0x21, []byte("TLSv1.3"))...), tlv(PP2_SUBTYPE_SSL_CN, []byte(cn))...))
+}
+
+var (
+	ipv4Addresses = []byte{192, 0, 2, 10, 10, 0, 0, 1, 0xc3, 0x50, 0x1f, 0x90}
+	ipv6Addresses = append(append(
+		[]byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x10},
+		[]byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01}...),
+		0xc3, 0x50, 0x1f, 0x90)
+)
+
+type HeaderTestCase struct {
+	Input       []byte
+	Source      string
+	Destination string
+	ClientID    string
+	Err         error
+}
+
+func TestReadHeader(t *testing.T) {
+	cases := []HeaderTestCase{
+		{
+			Input:       []byte("PROXY TCP4 192.0.2.10 10.0.0.1 50000 8080\r\n"),
+			Source:      "192.0.2.10:50000",
+			Destination: "10.0.0.1:8080",
+		},
+		{
+			Input:       []byte("PROXY TCP6 2001:db8::10 2001:db8::1 50000 8080\r\n"),
+			Source:      "[2001:db8::10]:50000",
+			Destination: "[2001:db8::1]:8080",
+		},
+		{
+			Input: []byte("PROXY UNKNOWN\r\n"),
+		},
+		{
+			Input:       v2Header(0x1, 0x11, ipv4Addresses),
+			Source:      "192.0.2.10:50000",
+			Destination: "10.0.0.1:8080",
+		},
+		{
+			Input:       v2Header(0x1, 0x21, ipv6Addresses, tlv(0x04, []byte{1, 2, 3, 4})),
+			Source:      "[2001:db8::10]:50000",
+			Destination: "[2001:db8::1]:8080",
+		},
+		{
+			Input:       v2Header(0x1, 0x11, ipv4Addresses, sslTLV(PP2_CLIENT_SSL|PP2_CLIENT_CERT_CONN, 0, "billing")),
+			Source:      "192.0.2.10:50000",
+			Destination: "10.0.0.1:8080",
+			ClientID:    "billing",
+		},
+		{
+			// Certificate which is not verified doesn't authenticate client
+			Input:       v2Header(0x1, 0x11, ipv4Addresses, sslTLV(PP2_CLIENT_SSL|PP2_CLIENT_CERT_CONN, 1, "billing")),
+			Source:      "192.0.2.10:50000",
+			Destination: "10.0.0.1:8080",
+		},
+		{
+			Input:       v2Header(0x1, 0x11, ipv4Addresses, sslTLV(PP2_CLIENT_SSL, 0, "billing")),
+			Source:      "192.0.2.10:50000",
+			Destination: "10.0.0.1:8080",
+		},
+		{
+			// LOCAL connection of proxy itself
+			Input: v2Header(0x0, 0x00, nil),
+		},
+		{
+			// UNIX sockets
+			Input: v2Header(0x1, 0x31, make([]byte, 216)),
+		},
+		{
+			Input: []byte("\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"),
+			Err:   ErrNoHeader,
+		},
+		{
+			Input: []byte("PROXY TCP4 192.0.2.10 10.0.0.1 50000\r\n"),
+			Err:   ErrBadHeader,
+		},
+		{
+			Input: []byte("PROXY TCP4 2001:db8::10 10.0.0.1 50000 8080\r\n"),
+			Err:   ErrBadHeader,
+		},
+		{
+			Input: []byte("PROXY TCP4 192.0.2.10 10.0.0.1 50000 80800\r\n"),
+			Err:   ErrBadHeader,
+		},
+		{
+			Input: []byte("PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n"),
+			Err:   ErrBadHeader,
+		},
+		{
+			Input: v2Header(0x2, 0x11, ipv4Addresses),
+			Err:   ErrBadHeader,
+		},
+		{
+			Input: v2Header(0x1, 0x11, ipv4Addresses[:8]),
+			Err:   ErrBadHeader,
+		},
+		{
+			Input: v2Header(0x1, 0x11, ipv4Addresses, []byte{PP2_TYPE_SSL, 0, 10, 1}),
+			Err:   ErrBadHeader,
+		},
+		{
+			Input: v2Header(0x1, 0x11, ipv4Addresses)[:20],
+			Err:   io.ErrUnexpectedEOF,
+		},
+	}
+	for caseNum, item := range cases {
+		// Header is followed by the first request, it must be left unread
+		reader := bufio.NewReader(bytes.NewReader(append(append([]byte{}, item.Input...), "request"...)))
+		header, err := ReadHeader(reader)
+		if item.Err != nil {
+			if !errors.Is(err, item.Err) {
+				t.Errorf("[%d] wrong results: got %v, expected %v", caseNum, err, item.Err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[%d] unexpected error: %v", caseNum, err)
+			continue
+		}
+		if addrString(header.Source) != item.Source || addrString(header.Destination) != item.Destination ||
+			header.ClientID != item.ClientID {
+			t.Errorf("[%d] wrong results: got %+v, expected source %s destination %s client %q", caseNum, header,
+				item.Source, item.Destination, item.ClientID)
+		}
+		if rest, _ := io.ReadAll(reader); string(rest) != "request" {
+			t.Errorf("[%d] wrong results: got %q after header, expected %q", caseNum, rest, "request")
+		}
+	}
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
@@ -0,0 +1,130 @@
+package rate_limiter
+
+// tokenBucket Limiter of TOKEN_BUCKET algorithm
+type tokenBucket struct {
+	*keyTable[bucket]
+	limit float64
+	// rate tokens refilled per nanosecond
+	rate float64
+}
+
+// bucket state of client of tokenBucket, zero bucket is full
+type bucket struct {
+	// spent tokens at time last
+	spent float64
+	last  int64
+}
+
+func newTokenBucket(config Config, o options) *tokenBucket {
+	return &tokenBucket{
+		keyTable: newKeyTable[bucket](config.Scale, o),
+		limit:    float64(config.Limit),
+		rate:     float64(config.Limit) / float64(config.Scale),
+	}
+}
+
+func (l *tokenBucket) Allow(key string) bool {
+	return l.update(key, func(b *bucket, now int64) bool {
+		if now > b.last {
+			b.spent -= float64(now-b.last) * l.rate
+			if b.spent < 0 {
+				b.spent = 0
+			}
+			b.last = now
+		}
+		if b.spent+1 > l.limit {
+			return false
+		}
+		b.spent++
+		return true
+	})
+}
+
+// slidingWindow Limiter of SLIDING_WINDOW algorithm
+type slidingWindow struct {
+	*keyTable[window]
+	limit  int
+	window int64
+}
+
+// window state of client of slidingWindow: ring of times of requests allowed within the last window.
+// Ring grows on demand up to limit, so clients far below the limit don't hold limit times each
+type window struct {
+	times []int64
+	first int
+	count int
+}
+
+func newSlidingWindow(config Config, o options) *slidingWindow {
+	return &slidingWindow{
+		keyTable: newKeyTable[window](config.Scale, o),
+		limit:    int(config.Limit),
+		window:   int64(config.Scale),
+	}
+}
+
+func (l *slidingWindow) Allow(key string) bool {
+	return l.update(key, func(w *window, now int64) bool {
+		for w.count > 0 && now-w.times[w.first] >= l.window {
+			w.first = (w.first + 1) % len(w.times)
+			w.count--
+		}
+		if w.count == l.limit {
+			return false
+		}
+		if w.count == len(w.times) {
+			w.grow(l.limit)
+		}
+		w.times[(w.first+w.count)%len(w.times)] = now
+		w.count++
+		return true
+	})
+}
+
+// grow doubles full ring, but not past limit, and unwraps it to start from the first time
+func (w *window) grow(limit int) {
+	size := 2 * len(w.times)
+	if size == 0 {
+		size = 1
+	}
+	if size > limit {
+		size = limit
+	}
+	times := make([]int64, size)
+	n := copy(times, w.times[w.first:])
+	copy(times[n:], w.times[:w.first])
+	w.times, w.first = times, 0
+}
+
+// gcra Limiter of GCRA algorithm
+type gcra struct {
+	*keyTable[int64]
+	// interval time between requests at limit rate
+	interval int64
+	// tolerance how far theoretical arrival time may be ahead of now, it allows bursts of limit requests
+	tolerance int64
+}
+
+func newGCRA(config Config, o options) *gcra {
+	interval := int64(config.Scale) / int64(config.Limit)
+	return &gcra{
+		keyTable:  newKeyTable[int64](config.Scale, o),
+		interval:  interval,
+		tolerance: int64(config.Scale) - interval,
+	}
+}
+
+// Allow state of client is theoretical arrival time of its next request, zero for new client
+func (l *gcra) Allow(key string) bool {
+	return l.update(key, func(tat *int64, now int64) bool {
+		arrival := *tat
+		if arrival < now {
+			arrival = now
+		}
+		if arrival-now > l.tolerance {
+			return false
+		}
+		*tat = arrival + l.interval
+		return true
+	})
+}
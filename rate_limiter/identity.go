@@ -0,0 +1,249 @@
+package rate_limiter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+const (
+	// DEFAULT_IPV4_PREFIX length of prefix of IPv4 networks aggregated by BY_NETWORK by default
+	DEFAULT_IPV4_PREFIX = 24
+	// DEFAULT_IPV6_PREFIX length of prefix of IPv6 networks aggregated by BY_NETWORK by default
+	DEFAULT_IPV6_PREFIX = 64
+)
+
+// Client connection of client as server sees it
+type Client struct {
+	// Addr remote address of connection
+	Addr net.Addr
+	// Source address of client behind proxy from header of PROXY protocol, nil without it
+	Source net.Addr
+	// ID identifier of client authenticated by proxy, empty if client isn't authenticated
+	ID string
+}
+
+// String returns address of client behind proxy if it's known, remote address of connection otherwise
+func (c Client) String() string {
+	if c.Source != nil {
+		return c.Source.String()
+	}
+	if c.Addr == nil {
+		return ""
+	}
+	return c.Addr.String()
+}
+
+// IdentityKind what identifies client for rate limits
+type IdentityKind int
+
+const (
+	// BY_IP IP address of client, port is ignored, so all connections of client share its limit
+	BY_IP IdentityKind = iota
+	// BY_NETWORK network of IP address of client, e.g. /24 for IPv4 and /64 for IPv6
+	BY_NETWORK
+	// BY_CLIENT_ID id of client authenticated by proxy, IP address for unauthenticated clients
+	BY_CLIENT_ID
+)
+
+var identityNames = []string{BY_IP: "ip", BY_NETWORK: "cidr", BY_CLIENT_ID: "client-id"}
+
+func (k IdentityKind) String() string {
+	if k < 0 || int(k) >= len(identityNames) {
+		return fmt.Sprintf("IdentityKind(%d)", int(k))
+	}
+	return identityNames[k]
+}
+
+// ParseIdentityKind returns IdentityKind by its name: ip, cidr or client-id
+func ParseIdentityKind(name string) (IdentityKind, error) {
+	for kind, kindName := range identityNames {
+		if strings.EqualFold(name, kindName) {
+			return IdentityKind(kind), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown client identity %q, expected one of %s", name, strings.Join(identityNames, ", "))
+}
+
+// Identity extracts key limits of client are counted by. Zero Identity keys clients by IP address of connection
+type Identity struct {
+	Kind IdentityKind
+	// ProxySource take address of client from header of PROXY protocol instead of address of connection
+	ProxySource bool
+	// IPv4Prefix, IPv6Prefix lengths of prefixes of networks of BY_NETWORK,
+	// DEFAULT_IPV4_PREFIX and DEFAULT_IPV6_PREFIX if zero
+	IPv4Prefix int
+	IPv6Prefix int
+}
+
+// Key returns key of client, clients with the same key share limit
+func (i Identity) Key(client Client) string {
+	if i.Kind == BY_CLIENT_ID && client.ID != "" {
+		return "id:" + client.ID
+	}
+	ip := i.IP(client)
+	if ip == nil {
+		return "addr:" + client.String()
+	}
+	if i.Kind != BY_NETWORK {
+		return "ip:" + ip.String()
+	}
+	prefix, bits := i.IPv4Prefix, 8*net.IPv4len
+	if prefix == 0 {
+		prefix = DEFAULT_IPV4_PREFIX
+	}
+	if ip.To4() == nil {
+		prefix, bits = i.IPv6Prefix, 8*net.IPv6len
+		if prefix == 0 {
+			prefix = DEFAULT_IPV6_PREFIX
+		}
+	}
+	network := net.IPNet{IP: ip.Mask(net.CIDRMask(prefix, bits)), Mask: net.CIDRMask(prefix, bits)}
+	return "net:" + network.String()
+}
+
+// IP returns IP address of client, nil if address isn't IP one
+func (i Identity) IP(client Client) net.IP {
+	addr := client.Addr
+	if i.ProxySource && client.Source != nil {
+		addr = client.Source
+	}
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case nil:
+		return nil
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			host = addr.String()
+		}
+		ip = net.ParseIP(host)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// Policy overrides limits of particular clients. Client is given as IP address, network
+// in CIDR notation, e.g. 10.0.0.0/8, or id of authenticated client. Denied clients are rejected
+// even if they are allowed too
+type Policy struct {
+	Identity Identity `json:"-"`
+	// Allow clients which are never limited
+	Allow []string `json:"allow"`
+	// Deny clients whose requests are always rejected
+	Deny []string `json:"deny"`
+	// Limits custom limits of clients per scale, the first matching one applies
+	Limits []ClientLimit `json:"limits"`
+}
+
+// ClientLimit custom limit of requests of client
+type ClientLimit struct {
+	Client string `json:"client"`
+	Limit  uint32 `json:"limit"`
+}
+
+var (
+	// ErrBadPolicy policy has client which can't be parsed or zero limit
+	ErrBadPolicy = errors.New("bad rate limit policy")
+)
+
+// ParsePolicy reads Policy in JSON, e.g.
+//
+//	{"allow": ["10.0.0.0/8"], "deny": ["192.0.2.1"], "limits": [{"client": "batch-job", "limit": 1000}]}
+func ParsePolicy(r io.Reader) (Policy, error) {
+	var policy Policy
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&policy); err != nil {
+		return Policy{}, fmt.Errorf("%w: %s", ErrBadPolicy, err.Error())
+	}
+	if _, err := compilePolicy(policy); err != nil {
+		return Policy{}, err
+	}
+	return policy, nil
+}
+
+// clientSet clients of list of Policy
+type clientSet struct {
+	networks []*net.IPNet
+	ids      map[string]bool
+}
+
+// newClientSet parses clients given as IP addresses, networks or ids
+func newClientSet(clients []string) (clientSet, error) {
+	set := clientSet{ids: make(map[string]bool)}
+	for _, client := range clients {
+		switch {
+		case client == "":
+			return set, fmt.Errorf("%w: empty client", ErrBadPolicy)
+		case strings.Contains(client, "/"):
+			_, network, err := net.ParseCIDR(client)
+			if err != nil {
+				return set, fmt.Errorf("%w: %s", ErrBadPolicy, err.Error())
+			}
+			set.networks = append(set.networks, network)
+		case net.ParseIP(client) != nil:
+			ip := net.ParseIP(client)
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			set.networks = append(set.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		default:
+			set.ids[client] = true
+		}
+	}
+	return set, nil
+}
+
+// contains reports whether client with ip and id is in set
+func (s clientSet) contains(ip net.IP, id string) bool {
+	if id != "" && s.ids[id] {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, network := range s.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// compiledPolicy Policy with parsed clients
+type compiledPolicy struct {
+	identity Identity
+	allow    clientSet
+	deny     clientSet
+	limits   []clientSet
+}
+
+func compilePolicy(policy Policy) (compiled compiledPolicy, err error) {
+	compiled.identity = policy.Identity
+	if compiled.allow, err = newClientSet(policy.Allow); err != nil {
+		return compiled, err
+	}
+	if compiled.deny, err = newClientSet(policy.Deny); err != nil {
+		return compiled, err
+	}
+	for _, limit := range policy.Limits {
+		if limit.Limit == 0 {
+			return compiled, fmt.Errorf("%w: zero limit of %q, deny the client instead", ErrBadPolicy, limit.Client)
+		}
+		set, err := newClientSet([]string{limit.Client})
+		if err != nil {
+			return compiled, err
+		}
+		compiled.limits = append(compiled.limits, set)
+	}
+	return compiled, nil
+}
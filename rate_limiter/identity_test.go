@@ -0,0 +1,177 @@
+package rate_limiter
+
+import (
+	"errors"
+	"github.com/Bambelbl/iproto-server/logging"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tcpAddr makes address of connection from host:port
+func tcpAddr(t *testing.T, address string) net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		t.Fatalf("bad address %q: %v", address, err)
+	}
+	return addr
+}
+
+type KeyTestCase struct {
+	Identity Identity
+	Addr     string
+	Source   string
+	ID       string
+	Key      string
+}
+
+func TestIdentity_Key(t *testing.T) {
+	cases := []KeyTestCase{
+		{Identity: Identity{}, Addr: "192.0.2.10:50123", Key: "ip:192.0.2.10"},
+		{Identity: Identity{}, Addr: "[::ffff:192.0.2.10]:50124", Key: "ip:192.0.2.10"},
+		{Identity: Identity{Kind: BY_IP}, Addr: "10.0.0.1:50000", Source: "192.0.2.10:4000", Key: "ip:10.0.0.1"},
+		{Identity: Identity{Kind: BY_IP, ProxySource: true}, Addr: "10.0.0.1:50000", Source: "192.0.2.10:4000", Key: "ip:192.0.2.10"},
+		{Identity: Identity{Kind: BY_IP, ProxySource: true}, Addr: "10.0.0.1:50000", Key: "ip:10.0.0.1"},
+		{Identity: Identity{Kind: BY_NETWORK}, Addr: "192.0.2.10:50123", Key: "net:192.0.2.0/24"},
+		{Identity: Identity{Kind: BY_NETWORK}, Addr: "[2001:db8:1:2:3::4]:50123", Key: "net:2001:db8:1:2::/64"},
+		{Identity: Identity{Kind: BY_NETWORK, IPv4Prefix: 16, IPv6Prefix: 48}, Addr: "192.0.2.10:1", Key: "net:192.0.0.0/16"},
+		{Identity: Identity{Kind: BY_NETWORK, IPv4Prefix: 16, IPv6Prefix: 48}, Addr: "[2001:db8:1:2::4]:1", Key: "net:2001:db8:1::/48"},
+		{Identity: Identity{Kind: BY_CLIENT_ID}, Addr: "192.0.2.10:50123", ID: "billing", Key: "id:billing"},
+		{Identity: Identity{Kind: BY_CLIENT_ID}, Addr: "192.0.2.10:50123", Key: "ip:192.0.2.10"},
+		{Identity: Identity{Kind: BY_IP}, ID: "billing", Key: "addr:"},
+	}
+	for caseNum, item := range cases {
+		var client Client
+		if item.Addr != "" {
+			client.Addr = tcpAddr(t, item.Addr)
+		}
+		if item.Source != "" {
+			client.Source = tcpAddr(t, item.Source)
+		}
+		client.ID = item.ID
+		if key := item.Identity.Key(client); key != item.Key {
+			t.Errorf("[%d] wrong results: got %q, expected %q", caseNum, key, item.Key)
+		}
+	}
+}
+
+type PolicyTestCase struct {
+	Policy string
+	Err    error
+}
+
+func TestParsePolicy(t *testing.T) {
+	cases := []PolicyTestCase{
+		{Policy: `{}`},
+		{Policy: `{"allow": ["10.0.0.0/8", "2001:db8::1", "monitoring"], "deny": ["192.0.2.1"],
+			"limits": [{"client": "203.0.113.0/24", "limit": 1000}]}`},
+		{Policy: `{"allow": ["10.0.0.0/33"]}`, Err: ErrBadPolicy},
+		{Policy: `{"deny": [""]}`, Err: ErrBadPolicy},
+		{Policy: `{"limits": [{"client": "batch", "limit": 0}]}`, Err: ErrBadPolicy},
+		{Policy: `{"allowlist": ["10.0.0.1"]}`, Err: ErrBadPolicy},
+		{Policy: `[`, Err: ErrBadPolicy},
+	}
+	for caseNum, item := range cases {
+		_, err := ParsePolicy(strings.NewReader(item.Policy))
+		if !errors.Is(err, item.Err) || item.Err == nil && err != nil {
+			t.Errorf("[%d] wrong results: got %v, expected %v", caseNum, err, item.Err)
+		}
+	}
+}
+
+// Attempt request of client at time since testStart
+type Attempt struct {
+	At      time.Duration
+	Addr    string
+	ID      string
+	Allowed bool
+}
+
+type RateLimiterTestCase struct {
+	Identity IdentityKind
+	Policy   string
+	Attempts []Attempt
+}
+
+func TestRateLimiter(t *testing.T) {
+	// Every case limits to 1 request per second by default
+	cases := []RateLimiterTestCase{
+		{
+			// Connections of client share its limit
+			Identity: BY_IP,
+			Policy:   `{}`,
+			Attempts: []Attempt{
+				{Addr: "192.0.2.10:50001", Allowed: true}, {Addr: "192.0.2.10:50002", Allowed: false},
+				{Addr: "192.0.2.11:50003", Allowed: true}, {At: time.Second, Addr: "192.0.2.10:50004", Allowed: true},
+			},
+		},
+		{
+			Identity: BY_NETWORK,
+			Policy:   `{}`,
+			Attempts: []Attempt{
+				{Addr: "192.0.2.10:50001", Allowed: true}, {Addr: "192.0.2.11:50002", Allowed: false},
+				{Addr: "198.51.100.1:50003", Allowed: true},
+			},
+		},
+		{
+			Identity: BY_CLIENT_ID,
+			Policy:   `{}`,
+			Attempts: []Attempt{
+				{Addr: "192.0.2.10:50001", ID: "billing", Allowed: true}, {Addr: "192.0.2.11:50002", ID: "billing", Allowed: false},
+				{Addr: "192.0.2.10:50003", Allowed: true}, {Addr: "192.0.2.10:50004", ID: "search", Allowed: true},
+			},
+		},
+		{
+			Identity: BY_IP,
+			Policy: `{"allow": ["10.0.0.0/8", "monitoring"], "deny": ["192.0.2.66", "10.6.6.6", "intruder"],
+				"limits": [{"client": "198.51.100.0/24", "limit": 3}, {"client": "batch", "limit": 2}]}`,
+			Attempts: []Attempt{
+				{Addr: "10.0.0.1:1", Allowed: true}, {Addr: "10.0.0.1:2", Allowed: true}, {Addr: "10.0.0.1:3", Allowed: true},
+				{Addr: "192.0.2.1:1", ID: "monitoring", Allowed: true}, {Addr: "192.0.2.1:1", ID: "monitoring", Allowed: true},
+				{Addr: "192.0.2.66:1", Allowed: false},
+				// Denied clients are rejected even from allowed network
+				{Addr: "10.6.6.6:1", Allowed: false},
+				{Addr: "10.0.0.2:1", ID: "intruder", Allowed: false},
+				{Addr: "198.51.100.7:1", Allowed: true}, {Addr: "198.51.100.7:2", Allowed: true},
+				{Addr: "198.51.100.7:3", Allowed: true}, {Addr: "198.51.100.7:4", Allowed: false},
+				{Addr: "203.0.113.1:1", ID: "batch", Allowed: true}, {Addr: "203.0.113.1:2", ID: "batch", Allowed: true},
+				{Addr: "203.0.113.1:3", ID: "batch", Allowed: false},
+				// Requests without id are counted under the default limit
+				{Addr: "203.0.113.1:4", Allowed: true}, {Addr: "203.0.113.1:5", Allowed: false},
+			},
+		},
+	}
+	for caseNum, item := range cases {
+		policy, err := ParsePolicy(strings.NewReader(item.Policy))
+		if err != nil {
+			t.Fatalf("[%d] unexpected error: %v", caseNum, err)
+		}
+		policy.Identity = Identity{Kind: item.Identity}
+		clock := &testClock{now: testStart}
+		rateLimiter, err := NewRateLimiter(logging.Nop(), Config{Algorithm: GCRA, Limit: 1, Scale: time.Second}, policy,
+			WithClock(clock.Now))
+		if err != nil {
+			t.Fatalf("[%d] unexpected error: %v", caseNum, err)
+		}
+		rejected := 0
+		rateLimiter.OnReject(func(string) {
+			rejected++
+		})
+		expectedRejected := 0
+		for i, attempt := range item.Attempts {
+			clock.now = testStart.Add(attempt.At)
+			if allowed := rateLimiter.ValidRate(Client{Addr: tcpAddr(t, attempt.Addr), ID: attempt.ID}); allowed != attempt.Allowed {
+				t.Errorf("[%d] wrong results of attempt %d %+v: got %v", caseNum, i, attempt, allowed)
+			}
+			if !attempt.Allowed {
+				expectedRejected++
+			}
+		}
+		if rejected != expectedRejected {
+			t.Errorf("[%d] wrong results: got %d rejected, expected %d", caseNum, rejected, expectedRejected)
+		}
+		rateLimiter.Stop()
+		rateLimiter.Stop()
+	}
+}
@@ -0,0 +1,87 @@
+package rate_limiter
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// keyTable states of clients ordered by time of their last request, at most maxKeys of them.
+// Zero state is the state of a new client and client idle for idle has the same state, so such clients
+// are forgotten: on every request, so the table never grows past active clients, and on cleanup
+type keyTable[T any] struct {
+	mutex   sync.Mutex
+	now     func() time.Time
+	idle    int64
+	maxKeys int
+	keys    map[string]*list.Element
+	// order *keyEntry of clients, the most recently seen first
+	order *list.List
+}
+
+type keyEntry[T any] struct {
+	key   string
+	seen  int64
+	state T
+}
+
+func newKeyTable[T any](idle time.Duration, o options) *keyTable[T] {
+	return &keyTable[T]{
+		now:     o.now,
+		idle:    int64(idle),
+		maxKeys: o.maxKeys,
+		keys:    make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// update calls fn with state of client with key and current unix time in nanoseconds, returns its result.
+// If table is full, the least recently seen client is forgotten to keep state of the new one
+func (t *keyTable[T]) update(key string, fn func(state *T, now int64) bool) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := t.now().UnixNano()
+	t.expire(now)
+	element, exist := t.keys[key]
+	if exist {
+		t.order.MoveToFront(element)
+	} else {
+		if t.order.Len() >= t.maxKeys {
+			t.remove(t.order.Back())
+		}
+		element = t.order.PushFront(&keyEntry[T]{key: key})
+		t.keys[key] = element
+	}
+	entry := element.Value.(*keyEntry[T])
+	entry.seen = now
+	return fn(&entry.state, now)
+}
+
+// expire forgets clients idle for idle at now, returns their number
+func (t *keyTable[T]) expire(now int64) int {
+	expired := 0
+	for element := t.order.Back(); element != nil; element = t.order.Back() {
+		if now-element.Value.(*keyEntry[T]).seen < t.idle {
+			break
+		}
+		t.remove(element)
+		expired++
+	}
+	return expired
+}
+
+func (t *keyTable[T]) remove(element *list.Element) {
+	delete(t.keys, t.order.Remove(element).(*keyEntry[T]).key)
+}
+
+func (t *keyTable[T]) Cleanup() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.expire(t.now().UnixNano())
+}
+
+func (t *keyTable[T]) Len() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.order.Len()
+}
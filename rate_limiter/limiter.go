@@ -0,0 +1,119 @@
+package rate_limiter
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MAX_KEYS default max number of clients whose state is kept by Limiter
+const MAX_KEYS = 1 << 16
+
+// Limiter decides whether client with key may make one more request
+type Limiter interface {
+
+	// Allow Reports whether request of client with key is within limit and counts it if so
+	Allow(key string) bool
+
+	// Cleanup Forget clients which made no requests for long enough that their state equals the state
+	// of a new client, return number of forgotten clients
+	Cleanup() int
+
+	// Len Return number of clients whose state is kept
+	Len() int
+}
+
+// Algorithm algorithm of Limiter
+type Algorithm int
+
+const (
+	// TOKEN_BUCKET bucket of Limit tokens refilled at Limit per Scale, request takes a token.
+	// Client may burst up to Limit requests at once
+	TOKEN_BUCKET Algorithm = iota
+	// SLIDING_WINDOW log of times of allowed requests, at most Limit of them within any Scale.
+	// The most precise algorithm, it keeps up to Limit times per client
+	SLIDING_WINDOW
+	// GCRA generic cell rate algorithm: requests are spaced by Scale/Limit on average
+	// with bursts up to Limit, only one time is kept per client
+	GCRA
+)
+
+var algorithmNames = []string{TOKEN_BUCKET: "token-bucket", SLIDING_WINDOW: "sliding-window", GCRA: "gcra"}
+
+func (a Algorithm) String() string {
+	if a < 0 || int(a) >= len(algorithmNames) {
+		return fmt.Sprintf("Algorithm(%d)", int(a))
+	}
+	return algorithmNames[a]
+}
+
+// ParseAlgorithm returns Algorithm by its name: token-bucket, sliding-window or gcra
+func ParseAlgorithm(name string) (Algorithm, error) {
+	for algorithm, algorithmName := range algorithmNames {
+		if strings.EqualFold(name, algorithmName) {
+			return Algorithm(algorithm), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown rate limit algorithm %q, expected one of %s", name, strings.Join(algorithmNames, ", "))
+}
+
+// Config limit of requests of every client
+type Config struct {
+	Algorithm Algorithm
+	// Limit max number of requests per Scale
+	Limit uint32
+	Scale time.Duration
+}
+
+var (
+	// ErrBadLimit limit or scale of Config is not positive
+	ErrBadLimit = errors.New("limit and scale must be positive")
+)
+
+// Option configures optional behaviour of Limiter
+type Option func(o *options)
+
+type options struct {
+	now     func() time.Time
+	maxKeys int
+}
+
+// WithClock makes Limiter read current time from now instead of time.Now, e.g. in tests
+func WithClock(now func() time.Time) Option {
+	return func(o *options) {
+		o.now = now
+	}
+}
+
+// WithMaxKeys sets max number of clients whose state is kept, MAX_KEYS by default.
+// When it's reached, state of the least recently seen client is forgotten
+func WithMaxKeys(maxKeys int) Option {
+	return func(o *options) {
+		o.maxKeys = maxKeys
+	}
+}
+
+// NewLimiter returns Limiter of algorithm of config
+func NewLimiter(config Config, opts ...Option) (Limiter, error) {
+	if config.Limit == 0 || config.Scale <= 0 {
+		return nil, ErrBadLimit
+	}
+	o := options{now: time.Now, maxKeys: MAX_KEYS}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.maxKeys <= 0 {
+		o.maxKeys = 1
+	}
+	switch config.Algorithm {
+	case TOKEN_BUCKET:
+		return newTokenBucket(config, o), nil
+	case SLIDING_WINDOW:
+		return newSlidingWindow(config, o), nil
+	case GCRA:
+		return newGCRA(config, o), nil
+	default:
+		return nil, fmt.Errorf("unknown rate limit algorithm %v", config.Algorithm)
+	}
+}
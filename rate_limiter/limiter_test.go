@@ -0,0 +1,232 @@
+package rate_limiter
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var testStart = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// testClock clock of limiter in tests, it's moved by hand
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+// Request request of client Key made At since testStart
+type Request struct {
+	At      time.Duration
+	Key     string
+	Allowed bool
+}
+
+type AllowTestCase struct {
+	Algorithm Algorithm
+	Requests  []Request
+}
+
+func TestLimiter_Allow(t *testing.T) {
+	// Every case limits to 2 requests per second
+	cases := []AllowTestCase{
+		{
+			Algorithm: TOKEN_BUCKET,
+			Requests: []Request{
+				{At: 0, Allowed: true}, {At: 0, Allowed: true}, {At: 0, Allowed: false},
+				{At: 0, Key: "other", Allowed: true},
+				{At: 500 * time.Millisecond, Allowed: true}, {At: 500 * time.Millisecond, Allowed: false},
+				{At: 1500 * time.Millisecond, Allowed: true}, {At: 1500 * time.Millisecond, Allowed: true},
+				{At: 1500 * time.Millisecond, Allowed: false},
+			},
+		},
+		{
+			// Burst across boundary of fixed windows is not allowed
+			Algorithm: TOKEN_BUCKET,
+			Requests: []Request{
+				{At: 900 * time.Millisecond, Allowed: true}, {At: 900 * time.Millisecond, Allowed: true},
+				{At: 1100 * time.Millisecond, Allowed: false}, {At: 1400 * time.Millisecond, Allowed: true},
+			},
+		},
+		{
+			Algorithm: SLIDING_WINDOW,
+			Requests: []Request{
+				{At: 0, Allowed: true}, {At: 0, Allowed: true}, {At: 0, Allowed: false},
+				{At: 0, Key: "other", Allowed: true},
+				{At: 500 * time.Millisecond, Allowed: false}, {At: 999 * time.Millisecond, Allowed: false},
+				{At: time.Second, Allowed: true}, {At: time.Second, Allowed: true}, {At: time.Second, Allowed: false},
+			},
+		},
+		{
+			Algorithm: SLIDING_WINDOW,
+			Requests: []Request{
+				{At: 900 * time.Millisecond, Allowed: true}, {At: 900 * time.Millisecond, Allowed: true},
+				{At: 1100 * time.Millisecond, Allowed: false}, {At: 1899 * time.Millisecond, Allowed: false},
+				{At: 1900 * time.Millisecond, Allowed: true}, {At: 2200 * time.Millisecond, Allowed: true},
+				{At: 2200 * time.Millisecond, Allowed: false},
+			},
+		},
+		{
+			Algorithm: GCRA,
+			Requests: []Request{
+				{At: 0, Allowed: true}, {At: 0, Allowed: true}, {At: 0, Allowed: false},
+				{At: 0, Key: "other", Allowed: true},
+				{At: 499 * time.Millisecond, Allowed: false}, {At: 500 * time.Millisecond, Allowed: true},
+				{At: 500 * time.Millisecond, Allowed: false},
+				{At: 2 * time.Second, Allowed: true}, {At: 2 * time.Second, Allowed: true}, {At: 2 * time.Second, Allowed: false},
+			},
+		},
+		{
+			Algorithm: GCRA,
+			Requests: []Request{
+				{At: 900 * time.Millisecond, Allowed: true}, {At: 900 * time.Millisecond, Allowed: true},
+				{At: 1100 * time.Millisecond, Allowed: false}, {At: 1400 * time.Millisecond, Allowed: true},
+				{At: 1400 * time.Millisecond, Allowed: false},
+			},
+		},
+	}
+	for caseNum, item := range cases {
+		clock := &testClock{now: testStart}
+		limiter, err := NewLimiter(Config{Algorithm: item.Algorithm, Limit: 2, Scale: time.Second}, WithClock(clock.Now))
+		if err != nil {
+			t.Fatalf("[%d] unexpected error: %v", caseNum, err)
+		}
+		for i, request := range item.Requests {
+			clock.now = testStart.Add(request.At)
+			if allowed := limiter.Allow("client" + request.Key); allowed != request.Allowed {
+				t.Errorf("[%d] wrong results of %v request %d at %v: got %v, expected %v", caseNum, item.Algorithm, i,
+					request.At, allowed, request.Allowed)
+			}
+		}
+	}
+}
+
+type CleanupTestCase struct {
+	Algorithm Algorithm
+	// MaxKeys max number of kept clients, MAX_KEYS if zero
+	MaxKeys int
+	// Clients number of clients making one request each, the i-th of them at i milliseconds
+	Clients int
+	// Idle time since the last request after which Cleanup is called
+	Idle    time.Duration
+	Len     int
+	Cleaned int
+}
+
+func TestLimiter_Cleanup(t *testing.T) {
+	cases := []CleanupTestCase{
+		{Algorithm: TOKEN_BUCKET, MaxKeys: 100, Clients: 10, Idle: 0, Len: 10, Cleaned: 0},
+		{Algorithm: TOKEN_BUCKET, MaxKeys: 100, Clients: 10, Idle: time.Second, Len: 0, Cleaned: 10},
+		{Algorithm: SLIDING_WINDOW, MaxKeys: 100, Clients: 10, Idle: 995 * time.Millisecond, Len: 5, Cleaned: 5},
+		{Algorithm: GCRA, MaxKeys: 100, Clients: 10, Idle: time.Hour, Len: 0, Cleaned: 10},
+		{Algorithm: GCRA, MaxKeys: 3, Clients: 10, Idle: 0, Len: 3, Cleaned: 0},
+		// Clients idle for scale are forgotten on requests of other clients
+		{Algorithm: SLIDING_WINDOW, Clients: 2000, Idle: 0, Len: 1000, Cleaned: 0},
+	}
+	for caseNum, item := range cases {
+		clock := &testClock{now: testStart}
+		opts := []Option{WithClock(clock.Now)}
+		if item.MaxKeys > 0 {
+			opts = append(opts, WithMaxKeys(item.MaxKeys))
+		}
+		limiter, err := NewLimiter(Config{Algorithm: item.Algorithm, Limit: 2, Scale: time.Second}, opts...)
+		if err != nil {
+			t.Fatalf("[%d] unexpected error: %v", caseNum, err)
+		}
+		for i := 0; i < item.Clients; i++ {
+			clock.now = testStart.Add(time.Duration(i) * time.Millisecond)
+			if !limiter.Allow(strconv.Itoa(i)) {
+				t.Errorf("[%d] request of new client %d isn't allowed", caseNum, i)
+			}
+		}
+		clock.now = clock.now.Add(item.Idle)
+		if cleaned := limiter.Cleanup(); cleaned != item.Cleaned || limiter.Len() != item.Len {
+			t.Errorf("[%d] wrong results: got %d cleaned and %d kept, expected %d and %d", caseNum,
+				cleaned, limiter.Len(), item.Cleaned, item.Len)
+		}
+	}
+}
+
+func TestLimiter_MaxKeys(t *testing.T) {
+	for _, algorithm := range []Algorithm{TOKEN_BUCKET, SLIDING_WINDOW, GCRA} {
+		clock := &testClock{now: testStart}
+		limiter, _ := NewLimiter(Config{Algorithm: algorithm, Limit: 1, Scale: time.Second}, WithClock(clock.Now), WithMaxKeys(2))
+		results := []bool{limiter.Allow("a"), limiter.Allow("b"), limiter.Allow("a"), limiter.Allow("c"), limiter.Allow("a"), limiter.Allow("b")}
+		// Client b is the least recently seen one when c comes, so it's forgotten and gets a new limit
+		expected := []bool{true, true, false, true, false, true}
+		for i := range results {
+			if results[i] != expected[i] {
+				t.Errorf("[%v] wrong results: got %v, expected %v", algorithm, results, expected)
+				break
+			}
+		}
+		if limiter.Len() != 2 {
+			t.Errorf("[%v] wrong results: got %d clients kept, expected 2", algorithm, limiter.Len())
+		}
+	}
+}
+
+type RingTestCase struct {
+	At      time.Duration
+	Allowed bool
+	// Size length of ring of client after request
+	Size int
+}
+
+func TestSlidingWindow_Ring(t *testing.T) {
+	clock := &testClock{now: testStart}
+	limiter, _ := NewLimiter(Config{Algorithm: SLIDING_WINDOW, Limit: 5, Scale: time.Second}, WithClock(clock.Now))
+	l := limiter.(*slidingWindow)
+	// Ring wraps around at 1s and grows at 1.1s while wrapped
+	cases := []RingTestCase{
+		{At: 0, Allowed: true, Size: 1},
+		{At: 600 * time.Millisecond, Allowed: true, Size: 2},
+		{At: time.Second, Allowed: true, Size: 2},
+		{At: 1100 * time.Millisecond, Allowed: true, Size: 4},
+		{At: 1100 * time.Millisecond, Allowed: true, Size: 4},
+		{At: 1100 * time.Millisecond, Allowed: true, Size: 5},
+		{At: 1100 * time.Millisecond, Allowed: false, Size: 5},
+		{At: 1599 * time.Millisecond, Allowed: false, Size: 5},
+		{At: 1600 * time.Millisecond, Allowed: true, Size: 5},
+	}
+	for caseNum, item := range cases {
+		clock.now = testStart.Add(item.At)
+		allowed := l.Allow("client")
+		size := len(l.keys["client"].Value.(*keyEntry[window]).state.times)
+		if allowed != item.Allowed || size != item.Size {
+			t.Errorf("[%d] wrong results: got %v with ring of %d, expected %v with ring of %d", caseNum,
+				allowed, size, item.Allowed, item.Size)
+		}
+	}
+}
+
+type ConfigTestCase struct {
+	Name   string
+	Config Config
+	Err    error
+}
+
+func TestNewLimiter(t *testing.T) {
+	cases := []ConfigTestCase{
+		{Name: "gcra", Config: Config{Algorithm: GCRA, Limit: 1, Scale: time.Second}},
+		{Name: "Token-Bucket", Config: Config{Algorithm: TOKEN_BUCKET, Limit: 100, Scale: time.Millisecond}},
+		{Name: "sliding-window", Config: Config{Algorithm: SLIDING_WINDOW, Limit: 0, Scale: time.Second}, Err: ErrBadLimit},
+		{Name: "gcra", Config: Config{Algorithm: GCRA, Limit: 1, Scale: 0}, Err: ErrBadLimit},
+	}
+	for caseNum, item := range cases {
+		algorithm, err := ParseAlgorithm(item.Name)
+		if err != nil || algorithm != item.Config.Algorithm {
+			t.Errorf("[%d] wrong results: got %v %v, expected %v", caseNum, algorithm, err, item.Config.Algorithm)
+		}
+		_, err = NewLimiter(item.Config)
+		if !errors.Is(err, item.Err) || item.Err == nil && err != nil {
+			t.Errorf("[%d] wrong results: got %v, expected %v", caseNum, err, item.Err)
+		}
+	}
+	if _, err := ParseAlgorithm("fixed-window"); err == nil {
+		t.Errorf("expected error for unknown algorithm")
+	}
+}
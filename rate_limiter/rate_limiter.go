@@ -1,87 +1,124 @@
 package rate_limiter
 
 import (
-	"log"
-	"strconv"
-	"strings"
+	"github.com/Bambelbl/iproto-server/logging"
 	"sync"
 	"time"
 )
 
+// CLEANUP_INTERVAL interval between cleanups of idle clients of Limiter
+const CLEANUP_INTERVAL = 5 * time.Second
+
+// RateLimiter limits requests of every client identified by Identity of policy, applying overrides
+// of policy, and forgets idle clients in background
 type RateLimiter struct {
-	logger   *log.Logger
-	buckets  map[string]uint32
-	scale    int64
-	limit    uint32
-	mutex    sync.RWMutex
+	logger  logging.Logger
+	policy  compiledPolicy
+	limiter Limiter
+	// limiters limiters of custom limits of policy
+	limiters []Limiter
 	stopChan chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+	onReject func(key string)
 }
 
-const (
-	DELETE_TIMEOUT = 1000
-	INTERVAL_TIME  = 5000
-)
-
-func NewRateLimiter(logger *log.Logger, scale int64, limit uint32) *RateLimiter {
+// NewRateLimiter initializes RateLimiter limiting clients by config and policy and starts cleanup of idle clients
+func NewRateLimiter(logger logging.Logger, config Config, policy Policy, opts ...Option) (*RateLimiter, error) {
+	compiled, err := compilePolicy(policy)
+	if err != nil {
+		return nil, err
+	}
+	limiter, err := NewLimiter(config, opts...)
+	if err != nil {
+		return nil, err
+	}
 	rateLimiter := &RateLimiter{
 		logger:   logger,
-		buckets:  make(map[string]uint32),
-		scale:    scale,
-		limit:    limit,
-		stopChan: make(chan struct{}, 1),
+		policy:   compiled,
+		limiter:  limiter,
+		stopChan: make(chan struct{}),
+		done:     make(chan struct{}),
 	}
-	go rateLimiter.removeOldLimiters()
-	return rateLimiter
+	for _, limit := range policy.Limits {
+		custom := config
+		custom.Limit = limit.Limit
+		if limiter, err = NewLimiter(custom, opts...); err != nil {
+			return nil, err
+		}
+		rateLimiter.limiters = append(rateLimiter.limiters, limiter)
+	}
+	go rateLimiter.removeOldLimiters(CLEANUP_INTERVAL)
+	return rateLimiter, nil
 }
 
 // Stop shutdown of RateLimiter
 func (rl *RateLimiter) Stop() {
-	rl.stopChan <- struct{}{}
+	rl.stopOnce.Do(func() {
+		close(rl.stopChan)
+	})
+	<-rl.done
+}
+
+// OnReject sets hook called with key of client of every rejected request, e.g. to count them.
+// It must be set before ValidRate is called
+func (rl *RateLimiter) OnReject(hook func(key string)) {
+	rl.onReject = hook
 }
 
-// ValidRate checks if the client sends requests more than limit times per scale
-func (rl *RateLimiter) ValidRate(IP string) bool {
-	stamp := time.Now().UnixNano() / int64(time.Millisecond)
-	bucketNumber := stamp / rl.scale
-	key := IP + "_" + strconv.FormatInt(bucketNumber, 10)
-	rl.mutex.Lock()
-	defer rl.mutex.Unlock()
-	if rps, exist := rl.buckets[key]; !exist {
-		rl.buckets[key] = 1
+// ValidRate checks if the client is allowed to send one more request: it isn't denied
+// and sends no more than its limit per scale
+func (rl *RateLimiter) ValidRate(client Client) bool {
+	key := rl.policy.identity.Key(client)
+	ip := rl.policy.identity.IP(client)
+	switch {
+	case rl.policy.deny.contains(ip, client.ID):
+		return rl.reject(client, key, "client is denied")
+	case rl.policy.allow.contains(ip, client.ID):
 		return true
-	} else {
-		if rps < rl.limit {
-			rl.buckets[key]++
-			return true
-		} else {
-			return false
+	}
+	limiter := rl.limiter
+	for i, clients := range rl.policy.limits {
+		if clients.contains(ip, client.ID) {
+			limiter = rl.limiters[i]
+			break
 		}
 	}
+	if limiter.Allow(key) {
+		return true
+	}
+	return rl.reject(client, key, "rate limit exceeded")
 }
 
-// removeOldLimiters deletes old buckets times per interval
-func (rl *RateLimiter) removeOldLimiters() {
-	select {
-	case <-rl.stopChan:
-		return
-	case <-time.Tick(time.Duration(INTERVAL_TIME)):
-		stamp := time.Now().UnixNano() / int64(time.Millisecond)
+// reject logs rejected request of client and reports it to hook
+func (rl *RateLimiter) reject(client Client, key string, reason string) bool {
+	if rl.logger.Enabled(logging.DEBUG) {
+		rl.logger.Debug(reason, logging.KEY_REMOTE_ADDR, client.String(), "client", key)
+	}
+	if rl.onReject != nil {
+		rl.onReject(key)
+	}
+	return false
+}
 
-		isOldTime := func(key string) bool {
-			_, bucketTimeStr, _ := strings.Cut(key, "_")
-			bucketTime, err := strconv.ParseInt(bucketTimeStr, 10, 64)
-			if err != nil {
-				rl.logger.Println("RateLimiter: parsing key error: ", err.Error())
+// removeOldLimiters forgets idle clients every interval until Stop
+func (rl *RateLimiter) removeOldLimiters(interval time.Duration) {
+	defer close(rl.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rl.stopChan:
+			return
+		case <-ticker.C:
+			removed, clients := 0, 0
+			for _, limiter := range append([]Limiter{rl.limiter}, rl.limiters...) {
+				removed += limiter.Cleanup()
+				clients += limiter.Len()
 			}
-			return bucketTime < (stamp - DELETE_TIMEOUT)
-		}
-
-		rl.mutex.Lock()
-		for key, _ := range rl.buckets {
-			if isOldTime(key) {
-				delete(rl.buckets, key)
+			if removed > 0 && rl.logger.Enabled(logging.DEBUG) {
+				rl.logger.Debug("idle clients are forgotten", "count", removed, "clients", clients)
 			}
 		}
-		rl.mutex.Unlock()
 	}
 }
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"github.com/Bambelbl/iproto-server/api"
+	"github.com/Bambelbl/iproto-server/logging"
+	"github.com/Bambelbl/iproto-server/storage"
+	"time"
+)
+
+// Observer is notified about connections, requests and storage of IprotoServer, e.g. to collect metrics.
+// Its methods are called concurrently from connections of clients and must not block
+type Observer interface {
+	api.Observer
+
+	// ConnectionOpened connection of client is accepted
+	ConnectionOpened()
+
+	// ConnectionClosed connection of client is closed
+	ConnectionClosed()
+
+	// QueueLength number of clients holding places in queue of clients of capacity, called on every change
+	QueueLength(length int, capacity int)
+
+	// DecodeError request can't be decoded
+	DecodeError()
+
+	// RateLimited request is rejected by rate limiter
+	RateLimited()
+
+	// StateChanged storage is switched to state
+	StateChanged(state int)
+}
+
+// WithObserver makes IprotoServer notify observer about connections, requests (including ones answered
+// with TOO_MANY_REQUESTS or INVALID_BODY before registry), rejections
+// by rate limiter and transitions of state of storage implementing storage.Watchable
+func WithObserver(observer Observer) Option {
+	return func(s *IprotoServer) {
+		s.observer = observer
+	}
+}
+
+// nopObserver Observer of IprotoServer created without WithObserver
+type nopObserver struct{}
+
+func (nopObserver) ObserveRequest(api.Function, uint32, time.Duration) {}
+func (nopObserver) ConnectionOpened()                                  {}
+func (nopObserver) ConnectionClosed()                                  {}
+func (nopObserver) QueueLength(int, int)                               {}
+func (nopObserver) DecodeError()                                       {}
+func (nopObserver) RateLimited()                                       {}
+func (nopObserver) StateChanged(int)                                   {}
+
+// observe hooks observer into registry, rate limiter and storage of IprotoServer
+// and logs transitions of state of storage implementing storage.Watchable
+func (s *IprotoServer) observe() {
+	if s.observer == nil {
+		s.observer = nopObserver{}
+	} else {
+		s.registry.Observe(s.observer)
+		s.rateLimiter.OnReject(func(string) {
+			s.observer.RateLimited()
+		})
+	}
+	watchable, ok := (*s.stor).(storage.Watchable)
+	if !ok {
+		return
+	}
+	watch, err := watchable.Watch([]int{}, true, 0, storage.DROP_EVENTS)
+	if err != nil {
+		s.storageLogger.Error("watch of storage state error", logging.KEY_ERROR, err)
+		return
+	}
+	s.stateWatch = watch
+	s.stateDone = make(chan struct{})
+	go func() {
+		defer close(s.stateDone)
+		for event := range watch.Events() {
+			s.storageLogger.Info("storage state is changed", "state", storage.StateName(event.State))
+			s.observer.StateChanged(event.State)
+		}
+	}()
+}
+
+// stopObserving stops watching storage state for observer
+func (s *IprotoServer) stopObserving() {
+	if s.stateWatch != nil {
+		s.stateWatch.Cancel()
+		<-s.stateDone
+	}
+}
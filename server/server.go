@@ -1,61 +1,263 @@
 package server
 
 import (
+	"bufio"
 	"context"
+	"errors"
+	"fmt"
 	"github.com/Bambelbl/iproto-server/api"
+	"github.com/Bambelbl/iproto-server/codes"
+	"github.com/Bambelbl/iproto-server/logging"
 	"github.com/Bambelbl/iproto-server/packet/request_packet"
 	"github.com/Bambelbl/iproto-server/packet/response_packet"
+	"github.com/Bambelbl/iproto-server/proxy_protocol"
 	"github.com/Bambelbl/iproto-server/rate_limiter"
 	"github.com/Bambelbl/iproto-server/storage"
-	"log"
+	"github.com/Bambelbl/iproto-server/tracing"
+	"io"
 	"net"
 	"sync"
 	"time"
 )
 
 const (
-	MAX_PACKET_SIZE = 350
+	// MAX_BODY_SLACK bodies longer than storage values allow are answered with CLIENT_INVALID_BODY,
+	// frames longer than batch of values allows by more than MAX_BODY_SLACK bytes close the connection
+	MAX_BODY_SLACK = 64
+	IDLE_TIMEOUT   = 60 * time.Second
+	WRITE_TIMEOUT  = 2 * time.Second
+	MAX_IN_FLIGHT  = 64
+	// PROXY_HEADER_TIMEOUT time proxy has to send header of PROXY protocol after connecting
+	PROXY_HEADER_TIMEOUT = 5 * time.Second
 )
 
+// Delays between retries of failed accept, doubled on every failure in a row
 const (
-	CLIENT_INVALID_BODY      = 401
-	CLIENT_TOO_MANY_REQUESTS = 402
+	ACCEPT_MIN_DELAY = 5 * time.Millisecond
+	ACCEPT_MAX_DELAY = time.Second
+)
+
+const (
+	CLIENT_INVALID_BODY      = codes.INVALID_BODY
+	CLIENT_TOO_MANY_REQUESTS = codes.TOO_MANY_REQUESTS
 )
 
 type IprotoServer struct {
 	listener        net.Listener
-	logger          *log.Logger
+	logger          logging.Logger
+	storageLogger   logging.Logger
 	quit            chan struct{}
 	queueForClients chan struct{}
 	wg              sync.WaitGroup
 	stor            *storage.Storage
+	registry        *api.Registry
 	rateLimiter     *rate_limiter.RateLimiter
+	rateLimit       rate_limiter.Config
+	rateLimitPolicy rate_limiter.Policy
+	proxyProtocol   bool
+	idleTimeout     time.Duration
+	legacyBody      bool
+	storageConfig   storage.Config
+
+	snapshotter      *storage.Snapshotter
+	snapshotPath     string
+	snapshotInterval time.Duration
+	restoreSnapshot  bool
+
+	sweeper       *storage.Sweeper
+	sweepInterval time.Duration
+
+	watchBuffer int
+	watchPolicy storage.SlowPolicy
+
+	observer   Observer
+	stateWatch *storage.Watch
+	stateDone  chan struct{}
+
+	tracer *tracing.Tracer
+}
+
+// response response or notification queued for writing to the connection
+// with span of request it answers, span is ended once response is written
+type response struct {
+	packet response_packet.IprotoPacketResponse
+	span   *tracing.Span
+}
+
+// Option configures optional behaviour of IprotoServer
+type Option func(s *IprotoServer)
+
+// WithLegacyBody makes IprotoServer accept request bodies in legacy encoding
+// (msgpack bin holding little-endian uint32 index followed by raw string)
+// instead of msgpack values described in API
+func WithLegacyBody() Option {
+	return func(s *IprotoServer) {
+		s.legacyBody = true
+	}
+}
+
+// WithGeometry sets number of cells and max length of value of storage created by IprotoServer
+func WithGeometry(config storage.Config) Option {
+	return func(s *IprotoServer) {
+		s.storageConfig = config
+	}
+}
+
+// WithStorage makes IprotoServer serve stor instead of new in-memory SimpleStorage.
+// Storage implementing io.Closer is closed on Stop
+func WithStorage(stor storage.Storage) Option {
+	return func(s *IprotoServer) {
+		s.stor = &stor
+	}
+}
+
+// WithSnapshots makes IprotoServer write snapshots of storage to file at path
+// on ADM_STORAGE_SNAPSHOT and every interval, zero interval means on demand only.
+// If restore is set, storage is restored from the file at startup
+func WithSnapshots(path string, interval time.Duration, restore bool) Option {
+	return func(s *IprotoServer) {
+		s.snapshotPath = path
+		s.snapshotInterval = interval
+		s.restoreSnapshot = restore
+	}
+}
+
+// WithSweepInterval sets interval between sweeps of expired cells of storage,
+// storage.SWEEP_INTERVAL by default, zero interval disables sweeps: expired cells still read as empty
+func WithSweepInterval(interval time.Duration) Option {
+	return func(s *IprotoServer) {
+		s.sweepInterval = interval
+	}
+}
+
+// WithWatchBuffer sets number of notifications buffered for every STORAGE_WATCH subscription
+// and what happens when a client doesn't read them in time: storage.DROP_EVENTS drops notifications
+// and counts them in the next one, storage.CLOSE_WATCH closes the connection of the client
+func WithWatchBuffer(buffer int, policy storage.SlowPolicy) Option {
+	return func(s *IprotoServer) {
+		s.watchBuffer = buffer
+		s.watchPolicy = policy
+	}
+}
+
+// WithTracer makes IprotoServer trace requests by tracer: accept of connection, decode, rate limit check,
+// handler, waits for locks of storage and write of response are exported as spans.
+// Requests carrying trace context of client continue its trace
+func WithTracer(tracer *tracing.Tracer) Option {
+	return func(s *IprotoServer) {
+		s.tracer = tracer
+	}
+}
+
+// WithRateLimitAlgorithm sets algorithm limiting requests of every client, rate_limiter.GCRA by default
+func WithRateLimitAlgorithm(algorithm rate_limiter.Algorithm) Option {
+	return func(s *IprotoServer) {
+		s.rateLimit.Algorithm = algorithm
+	}
+}
+
+// WithRateLimitPolicy sets how clients are identified by rate limiter, which of them are allowed
+// or denied regardless of limits and which have custom limits. By default clients are identified by IP address
+func WithRateLimitPolicy(policy rate_limiter.Policy) Option {
+	return func(s *IprotoServer) {
+		s.rateLimitPolicy = policy
+	}
 }
 
-// NewIprotoServer initializes IprotoServer and starts it to listen
-func NewIprotoServer(addr string, logger *log.Logger, maxClients int, scale_rps int64, limit_rps uint32) *IprotoServer {
+// WithProxyProtocol makes IprotoServer expect header of PROXY protocol at the start of every connection,
+// as sent by HAProxy or other proxy in front of the server. Connections without it are closed.
+// Address and id of client from header are used by rate limiter if its policy says so
+func WithProxyProtocol() Option {
+	return func(s *IprotoServer) {
+		s.proxyProtocol = true
+	}
+}
+
+// NewIprotoServer initializes IprotoServer and starts it to listen. Every client may send up to limit_rps
+// requests per scale_rps milliseconds
+func NewIprotoServer(addr string, logger logging.Logger, maxClients int, scale_rps int64, limit_rps uint32, opts ...Option) *IprotoServer {
 	s := &IprotoServer{
-		logger:          logger,
+		logger:          logger.With(logging.KEY_COMPONENT, "server"),
+		storageLogger:   logger.With(logging.KEY_COMPONENT, "storage"),
 		quit:            make(chan struct{}),
 		queueForClients: make(chan struct{}, maxClients),
-		rateLimiter:     rate_limiter.NewRateLimiter(logger, scale_rps, limit_rps),
+		rateLimit: rate_limiter.Config{
+			Algorithm: rate_limiter.GCRA,
+			Limit:     limit_rps,
+			Scale:     time.Duration(scale_rps) * time.Millisecond,
+		},
+		idleTimeout:   IDLE_TIMEOUT,
+		storageConfig: storage.DefaultConfig(),
+		sweepInterval: storage.SWEEP_INTERVAL,
+		watchBuffer:   storage.WATCH_BUFFER,
+		watchPolicy:   storage.CLOSE_WATCH,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	rateLimiter, err := rate_limiter.NewRateLimiter(logger.With(logging.KEY_COMPONENT, "rate_limiter"), s.rateLimit, s.rateLimitPolicy)
+	if err != nil {
+		logging.Fatal(s.logger, "wrong rate limit", "limit", s.rateLimit.Limit, "scale", s.rateLimit.Scale, logging.KEY_ERROR, err)
+	}
+	s.rateLimiter = rateLimiter
+	if s.stor == nil {
+		stor := storage.NewSimpleStorageRepo(s.storageConfig)
+		s.stor = &stor
+	}
+	if s.snapshotPath != "" {
+		s.snapshotter = storage.NewSnapshotter(*s.stor, s.snapshotPath)
+		if s.restoreSnapshot {
+			if err := s.snapshotter.Restore(); err != nil {
+				logging.Fatal(s.logger, "restore from snapshot error", "path", s.snapshotPath, logging.KEY_ERROR, err)
+			}
+			s.logger.Info("storage is restored from snapshot", "path", s.snapshotPath)
+		}
 	}
-	stor := storage.NewSimpleStorageRepo()
-	s.stor = &stor
+	if expiring, ok := (*s.stor).(storage.Expiring); ok && s.sweepInterval > 0 {
+		s.sweeper = storage.NewSweeper(expiring)
+	}
+	s.registry = api.NewRegistry()
+	s.registry.OnPanic(func(func_id uint32, recovered interface{}, stack []byte) {
+		s.logger.Error("handler panic", logging.KEY_FUNC_ID, funcID(func_id), "panic", recovered, "stack", string(stack))
+	})
+	api.RegisterStorage(s.registry, s.stor, s.snapshotter)
+	s.observe()
 	l, err := net.Listen("tcp", addr)
 	if err != nil {
-		s.logger.Fatal("Server: listen err: %s", err.Error())
+		logging.Fatal(s.logger, "listen error", "addr", addr, logging.KEY_ERROR, err)
 	}
 	s.listener = l
 	return s
 }
 
+// Registry returns registry of functions served by IprotoServer,
+// custom functions may be registered in it before Serve
+func (s *IprotoServer) Registry() *api.Registry {
+	return s.registry
+}
+
+// Addr returns the address IprotoServer is listening on
+func (s *IprotoServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
 // Serve listen and serve for IprotoServer
 func (s *IprotoServer) Serve() {
-	s.logger.Println("Server starts to serve...")
+	s.logger.Info("server starts to serve", "addr", s.Addr().String())
+	if s.snapshotter != nil && s.snapshotInterval > 0 {
+		s.snapshotter.Start(s.snapshotInterval, func(err error) {
+			s.logger.Error("snapshot error", "path", s.snapshotPath, logging.KEY_ERROR, err)
+		})
+	}
+	if s.sweeper != nil {
+		s.sweeper.Start(s.sweepInterval, func(err error) {
+			s.storageLogger.Error("sweep error", logging.KEY_ERROR, err)
+		})
+	}
 	s.wg.Add(1)
 	go func() {
 		defer s.wg.Done()
+		var delay time.Duration
 		for {
 			conn, err := s.listener.Accept()
 			if err != nil {
@@ -63,89 +265,380 @@ func (s *IprotoServer) Serve() {
 				case <-s.quit:
 					return
 				default:
-					s.logger.Println("Server: accept error: %s", err)
 				}
-			} else {
-				s.wg.Add(1)
-				s.queueForClients <- struct{}{}
-				go func() {
-					endOfHandler := make(chan struct{})
-					ctx, _ := context.WithTimeout(context.Background(), 2*time.Second)
-					go s.handleConnection(conn, ctx, endOfHandler)
-					select {
-					case <-ctx.Done():
-						s.logger.Println("Server: timeout for handler")
-					case <-endOfHandler:
-						s.logger.Println("Server: handler finished")
-					}
-					close(endOfHandler)
-					s.wg.Done()
-				}()
+				// Errors like EMFILE last for a while, retries are delayed not to spin on them
+				delay = acceptDelay(delay)
+				s.logger.Warn("accept error", logging.KEY_ERROR, err, "retry_in", delay)
+				select {
+				case <-time.After(delay):
+				case <-s.quit:
+					return
+				}
+				continue
+			}
+			delay = 0
+			_, accept := s.tracer.Start(context.Background(), "iproto.accept", tracing.WithKind(tracing.KIND_SERVER),
+				tracing.WithAttributes(tracing.ATTR_CLIENT_ADDRESS, conn.RemoteAddr().String()))
+			select {
+			case s.queueForClients <- struct{}{}:
+				accept.End()
+				s.observer.QueueLength(len(s.queueForClients), cap(s.queueForClients))
+			case <-s.quit:
+				accept.SetError(net.ErrClosed)
+				accept.End()
+				s.closeConnection(conn)
+				return
 			}
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.handleConnection(conn)
+				s.logger.Info("handler finished", logging.KEY_REMOTE_ADDR, conn.RemoteAddr().String())
+			}()
 		}
 	}()
 }
 
-// handleConnection handler for incoming requests to IprotoServer
-func (s *IprotoServer) handleConnection(conn net.Conn, ctx context.Context, endOfHandler chan struct{}) {
+// acceptDelay returns delay before the next retry of accept after delay before the previous one
+func acceptDelay(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return ACCEPT_MIN_DELAY
+	}
+	if delay *= 2; delay > ACCEPT_MAX_DELAY {
+		return ACCEPT_MAX_DELAY
+	}
+	return delay
+}
+
+// handleConnection serves one client connection until the client closes it, the connection
+// stays idle for too long or the server stops, then frees its place in queue of clients
+func (s *IprotoServer) handleConnection(conn net.Conn) {
+	endOfHandler := make(chan struct{})
+	s.observer.ConnectionOpened()
 	defer func() {
+		close(endOfHandler)
 		<-s.queueForClients
-		endOfHandler <- struct{}{}
-		err := conn.Close()
-		if err != nil {
-			s.logger.Println("Server: connection close error: %s", err.Error())
+		s.closeConnection(conn)
+		s.observer.ConnectionClosed()
+		s.observer.QueueLength(len(s.queueForClients), cap(s.queueForClients))
+	}()
+	go func() {
+		select {
+		case <-s.quit:
+			s.closeConnection(conn)
+		case <-endOfHandler:
 		}
 	}()
-	buf := make([]byte, MAX_PACKET_SIZE)
-	_, err := conn.Read(buf)
+
+	reader := bufio.NewReader(conn)
+	client, err := s.identify(conn, reader)
 	if err != nil {
-		s.logger.Println("Server: read from request error: %s", err.Error())
+		logger := s.logger.With(logging.KEY_REMOTE_ADDR, conn.RemoteAddr().String())
+		if errors.Is(err, proxy_protocol.ErrNoHeader) || errors.Is(err, proxy_protocol.ErrBadHeader) {
+			logger.Warn("PROXY protocol header error", logging.KEY_ERROR, err)
+		} else {
+			logReadError(logger, err)
+		}
 		return
 	}
-	var responseBody string
-	var returnCode uint32
-	var requestPacket request_packet.IprotoPacketRequest
-	if s.rateLimiter.ValidRate(conn.RemoteAddr().String()) {
-		requestPacket, err = request_packet.Unmarshal(buf)
-		if err != nil {
-			s.logger.Println("Server: unmarshal error: %s", err.Error())
-			responseBody = "Invalid body in request packet"
-			returnCode = CLIENT_INVALID_BODY
-		} else {
-			responseBody, returnCode = api.Handler(requestPacket, s.stor)
+	s.serveConnection(conn, reader, client)
+}
+
+// identify returns client of connection. With PROXY protocol address and id of client behind proxy
+// are read from header at the start of connection
+func (s *IprotoServer) identify(conn net.Conn, reader *bufio.Reader) (rate_limiter.Client, error) {
+	client := rate_limiter.Client{Addr: conn.RemoteAddr()}
+	if !s.proxyProtocol {
+		return client, nil
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(PROXY_HEADER_TIMEOUT)); err != nil {
+		return client, err
+	}
+	header, err := proxy_protocol.ReadHeader(reader)
+	if err != nil {
+		return client, err
+	}
+	client.Source, client.ID = header.Source, header.ClientID
+	return client, nil
+}
+
+// serveConnection serves requests of client read from reader of its connection.
+// Requests are handled concurrently, up to MAX_IN_FLIGHT at a time, and responses
+// are written back in order of completion by a single writer goroutine together with
+// notifications of subscriptions made by STORAGE_WATCH
+func (s *IprotoServer) serveConnection(conn net.Conn, reader *bufio.Reader, client rate_limiter.Client) {
+	responses := make(chan response, MAX_IN_FLIGHT)
+	inFlight := make(chan struct{}, MAX_IN_FLIGHT)
+	endOfWriter := make(chan struct{})
+	var handlers sync.WaitGroup
+	logger := s.logger.With(logging.KEY_REMOTE_ADDR, conn.RemoteAddr().String())
+	if client.Source != nil {
+		logger = logger.With(logging.KEY_SOURCE_ADDR, client.Source.String())
+	}
+	if client.ID != "" {
+		logger = logger.With(logging.KEY_CLIENT_ID, client.ID)
+	}
+	go func() {
+		defer close(endOfWriter)
+		s.writeResponses(conn, responses, logger)
+	}()
+	sess := s.newSession(responses, func(requestID uint32) {
+		logger.Warn("watch overflowed, closing connection", logging.KEY_REQUEST_ID, requestID)
+		s.closeConnection(conn)
+	})
+	ctx := api.WithSession(context.Background(), sess)
+	defer func() {
+		handlers.Wait()
+		sess.close()
+		close(responses)
+		<-endOfWriter
+	}()
+
+	maxValueSize := (*s.stor).Config().MaxValueBytes()
+	decoder := request_packet.NewDecoder(reader, request_packet.MaxBatchBodyLength(maxValueSize)+MAX_BODY_SLACK).
+		LimitValueSize(maxValueSize).AllowBatch(api.STORAGE_READ_MANY_ID, api.STORAGE_REPLACE_MANY_ID, api.STORAGE_WATCH_ID).
+		UseLegacyBody(s.legacyBody)
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(s.idleTimeout)); err != nil {
+			logger.Error("set read deadline error", logging.KEY_ERROR, err)
+			return
 		}
-	} else {
-		responseBody = "Too many requests"
-		returnCode = CLIENT_TOO_MANY_REQUESTS
-	}
-	response, err := response_packet.Marshal(response_packet.IprotoPacketResponse{
-		Header: response_packet.IprotoHeader{
-			Func_id:     requestPacket.Header.Func_id,
-			Body_length: 0,
-			Request_id:  requestPacket.Header.Request_id},
+		var decodeStart time.Time
+		if s.tracer != nil {
+			// Decode is timed from arrival of the first byte, not from the start of idle wait
+			if _, err := reader.Peek(1); err != nil {
+				logReadError(logger, err)
+				return
+			}
+			decodeStart = time.Now()
+		}
+		requestPacket, err := decoder.Decode()
+		decodeEnd := time.Now()
+		if err != nil && !errors.Is(err, request_packet.ErrMalformedBody) {
+			if errors.Is(err, request_packet.ErrFrameTooLarge) {
+				// The rest of the stream can't be trusted anymore, so answer and hang up
+				logger.Warn("decode error", logging.KEY_FUNC_ID, funcID(requestPacket.Header.Func_id),
+					logging.KEY_REQUEST_ID, requestPacket.Header.Request_id, logging.KEY_ERROR, err)
+				s.observer.DecodeError()
+				responses <- response{packet: invalidBodyResponse(requestPacket.Header)}
+			} else {
+				logReadError(logger, err)
+			}
+			return
+		}
+		inFlight <- struct{}{}
+		handlers.Add(1)
+		go func() {
+			defer func() {
+				<-inFlight
+				handlers.Done()
+			}()
+			start := time.Now()
+			ctx, span := s.traceRequest(ctx, client, requestPacket, err, decodeStart, decodeEnd)
+			packet := s.handleRequest(ctx, client, requestPacket, err)
+			logRequest(logger, packet, time.Since(start))
+			responses <- response{packet: packet, span: span}
+			if requestPacket.Header.Func_id == api.STORAGE_WATCH_ID {
+				sess.start(requestPacket.Header.Request_id)
+			}
+		}()
+	}
+}
+
+// traceRequest starts span of request continuing trace of client, if the request carries its context,
+// and records decode of the request as its child span. Span of request is kept in returned context.
+// Without tracer or if trace isn't sampled, nil span is returned
+func (s *IprotoServer) traceRequest(ctx context.Context, client rate_limiter.Client, requestPacket request_packet.IprotoPacketRequest,
+	decodeErr error, decodeStart time.Time, decodeEnd time.Time) (context.Context, *tracing.Span) {
+	if s.tracer == nil {
+		return ctx, nil
+	}
+	var parent tracing.SpanContext
+	if requestPacket.Trace != nil {
+		// Broken context of client only loses the link to its trace
+		parent, _ = tracing.ParseSpanContext(requestPacket.Trace)
+	}
+	ctx, span := s.tracer.Start(ctx, "iproto.request", tracing.WithKind(tracing.KIND_SERVER),
+		tracing.WithStartTime(decodeStart), tracing.WithParent(parent),
+		tracing.WithAttributes(tracing.ATTR_CLIENT_ADDRESS, client.String(), tracing.ATTR_FUNC_ID, funcID(requestPacket.Header.Func_id),
+			tracing.ATTR_REQUEST_ID, requestPacket.Header.Request_id))
+	_, decode := tracing.Start(ctx, "iproto.decode", tracing.WithStartTime(decodeStart),
+		tracing.WithAttributes("iproto.body_length", requestPacket.Header.Body_length))
+	decode.SetError(decodeErr)
+	decode.EndAt(decodeEnd)
+	return ctx, span
+}
+
+// handleRequest validates client rate and dispatches successfully decoded packet through registry
+func (s *IprotoServer) handleRequest(ctx context.Context, client rate_limiter.Client, requestPacket request_packet.IprotoPacketRequest, decodeErr error) response_packet.IprotoPacketResponse {
+	start := time.Now()
+	_, check := tracing.Start(ctx, "rate_limiter.check")
+	allowed := s.rateLimiter.ValidRate(client)
+	check.SetAttributes("rate_limiter.allowed", allowed)
+	check.End()
+	if !allowed {
+		s.observeRequest(requestPacket.Header.Func_id, CLIENT_TOO_MANY_REQUESTS, start)
+		return response_packet.IprotoPacketResponse{
+			Header:      responseHeader(requestPacket.Header),
+			Return_code: CLIENT_TOO_MANY_REQUESTS,
+			Body:        codes.ErrRateLimited.Error(),
+		}
+	}
+	if decodeErr != nil {
+		s.logger.Warn("decode error", logging.KEY_REMOTE_ADDR, client.String(), logging.KEY_FUNC_ID, funcID(requestPacket.Header.Func_id),
+			logging.KEY_REQUEST_ID, requestPacket.Header.Request_id, logging.KEY_ERROR, decodeErr)
+		s.observer.DecodeError()
+		s.observeRequest(requestPacket.Header.Func_id, CLIENT_INVALID_BODY, start)
+		return invalidBodyResponse(requestPacket.Header)
+	}
+	responseBody, returnCode := s.registry.Handle(ctx, requestPacket)
+	return response_packet.IprotoPacketResponse{
+		Header:      responseHeader(requestPacket.Header),
 		Return_code: returnCode,
 		Body:        responseBody,
-	})
-	if err != nil {
-		s.logger.Println("Server: marshal response error: %s", err.Error())
+	}
+}
+
+// observeRequest reports request answered before registry, so observer counts requests rejected
+// by rate limiter or decoder along with handled ones
+func (s *IprotoServer) observeRequest(func_id uint32, returnCode uint32, start time.Time) {
+	function, exist := s.registry.Lookup(func_id)
+	if !exist {
+		function = api.Function{Func_id: func_id}
+	}
+	s.observer.ObserveRequest(function, returnCode, time.Since(start))
+}
+
+// logRequest writes record of handled request with its func_id, request_id, return code and duration of handling
+func logRequest(logger logging.Logger, response response_packet.IprotoPacketResponse, duration time.Duration) {
+	if !logger.Enabled(logging.DEBUG) {
 		return
 	}
-	_, err = conn.Write(response)
+	logger.Debug("request handled", logging.KEY_FUNC_ID, funcID(response.Header.Func_id),
+		logging.KEY_REQUEST_ID, response.Header.Request_id, logging.KEY_RETURN_CODE, response.Return_code,
+		logging.KEY_DURATION, duration)
+}
+
+// funcID formats func_id the way it's written in API
+func funcID(id uint32) string {
+	return fmt.Sprintf("0x%08x", id)
+}
+
+// responseHeader makes header of response to the request with given header
+func responseHeader(header request_packet.IprotoHeader) response_packet.IprotoHeader {
+	return response_packet.IprotoHeader{
+		Func_id:    header.Func_id,
+		Request_id: header.Request_id,
+	}
+}
+
+// invalidBodyResponse makes response to the request which can't be decoded
+func invalidBodyResponse(header request_packet.IprotoHeader) response_packet.IprotoPacketResponse {
+	return response_packet.IprotoPacketResponse{
+		Header:      responseHeader(header),
+		Return_code: CLIENT_INVALID_BODY,
+		Body:        codes.ErrBadBody.Error(),
+	}
+}
+
+// writeResponses writes responses to the connection until the channel is closed.
+// Responses are buffered and flushed once there is nothing more to write right now.
+// After a write error the connection is closed and the rest of responses are dropped
+func (s *IprotoServer) writeResponses(conn net.Conn, responses <-chan response, logger logging.Logger) {
+	writer := bufio.NewWriter(conn)
+	failed := false
+	for r := range responses {
+		if failed {
+			endRequest(r, net.ErrClosed)
+			continue
+		}
+		_, write := tracing.Start(tracing.ContextWithSpan(context.Background(), r.span), "iproto.write")
+		err := writeResponse(conn, writer, r.packet, len(responses) == 0, logger)
+		write.SetError(err)
+		write.End()
+		endRequest(r, err)
+		if err != nil {
+			logger.Warn("write response error", logging.KEY_ERROR, err)
+			failed = true
+			s.closeConnection(conn)
+		}
+	}
+}
+
+// writeResponse writes packet to writer, writer is flushed if flush is set
+func writeResponse(conn net.Conn, writer *bufio.Writer, packet response_packet.IprotoPacketResponse,
+	flush bool, logger logging.Logger) error {
+	response, err := response_packet.Marshal(packet)
 	if err != nil {
-		s.logger.Println("Server: write response error: %s", err.Error())
+		logger.Error("marshal response error", logging.KEY_FUNC_ID, funcID(packet.Header.Func_id),
+			logging.KEY_REQUEST_ID, packet.Header.Request_id, logging.KEY_ERROR, err)
+		response, _ = response_packet.Marshal(response_packet.IprotoPacketResponse{
+			Header:      packet.Header,
+			Return_code: api.HANDLER_ERROR,
+			Body:        "Response can't be encoded",
+		})
+	}
+	if err = conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT)); err != nil {
+		return err
+	}
+	if _, err = writer.Write(response); err == nil && flush {
+		err = writer.Flush()
+	}
+	return err
+}
+
+// endRequest ends span of request answered by r, the span fails if the request isn't answered
+// successfully or the response can't be written
+func endRequest(r response, writeErr error) {
+	if r.span == nil {
+		return
+	}
+	r.span.SetAttributes(tracing.ATTR_RETURN_CODE, r.packet.Return_code)
+	if writeErr == nil && r.packet.Return_code != api.RETURN_OK {
+		writeErr = fmt.Errorf("return code %d", r.packet.Return_code)
+	}
+	r.span.SetError(writeErr)
+	r.span.End()
+}
+
+// logReadError logs read errors except the ones caused by client hanging up or server stopping
+func logReadError(logger logging.Logger, err error) {
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		return
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		logger.Info("idle timeout for connection")
 		return
 	}
+	logger.Warn("read from request error", logging.KEY_ERROR, err)
+}
+
+// closeConnection closes the connection and logs unexpected errors
+func (s *IprotoServer) closeConnection(conn net.Conn) {
+	if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		s.logger.Warn("connection close error", logging.KEY_REMOTE_ADDR, conn.RemoteAddr().String(), logging.KEY_ERROR, err)
+	}
 }
 
 // Stop shutdown to IprotoServer
 func (s *IprotoServer) Stop() error {
 	close(s.quit)
-	close(s.queueForClients)
 	s.rateLimiter.Stop()
 	err := s.listener.Close()
 	if err != nil {
 		return err
 	}
 	s.wg.Wait()
+	if s.snapshotter != nil {
+		s.snapshotter.Stop()
+	}
+	if s.sweeper != nil {
+		s.sweeper.Stop()
+	}
+	s.stopObserving()
+	if closer, ok := (*s.stor).(io.Closer); ok {
+		return closer.Close()
+	}
 	return nil
 }
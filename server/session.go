@@ -0,0 +1,145 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Bambelbl/iproto-server/api"
+	"github.com/Bambelbl/iproto-server/packet/response_packet"
+	"github.com/Bambelbl/iproto-server/storage"
+	"sync"
+)
+
+// MAX_WATCHES max number of subscriptions of one connection
+const MAX_WATCHES = 16
+
+var (
+	// errWatchNotSupported storage doesn't notify about changes
+	errWatchNotSupported = errors.New("storage doesn't notify about changes")
+	// errTooManyWatches connection has MAX_WATCHES subscriptions already
+	errTooManyWatches = fmt.Errorf("connection may have at most %d watches", MAX_WATCHES)
+	// errSessionClosed connection is closing
+	errSessionClosed = errors.New("connection is closing")
+)
+
+// session api.Session of one connection: it forwards events of storage watches to the connection
+// as notifications, the connection is closed by onOverflow when a watch can't keep up with changes
+type session struct {
+	stor       storage.Storage
+	buffer     int
+	policy     storage.SlowPolicy
+	responses  chan<- response
+	onOverflow func(requestID uint32)
+
+	mutex      sync.Mutex
+	watches    map[uint32]*sessionWatch
+	closed     bool
+	forwarders sync.WaitGroup
+}
+
+// sessionWatch watch of session, its events are forwarded once response to STORAGE_WATCH is sent
+type sessionWatch struct {
+	watch   *storage.Watch
+	started bool
+}
+
+// newSession makes session pushing notifications to responses
+func (s *IprotoServer) newSession(responses chan<- response, onOverflow func(requestID uint32)) *session {
+	return &session{
+		stor:       *s.stor,
+		buffer:     s.watchBuffer,
+		policy:     s.watchPolicy,
+		responses:  responses,
+		onOverflow: onOverflow,
+		watches:    make(map[uint32]*sessionWatch),
+	}
+}
+
+// Watch Subscribe connection to changes of cells idxs, all cells if idxs is nil, and to transitions
+// of state if state is set. Changes are pushed once start is called for requestID
+func (s *session) Watch(requestID uint32, idxs []int, state bool) error {
+	watchable, ok := s.stor.(storage.Watchable)
+	if !ok {
+		return errWatchNotSupported
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return errSessionClosed
+	}
+	if _, exist := s.watches[requestID]; exist {
+		return fmt.Errorf("request_id %d is already watching", requestID)
+	}
+	if len(s.watches) >= MAX_WATCHES {
+		return errTooManyWatches
+	}
+	watch, err := watchable.Watch(idxs, state, s.buffer, s.policy)
+	if err != nil {
+		return err
+	}
+	s.watches[requestID] = &sessionWatch{watch: watch}
+	return nil
+}
+
+// Unwatch Cancel subscription made by request with requestID, notifications already
+// buffered for it may still come
+func (s *session) Unwatch(requestID uint32) error {
+	s.mutex.Lock()
+	w, exist := s.watches[requestID]
+	delete(s.watches, requestID)
+	s.mutex.Unlock()
+	if !exist {
+		return fmt.Errorf("request_id %d isn't watching", requestID)
+	}
+	w.watch.Cancel()
+	return nil
+}
+
+// start starts forwarding events of watch made by request with requestID, it's called
+// after response to the request is sent, so notifications never come before it
+func (s *session) start(requestID uint32) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	w, exist := s.watches[requestID]
+	if !exist || w.started || s.closed {
+		return
+	}
+	w.started = true
+	s.forwarders.Add(1)
+	go s.forward(requestID, w.watch)
+}
+
+// forward pushes events of watch to the connection until the watch is closed
+func (s *session) forward(requestID uint32, watch *storage.Watch) {
+	defer s.forwarders.Done()
+	for event := range watch.Events() {
+		s.responses <- response{packet: response_packet.IprotoPacketResponse{
+			Header: response_packet.IprotoHeader{Func_id: api.STORAGE_NOTIFY_ID, Request_id: requestID},
+			Body: api.Notification{
+				Idx:     event.Idx,
+				Str:     event.Value,
+				Version: event.Version,
+				State:   event.State,
+				Dropped: event.Dropped,
+			},
+		}}
+	}
+	if errors.Is(watch.Err(), storage.ErrWatchOverflow) {
+		s.mutex.Lock()
+		delete(s.watches, requestID)
+		s.mutex.Unlock()
+		s.onOverflow(requestID)
+	}
+}
+
+// close cancels all watches and waits until their buffered events are pushed
+func (s *session) close() {
+	s.mutex.Lock()
+	s.closed = true
+	watches := s.watches
+	s.watches = nil
+	s.mutex.Unlock()
+	for _, w := range watches {
+		w.watch.Cancel()
+	}
+	s.forwarders.Wait()
+}
@@ -1,20 +1,156 @@
 package storage
 
 import (
-	"errors"
 	"fmt"
+	"github.com/Bambelbl/iproto-server/codes"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 )
 
 const (
-	SIZE = 1000
+	SIZE           = 1000
+	MAX_VALUE_SIZE = 256
 )
 
+// Config geometry of storage
+type Config struct {
+	// Size number of cells, valid indexes are in [0;Size-1]
+	Size int
+	// MaxValueSize max length of value in bytes, or in runes if CountRunes is set
+	MaxValueSize int
+	// CountRunes makes MaxValueSize limit number of UTF-8 runes of value instead of bytes
+	CountRunes bool
+}
+
+// MaxValueBytes returns max length of value in bytes
+func (c Config) MaxValueBytes() int {
+	if c.CountRunes {
+		return c.MaxValueSize * utf8.UTFMax
+	}
+	return c.MaxValueSize
+}
+
+var (
+	// ErrValueTooLarge value is longer than MaxValueSize of storage
+	ErrValueTooLarge = codes.ErrValueTooLarge
+	// ErrOutOfRange index is out of range of storage
+	ErrOutOfRange = codes.ErrOutOfRange
+	// ErrWrongState state of storage doesn't allow the operation
+	ErrWrongState = codes.ErrWrongState
+	// ErrMismatch current value of the cell doesn't match expected one
+	ErrMismatch = codes.ErrMismatch
+	// ErrBadTTL time to live of value isn't positive
+	ErrBadTTL = fmt.Errorf("%w: time to live must be positive", codes.ErrBadBody)
+)
+
+// MismatchError conditional write failed, it holds current value of the cell
+type MismatchError struct {
+	Current string
+}
+
+func (e *MismatchError) Error() string {
+	return ErrMismatch.Error()
+}
+
+func (e *MismatchError) Unwrap() error {
+	return ErrMismatch
+}
+
+// ResponseBody current value of the cell is sent to client instead of description of error
+func (e *MismatchError) ResponseBody() interface{} {
+	return e.Current
+}
+
+// VersionMismatchError write conditioned on version of the cell failed, it holds current version
+type VersionMismatchError struct {
+	Current uint64
+}
+
+func (e *VersionMismatchError) Error() string {
+	return fmt.Sprintf("%s: current version is %d", ErrMismatch.Error(), e.Current)
+}
+
+func (e *VersionMismatchError) Unwrap() error {
+	return ErrMismatch
+}
+
+// ResponseBody current version of the cell is sent to client instead of description of error
+func (e *VersionMismatchError) ResponseBody() interface{} {
+	return e.Current
+}
+
+// Cell value of storage cell with its version and time of its last change
+type Cell struct {
+	Value string
+	// Version grows by one with every write to the cell, never written cell has version 0
+	Version uint64
+	// Modified time of the last write, zero if it's unknown
+	Modified time.Time
+	// Expires time the value expires at, zero if it doesn't expire
+	Expires time.Time
+}
+
+// cellMeta version, time of the last write and time of expiry of cell in unix nanoseconds
+type cellMeta struct {
+	version  uint64
+	modified int64
+	expires  int64
+}
+
+// cell returns Cell of value and its meta
+func (m cellMeta) cell(value string) Cell {
+	c := Cell{Value: value, Version: m.version}
+	if m.modified != 0 {
+		c.Modified = time.Unix(0, m.modified)
+	}
+	if m.expires != 0 {
+		c.Expires = time.Unix(0, m.expires)
+	}
+	return c
+}
+
+// expired reports whether value of cell is expired at now
+func (m cellMeta) expired(now int64) bool {
+	return m.expires != 0 && now >= m.expires
+}
+
+// current returns value and meta of cell idx at now, the cell must be locked. Expired cell is empty
+// and has meta it gets when it's swept, so readers see the same before and after sweep
+func (s *SimpleStorage) current(idx int, now int64) (string, cellMeta) {
+	meta := s.meta[idx]
+	if meta.expired(now) {
+		return "", cellMeta{version: meta.version + 1, modified: meta.expires}
+	}
+	return s.data[idx], meta
+}
+
+// DefaultConfig returns geometry of storage used by default: SIZE cells of MAX_VALUE_SIZE bytes
+func DefaultConfig() Config {
+	return Config{Size: SIZE, MaxValueSize: MAX_VALUE_SIZE}
+}
+
 type SimpleStorage struct {
+	config    Config
 	state     int
 	mutex     sync.RWMutex
-	data      [SIZE]string
-	dataMutex [SIZE]sync.RWMutex
+	data      []string
+	meta      []cellMeta
+	dataMutex []sync.RWMutex
+	wal       *wal
+
+	// stateMutex orders writes of state, so they are applied in order of their records in the log
+	stateMutex sync.Mutex
+	// writeMutex is held for reading by every write from its record in the log to its last changed cell,
+	// snapshot takes it for writing to start at a point where no write is half-applied
+	writeMutex    sync.RWMutex
+	snapshotMutex sync.Mutex
+	snapshot      atomic.Pointer[snapshotCopy]
+
+	watches watchHub
 }
 
 const (
@@ -23,50 +159,353 @@ const (
 	READ_WRITE  = 2
 )
 
-func NewSimpleStorageRepo() Storage {
-	return &SimpleStorage{state: READ_WRITE}
+// StateName Return name of state of storage
+func StateName(state int) string {
+	switch state {
+	case MAINTENANCE:
+		return "MAINTENANCE"
+	case READ_ONLY:
+		return "READ_ONLY"
+	case READ_WRITE:
+		return "READ_WRITE"
+	}
+	return strconv.Itoa(state)
+}
+
+func NewSimpleStorageRepo(config Config) Storage {
+	return newSimpleStorage(config)
+}
+
+// newSimpleStorage initializes SimpleStorage with cells of config in READ_WRITE state
+func newSimpleStorage(config Config) *SimpleStorage {
+	return &SimpleStorage{
+		config:    config,
+		state:     READ_WRITE,
+		data:      make([]string, config.Size),
+		meta:      make([]cellMeta, config.Size),
+		dataMutex: make([]sync.RWMutex, config.Size),
+	}
+}
+
+// Config Return geometry of storage
+func (s *SimpleStorage) Config() Config {
+	return s.config
 }
 
 // GetState Return current state of storage
 func (s *SimpleStorage) GetState() (state int) {
-	s.mutex.RLock()
+	return s.getState(nil)
+}
+
+// getState returns current state of storage, wait for its lock is reported to onWait
+func (s *SimpleStorage) getState(onWait lockWait) (state int) {
+	rlock(&s.mutex, onWait)
 	state = s.state
 	s.mutex.RUnlock()
 	return
 }
 
 // SetState Set new value of state for storage
-func (s *SimpleStorage) SetState(state int) {
+func (s *SimpleStorage) SetState(state int) (err error) {
+	s.writeMutex.RLock()
+	defer s.writeMutex.RUnlock()
+	// State is locked only to apply it, so readers don't wait for fsync of the record
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	if s.wal != nil {
+		if err = s.wal.write(setStateRecord(state)); err != nil {
+			return
+		}
+	}
 	s.mutex.Lock()
 	s.state = state
 	s.mutex.Unlock()
+	s.watches.notify(Event{Idx: STATE_EVENT, State: state})
 	return
 }
 
 // GetValue Return value from storage by index
 func (s *SimpleStorage) GetValue(idx int) (data string, err error) {
-	if (*s).GetState() == MAINTENANCE {
-		return "", errors.New("storage state doesn't allow this operation")
+	return s.getValue(idx, nil)
+}
+
+func (s *SimpleStorage) getValue(idx int, onWait lockWait) (data string, err error) {
+	if s.getState(onWait) == MAINTENANCE {
+		return "", ErrWrongState
 	}
-	if idx < 0 || idx >= SIZE {
-		return "", fmt.Errorf("index is out of range: valid index is in [0;%d]", SIZE)
+	if idx < 0 || idx >= len(s.data) {
+		return "", fmt.Errorf("%w: valid index is in [0;%d]", ErrOutOfRange, len(s.data)-1)
 	}
-	s.dataMutex[idx].RLock()
-	data = s.data[idx]
+	rlock(&s.dataMutex[idx], onWait)
+	data, _ = s.current(idx, time.Now().UnixNano())
 	s.dataMutex[idx].RUnlock()
 	return
 }
 
+// GetCell Return value from storage by index together with its version and time of the last write
+func (s *SimpleStorage) GetCell(idx int) (cell Cell, err error) {
+	return s.getCell(idx, nil)
+}
+
+func (s *SimpleStorage) getCell(idx int, onWait lockWait) (cell Cell, err error) {
+	if s.getState(onWait) == MAINTENANCE {
+		return cell, ErrWrongState
+	}
+	if idx < 0 || idx >= len(s.data) {
+		return cell, fmt.Errorf("%w: valid index is in [0;%d]", ErrOutOfRange, len(s.data)-1)
+	}
+	rlock(&s.dataMutex[idx], onWait)
+	str, meta := s.current(idx, time.Now().UnixNano())
+	s.dataMutex[idx].RUnlock()
+	cell = meta.cell(str)
+	return
+}
+
 // SetValue Set value to known index of storage
-func (s *SimpleStorage) SetValue(idx int, str string) (err error) {
-	if (*s).GetState() != READ_WRITE {
-		return errors.New("storage state doesn't allow this operation")
+func (s *SimpleStorage) SetValue(idx int, str string) error {
+	return s.replace(idx, str, 0, nil, nil)
+}
+
+// GetValues Return values from storage by indexes as of one moment: cells are locked in index order
+// for the whole batch. Out of range indexes get their errors in errs, values of them are empty
+func (s *SimpleStorage) GetValues(idxs []int) (values []string, errs []error, err error) {
+	return s.getValues(idxs, nil)
+}
+
+func (s *SimpleStorage) getValues(idxs []int, onWait lockWait) (values []string, errs []error, err error) {
+	if s.getState(onWait) == MAINTENANCE {
+		return nil, nil, ErrWrongState
 	}
-	if idx < 0 || idx >= SIZE {
-		return fmt.Errorf("index is out of range: valid index is in [0;%d]", SIZE)
+	values = make([]string, len(idxs))
+	errs = make([]error, len(idxs))
+	locked := make([]int, 0, len(idxs))
+	for i, idx := range idxs {
+		if idx < 0 || idx >= len(s.data) {
+			errs[i] = fmt.Errorf("%w: valid index is in [0;%d]", ErrOutOfRange, len(s.data)-1)
+			continue
+		}
+		locked = append(locked, idx)
+	}
+	locked = lockOrder(locked)
+	for _, idx := range locked {
+		rlock(&s.dataMutex[idx], onWait)
+	}
+	now := time.Now().UnixNano()
+	for i, idx := range idxs {
+		if errs[i] == nil {
+			values[i], _ = s.current(idx, now)
+		}
+	}
+	for _, idx := range locked {
+		s.dataMutex[idx].RUnlock()
 	}
-	s.dataMutex[idx].Lock()
-	s.data[idx] = str
-	s.dataMutex[idx].Unlock()
 	return
 }
+
+// SetValues Set values to known indexes of storage all at once: either every value is written or none.
+// Values are checked before cells are locked in index order, the batch is a single record of the log
+func (s *SimpleStorage) SetValues(values map[int]string) (err error) {
+	return s.setValues(values, nil)
+}
+
+func (s *SimpleStorage) setValues(values map[int]string, onWait lockWait) (err error) {
+	if s.getState(onWait) != READ_WRITE {
+		return ErrWrongState
+	}
+	idxs := make([]int, 0, len(values))
+	for idx := range values {
+		idxs = append(idxs, idx)
+	}
+	idxs = lockOrder(idxs)
+	for _, idx := range idxs {
+		if idx < 0 || idx >= len(s.data) {
+			return fmt.Errorf("index %d: %w: valid index is in [0;%d]", idx, ErrOutOfRange, len(s.data)-1)
+		}
+		if err = s.checkValue(values[idx]); err != nil {
+			return fmt.Errorf("index %d: %w", idx, err)
+		}
+	}
+	for _, idx := range idxs {
+		lock(&s.dataMutex[idx], onWait)
+		defer s.dataMutex[idx].Unlock()
+	}
+	s.writeMutex.RLock()
+	defer s.writeMutex.RUnlock()
+	now := time.Now().UnixNano()
+	metas := make([]cellMeta, len(idxs))
+	for i, idx := range idxs {
+		_, meta := s.current(idx, now)
+		metas[i] = cellMeta{version: meta.version + 1, modified: now}
+	}
+	if s.wal != nil {
+		if err = s.wal.write(setCellsRecord(idxs, values, metas)); err != nil {
+			return
+		}
+	}
+	for i, idx := range idxs {
+		s.preserve(idx)
+		s.data[idx] = values[idx]
+		s.meta[idx] = metas[i]
+		s.watches.notify(Event{Idx: idx, Value: values[idx], Version: metas[i].version})
+	}
+	return
+}
+
+// SetValuesEach Set values to known indexes of storage one by one in index order: every value is written
+// or fails on its own, errs holds errors of single indexes which failed
+func (s *SimpleStorage) SetValuesEach(values map[int]string) (errs map[int]error, err error) {
+	return s.setValuesEach(values, nil)
+}
+
+func (s *SimpleStorage) setValuesEach(values map[int]string, onWait lockWait) (errs map[int]error, err error) {
+	if s.getState(onWait) != READ_WRITE {
+		return nil, ErrWrongState
+	}
+	idxs := make([]int, 0, len(values))
+	for idx := range values {
+		idxs = append(idxs, idx)
+	}
+	errs = make(map[int]error)
+	for _, idx := range lockOrder(idxs) {
+		if err := s.replace(idx, values[idx], 0, nil, onWait); err != nil {
+			errs[idx] = err
+		}
+	}
+	return errs, nil
+}
+
+// Scan Call fn with index and value of every non-empty cell in [from;to) in index order until fn returns false.
+// Every cell is read under its own lock, fn is called without locks held
+func (s *SimpleStorage) Scan(from int, to int, fn func(idx int, str string) bool) error {
+	return s.scan(from, to, fn, nil)
+}
+
+func (s *SimpleStorage) scan(from int, to int, fn func(idx int, str string) bool, onWait lockWait) error {
+	if s.getState(onWait) == MAINTENANCE {
+		return ErrWrongState
+	}
+	if from < 0 || to > len(s.data) || from > to {
+		return fmt.Errorf("%w: valid range is in [0;%d)", ErrOutOfRange, len(s.data))
+	}
+	for idx := from; idx < to; idx++ {
+		rlock(&s.dataMutex[idx], onWait)
+		str, _ := s.current(idx, time.Now().UnixNano())
+		s.dataMutex[idx].RUnlock()
+		if str != "" && !fn(idx, str) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// lockOrder sorts indexes and drops duplicates, so cells of batch are locked once and in the same
+// order by everyone
+func lockOrder(idxs []int) []int {
+	sort.Ints(idxs)
+	unique := idxs[:0]
+	for i, idx := range idxs {
+		if i == 0 || idx != idxs[i-1] {
+			unique = append(unique, idx)
+		}
+	}
+	return unique
+}
+
+// ReplaceIfVersion Set value to known index of storage if current version of the cell is version,
+// otherwise return *VersionMismatchError with current version
+func (s *SimpleStorage) ReplaceIfVersion(idx int, version uint64, str string) error {
+	return s.replace(idx, str, 0, ifVersion(version), nil)
+}
+
+// ifVersion condition of replace met if current version of the cell is version
+func ifVersion(version uint64) func(current string, version uint64) error {
+	return func(_ string, current uint64) error {
+		if current != version {
+			return &VersionMismatchError{Current: current}
+		}
+		return nil
+	}
+}
+
+// CompareAndSwap Set value to known index of storage if current value of the cell is expected,
+// otherwise return *MismatchError with current value
+func (s *SimpleStorage) CompareAndSwap(idx int, expected string, str string) error {
+	return s.replace(idx, str, 0, ifValue(expected), nil)
+}
+
+// ifValue condition of replace met if current value of the cell is expected
+func ifValue(expected string) func(current string, version uint64) error {
+	return func(current string, _ uint64) error {
+		if current != expected {
+			return &MismatchError{Current: current}
+		}
+		return nil
+	}
+}
+
+// replace Set value to known index of storage if condition on current value and version, when given, is met.
+// Every write increases version of the cell, value expires after ttl if it's positive.
+// Waits for locks are reported to onWait
+func (s *SimpleStorage) replace(idx int, str string, ttl time.Duration,
+	condition func(current string, version uint64) error, onWait lockWait) (err error) {
+	if s.getState(onWait) != READ_WRITE {
+		return ErrWrongState
+	}
+	if idx < 0 || idx >= len(s.data) {
+		return fmt.Errorf("%w: valid index is in [0;%d]", ErrOutOfRange, len(s.data)-1)
+	}
+	if err = s.checkValue(str); err != nil {
+		return
+	}
+	lock(&s.dataMutex[idx], onWait)
+	defer s.dataMutex[idx].Unlock()
+	now := time.Now().UnixNano()
+	current, meta := s.current(idx, now)
+	if condition != nil {
+		if err = condition(current, meta.version); err != nil {
+			return
+		}
+	}
+	meta = cellMeta{version: meta.version + 1, modified: now}
+	if ttl > 0 {
+		meta.expires = now + int64(ttl)
+	}
+	return s.write(idx, str, meta)
+}
+
+// write Set value and meta of cell, the cell must be locked for writing
+func (s *SimpleStorage) write(idx int, str string, meta cellMeta) error {
+	s.writeMutex.RLock()
+	defer s.writeMutex.RUnlock()
+	if s.wal != nil {
+		if err := s.wal.write(setCellRecord(idx, str, meta)); err != nil {
+			return err
+		}
+	}
+	s.preserve(idx)
+	s.data[idx] = str
+	s.meta[idx] = meta
+	s.watches.notify(Event{Idx: idx, Value: str, Version: meta.version})
+	return nil
+}
+
+// checkValue Check length of value against MaxValueSize
+func (s *SimpleStorage) checkValue(str string) error {
+	if s.config.CountRunes {
+		if utf8.RuneCountInString(str) > s.config.MaxValueSize {
+			return fmt.Errorf("%w: max length of string is %d runes", ErrValueTooLarge, s.config.MaxValueSize)
+		}
+	} else if len(str) > s.config.MaxValueSize {
+		return fmt.Errorf("%w: max length of string is %d bytes", ErrValueTooLarge, s.config.MaxValueSize)
+	}
+	return nil
+}
+
+// Close Flush and close write-ahead log of storage if it has one, open watches are canceled
+func (s *SimpleStorage) Close() error {
+	s.watches.cancelAll()
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.close()
+}
@@ -1,7 +1,14 @@
 package storage
 
 import (
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type TestCase struct {
@@ -12,28 +19,36 @@ type TestCase struct {
 	IsError bool
 }
 
-func pointer2Storage(stor SimpleStorage) *SimpleStorage {
-	return &stor
+// pointer2Storage completes SimpleStorage of test case to default geometry,
+// data shared by test cases is copied
+func pointer2Storage(stor *SimpleStorage) *SimpleStorage {
+	stor.config = DefaultConfig()
+	data := make([]string, SIZE)
+	copy(data, stor.data)
+	stor.data = data
+	stor.meta = make([]cellMeta, SIZE)
+	stor.dataMutex = make([]sync.RWMutex, SIZE)
+	return stor
 }
 
 func TestSimpleStorage_GetState(t *testing.T) {
 	cases := []TestCase{
 		{
-			Storage: pointer2Storage(SimpleStorage{
+			Storage: pointer2Storage(&SimpleStorage{
 				state: READ_WRITE,
 			}),
 			State:   READ_WRITE,
 			IsError: false,
 		},
 		{
-			Storage: pointer2Storage(SimpleStorage{
+			Storage: pointer2Storage(&SimpleStorage{
 				state: READ_ONLY,
 			}),
 			State:   READ_ONLY,
 			IsError: false,
 		},
 		{
-			Storage: pointer2Storage(SimpleStorage{
+			Storage: pointer2Storage(&SimpleStorage{
 				state: MAINTENANCE,
 			}),
 			State:   MAINTENANCE,
@@ -51,11 +66,11 @@ func TestSimpleStorage_GetState(t *testing.T) {
 }
 
 func TestSimpleStorage_GetValue(t *testing.T) {
-	data := [1000]string{}
+	data := make([]string, 1000)
 	data[0] = "zero"
 	cases := []TestCase{
 		{
-			Storage: pointer2Storage(SimpleStorage{
+			Storage: pointer2Storage(&SimpleStorage{
 				data:  data,
 				state: READ_WRITE,
 			}),
@@ -64,7 +79,7 @@ func TestSimpleStorage_GetValue(t *testing.T) {
 			IsError: false,
 		},
 		{
-			Storage: pointer2Storage(SimpleStorage{
+			Storage: pointer2Storage(&SimpleStorage{
 				data:  data,
 				state: READ_ONLY,
 			}),
@@ -73,7 +88,7 @@ func TestSimpleStorage_GetValue(t *testing.T) {
 			IsError: false,
 		},
 		{
-			Storage: pointer2Storage(SimpleStorage{
+			Storage: pointer2Storage(&SimpleStorage{
 				data:  data,
 				state: MAINTENANCE,
 			}),
@@ -81,7 +96,7 @@ func TestSimpleStorage_GetValue(t *testing.T) {
 			IsError: true,
 		},
 		{
-			Storage: pointer2Storage(SimpleStorage{
+			Storage: pointer2Storage(&SimpleStorage{
 				data:  data,
 				state: READ_WRITE,
 			}),
@@ -89,7 +104,7 @@ func TestSimpleStorage_GetValue(t *testing.T) {
 			IsError: true,
 		},
 		{
-			Storage: pointer2Storage(SimpleStorage{
+			Storage: pointer2Storage(&SimpleStorage{
 				data:  data,
 				state: READ_WRITE,
 			}),
@@ -118,17 +133,17 @@ func TestSimpleStorage_GetValue(t *testing.T) {
 func TestSimpleStorage_SetState(t *testing.T) {
 	cases := []TestCase{
 		{
-			Storage: pointer2Storage(SimpleStorage{}),
+			Storage: pointer2Storage(&SimpleStorage{}),
 			State:   READ_WRITE,
 			IsError: false,
 		},
 		{
-			Storage: pointer2Storage(SimpleStorage{}),
+			Storage: pointer2Storage(&SimpleStorage{}),
 			State:   READ_ONLY,
 			IsError: false,
 		},
 		{
-			Storage: pointer2Storage(SimpleStorage{}),
+			Storage: pointer2Storage(&SimpleStorage{}),
 			State:   MAINTENANCE,
 			IsError: false,
 		},
@@ -144,11 +159,11 @@ func TestSimpleStorage_SetState(t *testing.T) {
 }
 
 func TestSimpleStorage_SetValue(t *testing.T) {
-	data := [1000]string{}
+	data := make([]string, 1000)
 	data[0] = "zero"
 	cases := []TestCase{
 		{
-			Storage: pointer2Storage(SimpleStorage{
+			Storage: pointer2Storage(&SimpleStorage{
 				data:  data,
 				state: READ_WRITE,
 			}),
@@ -157,7 +172,7 @@ func TestSimpleStorage_SetValue(t *testing.T) {
 			IsError: false,
 		},
 		{
-			Storage: pointer2Storage(SimpleStorage{
+			Storage: pointer2Storage(&SimpleStorage{
 				data:  data,
 				state: READ_ONLY,
 			}),
@@ -165,7 +180,7 @@ func TestSimpleStorage_SetValue(t *testing.T) {
 			IsError: true,
 		},
 		{
-			Storage: pointer2Storage(SimpleStorage{
+			Storage: pointer2Storage(&SimpleStorage{
 				data:  data,
 				state: MAINTENANCE,
 			}),
@@ -173,7 +188,7 @@ func TestSimpleStorage_SetValue(t *testing.T) {
 			IsError: true,
 		},
 		{
-			Storage: pointer2Storage(SimpleStorage{
+			Storage: pointer2Storage(&SimpleStorage{
 				data:  data,
 				state: READ_WRITE,
 			}),
@@ -181,7 +196,7 @@ func TestSimpleStorage_SetValue(t *testing.T) {
 			IsError: true,
 		},
 		{
-			Storage: pointer2Storage(SimpleStorage{
+			Storage: pointer2Storage(&SimpleStorage{
 				data:  data,
 				state: READ_WRITE,
 			}),
@@ -208,3 +223,351 @@ func TestSimpleStorage_SetValue(t *testing.T) {
 		}
 	}
 }
+
+type ConfigTestCase struct {
+	Config  Config
+	Idx     int
+	Val     string
+	Error   string
+	IsError bool
+}
+
+func TestSimpleStorage_Config(t *testing.T) {
+	bytesConfig := Config{Size: 10, MaxValueSize: 4}
+	runesConfig := Config{Size: 10, MaxValueSize: 4, CountRunes: true}
+	cases := []ConfigTestCase{
+		{Config: bytesConfig, Idx: 9, Val: "1234"},
+		{Config: bytesConfig, Idx: 10, Val: "1", Error: "index is out of range: valid index is in [0;9]", IsError: true},
+		{Config: bytesConfig, Idx: 0, Val: "12345", Error: "value is too large: max length of string is 4 bytes", IsError: true},
+		{Config: bytesConfig, Idx: 0, Val: "ёжик", Error: "value is too large: max length of string is 4 bytes", IsError: true},
+		{Config: runesConfig, Idx: 0, Val: "ёжик"},
+		{Config: runesConfig, Idx: 0, Val: "ёжики", Error: "value is too large: max length of string is 4 runes", IsError: true},
+	}
+	for caseNum, item := range cases {
+		stor := NewSimpleStorageRepo(item.Config)
+		err := stor.SetValue(item.Idx, item.Val)
+		if item.IsError && (err == nil || err.Error() != item.Error) {
+			t.Errorf("[%d] wrong results: got %v, expected %s", caseNum, err, item.Error)
+		}
+		if item.IsError && strings.HasPrefix(item.Error, "value") && !errors.Is(err, ErrValueTooLarge) {
+			t.Errorf("[%d] wrong results: got %v, expected %v", caseNum, err, ErrValueTooLarge)
+		}
+		if !item.IsError && err != nil {
+			t.Errorf("[%d] unexpected error: %v", caseNum, err)
+		}
+		if config := stor.Config(); config != item.Config {
+			t.Errorf("[%d] wrong results: got %+v, expected %+v", caseNum, config, item.Config)
+		}
+	}
+}
+
+type CASTestCase struct {
+	Idx      int
+	Expected string
+	Val      string
+	Current  string
+	Err      error
+}
+
+func TestSimpleStorage_CompareAndSwap(t *testing.T) {
+	stor := newSimpleStorage(DefaultConfig())
+	cases := []CASTestCase{
+		{Idx: 1, Expected: "", Val: "one", Current: "one"},
+		{Idx: 1, Expected: "", Val: "uno", Current: "one", Err: ErrMismatch},
+		{Idx: 1, Expected: "one", Val: "uno", Current: "uno"},
+		{Idx: SIZE, Expected: "", Val: "one", Err: ErrOutOfRange},
+		{Idx: 1, Expected: "uno", Val: string(make([]byte, MAX_VALUE_SIZE+1)), Current: "uno", Err: ErrValueTooLarge},
+	}
+	for caseNum, item := range cases {
+		err := stor.CompareAndSwap(item.Idx, item.Expected, item.Val)
+		if !errors.Is(err, item.Err) || item.Err == nil && err != nil {
+			t.Errorf("[%d] wrong results: got %v, expected %v", caseNum, err, item.Err)
+		}
+		var mismatch *MismatchError
+		if errors.Is(item.Err, ErrMismatch) && (!errors.As(err, &mismatch) || mismatch.Current != item.Current) {
+			t.Errorf("[%d] wrong results: got %v, expected current value %q", caseNum, err, item.Current)
+		}
+		if val, _ := stor.GetValue(item.Idx); item.Current != "" && val != item.Current {
+			t.Errorf("[%d] wrong results: got %q, expected %q", caseNum, val, item.Current)
+		}
+	}
+
+	// Concurrent increments retried on mismatch lose no writes
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 100; n++ {
+				for {
+					current, _ := stor.GetValue(2)
+					counter, _ := strconv.Atoi(current)
+					if stor.CompareAndSwap(2, current, strconv.Itoa(counter+1)) == nil {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if val, _ := stor.GetValue(2); val != "1000" {
+		t.Errorf("wrong results: got %q, expected %q", val, "1000")
+	}
+}
+
+type VersionTestCase struct {
+	Write   func(stor *SimpleStorage) error
+	Value   string
+	Version uint64
+	Err     error
+}
+
+func TestSimpleStorage_Versions(t *testing.T) {
+	stor := newSimpleStorage(DefaultConfig())
+	cases := []VersionTestCase{
+		{Write: func(stor *SimpleStorage) error { return nil }, Value: "", Version: 0},
+		{Write: func(stor *SimpleStorage) error { return stor.SetValue(3, "one") }, Value: "one", Version: 1},
+		{Write: func(stor *SimpleStorage) error { return stor.SetValue(3, "one") }, Value: "one", Version: 2},
+		{Write: func(stor *SimpleStorage) error { return stor.ReplaceIfVersion(3, 2, "two") }, Value: "two", Version: 3},
+		{Write: func(stor *SimpleStorage) error { return stor.ReplaceIfVersion(3, 2, "three") }, Value: "two", Version: 3, Err: ErrMismatch},
+		{Write: func(stor *SimpleStorage) error { return stor.CompareAndSwap(3, "two", "three") }, Value: "three", Version: 4},
+		{Write: func(stor *SimpleStorage) error { return stor.ReplaceIfVersion(SIZE, 0, "") }, Value: "three", Version: 4, Err: ErrOutOfRange},
+	}
+	for caseNum, item := range cases {
+		err := item.Write(stor)
+		if !errors.Is(err, item.Err) || item.Err == nil && err != nil {
+			t.Errorf("[%d] wrong results: got %v, expected %v", caseNum, err, item.Err)
+		}
+		var mismatch *VersionMismatchError
+		if errors.Is(item.Err, ErrMismatch) && (!errors.As(err, &mismatch) || mismatch.Current != item.Version) {
+			t.Errorf("[%d] wrong results: got %v, expected current version %d", caseNum, err, item.Version)
+		}
+		cell, err := stor.GetCell(3)
+		if err != nil || cell.Value != item.Value || cell.Version != item.Version {
+			t.Errorf("[%d] wrong results: got %+v, expected %q of version %d", caseNum, cell, item.Value, item.Version)
+		}
+		if cell.Modified.IsZero() != (item.Version == 0) {
+			t.Errorf("[%d] wrong results: got modified %v for version %d", caseNum, cell.Modified, item.Version)
+		}
+	}
+}
+
+type BatchTestCase struct {
+	State   int
+	Values  map[int]string
+	Idxs    []int
+	Read    []string
+	Err     error
+	ItemErr []error
+}
+
+func TestSimpleStorage_Batch(t *testing.T) {
+	stor := newSimpleStorage(DefaultConfig())
+	cases := []BatchTestCase{
+		{State: READ_WRITE, Values: map[int]string{1: "one", 3: "three"},
+			Idxs: []int{3, 1, 2, 3}, Read: []string{"three", "one", "", "three"}},
+		// Batch with a wrong item changes nothing
+		{State: READ_WRITE, Values: map[int]string{1: "uno", SIZE: "out"}, Err: ErrOutOfRange,
+			Idxs: []int{1}, Read: []string{"one"}},
+		{State: READ_WRITE, Values: map[int]string{1: "uno", 2: string(make([]byte, MAX_VALUE_SIZE+1))}, Err: ErrValueTooLarge,
+			Idxs: []int{1, 2}, Read: []string{"one", ""}},
+		{State: READ_ONLY, Values: map[int]string{1: "uno"}, Err: ErrWrongState,
+			Idxs: []int{1, -1, SIZE}, Read: []string{"one", "", ""}, ItemErr: []error{nil, ErrOutOfRange, ErrOutOfRange}},
+		{State: MAINTENANCE, Values: map[int]string{1: "uno"}, Err: ErrWrongState, Idxs: []int{1}},
+	}
+	for caseNum, item := range cases {
+		_ = stor.SetState(item.State)
+		if err := stor.SetValues(item.Values); !errors.Is(err, item.Err) || item.Err == nil && err != nil {
+			t.Errorf("[%d] wrong results: got %v, expected %v", caseNum, err, item.Err)
+		}
+		values, errs, err := stor.GetValues(item.Idxs)
+		if item.State == MAINTENANCE {
+			if !errors.Is(err, ErrWrongState) {
+				t.Errorf("[%d] wrong results: got %v, expected %v", caseNum, err, ErrWrongState)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(values, item.Read) {
+			t.Errorf("[%d] wrong results: got %q %v, expected %q", caseNum, values, err, item.Read)
+		}
+		for i := range errs {
+			var expected error
+			if item.ItemErr != nil {
+				expected = item.ItemErr[i]
+			}
+			if !errors.Is(errs[i], expected) || expected == nil && errs[i] != nil {
+				t.Errorf("[%d] wrong results: got error %v of item %d, expected %v", caseNum, errs[i], i, expected)
+			}
+		}
+	}
+}
+
+type BatchEachTestCase struct {
+	State   int
+	Values  map[int]string
+	Err     error
+	ItemErr map[int]error
+	Idxs    []int
+	Read    []string
+}
+
+func TestSimpleStorage_BatchEach(t *testing.T) {
+	stor := newSimpleStorage(DefaultConfig())
+	cases := []BatchEachTestCase{
+		{State: READ_WRITE, Values: map[int]string{1: "one", 3: "three"}, ItemErr: map[int]error{},
+			Idxs: []int{1, 3}, Read: []string{"one", "three"}},
+		// Wrong items fail on their own, the rest is written
+		{State: READ_WRITE, Values: map[int]string{1: "uno", SIZE: "out", 2: string(make([]byte, MAX_VALUE_SIZE+1))},
+			ItemErr: map[int]error{SIZE: ErrOutOfRange, 2: ErrValueTooLarge}, Idxs: []int{1, 2}, Read: []string{"uno", ""}},
+		{State: READ_ONLY, Values: map[int]string{1: "one"}, Err: ErrWrongState, Idxs: []int{1}, Read: []string{"uno"}},
+	}
+	for caseNum, item := range cases {
+		_ = stor.SetState(item.State)
+		errs, err := stor.SetValuesEach(item.Values)
+		if !errors.Is(err, item.Err) || item.Err == nil && err != nil {
+			t.Errorf("[%d] wrong results: got %v, expected %v", caseNum, err, item.Err)
+		}
+		if len(errs) != len(item.ItemErr) {
+			t.Errorf("[%d] wrong results: got errors %v, expected %v", caseNum, errs, item.ItemErr)
+		}
+		for idx, expected := range item.ItemErr {
+			if !errors.Is(errs[idx], expected) {
+				t.Errorf("[%d] wrong results: got error %v of index %d, expected %v", caseNum, errs[idx], idx, expected)
+			}
+		}
+		if values, _, err := stor.GetValues(item.Idxs); err != nil || !reflect.DeepEqual(values, item.Read) {
+			t.Errorf("[%d] wrong results: got %q %v, expected %q", caseNum, values, err, item.Read)
+		}
+	}
+}
+
+func TestSimpleStorage_BatchConcurrent(t *testing.T) {
+	stor := newSimpleStorage(DefaultConfig())
+	idxs := []int{7, 3, 5, 1}
+	var wg sync.WaitGroup
+	// Writers of overlapping batches don't deadlock, readers see every batch whole
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(gen int) {
+			defer wg.Done()
+			for n := 0; n < 200; n++ {
+				str := strconv.Itoa(gen*1000 + n)
+				_ = stor.SetValues(map[int]string{1: str, 3: str, 5: str, 7: str, gen: str})
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 200; n++ {
+				values, _, _ := stor.GetValues(idxs)
+				for _, str := range values {
+					if str != values[0] {
+						t.Errorf("wrong results: batch is read partially %q", values)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+type ScanTestCase struct {
+	State int
+	From  int
+	To    int
+	Limit int
+	Idxs  []int
+	Err   error
+}
+
+func TestSimpleStorage_Scan(t *testing.T) {
+	stor := newSimpleStorage(DefaultConfig())
+	for _, idx := range []int{0, 2, 3, 7, SIZE - 1} {
+		_ = stor.SetValue(idx, strconv.Itoa(idx))
+	}
+	cases := []ScanTestCase{
+		{State: READ_WRITE, From: 0, To: SIZE, Idxs: []int{0, 2, 3, 7, SIZE - 1}},
+		{State: READ_ONLY, From: 1, To: 7, Idxs: []int{2, 3}},
+		{State: READ_ONLY, From: 2, To: SIZE, Limit: 2, Idxs: []int{2, 3}},
+		{State: READ_ONLY, From: 4, To: 4},
+		{State: READ_ONLY, From: -1, To: 4, Err: ErrOutOfRange},
+		{State: READ_ONLY, From: 0, To: SIZE + 1, Err: ErrOutOfRange},
+		{State: READ_ONLY, From: 5, To: 4, Err: ErrOutOfRange},
+		{State: MAINTENANCE, From: 0, To: SIZE, Err: ErrWrongState},
+	}
+	for caseNum, item := range cases {
+		_ = stor.SetState(item.State)
+		var idxs []int
+		err := stor.Scan(item.From, item.To, func(idx int, str string) bool {
+			if str != strconv.Itoa(idx) {
+				t.Errorf("[%d] wrong results: got %q of cell %d", caseNum, str, idx)
+			}
+			idxs = append(idxs, idx)
+			return item.Limit == 0 || len(idxs) < item.Limit
+		})
+		if !errors.Is(err, item.Err) || item.Err == nil && err != nil {
+			t.Errorf("[%d] wrong results: got %v, expected %v", caseNum, err, item.Err)
+		}
+		if !reflect.DeepEqual(idxs, item.Idxs) {
+			t.Errorf("[%d] wrong results: got %v, expected %v", caseNum, idxs, item.Idxs)
+		}
+	}
+}
+
+func TestSimpleStorage_WithLockWait(t *testing.T) {
+	stor := NewSimpleStorageRepo(DefaultConfig()).(*SimpleStorage)
+	var waits []time.Duration
+	traced := stor.WithLockWait(func(start time.Time, end time.Time) {
+		waits = append(waits, end.Sub(start))
+	})
+	if err := traced.SetValue(1, "one"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(waits) != 0 {
+		t.Fatalf("wrong results: got waits %v for uncontended locks", waits)
+	}
+
+	stor.dataMutex[1].Lock()
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		stor.dataMutex[1].Unlock()
+	}()
+	if str, err := traced.GetValue(1); err != nil || str != "one" {
+		t.Fatalf("wrong results: got %q %v, expected %q", str, err, "one")
+	}
+	if len(waits) != 1 || waits[0] < 10*time.Millisecond {
+		t.Errorf("wrong results: got waits %v, expected one wait for locked cell", waits)
+	}
+	if _, ok := traced.(Versioned); !ok {
+		t.Errorf("view of storage isn't Versioned")
+	}
+	if _, ok := traced.(Expiring); !ok {
+		t.Errorf("view of storage isn't Expiring")
+	}
+	if _, ok := traced.(Checkpointed); !ok {
+		t.Errorf("view of storage isn't Checkpointed")
+	}
+	if _, ok := traced.(io.Closer); !ok {
+		t.Errorf("view of storage isn't io.Closer")
+	}
+	watchable, ok := traced.(Watchable)
+	if !ok {
+		t.Fatalf("view of storage isn't Watchable")
+	}
+	watch, err := watchable.Watch([]int{1}, false, 1, DROP_EVENTS)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer watch.Cancel()
+	if err := traced.SetValue(1, "uno"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	select {
+	case event := <-watch.Events():
+		if event.Idx != 1 || event.Value != "uno" {
+			t.Errorf("wrong results: got event %+v, expected write of %q to 1", event, "uno")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("no event of write through view of storage")
+	}
+}
@@ -0,0 +1,353 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	SNAPSHOT_MAGIC = "IPRSNAP"
+	// SNAPSHOT_VERSION format of written snapshots, version 1 has no meta of cells,
+	// version 2 has no time of expiry
+	SNAPSHOT_VERSION = 3
+	// SNAPSHOT_HEADER magic, version, unix time in nanoseconds, state, number of cells
+	SNAPSHOT_HEADER = len(SNAPSHOT_MAGIC) + 1 + 8 + 1 + 4
+)
+
+// ErrSnapshotCorrupted snapshot file has unknown format or doesn't match its checksum
+var ErrSnapshotCorrupted = errors.New("snapshot is corrupted")
+
+// snapshotCopy cells of storage at the moment snapshot started. Writers copy old value
+// of a cell here before they overwrite it, snapshot copies the rest of cells itself
+type snapshotCopy struct {
+	state  int
+	data   []string
+	meta   []cellMeta
+	copied []bool
+}
+
+// preserve keeps value of cell idx for running snapshot before it is overwritten,
+// the cell must be locked for writing
+func (s *SimpleStorage) preserve(idx int) {
+	if c := s.snapshot.Load(); c != nil && !c.copied[idx] {
+		c.data[idx] = s.data[idx]
+		c.meta[idx] = s.meta[idx]
+		c.copied[idx] = true
+	}
+}
+
+// Snapshot Write consistent copy of all cells and state to w, writers are blocked only while snapshot starts.
+// Snapshot format: <magic><uint8 version><uint64 time><uint8 state><uint32 number of cells>,
+// then <uint32 length><bytes><uint64 version><int64 time of write><int64 time of expiry> of every cell
+// and <uint32 crc32> of everything before it
+func (s *SimpleStorage) Snapshot(w io.Writer) error {
+	s.snapshotMutex.Lock()
+	defer s.snapshotMutex.Unlock()
+	_, err := s.snapshotTo(w)
+	return err
+}
+
+// Checkpoint Write snapshot to w like Snapshot and call commit to make it durable. Once commit succeeds,
+// records of write-ahead log written before the snapshot started are dropped, the snapshot holds them all
+func (s *SimpleStorage) Checkpoint(w io.Writer, commit func() error) error {
+	s.snapshotMutex.Lock()
+	defer s.snapshotMutex.Unlock()
+	offset, err := s.snapshotTo(w)
+	if err == nil {
+		err = commit()
+	}
+	if err != nil || s.wal == nil {
+		return err
+	}
+	return s.wal.cut(offset)
+}
+
+// snapshotTo writes snapshot to w and returns size of write-ahead log at the moment snapshot started,
+// snapshotMutex must be held
+func (s *SimpleStorage) snapshotTo(w io.Writer) (offset int64, err error) {
+	c := &snapshotCopy{
+		data:   make([]string, len(s.data)),
+		meta:   make([]cellMeta, len(s.data)),
+		copied: make([]bool, len(s.data)),
+	}
+	// Writes in progress are applied completely before snapshot starts, the following ones preserve
+	// every cell they change, so the log from offset on holds exactly the writes snapshot misses
+	s.writeMutex.Lock()
+	s.mutex.RLock()
+	c.state = s.state
+	s.mutex.RUnlock()
+	if s.wal != nil {
+		offset = s.wal.offset()
+	}
+	s.snapshot.Store(c)
+	s.writeMutex.Unlock()
+	defer s.snapshot.Store(nil)
+
+	for idx := range s.data {
+		// Writers touch copy only while the cell is locked for writing
+		s.dataMutex[idx].RLock()
+		if !c.copied[idx] {
+			c.data[idx] = s.data[idx]
+			c.meta[idx] = s.meta[idx]
+			c.copied[idx] = true
+		}
+		s.dataMutex[idx].RUnlock()
+	}
+
+	hash := crc32.New(crcTable)
+	buf := bufio.NewWriter(io.MultiWriter(w, hash))
+	header := make([]byte, SNAPSHOT_HEADER)
+	copy(header, SNAPSHOT_MAGIC)
+	header[len(SNAPSHOT_MAGIC)] = SNAPSHOT_VERSION
+	binary.LittleEndian.PutUint64(header[len(SNAPSHOT_MAGIC)+1:], uint64(time.Now().UnixNano()))
+	header[len(SNAPSHOT_MAGIC)+9] = byte(c.state)
+	binary.LittleEndian.PutUint32(header[len(SNAPSHOT_MAGIC)+10:], uint32(len(c.data)))
+	_, _ = buf.Write(header)
+	length := make([]byte, 4)
+	meta := make([]byte, 24)
+	for idx, str := range c.data {
+		binary.LittleEndian.PutUint32(length, uint32(len(str)))
+		_, _ = buf.Write(length)
+		_, _ = buf.WriteString(str)
+		binary.LittleEndian.PutUint64(meta[:8], c.meta[idx].version)
+		binary.LittleEndian.PutUint64(meta[8:16], uint64(c.meta[idx].modified))
+		binary.LittleEndian.PutUint64(meta[16:], uint64(c.meta[idx].expires))
+		_, _ = buf.Write(meta)
+	}
+	if err = buf.Flush(); err != nil {
+		return
+	}
+	binary.LittleEndian.PutUint32(length, hash.Sum32())
+	_, err = w.Write(length)
+	return
+}
+
+// Restore Replace all cells and state of storage with snapshot read from r.
+// Snapshot is checked completely before storage is changed. Versions of cells never go back:
+// changed cell gets version from snapshot or, if it's not greater, the next version of the cell
+func (s *SimpleStorage) Restore(r io.Reader) error {
+	c, err := readSnapshot(r)
+	if err != nil {
+		return err
+	}
+	if len(c.data) != len(s.data) {
+		return fmt.Errorf("%w: snapshot has %d cells, storage has %d", ErrSnapshotCorrupted, len(c.data), len(s.data))
+	}
+	if err = s.SetState(c.state); err != nil {
+		return err
+	}
+	for idx := range c.data {
+		if err = s.restoreValue(idx, c.data[idx], c.meta[idx]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreValue sets value of cell regardless of state of storage
+func (s *SimpleStorage) restoreValue(idx int, str string, meta cellMeta) error {
+	s.dataMutex[idx].Lock()
+	defer s.dataMutex[idx].Unlock()
+	if s.data[idx] == str && s.meta[idx].expires == meta.expires {
+		return nil
+	}
+	if meta.version <= s.meta[idx].version {
+		meta = cellMeta{version: s.meta[idx].version + 1, modified: time.Now().UnixNano(), expires: meta.expires}
+	}
+	return s.write(idx, str, meta)
+}
+
+// loadSnapshot sets cells and state of storage nobody uses yet from snapshot file at path,
+// missing file leaves storage empty
+func (s *SimpleStorage) loadSnapshot(path string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	c, err := readSnapshot(file)
+	if err != nil {
+		return err
+	}
+	if len(c.data) != len(s.data) {
+		return fmt.Errorf("%w: snapshot has %d cells, storage has %d", ErrSnapshotCorrupted, len(c.data), len(s.data))
+	}
+	s.state = c.state
+	copy(s.data, c.data)
+	copy(s.meta, c.meta)
+	return nil
+}
+
+// readSnapshot decodes snapshot and checks its checksum
+func readSnapshot(r io.Reader) (*snapshotCopy, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < SNAPSHOT_HEADER+4 || !bytes.HasPrefix(data, []byte(SNAPSHOT_MAGIC)) {
+		return nil, fmt.Errorf("%w: unknown format", ErrSnapshotCorrupted)
+	}
+	version := data[len(SNAPSHOT_MAGIC)]
+	if version < 1 || version > SNAPSHOT_VERSION {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrSnapshotCorrupted, version)
+	}
+	// Meta of cells grew with versions of format
+	metaSize := []int{0, 16, 24}[version-1]
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.Checksum(body, crcTable) != sum {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrSnapshotCorrupted)
+	}
+	count := binary.LittleEndian.Uint32(body[len(SNAPSHOT_MAGIC)+10:])
+	body = body[SNAPSHOT_HEADER:]
+	// Every cell takes at least 4 bytes of its length and its meta
+	if uint64(count)*uint64(4+metaSize) > uint64(len(body)) {
+		return nil, fmt.Errorf("%w: %d cells don't fit in snapshot", ErrSnapshotCorrupted, count)
+	}
+	c := &snapshotCopy{
+		state: int(data[len(SNAPSHOT_MAGIC)+9]),
+		data:  make([]string, count),
+		meta:  make([]cellMeta, count),
+	}
+	for idx := range c.data {
+		if len(body) < 4 || uint64(len(body)-4) < uint64(binary.LittleEndian.Uint32(body))+uint64(metaSize) {
+			return nil, fmt.Errorf("%w: cell %d is truncated", ErrSnapshotCorrupted, idx)
+		}
+		length := binary.LittleEndian.Uint32(body)
+		c.data[idx] = string(body[4 : 4+length])
+		body = body[4+length:]
+		if metaSize >= 16 {
+			c.meta[idx] = cellMeta{
+				version:  binary.LittleEndian.Uint64(body[:8]),
+				modified: int64(binary.LittleEndian.Uint64(body[8:16])),
+			}
+		}
+		if metaSize >= 24 {
+			c.meta[idx].expires = int64(binary.LittleEndian.Uint64(body[16:24]))
+		}
+		body = body[metaSize:]
+	}
+	if len(body) != 0 {
+		return nil, fmt.Errorf("%w: trailing data", ErrSnapshotCorrupted)
+	}
+	return c, nil
+}
+
+// Snapshotter writes snapshots of storage to file on demand and on schedule
+type Snapshotter struct {
+	stor  Storage
+	path  string
+	mutex sync.Mutex
+	quit  chan struct{}
+	done  chan struct{}
+}
+
+// NewSnapshotter initializes Snapshotter writing snapshots of stor to file at path
+func NewSnapshotter(stor Storage, path string) *Snapshotter {
+	return &Snapshotter{stor: stor, path: path}
+}
+
+// Path returns path of snapshot file
+func (s *Snapshotter) Path() string {
+	return s.path
+}
+
+// Snapshot writes snapshot to temporary file and replaces snapshot file with it,
+// so the previous snapshot stays whole if writing fails. Storage which is Checkpointed
+// drops records of its log the snapshot holds once the file is replaced
+func (s *Snapshotter) Snapshot() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	tmp := s.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	commit := func() error {
+		err := file.Sync()
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmp, s.path)
+		}
+		if err == nil {
+			err = syncDir(s.path)
+		}
+		return err
+	}
+	if checkpointed, ok := s.stor.(Checkpointed); ok {
+		err = checkpointed.Checkpoint(file, commit)
+	} else if err = s.stor.Snapshot(file); err == nil {
+		err = commit()
+	}
+	if err != nil {
+		_ = file.Close()
+		_ = os.Remove(tmp)
+	}
+	return err
+}
+
+// syncDir fsyncs directory of file at path, rename of the file is durable only after it
+func syncDir(path string) error {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if closeErr := dir.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Restore replaces content of storage with snapshot file
+func (s *Snapshotter) Restore() error {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return s.stor.Restore(file)
+}
+
+// Start writes snapshot every interval until Stop, errors are passed to onError
+func (s *Snapshotter) Start(interval time.Duration, onError func(err error)) {
+	s.quit = make(chan struct{})
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.Snapshot(); err != nil && onError != nil {
+					onError(err)
+				}
+			case <-s.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops scheduled snapshots started by Start
+func (s *Snapshotter) Stop() {
+	if s.quit == nil {
+		return
+	}
+	close(s.quit)
+	<-s.done
+}
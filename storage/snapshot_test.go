@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestSimpleStorage_Snapshot(t *testing.T) {
+	stor := newSimpleStorage(DefaultConfig())
+	_ = stor.SetValue(0, "zero")
+	_ = stor.SetValue(SIZE-1, "last")
+	_ = stor.SetState(READ_ONLY)
+
+	var buf bytes.Buffer
+	if err := stor.Snapshot(&buf); err != nil {
+		t.Fatalf("unexpected snapshot error: %v", err)
+	}
+	restored := newSimpleStorage(DefaultConfig())
+	_ = restored.SetValue(5, "five")
+	if err := restored.Restore(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("unexpected restore error: %v", err)
+	}
+	if restored.state != READ_ONLY || !reflect.DeepEqual(restored.data, stor.data) {
+		t.Errorf("wrong results: restored storage differs from snapshot")
+	}
+	if restored.meta[0] != stor.meta[0] || restored.meta[SIZE-1] != stor.meta[SIZE-1] {
+		t.Errorf("wrong results: got meta %+v, expected %+v", restored.meta[0], stor.meta[0])
+	}
+	// Cell changed since snapshot doesn't get back older version
+	if restored.meta[5].version != 2 {
+		t.Errorf("wrong results: got version %d, expected %d", restored.meta[5].version, 2)
+	}
+}
+
+// generation decodes value written by TestSimpleStorage_SnapshotConsistent
+func generation(t *testing.T, str string) int {
+	if str == "" {
+		return 0
+	}
+	gen, err := strconv.Atoi(str)
+	if err != nil {
+		t.Fatalf("unexpected value %q", str)
+	}
+	return gen
+}
+
+func TestSimpleStorage_SnapshotConsistent(t *testing.T) {
+	stor := newSimpleStorage(DefaultConfig())
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	// Writer fills cells in order with number of its pass, so in any point in time
+	// cells are split into prefix of pass N and suffix of pass N-1
+	go func() {
+		defer close(done)
+		for gen := 1; ; gen++ {
+			for idx := 0; idx < SIZE; idx++ {
+				select {
+				case <-quit:
+					return
+				default:
+				}
+				_ = stor.SetValue(idx, strconv.Itoa(gen))
+			}
+		}
+	}()
+	defer func() {
+		close(quit)
+		<-done
+	}()
+
+	for i := 0; i < 20; i++ {
+		var buf bytes.Buffer
+		if err := stor.Snapshot(&buf); err != nil {
+			t.Fatalf("[%d] unexpected snapshot error: %v", i, err)
+		}
+		c, err := readSnapshot(&buf)
+		if err != nil {
+			t.Fatalf("[%d] unexpected read error: %v", i, err)
+		}
+		first := generation(t, c.data[0])
+		for idx := 1; idx < SIZE; idx++ {
+			gen := generation(t, c.data[idx])
+			if gen != first && gen != first-1 || gen > generation(t, c.data[idx-1]) {
+				t.Fatalf("[%d] snapshot is not consistent: cell %d is of pass %d, cell 0 is of pass %d",
+					i, idx, gen, first)
+			}
+		}
+	}
+}
+
+func TestSimpleStorage_SnapshotBatches(t *testing.T) {
+	stor := newSimpleStorage(DefaultConfig())
+	batch := make([]int, 0, SIZE/10)
+	for idx := 0; idx < SIZE; idx += 10 {
+		batch = append(batch, idx)
+	}
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	// Every batch writes the same number to all its cells, so snapshot must have equal values in them
+	go func() {
+		defer close(done)
+		for gen := 1; ; gen++ {
+			select {
+			case <-quit:
+				return
+			default:
+			}
+			values := make(map[int]string, len(batch))
+			for _, idx := range batch {
+				values[idx] = strconv.Itoa(gen)
+			}
+			_ = stor.SetValues(values)
+		}
+	}()
+	defer func() {
+		close(quit)
+		<-done
+	}()
+
+	for i := 0; i < 200; i++ {
+		var buf bytes.Buffer
+		if err := stor.Snapshot(&buf); err != nil {
+			t.Fatalf("[%d] unexpected snapshot error: %v", i, err)
+		}
+		c, err := readSnapshot(&buf)
+		if err != nil {
+			t.Fatalf("[%d] unexpected read error: %v", i, err)
+		}
+		for _, idx := range batch[1:] {
+			if c.data[idx] != c.data[batch[0]] || c.meta[idx].version != c.meta[batch[0]].version {
+				t.Fatalf("[%d] snapshot has part of batch: cell %d is %q, cell %d is %q", i,
+					idx, c.data[idx], batch[0], c.data[batch[0]])
+			}
+		}
+	}
+}
+
+type SnapshotTestCase struct {
+	Damage func(data []byte) []byte
+}
+
+func TestSimpleStorage_RestoreCorrupted(t *testing.T) {
+	stor := newSimpleStorage(DefaultConfig())
+	_ = stor.SetValue(1, "one")
+	var buf bytes.Buffer
+	if err := stor.Snapshot(&buf); err != nil {
+		t.Fatalf("unexpected snapshot error: %v", err)
+	}
+	cases := []SnapshotTestCase{
+		{Damage: func(data []byte) []byte { return data[:len(data)-1] }},
+		{Damage: func(data []byte) []byte { data[SNAPSHOT_HEADER+5] ^= 0xff; return data }},
+		{Damage: func(data []byte) []byte { data[len(SNAPSHOT_MAGIC)] = SNAPSHOT_VERSION + 1; return data }},
+		{Damage: func(data []byte) []byte { return data[:10] }},
+		{Damage: func(data []byte) []byte { return nil }},
+	}
+	for caseNum, item := range cases {
+		data := item.Damage(append([]byte(nil), buf.Bytes()...))
+		restored := newSimpleStorage(DefaultConfig())
+		_ = restored.SetValue(1, "untouched")
+		err := restored.Restore(bytes.NewReader(data))
+		if !errors.Is(err, ErrSnapshotCorrupted) {
+			t.Errorf("[%d] wrong results: got %v, expected %v", caseNum, err, ErrSnapshotCorrupted)
+		}
+		if restored.data[1] != "untouched" {
+			t.Errorf("[%d] storage is changed by broken snapshot", caseNum)
+		}
+	}
+}
+
+func TestSnapshotter(t *testing.T) {
+	dir := t.TempDir()
+	stor := newSimpleStorage(DefaultConfig())
+	for idx := 0; idx < SIZE; idx++ {
+		_ = stor.SetValue(idx, fmt.Sprintf("value %d", idx))
+	}
+	snapshotter := NewSnapshotter(stor, filepath.Join(dir, "storage.snap"))
+	if err := snapshotter.Snapshot(); err != nil {
+		t.Fatalf("unexpected snapshot error: %v", err)
+	}
+	if _, err := os.Stat(snapshotter.Path() + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file is left: %v", err)
+	}
+
+	// Restored values are written to the log of storage and survive restart
+	walPath := filepath.Join(dir, "storage.wal")
+	walStor := openWALStorage(t, walPath)
+	if err := NewSnapshotter(walStor, snapshotter.Path()).Restore(); err != nil {
+		t.Fatalf("unexpected restore error: %v", err)
+	}
+	_ = walStor.Close()
+	reopened := openWALStorage(t, walPath)
+	defer reopened.Close()
+	if !reflect.DeepEqual(reopened.data, stor.data) {
+		t.Errorf("wrong results: restored storage differs from snapshot")
+	}
+}
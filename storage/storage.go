@@ -1,7 +1,15 @@
 package storage
 
+import (
+	"io"
+	"time"
+)
+
 type Storage interface {
 
+	// Config Return geometry of storage
+	Config() Config
+
 	// GetState Return current state of storage
 	GetState() int
 
@@ -9,8 +17,60 @@ type Storage interface {
 	GetValue(idx int) (string, error)
 
 	// SetState Set new value of state for storage
-	SetState(state int)
+	SetState(state int) error
 
 	// SetValue Set value to known index of storage
 	SetValue(idx int, str string) error
+
+	// GetValues Return values from storage by indexes as of one moment, errs holds errors of single indexes,
+	// err fails the whole batch
+	GetValues(idxs []int) (values []string, errs []error, err error)
+
+	// SetValues Set values to known indexes of storage all at once: either every value is written or none
+	SetValues(values map[int]string) error
+
+	// SetValuesEach Set values to known indexes of storage one by one: every value is written or fails on its own.
+	// errs holds errors of single indexes which failed, err fails the whole batch
+	SetValuesEach(values map[int]string) (errs map[int]error, err error)
+
+	// Scan Call fn with index and value of every non-empty cell in [from;to) in index order until fn returns false
+	Scan(from int, to int, fn func(idx int, str string) bool) error
+
+	// CompareAndSwap Set value to known index of storage if current value of the cell is expected
+	CompareAndSwap(idx int, expected string, str string) error
+
+	// Snapshot Write consistent copy of all cells and state to w, writers are blocked only while it starts
+	Snapshot(w io.Writer) error
+
+	// Restore Replace all cells and state of storage with snapshot read from r
+	Restore(r io.Reader) error
+}
+
+// Versioned is implemented by storages keeping version and time of the last write of every cell
+type Versioned interface {
+
+	// GetCell Return value from storage by index together with its version and time of the last write
+	GetCell(idx int) (Cell, error)
+
+	// ReplaceIfVersion Set value to known index of storage if current version of the cell is version
+	ReplaceIfVersion(idx int, version uint64, str string) error
+}
+
+// Checkpointed is implemented by storages with write-ahead log which is cut off by snapshots
+type Checkpointed interface {
+
+	// Checkpoint Write snapshot to w like Snapshot and call commit to make it durable. Once commit succeeds,
+	// records of write-ahead log the snapshot holds are dropped
+	Checkpoint(w io.Writer, commit func() error) error
+}
+
+// Expiring is implemented by storages able to expire values of cells, remaining time to live
+// of the cell is found by Expires of Versioned.GetCell
+type Expiring interface {
+
+	// SetValueTTL Set value to known index of storage, the cell reads as empty after ttl
+	SetValueTTL(idx int, str string, ttl time.Duration) error
+
+	// Sweep Clear expired cells, return number of cleared cells
+	Sweep() (int, error)
 }
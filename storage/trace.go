@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Traceable is implemented by storages able to report waits for their locks, e.g. as spans of traced request
+type Traceable interface {
+
+	// WithLockWait Return view of storage calling onWait with start and end of every wait for a lock
+	// held by someone else, the view implements the same optional interfaces as storage
+	WithLockWait(onWait func(start time.Time, end time.Time)) Storage
+}
+
+// lockWait is called with start and end of wait for a lock held by someone else
+type lockWait func(start time.Time, end time.Time)
+
+// lock locks m for writing reporting wait for it to onWait, if onWait is given
+func lock(m *sync.RWMutex, onWait lockWait) {
+	if onWait == nil {
+		m.Lock()
+		return
+	}
+	if m.TryLock() {
+		return
+	}
+	start := time.Now()
+	m.Lock()
+	onWait(start, time.Now())
+}
+
+// rlock locks m for reading reporting wait for it to onWait, if onWait is given
+func rlock(m *sync.RWMutex, onWait lockWait) {
+	if onWait == nil {
+		m.RLock()
+		return
+	}
+	if m.TryRLock() {
+		return
+	}
+	start := time.Now()
+	m.RLock()
+	onWait(start, time.Now())
+}
+
+// WithLockWait Return view of storage calling onWait with start and end of every wait for lock
+// of state or cell held by someone else, uncontended locks are not reported
+func (s *SimpleStorage) WithLockWait(onWait func(start time.Time, end time.Time)) Storage {
+	return &lockTracedStorage{s: s, onWait: onWait}
+}
+
+// lockTracedStorage view of SimpleStorage reporting waits for locks of reads and writes of cells
+type lockTracedStorage struct {
+	s      *SimpleStorage
+	onWait lockWait
+}
+
+var (
+	_ Versioned    = (*lockTracedStorage)(nil)
+	_ Expiring     = (*lockTracedStorage)(nil)
+	_ Checkpointed = (*lockTracedStorage)(nil)
+	_ Watchable    = (*lockTracedStorage)(nil)
+	_ io.Closer    = (*lockTracedStorage)(nil)
+)
+
+func (t *lockTracedStorage) Config() Config {
+	return t.s.Config()
+}
+
+func (t *lockTracedStorage) GetState() int {
+	return t.s.getState(t.onWait)
+}
+
+func (t *lockTracedStorage) GetValue(idx int) (string, error) {
+	return t.s.getValue(idx, t.onWait)
+}
+
+func (t *lockTracedStorage) SetState(state int) error {
+	return t.s.SetState(state)
+}
+
+func (t *lockTracedStorage) SetValue(idx int, str string) error {
+	return t.s.replace(idx, str, 0, nil, t.onWait)
+}
+
+func (t *lockTracedStorage) GetValues(idxs []int) ([]string, []error, error) {
+	return t.s.getValues(idxs, t.onWait)
+}
+
+func (t *lockTracedStorage) SetValues(values map[int]string) error {
+	return t.s.setValues(values, t.onWait)
+}
+
+func (t *lockTracedStorage) SetValuesEach(values map[int]string) (map[int]error, error) {
+	return t.s.setValuesEach(values, t.onWait)
+}
+
+func (t *lockTracedStorage) Scan(from int, to int, fn func(idx int, str string) bool) error {
+	return t.s.scan(from, to, fn, t.onWait)
+}
+
+func (t *lockTracedStorage) CompareAndSwap(idx int, expected string, str string) error {
+	return t.s.replace(idx, str, 0, ifValue(expected), t.onWait)
+}
+
+func (t *lockTracedStorage) Snapshot(w io.Writer) error {
+	return t.s.Snapshot(w)
+}
+
+func (t *lockTracedStorage) Restore(r io.Reader) error {
+	return t.s.Restore(r)
+}
+
+func (t *lockTracedStorage) Checkpoint(w io.Writer, commit func() error) error {
+	return t.s.Checkpoint(w, commit)
+}
+
+func (t *lockTracedStorage) GetCell(idx int) (Cell, error) {
+	return t.s.getCell(idx, t.onWait)
+}
+
+func (t *lockTracedStorage) ReplaceIfVersion(idx int, version uint64, str string) error {
+	return t.s.replace(idx, str, 0, ifVersion(version), t.onWait)
+}
+
+func (t *lockTracedStorage) SetValueTTL(idx int, str string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrBadTTL
+	}
+	return t.s.replace(idx, str, ttl, nil, t.onWait)
+}
+
+func (t *lockTracedStorage) Sweep() (int, error) {
+	return t.s.Sweep()
+}
+
+func (t *lockTracedStorage) Watch(idxs []int, state bool, buffer int, policy SlowPolicy) (*Watch, error) {
+	return t.s.Watch(idxs, state, buffer, policy)
+}
+
+func (t *lockTracedStorage) Close() error {
+	return t.s.Close()
+}
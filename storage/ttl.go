@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"time"
+)
+
+// SWEEP_INTERVAL default interval between sweeps of expired cells
+const SWEEP_INTERVAL = time.Second
+
+// SetValueTTL Set value to known index of storage, the cell reads as empty after ttl
+func (s *SimpleStorage) SetValueTTL(idx int, str string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrBadTTL
+	}
+	return s.replace(idx, str, ttl, nil, nil)
+}
+
+// Sweep Clear expired cells regardless of state of storage, return number of cleared cells.
+// Cleared cell gets the next version with time of expiry as time of write
+func (s *SimpleStorage) Sweep() (count int, err error) {
+	now := time.Now().UnixNano()
+	for idx := range s.data {
+		s.dataMutex[idx].RLock()
+		expired := s.meta[idx].expired(now)
+		s.dataMutex[idx].RUnlock()
+		if !expired {
+			continue
+		}
+		s.dataMutex[idx].Lock()
+		// The cell may be overwritten since it was checked
+		if s.meta[idx].expired(now) {
+			str, meta := s.current(idx, now)
+			err = s.write(idx, str, meta)
+			count++
+		}
+		s.dataMutex[idx].Unlock()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Sweeper clears expired cells of storage on schedule
+type Sweeper struct {
+	stor Expiring
+	quit chan struct{}
+	done chan struct{}
+}
+
+// NewSweeper initializes Sweeper of stor
+func NewSweeper(stor Expiring) *Sweeper {
+	return &Sweeper{stor: stor}
+}
+
+// Start sweeps expired cells every interval until Stop, errors are passed to onError
+func (s *Sweeper) Start(interval time.Duration, onError func(err error)) {
+	s.quit = make(chan struct{})
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := s.stor.Sweep(); err != nil && onError != nil {
+					onError(err)
+				}
+			case <-s.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops sweeps started by Start and waits for the running one
+func (s *Sweeper) Stop() {
+	if s.quit == nil {
+		return
+	}
+	close(s.quit)
+	<-s.done
+}
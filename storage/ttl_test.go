@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSimpleStorage_SetValueTTL(t *testing.T) {
+	stor := newSimpleStorage(DefaultConfig())
+	if err := stor.SetValueTTL(1, "token", 0); !errors.Is(err, ErrBadTTL) {
+		t.Errorf("wrong results: got %v, expected %v", err, ErrBadTTL)
+	}
+	if err := stor.SetValueTTL(1, "token", 20*time.Millisecond); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := stor.SetValueTTL(2, "token", 20*time.Millisecond); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Plain write drops time to live
+	if err := stor.SetValue(2, "forever"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cell, _ := stor.GetCell(1)
+	if cell.Value != "token" || cell.Expires.IsZero() || time.Until(cell.Expires) > 20*time.Millisecond {
+		t.Errorf("wrong results: got %+v before expiry", cell)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if str, _ := stor.GetValue(1); str != "" {
+		t.Errorf("wrong results: got %q, expected expired cell to be empty", str)
+	}
+	if values, _, _ := stor.GetValues([]int{1, 2}); values[0] != "" || values[1] != "forever" {
+		t.Errorf("wrong results: got %q", values)
+	}
+	expired, _ := stor.GetCell(1)
+	if expired.Value != "" || expired.Version != cell.Version+1 || !expired.Expires.IsZero() {
+		t.Errorf("wrong results: got %+v after expiry", expired)
+	}
+	if err := stor.CompareAndSwap(3, "", "three"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	count, err := stor.Sweep()
+	if err != nil || count != 1 {
+		t.Errorf("wrong results: swept %d cells %v, expected %d", count, err, 1)
+	}
+	if swept, _ := stor.GetCell(1); swept != expired || stor.data[1] != "" {
+		t.Errorf("wrong results: got %+v after sweep, expected %+v", swept, expired)
+	}
+}
+
+func TestWALStorage_ReplayTTL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.wal")
+	stor := openWALStorage(t, path)
+	if err := stor.SetValueTTL(1, "token", time.Hour); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := stor.SetValueTTL(2, "short", time.Millisecond); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if _, err := stor.Sweep(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = stor.Close()
+
+	replayed := openWALStorage(t, path)
+	defer replayed.Close()
+	for _, idx := range []int{1, 2} {
+		if replayed.data[idx] != stor.data[idx] || replayed.meta[idx] != stor.meta[idx] {
+			t.Errorf("wrong results: got cell %d %q %+v, expected %q %+v",
+				idx, replayed.data[idx], replayed.meta[idx], stor.data[idx], stor.meta[idx])
+		}
+	}
+}
+
+func TestSweeper(t *testing.T) {
+	stor := newSimpleStorage(DefaultConfig())
+	_ = stor.SetValueTTL(1, "token", time.Millisecond)
+	sweeper := NewSweeper(stor)
+	sweeper.Start(time.Millisecond, func(err error) {
+		t.Errorf("unexpected sweep error: %v", err)
+	})
+	deadline := time.Now().Add(time.Second)
+	for {
+		stor.dataMutex[1].RLock()
+		str := stor.data[1]
+		stor.dataMutex[1].RUnlock()
+		if str == "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expired cell isn't swept")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	sweeper.Stop()
+	// Stopped sweeper doesn't touch storage
+	_ = stor.SetValueTTL(2, "token", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if stor.data[2] != "token" {
+		t.Errorf("wrong results: cell is swept after Stop")
+	}
+}
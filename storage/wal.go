@@ -0,0 +1,627 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/Bambelbl/iproto-server/logging"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// SyncPolicy defines when records of write-ahead log are considered durable
+type SyncPolicy int
+
+const (
+	// SYNC_ALWAYS every write is acknowledged after fsync of the record,
+	// concurrent writes share one fsync
+	SYNC_ALWAYS SyncPolicy = iota
+	// SYNC_BATCHED writes are collected for up to batch delay or batch size
+	// and acknowledged after one fsync of the whole batch
+	SYNC_BATCHED
+	// SYNC_INTERVAL writes are acknowledged after they are written to the file,
+	// the file is fsynced every sync interval
+	SYNC_INTERVAL
+)
+
+const (
+	WAL_MAGIC          = "IPRWAL01"
+	WAL_RECORD_HEADER  = 8
+	WAL_SYNC_INTERVAL  = time.Second
+	WAL_BATCH_SIZE     = 64
+	WAL_BATCH_DELAY    = 2 * time.Millisecond
+	WAL_MAX_RECORD_LEN = 1 << 20
+)
+
+const (
+	// OP_SET_VALUE value of cell, its version grows by one on replay
+	OP_SET_VALUE = 1
+	OP_SET_STATE = 2
+	// OP_SET_CELL value of cell with its version and time of write
+	OP_SET_CELL = 3
+	// OP_SET_CELLS values of batch of cells written at once
+	OP_SET_CELLS = 4
+	// OP_SET_CELL_TTL value of cell with its version, time of write and time of expiry
+	OP_SET_CELL_TTL = 5
+)
+
+var (
+	// ErrWALCorrupted write-ahead log has unknown header or broken record followed by other data
+	ErrWALCorrupted = errors.New("write-ahead log is corrupted")
+	// ErrWALClosed write-ahead log is closed
+	ErrWALClosed = errors.New("write-ahead log is closed")
+)
+
+// ParseSyncPolicy returns SyncPolicy by its name: always, batched or interval
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	switch name {
+	case "always":
+		return SYNC_ALWAYS, nil
+	case "batched":
+		return SYNC_BATCHED, nil
+	case "interval":
+		return SYNC_INTERVAL, nil
+	}
+	return 0, fmt.Errorf("unknown sync policy %q: expected always, batched or interval", name)
+}
+
+// WALOption configures optional behaviour of write-ahead log
+type WALOption func(w *wal)
+
+// WithSyncPolicy sets when writes are acknowledged, SYNC_ALWAYS by default
+func WithSyncPolicy(policy SyncPolicy) WALOption {
+	return func(w *wal) {
+		w.policy = policy
+	}
+}
+
+// WithSyncInterval sets period of fsync for SYNC_INTERVAL policy
+func WithSyncInterval(interval time.Duration) WALOption {
+	return func(w *wal) {
+		w.interval = interval
+	}
+}
+
+// WithBatch sets max number of records and max delay of one batch for SYNC_BATCHED policy
+func WithBatch(size int, delay time.Duration) WALOption {
+	return func(w *wal) {
+		w.batchSize = size
+		w.batchDelay = delay
+	}
+}
+
+// WithSnapshot makes snapshot file at path the base of the log: storage is loaded from the file, if it exists,
+// before records of the log are replayed, so records of the log win over the snapshot. Checkpoint with
+// the snapshot drops records the snapshot holds, so the log must be kept together with the file
+func WithSnapshot(path string) WALOption {
+	return func(w *wal) {
+		w.snapshotPath = path
+	}
+}
+
+// WithLogger sets logger of replay and failures of write-ahead log, nothing is logged by default
+func WithLogger(logger logging.Logger) WALOption {
+	return func(w *wal) {
+		w.logger = logger
+	}
+}
+
+// NewWALStorageRepo initializes SimpleStorage backed by write-ahead log in file at path.
+// Snapshot given by WithSnapshot is loaded and records of the log are replayed first, then every
+// SetValue and SetState is appended to the log and applied only when it is durable under the chosen SyncPolicy
+func NewWALStorageRepo(config Config, path string, opts ...WALOption) (Storage, error) {
+	s := newSimpleStorage(config)
+	w, err := openWAL(path, s, opts...)
+	if err != nil {
+		return nil, err
+	}
+	s.wal = w
+	return s, nil
+}
+
+// wal append-only log of changes of storage. Every record is
+// <uint32 length><uint32 crc32 of payload><payload>, payload starts with operation code
+type wal struct {
+	file       *os.File
+	policy     SyncPolicy
+	interval   time.Duration
+	batchSize  int
+	batchDelay time.Duration
+	logger     logging.Logger
+
+	path         string
+	snapshotPath string
+
+	// fileMutex is locked for writing while file is replaced by cut,
+	// size is size of the file with records written to it
+	fileMutex sync.RWMutex
+
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	size     int64
+	buf      []byte
+	count    int
+	appended uint64
+	durable  uint64
+	flushing bool
+	err      error
+
+	pending chan struct{}
+	full    chan struct{}
+	quit    chan struct{}
+	done    chan struct{}
+}
+
+// openWAL opens log at path, replays its records to s and starts background sync
+func openWAL(path string, s *SimpleStorage, opts ...WALOption) (*wal, error) {
+	w := &wal{
+		policy:     SYNC_ALWAYS,
+		interval:   WAL_SYNC_INTERVAL,
+		batchSize:  WAL_BATCH_SIZE,
+		batchDelay: WAL_BATCH_DELAY,
+		logger:     logging.Nop(),
+		pending:    make(chan struct{}, 1),
+		full:       make(chan struct{}, 1),
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	w.cond = sync.NewCond(&w.mutex)
+
+	if w.snapshotPath != "" {
+		if err := s.loadSnapshot(w.snapshotPath); err != nil {
+			return nil, fmt.Errorf("load snapshot %s: %w", w.snapshotPath, err)
+		}
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w.path = path
+	w.file = file
+	if err = w.replay(s); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("replay %s: %w", path, err)
+	}
+
+	switch w.policy {
+	case SYNC_BATCHED:
+		go w.syncBatches()
+	case SYNC_INTERVAL:
+		go w.syncPeriodically()
+	default:
+		close(w.done)
+	}
+	return w, nil
+}
+
+// replay applies records of the log to s. Incomplete or broken record at the end of the log
+// is left from interrupted write, it is cut off. Broken record followed by other data
+// means the log is corrupted
+func (w *wal) replay(s *SimpleStorage) error {
+	info, err := w.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < int64(len(WAL_MAGIC)) {
+		// New log or log interrupted while its header was written
+		if err = w.file.Truncate(0); err != nil {
+			return err
+		}
+		if _, err = w.file.WriteAt([]byte(WAL_MAGIC), 0); err != nil {
+			return err
+		}
+		if err = w.file.Sync(); err != nil {
+			return err
+		}
+		w.size = int64(len(WAL_MAGIC))
+		_, err = w.file.Seek(w.size, io.SeekStart)
+		return err
+	}
+
+	reader := bufio.NewReader(w.file)
+	magic := make([]byte, len(WAL_MAGIC))
+	if _, err = io.ReadFull(reader, magic); err != nil {
+		return err
+	}
+	if string(magic) != WAL_MAGIC {
+		return fmt.Errorf("%w: unknown header %q", ErrWALCorrupted, magic)
+	}
+	offset := int64(len(WAL_MAGIC))
+	header := make([]byte, WAL_RECORD_HEADER)
+	records := 0
+	for {
+		payload, err := readRecord(reader, header)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		end := offset + int64(WAL_RECORD_HEADER+len(payload))
+		if errors.Is(err, io.ErrUnexpectedEOF) || err != nil && end >= info.Size() {
+			w.logger.Warn("incomplete record at the end of write-ahead log is cut off", "path", w.path,
+				"offset", offset, "size", info.Size()-offset, logging.KEY_ERROR, err)
+			if err = w.file.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		if err == nil {
+			err = s.applyRecord(payload)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: record at offset %d: %s", ErrWALCorrupted, offset, err.Error())
+		}
+		offset = end
+		records++
+	}
+	w.logger.Info("write-ahead log is replayed", "path", w.path, "records", records)
+	w.size = offset
+	_, err = w.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+// readRecord reads one record and checks its checksum
+func readRecord(reader io.Reader, header []byte) ([]byte, error) {
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	length := binary.LittleEndian.Uint32(header[:4])
+	if length > WAL_MAX_RECORD_LEN {
+		return nil, fmt.Errorf("record length %d exceeds %d", length, WAL_MAX_RECORD_LEN)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(header[4:]) {
+		return payload, errors.New("checksum mismatch")
+	}
+	return payload, nil
+}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// setValueRecord payload of record of value of cell written by old versions of the log
+func setValueRecord(idx int, str string) []byte {
+	payload := make([]byte, 5, 5+len(str))
+	payload[0] = OP_SET_VALUE
+	binary.LittleEndian.PutUint32(payload[1:5], uint32(idx))
+	return append(payload, str...)
+}
+
+// setCellRecord payload of record of value of cell with its meta:
+// <op><uint32 idx><uint64 version><int64 time of write>[<int64 time of expiry>]<bytes of value>,
+// time of expiry is written with OP_SET_CELL_TTL only
+func setCellRecord(idx int, str string, meta cellMeta) []byte {
+	header := 21
+	if meta.expires != 0 {
+		header = 29
+	}
+	payload := make([]byte, header, header+len(str))
+	payload[0] = OP_SET_CELL
+	binary.LittleEndian.PutUint32(payload[1:5], uint32(idx))
+	binary.LittleEndian.PutUint64(payload[5:13], meta.version)
+	binary.LittleEndian.PutUint64(payload[13:21], uint64(meta.modified))
+	if meta.expires != 0 {
+		payload[0] = OP_SET_CELL_TTL
+		binary.LittleEndian.PutUint64(payload[21:29], uint64(meta.expires))
+	}
+	return append(payload, str...)
+}
+
+// setCellsRecord payload of record of values of cells idxs with their meta: <op><uint32 number of cells>,
+// then <uint32 idx><uint64 version><int64 time of write><uint32 length><bytes of value> of every cell
+func setCellsRecord(idxs []int, values map[int]string, metas []cellMeta) []byte {
+	size := 5
+	for _, idx := range idxs {
+		size += 24 + len(values[idx])
+	}
+	payload := make([]byte, 5, size)
+	payload[0] = OP_SET_CELLS
+	binary.LittleEndian.PutUint32(payload[1:5], uint32(len(idxs)))
+	var cell [24]byte
+	for i, idx := range idxs {
+		binary.LittleEndian.PutUint32(cell[0:4], uint32(idx))
+		binary.LittleEndian.PutUint64(cell[4:12], metas[i].version)
+		binary.LittleEndian.PutUint64(cell[12:20], uint64(metas[i].modified))
+		binary.LittleEndian.PutUint32(cell[20:24], uint32(len(values[idx])))
+		payload = append(append(payload, cell[:]...), values[idx]...)
+	}
+	return payload
+}
+
+// setStateRecord payload of record of SetState
+func setStateRecord(state int) []byte {
+	return []byte{OP_SET_STATE, byte(state)}
+}
+
+// applyRecord applies payload of record to storage without checks of its state
+func (s *SimpleStorage) applyRecord(payload []byte) error {
+	if len(payload) == 0 {
+		return errors.New("empty record")
+	}
+	switch payload[0] {
+	case OP_SET_VALUE:
+		if len(payload) < 5 {
+			return errors.New("short SetValue record")
+		}
+		idx := int(binary.LittleEndian.Uint32(payload[1:5]))
+		if idx >= len(s.data) {
+			return fmt.Errorf("index %d of SetValue record is out of range", idx)
+		}
+		s.data[idx] = string(payload[5:])
+		s.meta[idx] = cellMeta{version: s.meta[idx].version + 1}
+	case OP_SET_CELL, OP_SET_CELL_TTL:
+		header := 21
+		if payload[0] == OP_SET_CELL_TTL {
+			header = 29
+		}
+		if len(payload) < header {
+			return errors.New("short SetCell record")
+		}
+		idx := int(binary.LittleEndian.Uint32(payload[1:5]))
+		if idx >= len(s.data) {
+			return fmt.Errorf("index %d of SetCell record is out of range", idx)
+		}
+		s.data[idx] = string(payload[header:])
+		s.meta[idx] = cellMeta{
+			version:  binary.LittleEndian.Uint64(payload[5:13]),
+			modified: int64(binary.LittleEndian.Uint64(payload[13:21])),
+		}
+		if header == 29 {
+			s.meta[idx].expires = int64(binary.LittleEndian.Uint64(payload[21:29]))
+		}
+	case OP_SET_CELLS:
+		if len(payload) < 5 {
+			return errors.New("short SetCells record")
+		}
+		count := binary.LittleEndian.Uint32(payload[1:5])
+		if uint64(count)*24 > uint64(len(payload)-5) {
+			return fmt.Errorf("%d cells don't fit in SetCells record", count)
+		}
+		// The batch is checked completely before it's applied
+		type cell struct {
+			idx   int
+			value string
+			meta  cellMeta
+		}
+		cells := make([]cell, 0, count)
+		rest := payload[5:]
+		for i := uint32(0); i < count; i++ {
+			if len(rest) < 24 || uint64(len(rest)-24) < uint64(binary.LittleEndian.Uint32(rest[20:24])) {
+				return fmt.Errorf("cell %d of SetCells record is truncated", i)
+			}
+			idx := int(binary.LittleEndian.Uint32(rest[0:4]))
+			if idx >= len(s.data) {
+				return fmt.Errorf("index %d of SetCells record is out of range", idx)
+			}
+			length := binary.LittleEndian.Uint32(rest[20:24])
+			cells = append(cells, cell{idx: idx, value: string(rest[24 : 24+length]), meta: cellMeta{
+				version:  binary.LittleEndian.Uint64(rest[4:12]),
+				modified: int64(binary.LittleEndian.Uint64(rest[12:20])),
+			}})
+			rest = rest[24+length:]
+		}
+		if len(rest) != 0 {
+			return errors.New("trailing data in SetCells record")
+		}
+		for _, c := range cells {
+			s.data[c.idx] = c.value
+			s.meta[c.idx] = c.meta
+		}
+	case OP_SET_STATE:
+		if len(payload) != 2 {
+			return errors.New("wrong SetState record")
+		}
+		s.state = int(payload[1])
+	default:
+		return fmt.Errorf("unknown operation %d", payload[0])
+	}
+	return nil
+}
+
+// write appends record with payload to the log and waits until it is durable
+func (w *wal) write(payload []byte) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	var header [WAL_RECORD_HEADER]byte
+	binary.LittleEndian.PutUint32(header[:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[4:], crc32.Checksum(payload, crcTable))
+	w.buf = append(append(w.buf, header[:]...), payload...)
+	w.count++
+	w.appended++
+	lsn := w.appended
+
+	if w.policy == SYNC_BATCHED {
+		notify(w.pending)
+		if w.count >= w.batchSize {
+			notify(w.full)
+		}
+	}
+	for w.durable < lsn && w.err == nil {
+		if w.policy != SYNC_BATCHED && !w.flushing {
+			w.flush(w.policy == SYNC_ALWAYS)
+			continue
+		}
+		w.cond.Wait()
+	}
+	return w.err
+}
+
+// notify sends signal to channel with buffer of one without blocking
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// flush writes buffered records to the file and fsyncs it if sync is set.
+// It must be called with mutex held, the mutex is released during IO
+func (w *wal) flush(sync bool) {
+	if w.flushing || len(w.buf) == 0 {
+		return
+	}
+	w.flushing = true
+	data, upto := w.buf, w.appended
+	w.buf, w.count = nil, 0
+	w.mutex.Unlock()
+	_, err := w.file.Write(data)
+	if err == nil && sync {
+		err = w.file.Sync()
+	}
+	w.mutex.Lock()
+	w.flushing = false
+	if err != nil {
+		// Position of the file is unknown after failed write, the log can't go on
+		w.fail(err)
+	}
+	if err == nil {
+		w.durable = upto
+		w.size += int64(len(data))
+	}
+	w.cond.Broadcast()
+}
+
+// fail makes all following writes fail with err, it must be called with mutex held
+func (w *wal) fail(err error) {
+	if w.err != nil {
+		return
+	}
+	w.err = fmt.Errorf("write-ahead log: %w", err)
+	w.logger.Error("write-ahead log failed, writes are rejected", "path", w.path, logging.KEY_ERROR, err)
+}
+
+// syncBatches flushes batches of records for SYNC_BATCHED policy
+func (w *wal) syncBatches() {
+	defer close(w.done)
+	for {
+		select {
+		case <-w.pending:
+		case <-w.quit:
+			return
+		}
+		timer := time.NewTimer(w.batchDelay)
+		select {
+		case <-timer.C:
+		case <-w.full:
+			timer.Stop()
+		case <-w.quit:
+			timer.Stop()
+			return
+		}
+		w.mutex.Lock()
+		for w.flushing {
+			w.cond.Wait()
+		}
+		w.flush(true)
+		w.mutex.Unlock()
+	}
+}
+
+// syncPeriodically fsyncs the file for SYNC_INTERVAL policy
+func (w *wal) syncPeriodically() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.fileMutex.RLock()
+			err := w.file.Sync()
+			w.fileMutex.RUnlock()
+			if err != nil {
+				w.mutex.Lock()
+				w.fail(err)
+				w.cond.Broadcast()
+				w.mutex.Unlock()
+			}
+		case <-w.quit:
+			return
+		}
+	}
+}
+
+// offset returns size of the log, records written after it are appended behind it
+func (w *wal) offset() int64 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for w.flushing {
+		w.cond.Wait()
+	}
+	return w.size
+}
+
+// cut drops records before offset, they are held by snapshot. Records after offset are copied
+// to a new log which replaces the file, writes wait until it's replaced
+func (w *wal) cut(offset int64) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for w.flushing {
+		w.cond.Wait()
+	}
+	if w.err != nil {
+		return w.err
+	}
+	tmp := w.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write([]byte(WAL_MAGIC))
+	if err == nil {
+		_, err = io.Copy(file, io.NewSectionReader(w.file, offset, w.size-offset))
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, w.path)
+	}
+	if err != nil {
+		_ = file.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	w.fileMutex.Lock()
+	old := w.file
+	w.file = file
+	w.fileMutex.Unlock()
+	_ = old.Close()
+	w.logger.Info("write-ahead log is cut off by snapshot", "path", w.path, "dropped", offset-int64(len(WAL_MAGIC)))
+	w.size -= offset - int64(len(WAL_MAGIC))
+	return syncDir(w.path)
+}
+
+// close flushes and fsyncs the rest of records and closes the file
+func (w *wal) close() error {
+	close(w.quit)
+	<-w.done
+	w.mutex.Lock()
+	for w.flushing {
+		w.cond.Wait()
+	}
+	w.flush(true)
+	err := w.err
+	if err == nil {
+		err = w.file.Sync()
+	}
+	w.err = ErrWALClosed
+	w.cond.Broadcast()
+	w.mutex.Unlock()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,261 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/Bambelbl/iproto-server/logging"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type WALTestCase struct {
+	Policy SyncPolicy
+}
+
+// openWALStorage opens storage backed by log at path failing the test on error
+func openWALStorage(t *testing.T, path string, opts ...WALOption) *SimpleStorage {
+	stor, err := NewWALStorageRepo(DefaultConfig(), path, opts...)
+	if err != nil {
+		t.Fatalf("unexpected open error: %v", err)
+	}
+	return stor.(*SimpleStorage)
+}
+
+func TestWALStorage_Replay(t *testing.T) {
+	cases := []WALTestCase{
+		{Policy: SYNC_ALWAYS},
+		{Policy: SYNC_BATCHED},
+		{Policy: SYNC_INTERVAL},
+	}
+	for caseNum, item := range cases {
+		path := filepath.Join(t.TempDir(), "storage.wal")
+		opts := []WALOption{WithSyncPolicy(item.Policy), WithSyncInterval(time.Millisecond)}
+		stor := openWALStorage(t, path, opts...)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			go func(idx int) {
+				defer wg.Done()
+				if err := stor.SetValue(idx, fmt.Sprintf("value %d", idx)); err != nil {
+					t.Errorf("[%d] unexpected error: %v", caseNum, err)
+				}
+			}(i)
+		}
+		wg.Wait()
+		if err := stor.SetValue(0, "zero"); err != nil {
+			t.Errorf("[%d] unexpected error: %v", caseNum, err)
+		}
+		if err := stor.SetValues(map[int]string{1: "one", 2: "", SIZE - 1: "last"}); err != nil {
+			t.Errorf("[%d] unexpected error: %v", caseNum, err)
+		}
+		if err := stor.SetState(READ_ONLY); err != nil {
+			t.Errorf("[%d] unexpected error: %v", caseNum, err)
+		}
+		if err := stor.Close(); err != nil {
+			t.Errorf("[%d] unexpected close error: %v", caseNum, err)
+		}
+		if err := stor.SetState(READ_WRITE); !errors.Is(err, ErrWALClosed) {
+			t.Errorf("[%d] wrong results: got %v, expected %v", caseNum, err, ErrWALClosed)
+		}
+
+		replayed := openWALStorage(t, path, opts...)
+		if state := replayed.GetState(); state != READ_ONLY {
+			t.Errorf("[%d] wrong results: got state %d, expected %d", caseNum, state, READ_ONLY)
+		}
+		expected := append([]string(nil), stor.data...)
+		expected[0], expected[1], expected[2], expected[SIZE-1] = "zero", "one", "", "last"
+		if !reflect.DeepEqual(replayed.data, expected) {
+			t.Errorf("[%d] wrong results: replayed data differs from written", caseNum)
+		}
+		if !reflect.DeepEqual(replayed.meta, stor.meta) {
+			t.Errorf("[%d] wrong results: replayed versions differ from written", caseNum)
+		}
+		if err := replayed.Close(); err != nil {
+			t.Errorf("[%d] unexpected close error: %v", caseNum, err)
+		}
+	}
+}
+
+type DamageTestCase struct {
+	Damage  func(data []byte) []byte
+	Value   string
+	IsError bool
+	CutOff  bool
+}
+
+func TestWALStorage_Damaged(t *testing.T) {
+	cases := []DamageTestCase{
+		// write interrupted in the middle of the last record
+		{Damage: func(data []byte) []byte { return data[:len(data)-2] }, Value: "first", CutOff: true},
+		// write interrupted in the middle of header of the last record
+		{Damage: func(data []byte) []byte { return data[:len(data)-len("second")-21-5] }, Value: "first", CutOff: true},
+		// last record is broken
+		{Damage: func(data []byte) []byte { data[len(data)-1] ^= 0xff; return data }, Value: "first", CutOff: true},
+		// record followed by other records is broken
+		{Damage: func(data []byte) []byte { data[len(WAL_MAGIC)+WAL_RECORD_HEADER+5] ^= 0xff; return data }, IsError: true},
+		{Damage: func(data []byte) []byte { data[0] = 'X'; return data }, IsError: true},
+		{Damage: func(data []byte) []byte { return data[:3] }},
+	}
+	for caseNum, item := range cases {
+		path := filepath.Join(t.TempDir(), "storage.wal")
+		stor := openWALStorage(t, path)
+		if err := stor.SetValue(7, "first"); err != nil {
+			t.Fatalf("[%d] unexpected error: %v", caseNum, err)
+		}
+		if err := stor.SetValue(7, "second"); err != nil {
+			t.Fatalf("[%d] unexpected error: %v", caseNum, err)
+		}
+		if err := stor.Close(); err != nil {
+			t.Fatalf("[%d] unexpected close error: %v", caseNum, err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("[%d] read error: %v", caseNum, err)
+		}
+		if err = os.WriteFile(path, item.Damage(data), 0644); err != nil {
+			t.Fatalf("[%d] write error: %v", caseNum, err)
+		}
+
+		var logged bytes.Buffer
+		logger := logging.New(&logged, logging.WithLevel(logging.NewLevelVar(logging.WARN)))
+		replayed, err := NewWALStorageRepo(DefaultConfig(), path, WithLogger(logger))
+		if cutOff := strings.Contains(logged.String(), "is cut off"); cutOff != item.CutOff {
+			t.Errorf("[%d] wrong results: got cut off logged %v, expected %v: %q", caseNum, cutOff, item.CutOff, logged.String())
+		}
+		if item.IsError {
+			if !errors.Is(err, ErrWALCorrupted) {
+				t.Errorf("[%d] wrong results: got %v, expected %v", caseNum, err, ErrWALCorrupted)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[%d] unexpected error: %v", caseNum, err)
+			continue
+		}
+		if val, _ := replayed.GetValue(7); val != item.Value {
+			t.Errorf("[%d] wrong results: got %q, expected %q", caseNum, val, item.Value)
+		}
+		// The log goes on after the cut off record
+		if err = replayed.SetValue(8, "third"); err != nil {
+			t.Errorf("[%d] unexpected error: %v", caseNum, err)
+		}
+		_ = replayed.(*SimpleStorage).Close()
+		reopened := openWALStorage(t, path)
+		if val, _ := reopened.GetValue(8); val != "third" {
+			t.Errorf("[%d] wrong results after reopen: got %q, expected %q", caseNum, val, "third")
+		}
+		_ = reopened.Close()
+	}
+}
+
+func TestWALStorage_SetStateDoesNotBlockReaders(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.wal")
+	// Record of state waits for the whole delay of its batch before it's durable
+	stor := openWALStorage(t, path, WithSyncPolicy(SYNC_BATCHED), WithBatch(WAL_BATCH_SIZE, time.Second))
+	defer stor.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- stor.SetState(READ_ONLY)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	if state := stor.GetState(); state != READ_WRITE {
+		t.Errorf("wrong results: got state %d before its record is durable, expected %d", state, READ_WRITE)
+	}
+	if _, err := stor.GetValue(0); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if wait := time.Since(start); wait > 500*time.Millisecond {
+		t.Errorf("wrong results: readers waited %v for record of state", wait)
+	}
+	if err := <-done; err != nil || stor.GetState() != READ_ONLY {
+		t.Errorf("wrong results: got %v and state %d, expected state %d", err, stor.GetState(), READ_ONLY)
+	}
+}
+
+func TestWALStorage_Checkpoint(t *testing.T) {
+	dir := t.TempDir()
+	path, snapshotPath := filepath.Join(dir, "storage.wal"), filepath.Join(dir, "storage.snap")
+	stor := openWALStorage(t, path, WithSnapshot(snapshotPath))
+	snapshotter := NewSnapshotter(stor, snapshotPath)
+	for idx := 0; idx < 10; idx++ {
+		_ = stor.SetValue(idx, "before")
+	}
+	if err := snapshotter.Snapshot(); err != nil {
+		t.Fatalf("unexpected snapshot error: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != int64(len(WAL_MAGIC)) {
+		t.Errorf("wrong results: got log of %v bytes %v, expected records held by snapshot dropped", info.Size(), err)
+	}
+
+	// Records written while snapshot is taken are kept in the log
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-quit:
+				return
+			default:
+			}
+			_ = stor.SetValue(i%10, fmt.Sprintf("during %d", i))
+			_ = stor.SetValue(10+i%10, "during")
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		if err := snapshotter.Snapshot(); err != nil {
+			t.Fatalf("[%d] unexpected snapshot error: %v", i, err)
+		}
+	}
+	close(quit)
+	<-done
+	if err := snapshotter.Snapshot(); err != nil {
+		t.Fatalf("unexpected snapshot error: %v", err)
+	}
+	_ = stor.SetValue(0, "after")
+	_ = stor.SetState(READ_ONLY)
+	if err := stor.Close(); err != nil {
+		t.Fatalf("unexpected close error: %v", err)
+	}
+
+	replayed := openWALStorage(t, path, WithSnapshot(snapshotPath))
+	defer replayed.Close()
+	if replayed.GetState() != READ_ONLY || !reflect.DeepEqual(replayed.data, stor.data) ||
+		!reflect.DeepEqual(replayed.meta, stor.meta) {
+		t.Errorf("wrong results: storage loaded from snapshot and log differs from written")
+	}
+	// The log alone has only records after the last snapshot
+	cut := openWALStorage(t, path)
+	defer cut.Close()
+	if cut.data[0] != "after" || cut.data[9] != "" {
+		t.Errorf("wrong results: got %q and %q from the log, expected %q and %q", cut.data[0], cut.data[9], "after", "")
+	}
+}
+
+func TestWALStorage_ReplayValueRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.wal")
+	stor := openWALStorage(t, path)
+	// Log written before cells got versions
+	for _, str := range []string{"first", "second"} {
+		if err := stor.wal.write(setValueRecord(7, str)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	_ = stor.Close()
+
+	replayed := openWALStorage(t, path)
+	defer replayed.Close()
+	cell, err := replayed.GetCell(7)
+	if err != nil || cell.Value != "second" || cell.Version != 2 || !cell.Modified.IsZero() {
+		t.Errorf("wrong results: got %+v %v, expected %q of version %d", cell, err, "second", 2)
+	}
+}
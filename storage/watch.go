@@ -0,0 +1,218 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// WATCH_BUFFER number of events buffered for a watch by default
+	WATCH_BUFFER = 256
+	// STATE_EVENT index of events of transitions of state
+	STATE_EVENT = -1
+)
+
+// SlowPolicy what happens to events for a watch whose buffer is full
+type SlowPolicy int
+
+const (
+	// DROP_EVENTS events that don't fit the buffer are dropped, the next delivered event counts them
+	DROP_EVENTS SlowPolicy = iota
+	// CLOSE_WATCH watch is closed with ErrWatchOverflow
+	CLOSE_WATCH
+)
+
+// ParseSlowPolicy returns SlowPolicy by its name: drop or close
+func ParseSlowPolicy(name string) (SlowPolicy, error) {
+	switch name {
+	case "drop":
+		return DROP_EVENTS, nil
+	case "close":
+		return CLOSE_WATCH, nil
+	}
+	return 0, fmt.Errorf("unknown slow watch policy %q: expected drop or close", name)
+}
+
+var (
+	// ErrWatchOverflow watch is closed because its consumer didn't keep up with changes
+	ErrWatchOverflow = errors.New("watch is closed: buffer of events overflowed")
+	// ErrWatchCanceled watch is closed by Cancel
+	ErrWatchCanceled = errors.New("watch is canceled")
+)
+
+// Event change of storage delivered to watches
+type Event struct {
+	// Idx index of changed cell, STATE_EVENT for transition of state
+	Idx int
+	// Value new value of the cell
+	Value string
+	// Version new version of the cell
+	Version uint64
+	// State state of storage after transition, set only for STATE_EVENT
+	State int
+	// Dropped number of events dropped for the watch right before this one
+	Dropped uint64
+}
+
+// Watchable is implemented by storages notifying about changes of cells and state
+type Watchable interface {
+
+	// Watch Subscribe to changes of cells idxs, all cells if idxs is nil, and to transitions of state if state is set.
+	// Events are buffered up to buffer, when the buffer is full policy applies
+	Watch(idxs []int, state bool, buffer int, policy SlowPolicy) (*Watch, error)
+}
+
+// Watch subscription to changes of storage, events of one cell come in order of writes
+type Watch struct {
+	events  chan Event
+	idxs    map[int]struct{}
+	state   bool
+	policy  SlowPolicy
+	hub     *watchHub
+	mutex   sync.Mutex
+	dropped uint64
+	err     error
+}
+
+// Events returns channel of events, it's closed when the watch is closed
+func (w *Watch) Events() <-chan Event {
+	return w.events
+}
+
+// Err returns why the watch is closed, nil while it's open
+func (w *Watch) Err() (err error) {
+	w.mutex.Lock()
+	err = w.err
+	w.mutex.Unlock()
+	return
+}
+
+// Cancel closes the watch, events are not delivered anymore
+func (w *Watch) Cancel() {
+	w.hub.remove(w)
+	w.close(ErrWatchCanceled)
+}
+
+// matches reports whether the watch is subscribed to event
+func (w *Watch) matches(event Event) bool {
+	if event.Idx == STATE_EVENT {
+		return w.state
+	}
+	if w.idxs == nil {
+		return true
+	}
+	_, exist := w.idxs[event.Idx]
+	return exist
+}
+
+// deliver sends event to the watch without blocking, applying policy if the buffer is full
+func (w *Watch) deliver(event Event) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.err != nil {
+		return
+	}
+	event.Dropped = w.dropped
+	select {
+	case w.events <- event:
+		w.dropped = 0
+		return
+	default:
+	}
+	if w.policy == CLOSE_WATCH {
+		w.err = ErrWatchOverflow
+		close(w.events)
+		return
+	}
+	w.dropped++
+}
+
+// close closes channel of events with reason err unless the watch is already closed
+func (w *Watch) close(err error) {
+	w.mutex.Lock()
+	if w.err == nil {
+		w.err = err
+		close(w.events)
+	}
+	w.mutex.Unlock()
+}
+
+// watchHub watches of storage
+type watchHub struct {
+	mutex   sync.RWMutex
+	watches map[*Watch]struct{}
+	count   atomic.Int32
+}
+
+// add subscribes w to events of hub
+func (h *watchHub) add(w *Watch) {
+	h.mutex.Lock()
+	if h.watches == nil {
+		h.watches = make(map[*Watch]struct{})
+	}
+	h.watches[w] = struct{}{}
+	h.count.Store(int32(len(h.watches)))
+	h.mutex.Unlock()
+}
+
+// remove unsubscribes w from events of hub
+func (h *watchHub) remove(w *Watch) {
+	h.mutex.Lock()
+	delete(h.watches, w)
+	h.count.Store(int32(len(h.watches)))
+	h.mutex.Unlock()
+}
+
+// cancelAll closes all watches of hub
+func (h *watchHub) cancelAll() {
+	h.mutex.Lock()
+	watches := h.watches
+	h.watches = nil
+	h.count.Store(0)
+	h.mutex.Unlock()
+	for w := range watches {
+		w.close(ErrWatchCanceled)
+	}
+}
+
+// notify delivers event to every watch subscribed to it, it never blocks on slow watches
+func (h *watchHub) notify(event Event) {
+	if h.count.Load() == 0 {
+		return
+	}
+	h.mutex.RLock()
+	for w := range h.watches {
+		if w.matches(event) {
+			w.deliver(event)
+		}
+	}
+	h.mutex.RUnlock()
+}
+
+// Watch Subscribe to changes of cells idxs, all cells if idxs is nil, and to transitions of state if state is set.
+// Events are sent after the change is written, while the cell is still locked, so events of one cell
+// come in order of writes. Expired values are reported when they are swept
+func (s *SimpleStorage) Watch(idxs []int, state bool, buffer int, policy SlowPolicy) (*Watch, error) {
+	if buffer <= 0 {
+		buffer = WATCH_BUFFER
+	}
+	w := &Watch{
+		events: make(chan Event, buffer),
+		state:  state,
+		policy: policy,
+		hub:    &s.watches,
+	}
+	if idxs != nil {
+		w.idxs = make(map[int]struct{}, len(idxs))
+		for _, idx := range idxs {
+			if idx < 0 || idx >= len(s.data) {
+				return nil, fmt.Errorf("%w: valid index is in [0;%d]", ErrOutOfRange, len(s.data)-1)
+			}
+			w.idxs[idx] = struct{}{}
+		}
+	}
+	s.watches.add(w)
+	return w, nil
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// drain returns events buffered for the watch
+func drain(w *Watch) []Event {
+	var events []Event
+	for {
+		select {
+		case event, ok := <-w.Events():
+			if !ok {
+				return events
+			}
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+type WatchTestCase struct {
+	Idxs   []int
+	State  bool
+	Events []Event
+}
+
+func TestSimpleStorage_Watch(t *testing.T) {
+	stor := newSimpleStorage(DefaultConfig())
+	cases := []WatchTestCase{
+		{Idxs: nil, State: false, Events: []Event{
+			{Idx: 1, Value: "one", Version: 1},
+			{Idx: 2, Value: "two", Version: 1},
+			{Idx: 3, Value: "three", Version: 1},
+			{Idx: 1, Value: "uno", Version: 2},
+		}},
+		{Idxs: []int{1}, State: true, Events: []Event{
+			{Idx: 1, Value: "one", Version: 1},
+			{Idx: 1, Value: "uno", Version: 2},
+			{Idx: STATE_EVENT, State: READ_ONLY},
+		}},
+		{Idxs: []int{}, State: true, Events: []Event{
+			{Idx: STATE_EVENT, State: READ_ONLY},
+		}},
+	}
+	watches := make([]*Watch, len(cases))
+	for caseNum, item := range cases {
+		w, err := stor.Watch(item.Idxs, item.State, 0, CLOSE_WATCH)
+		if err != nil {
+			t.Fatalf("[%d] unexpected error: %v", caseNum, err)
+		}
+		watches[caseNum] = w
+	}
+	if _, err := stor.Watch([]int{1000}, false, 0, CLOSE_WATCH); !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("wrong results: got %v, expected %v", err, ErrOutOfRange)
+	}
+
+	if err := stor.SetValue(1, "one"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := stor.SetValues(map[int]string{2: "two", 3: "three"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := stor.CompareAndSwap(1, "one", "uno"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Failed writes are not reported
+	if err := stor.CompareAndSwap(1, "one", "eins"); !errors.Is(err, ErrMismatch) {
+		t.Fatalf("wrong results: got %v, expected %v", err, ErrMismatch)
+	}
+	if err := stor.SetState(READ_ONLY); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for caseNum, item := range cases {
+		if events := drain(watches[caseNum]); !reflect.DeepEqual(events, item.Events) {
+			t.Errorf("[%d] wrong results: got %+v, expected %+v", caseNum, events, item.Events)
+		}
+	}
+
+	watches[0].Cancel()
+	if err := stor.SetState(READ_WRITE); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := <-watches[0].Events(); ok || !errors.Is(watches[0].Err(), ErrWatchCanceled) {
+		t.Errorf("wrong results: canceled watch got event or %v", watches[0].Err())
+	}
+	if err := stor.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if events := drain(watches[1]); len(events) != 1 || !errors.Is(watches[1].Err(), ErrWatchCanceled) {
+		t.Errorf("wrong results: got %+v %v after close", events, watches[1].Err())
+	}
+}
+
+func TestSimpleStorage_WatchSlowConsumer(t *testing.T) {
+	stor := newSimpleStorage(DefaultConfig())
+	dropping, _ := stor.Watch([]int{1}, false, 2, DROP_EVENTS)
+	closing, _ := stor.Watch([]int{1}, false, 2, CLOSE_WATCH)
+	for _, str := range []string{"a", "b", "c", "d"} {
+		if err := stor.SetValue(1, str); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// Dropped events are counted by the next delivered one
+	expected := []Event{{Idx: 1, Value: "a", Version: 1}, {Idx: 1, Value: "b", Version: 2}}
+	if events := drain(dropping); !reflect.DeepEqual(events, expected) || dropping.Err() != nil {
+		t.Errorf("wrong results: got %+v %v, expected %+v", events, dropping.Err(), expected)
+	}
+	if err := stor.SetValue(1, "e"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected = []Event{{Idx: 1, Value: "e", Version: 5, Dropped: 2}}
+	if events := drain(dropping); !reflect.DeepEqual(events, expected) {
+		t.Errorf("wrong results: got %+v, expected %+v", events, expected)
+	}
+
+	if events := drain(closing); len(events) != 2 || !errors.Is(closing.Err(), ErrWatchOverflow) {
+		t.Errorf("wrong results: got %+v %v, expected overflow", events, closing.Err())
+	}
+}
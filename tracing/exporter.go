@@ -0,0 +1,88 @@
+package tracing
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EXPORT_TIMEOUT timeout of export of one batch to collector
+const EXPORT_TIMEOUT = 5 * time.Second
+
+// Exporter sends batches of spans encoded as ExportTraceServiceRequest of OTLP/JSON.
+// Export is called by one goroutine at a time
+type Exporter interface {
+	Export(payload []byte) error
+	Close() error
+}
+
+// ParseExporter returns exporter by endpoint: HTTPExporter for http:// and https:// URLs
+// of collector, e.g. http://localhost:4318/v1/traces, FileExporter for other endpoints
+func ParseExporter(endpoint string) (Exporter, error) {
+	if strings.HasPrefix(endpoint, "http://") || strings.HasPrefix(endpoint, "https://") {
+		return NewHTTPExporter(endpoint), nil
+	}
+	return NewFileExporter(endpoint)
+}
+
+// FileExporter appends every batch to file as one line, the format of file exporter of OpenTelemetry Collector
+type FileExporter struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+// NewFileExporter opens file at path for appending, the file is created if it doesn't exist
+func NewFileExporter(path string) (*FileExporter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{file: file}, nil
+}
+
+func (e *FileExporter) Export(payload []byte) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	_, err := e.file.Write(append(payload, '\n'))
+	return err
+}
+
+func (e *FileExporter) Close() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.file.Close()
+}
+
+// HTTPExporter posts every batch to OTLP/HTTP endpoint of collector
+type HTTPExporter struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPExporter initializes HTTPExporter posting to url
+func NewHTTPExporter(url string) *HTTPExporter {
+	return &HTTPExporter{url: url, client: &http.Client{Timeout: EXPORT_TIMEOUT}}
+}
+
+func (e *HTTPExporter) Export(payload []byte) error {
+	response, err := e.client.Post(e.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, 4096))
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded %s", response.Status)
+	}
+	return nil
+}
+
+func (e *HTTPExporter) Close() error {
+	e.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,139 @@
+package tracing
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// SCOPE_NAME name of instrumentation scope of spans
+const SCOPE_NAME = "github.com/Bambelbl/iproto-server"
+
+// Status codes of spans of OTLP
+const (
+	STATUS_UNSET = 0
+	STATUS_ERROR = 2
+)
+
+// otlpRequest ExportTraceServiceRequest of OTLP in its JSON encoding
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+// otlpAnyValue value of attribute, 64-bit integers are strings in JSON encoding of OTLP
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// MarshalOTLP encodes spans of service as ExportTraceServiceRequest of OTLP/JSON,
+// the body collectors accept on /v1/traces
+func MarshalOTLP(service string, spans []SpanData) ([]byte, error) {
+	encoded := make([]otlpSpan, len(spans))
+	for i, data := range spans {
+		span := otlpSpan{
+			TraceID:           data.TraceID.String(),
+			SpanID:            data.SpanID.String(),
+			Name:              data.Name,
+			Kind:              data.Kind,
+			StartTimeUnixNano: unixNano(data.Start),
+			EndTimeUnixNano:   unixNano(data.End),
+			Attributes:        make([]otlpKeyValue, len(data.Attributes)),
+		}
+		if data.ParentID.IsValid() {
+			span.ParentSpanID = data.ParentID.String()
+		}
+		for j, attribute := range data.Attributes {
+			span.Attributes[j] = otlpKeyValue{Key: attribute.Key, Value: anyValue(attribute.Value)}
+		}
+		if data.Error {
+			span.Status = otlpStatus{Code: STATUS_ERROR, Message: data.StatusMessage}
+		}
+		encoded[i] = span
+	}
+	return json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{
+			{Key: "service.name", Value: anyValue(service)},
+		}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: SCOPE_NAME}, Spans: encoded}},
+	}}})
+}
+
+// unixNano formats time as unix nanoseconds
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// anyValue converts value of attribute to OTLP value, values of other types are formatted as strings
+func anyValue(value interface{}) otlpAnyValue {
+	var integer int64
+	switch v := value.(type) {
+	case string:
+		return otlpAnyValue{StringValue: &v}
+	case bool:
+		return otlpAnyValue{BoolValue: &v}
+	case float64:
+		return otlpAnyValue{DoubleValue: &v}
+	case int:
+		integer = int64(v)
+	case int32:
+		integer = int64(v)
+	case int64:
+		integer = v
+	case uint32:
+		integer = int64(v)
+	case time.Duration:
+		integer = int64(v)
+	case fmt.Stringer:
+		str := v.String()
+		return otlpAnyValue{StringValue: &str}
+	default:
+		str := fmt.Sprint(v)
+		return otlpAnyValue{StringValue: &str}
+	}
+	str := strconv.FormatInt(integer, 10)
+	return otlpAnyValue{IntValue: &str}
+}
@@ -0,0 +1,483 @@
+// Package tracing records spans of requests of iproto server and exports them as OTLP/JSON
+// to a file or a collector, so slow requests can be broken down by stages.
+//
+// Tracer starts root spans, Start starts child spans of span kept in context.
+// Nil *Tracer and nil *Span are valid and do nothing, so code is traced the same way
+// whether tracing is enabled or not
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// TRACE_CONTEXT_SIZE length of SpanContext in binary form: trace id, span id and trace flags
+	TRACE_CONTEXT_SIZE = 16 + 8 + 1
+	// FLAG_SAMPLED trace flag of sampled trace as in W3C Trace Context
+	FLAG_SAMPLED = 0x01
+	// QUEUE_SIZE number of ended spans waiting for export, spans ended when queue is full are dropped
+	QUEUE_SIZE = 2048
+	// BATCH_SIZE max number of spans exported at once
+	BATCH_SIZE = 512
+	// BATCH_INTERVAL max time ended span waits for export
+	BATCH_INTERVAL = time.Second
+	// SERVICE_NAME default service.name of resource of spans
+	SERVICE_NAME = "iproto-server"
+)
+
+// Attributes of spans of iproto server
+const (
+	ATTR_CLIENT_ADDRESS = "client.address"
+	ATTR_FUNC_ID        = "iproto.func_id"
+	ATTR_REQUEST_ID     = "iproto.request_id"
+	ATTR_RETURN_CODE    = "iproto.return_code"
+	ATTR_FUNCTION       = "iproto.function"
+)
+
+// SpanKind role of span in trace, values are the ones of OTLP
+type SpanKind int
+
+const (
+	KIND_INTERNAL SpanKind = 1
+	KIND_SERVER   SpanKind = 2
+	KIND_CLIENT   SpanKind = 3
+)
+
+// TraceID identifier of trace
+type TraceID [16]byte
+
+// SpanID identifier of span
+type SpanID [8]byte
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// IsValid reports whether id is not zero
+func (id TraceID) IsValid() bool {
+	return id != TraceID{}
+}
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// IsValid reports whether id is not zero
+func (id SpanID) IsValid() bool {
+	return id != SpanID{}
+}
+
+// SpanContext identifies span within trace, it's what is propagated between processes
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid reports whether both trace id and span id are set
+func (c SpanContext) IsValid() bool {
+	return c.TraceID.IsValid() && c.SpanID.IsValid()
+}
+
+// Bytes returns binary form of context: trace id, span id and trace flags
+func (c SpanContext) Bytes() []byte {
+	data := make([]byte, 0, TRACE_CONTEXT_SIZE)
+	data = append(append(data, c.TraceID[:]...), c.SpanID[:]...)
+	var flags byte
+	if c.Sampled {
+		flags |= FLAG_SAMPLED
+	}
+	return append(data, flags)
+}
+
+// ParseSpanContext returns SpanContext from its binary form made by Bytes
+func ParseSpanContext(data []byte) (c SpanContext, err error) {
+	if len(data) != TRACE_CONTEXT_SIZE {
+		return c, fmt.Errorf("trace context must be %d bytes, got %d", TRACE_CONTEXT_SIZE, len(data))
+	}
+	copy(c.TraceID[:], data[:16])
+	copy(c.SpanID[:], data[16:24])
+	c.Sampled = data[24]&FLAG_SAMPLED != 0
+	if !c.IsValid() {
+		return c, errors.New("trace context has zero id")
+	}
+	return c, nil
+}
+
+type spanKey struct{}
+
+type remoteKey struct{}
+
+// ContextWithSpan returns ctx keeping span, spans started by Start with the context are its children
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// SpanFromContext returns span kept in ctx, nil if there is none
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// ContextWithRemote returns ctx keeping context of span of other process, e.g. to propagate it
+// to server by client.Client without tracing in this process
+func ContextWithRemote(ctx context.Context, c SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, c)
+}
+
+// SpanContextFromContext returns context of span kept in ctx or the remote one, zero if there is none
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	if span := SpanFromContext(ctx); span != nil {
+		return span.Context()
+	}
+	c, _ := ctx.Value(remoteKey{}).(SpanContext)
+	return c
+}
+
+// Attribute key and value of attribute of span
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// SpanData everything recorded about ended span
+type SpanData struct {
+	Name          string
+	Kind          SpanKind
+	TraceID       TraceID
+	SpanID        SpanID
+	ParentID      SpanID
+	Start         time.Time
+	End           time.Time
+	Attributes    []Attribute
+	Error         bool
+	StatusMessage string
+}
+
+// Span stage of handling of request, its methods must be called by one goroutine at a time
+type Span struct {
+	tracer *Tracer
+	data   SpanData
+}
+
+// Context returns context of span to start its children in other process
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return SpanContext{TraceID: s.data.TraceID, SpanID: s.data.SpanID, Sampled: true}
+}
+
+// SetAttributes adds attributes given as alternating keys and values
+func (s *Span) SetAttributes(kv ...interface{}) {
+	if s == nil {
+		return
+	}
+	s.data.Attributes = appendAttributes(s.data.Attributes, kv)
+}
+
+// SetError marks span as failed with description of err
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.data.Error = true
+	s.data.StatusMessage = err.Error()
+}
+
+// End ends span now and queues it for export
+func (s *Span) End() {
+	s.EndAt(time.Now())
+}
+
+// EndAt ends span at end and queues it for export, span must not be used after it
+func (s *Span) EndAt(end time.Time) {
+	if s == nil {
+		return
+	}
+	s.data.End = end
+	s.tracer.queue(s.data)
+}
+
+// appendAttributes appends kv to attributes, value of odd key is missing
+func appendAttributes(attributes []Attribute, kv []interface{}) []Attribute {
+	for i := 0; i < len(kv); i += 2 {
+		key, ok := kv[i].(string)
+		if !ok {
+			key = fmt.Sprint(kv[i])
+		}
+		var value interface{} = "(MISSING)"
+		if i+1 < len(kv) {
+			value = kv[i+1]
+		}
+		attributes = append(attributes, Attribute{Key: key, Value: value})
+	}
+	return attributes
+}
+
+// StartOption configures span started by Tracer.Start or Start
+type StartOption func(c *startConfig)
+
+type startConfig struct {
+	start      time.Time
+	kind       SpanKind
+	parent     SpanContext
+	attributes []interface{}
+}
+
+// WithStartTime starts span at start instead of now, e.g. when it's known only afterwards that stage is traced
+func WithStartTime(start time.Time) StartOption {
+	return func(c *startConfig) {
+		c.start = start
+	}
+}
+
+// WithKind sets kind of span, KIND_INTERNAL by default
+func WithKind(kind SpanKind) StartOption {
+	return func(c *startConfig) {
+		c.kind = kind
+	}
+}
+
+// WithParent makes span child of span of other process, it takes precedence over span kept in context.
+// Invalid parent is ignored
+func WithParent(parent SpanContext) StartOption {
+	return func(c *startConfig) {
+		c.parent = parent
+	}
+}
+
+// WithAttributes sets attributes given as alternating keys and values
+func WithAttributes(kv ...interface{}) StartOption {
+	return func(c *startConfig) {
+		c.attributes = append(c.attributes, kv...)
+	}
+}
+
+// Start starts child span of span kept in ctx and returns context keeping the child.
+// Without span in ctx nothing is traced: ctx and nil span are returned
+func Start(ctx context.Context, name string, opts ...StartOption) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	return parent.tracer.Start(ctx, name, opts...)
+}
+
+// Option configures optional behaviour of Tracer
+type Option func(t *Tracer)
+
+// WithSampleRatio makes Tracer record given ratio of traces started by it, all of them by default.
+// Traces continued from other process are recorded if they are sampled there
+func WithSampleRatio(ratio float64) Option {
+	return func(t *Tracer) {
+		switch {
+		case ratio >= 1:
+			t.threshold = math.MaxUint64
+		case ratio <= 0:
+			t.threshold = 0
+		default:
+			t.threshold = uint64(ratio * math.MaxUint64)
+		}
+	}
+}
+
+// WithServiceName sets service.name of resource of spans, SERVICE_NAME by default
+func WithServiceName(name string) Option {
+	return func(t *Tracer) {
+		t.service = name
+	}
+}
+
+// WithBatch sets max number of spans exported at once and max time ended span waits for export
+func WithBatch(size int, interval time.Duration) Option {
+	return func(t *Tracer) {
+		t.batchSize = size
+		t.interval = interval
+	}
+}
+
+// WithErrorHandler sets hook called with errors of export and number of dropped spans
+func WithErrorHandler(onError func(err error)) Option {
+	return func(t *Tracer) {
+		t.onError = onError
+	}
+}
+
+// Tracer starts root spans and exports ended spans of its traces in batches
+type Tracer struct {
+	exporter  Exporter
+	service   string
+	threshold uint64
+	batchSize int
+	interval  time.Duration
+	onError   func(err error)
+
+	spans     chan SpanData
+	dropped   atomic.Uint64
+	quit      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewTracer initializes Tracer exporting spans to exporter and starts export in background
+func NewTracer(exporter Exporter, opts ...Option) *Tracer {
+	t := &Tracer{
+		exporter:  exporter,
+		service:   SERVICE_NAME,
+		threshold: math.MaxUint64,
+		batchSize: BATCH_SIZE,
+		interval:  BATCH_INTERVAL,
+		spans:     make(chan SpanData, QUEUE_SIZE),
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	go t.export()
+	return t
+}
+
+// Start starts span and returns context keeping it. Span is child of parent given by WithParent,
+// of span kept in ctx or of span of other process kept by ContextWithRemote, or root of new trace.
+// Span of trace which is not sampled is nil
+func (t *Tracer) Start(ctx context.Context, name string, opts ...StartOption) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	config := startConfig{kind: KIND_INTERNAL}
+	for _, opt := range opts {
+		opt(&config)
+	}
+	parent := config.parent
+	if !parent.IsValid() {
+		parent = SpanContextFromContext(ctx)
+	}
+	span := &Span{tracer: t, data: SpanData{Name: name, Kind: config.kind, Start: config.start, SpanID: newSpanID()}}
+	if parent.IsValid() {
+		if !parent.Sampled {
+			return ctx, nil
+		}
+		span.data.TraceID, span.data.ParentID = parent.TraceID, parent.SpanID
+	} else {
+		span.data.TraceID = newTraceID()
+		if binary.BigEndian.Uint64(span.data.TraceID[8:]) > t.threshold || t.threshold == 0 {
+			return ctx, nil
+		}
+	}
+	if span.data.Start.IsZero() {
+		span.data.Start = time.Now()
+	}
+	span.data.Attributes = appendAttributes(nil, config.attributes)
+	return ContextWithSpan(ctx, span), span
+}
+
+// queue queues ended span for export, span is dropped if queue is full or tracer is closed
+func (t *Tracer) queue(data SpanData) {
+	select {
+	case <-t.quit:
+		t.dropped.Add(1)
+		return
+	default:
+	}
+	select {
+	case t.spans <- data:
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+// export exports queued spans in batches until Close
+func (t *Tracer) export() {
+	defer close(t.done)
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	batch := make([]SpanData, 0, t.batchSize)
+	flush := func() {
+		if dropped := t.dropped.Swap(0); dropped > 0 {
+			t.fail(fmt.Errorf("%d spans dropped: export queue is full", dropped))
+		}
+		if len(batch) == 0 {
+			return
+		}
+		payload, err := MarshalOTLP(t.service, batch)
+		if err == nil {
+			err = t.exporter.Export(payload)
+		}
+		if err != nil {
+			t.fail(fmt.Errorf("export of %d spans: %w", len(batch), err))
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case data := <-t.spans:
+			batch = append(batch, data)
+			if len(batch) >= t.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-t.quit:
+			for {
+				select {
+				case data := <-t.spans:
+					batch = append(batch, data)
+					if len(batch) >= t.batchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// fail passes err to error handler
+func (t *Tracer) fail(err error) {
+	if t.onError != nil {
+		t.onError(err)
+	}
+}
+
+// Close exports queued spans and closes exporter, spans ended afterwards are dropped
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	t.closeOnce.Do(func() {
+		close(t.quit)
+		<-t.done
+		t.closeErr = t.exporter.Close()
+	})
+	return t.closeErr
+}
+
+// newTraceID returns random trace id
+func newTraceID() (id TraceID) {
+	for !id.IsValid() {
+		_, _ = rand.Read(id[:])
+	}
+	return
+}
+
+// newSpanID returns random span id
+func newSpanID() (id SpanID) {
+	for !id.IsValid() {
+		_, _ = rand.Read(id[:])
+	}
+	return
+}
@@ -0,0 +1,268 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingExporter keeps exported payloads
+type recordingExporter struct {
+	mutex    sync.Mutex
+	payloads [][]byte
+	err      error
+	closed   bool
+}
+
+func (e *recordingExporter) Export(payload []byte) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.payloads = append(e.payloads, payload)
+	return e.err
+}
+
+func (e *recordingExporter) Close() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.closed = true
+	return nil
+}
+
+// spans decodes spans of all exported payloads
+func (e *recordingExporter) spans(t *testing.T) []otlpSpan {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	var spans []otlpSpan
+	for _, payload := range e.payloads {
+		var request otlpRequest
+		if err := json.Unmarshal(payload, &request); err != nil {
+			t.Fatalf("invalid payload %q: %v", payload, err)
+		}
+		for _, resource := range request.ResourceSpans {
+			for _, scope := range resource.ScopeSpans {
+				spans = append(spans, scope.Spans...)
+			}
+		}
+	}
+	return spans
+}
+
+var (
+	testTraceID = TraceID{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36}
+	testSpanID  = SpanID{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7}
+)
+
+type SpanContextTestCase struct {
+	Data    []byte
+	Context SpanContext
+	IsError bool
+}
+
+func TestParseSpanContext(t *testing.T) {
+	cases := []SpanContextTestCase{
+		{
+			Data:    append(append(testTraceID[:], testSpanID[:]...), FLAG_SAMPLED),
+			Context: SpanContext{TraceID: testTraceID, SpanID: testSpanID, Sampled: true},
+		},
+		{
+			Data:    append(append(testTraceID[:], testSpanID[:]...), 0x02),
+			Context: SpanContext{TraceID: testTraceID, SpanID: testSpanID},
+		},
+		{
+			Data:    testTraceID[:],
+			IsError: true,
+		},
+		{
+			Data:    make([]byte, TRACE_CONTEXT_SIZE),
+			IsError: true,
+		},
+	}
+	for caseNum, item := range cases {
+		c, err := ParseSpanContext(item.Data)
+		if item.IsError {
+			if err == nil {
+				t.Errorf("[%d] expected error, got %+v", caseNum, c)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[%d] unexpected error: %v", caseNum, err)
+			continue
+		}
+		if c != item.Context {
+			t.Errorf("[%d] wrong results: got %+v, expected %+v", caseNum, c, item.Context)
+		}
+		if item.Context.Sampled && !bytes.Equal(c.Bytes(), item.Data) {
+			t.Errorf("[%d] wrong bytes: got %x, expected %x", caseNum, c.Bytes(), item.Data)
+		}
+	}
+}
+
+type SamplingTestCase struct {
+	Ratio   float64
+	Parent  SpanContext
+	Traced  bool
+	TraceID TraceID
+}
+
+func TestTracer_Sampling(t *testing.T) {
+	cases := []SamplingTestCase{
+		{Ratio: 1, Traced: true},
+		{Ratio: 0, Traced: false},
+		{Ratio: 0, Parent: SpanContext{TraceID: testTraceID, SpanID: testSpanID, Sampled: true}, Traced: true, TraceID: testTraceID},
+		{Ratio: 1, Parent: SpanContext{TraceID: testTraceID, SpanID: testSpanID}, Traced: false},
+	}
+	for caseNum, item := range cases {
+		tracer := NewTracer(&recordingExporter{}, WithSampleRatio(item.Ratio))
+		_, span := tracer.Start(context.Background(), "request", WithParent(item.Parent))
+		if (span != nil) != item.Traced {
+			t.Errorf("[%d] wrong results: got traced %v, expected %v", caseNum, span != nil, item.Traced)
+		}
+		if span != nil && item.TraceID.IsValid() && (span.data.TraceID != item.TraceID || span.data.ParentID != item.Parent.SpanID) {
+			t.Errorf("[%d] wrong results: got trace %s parent %s, expected trace %s parent %s", caseNum,
+				span.data.TraceID, span.data.ParentID, item.TraceID, item.Parent.SpanID)
+		}
+		_ = tracer.Close()
+	}
+
+	// About half of new traces is recorded with ratio 0.5
+	tracer := NewTracer(&recordingExporter{}, WithSampleRatio(0.5))
+	defer tracer.Close()
+	traced := 0
+	for i := 0; i < 1000; i++ {
+		if _, span := tracer.Start(context.Background(), "request"); span != nil {
+			traced++
+		}
+	}
+	if traced < 400 || traced > 600 {
+		t.Errorf("wrong results: got %d of 1000 traces recorded, expected about 500", traced)
+	}
+}
+
+func TestTracer_Nil(t *testing.T) {
+	var tracer *Tracer
+	ctx, span := tracer.Start(context.Background(), "request")
+	if span != nil || SpanFromContext(ctx) != nil {
+		t.Fatalf("wrong results: nil tracer started span %+v", span)
+	}
+	_, child := Start(ctx, "child")
+	child.SetAttributes("key", "value")
+	child.SetError(errors.New("failed"))
+	child.End()
+	if child.Context().IsValid() {
+		t.Errorf("wrong results: nil span has valid context")
+	}
+	if err := tracer.Close(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestTracer_Export(t *testing.T) {
+	exporter := &recordingExporter{}
+	tracer := NewTracer(exporter, WithServiceName("test"), WithBatch(2, time.Hour))
+	start := time.Unix(1700000000, 0)
+	ctx, root := tracer.Start(context.Background(), "iproto.request", WithKind(KIND_SERVER), WithStartTime(start),
+		WithAttributes(ATTR_REQUEST_ID, uint32(7)))
+	_, child := Start(ctx, "iproto.decode", WithStartTime(start))
+	child.SetError(errors.New("bad body"))
+	child.EndAt(start.Add(time.Millisecond))
+	root.SetAttributes(ATTR_RETURN_CODE, uint32(0), "ok", true)
+	root.EndAt(start.Add(2 * time.Millisecond))
+	_, last := tracer.Start(context.Background(), "iproto.accept")
+	last.End()
+	if err := tracer.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !exporter.closed {
+		t.Errorf("exporter isn't closed")
+	}
+	if len(exporter.payloads) != 2 {
+		t.Fatalf("wrong results: got %d batches, expected 2", len(exporter.payloads))
+	}
+	if !strings.Contains(string(exporter.payloads[0]), `{"key":"service.name","value":{"stringValue":"test"}}`) {
+		t.Errorf("wrong resource: %s", exporter.payloads[0])
+	}
+
+	spans := exporter.spans(t)
+	decode, request := spans[0], spans[1]
+	expected := otlpSpan{
+		TraceID:           request.TraceID,
+		SpanID:            decode.SpanID,
+		ParentSpanID:      request.SpanID,
+		Name:              "iproto.decode",
+		Kind:              KIND_INTERNAL,
+		StartTimeUnixNano: "1700000000000000000",
+		EndTimeUnixNano:   "1700000000001000000",
+		Status:            otlpStatus{Code: STATUS_ERROR, Message: "bad body"},
+	}
+	if decode.TraceID != root.data.TraceID.String() || decode.ParentSpanID != expected.ParentSpanID ||
+		decode.Name != expected.Name || decode.Kind != expected.Kind || decode.StartTimeUnixNano != expected.StartTimeUnixNano ||
+		decode.EndTimeUnixNano != expected.EndTimeUnixNano || decode.Status != expected.Status || len(decode.Attributes) != 0 {
+		t.Errorf("wrong results: got %+v, expected %+v", decode, expected)
+	}
+	if request.ParentSpanID != "" || request.Kind != KIND_SERVER || request.Status.Code != STATUS_UNSET || len(request.Attributes) != 3 {
+		t.Fatalf("wrong results: got %+v", request)
+	}
+	if v := request.Attributes[0].Value; request.Attributes[0].Key != ATTR_REQUEST_ID || v.IntValue == nil || *v.IntValue != "7" {
+		t.Errorf("wrong attribute: got %+v", request.Attributes[0])
+	}
+	if v := request.Attributes[2].Value; v.BoolValue == nil || !*v.BoolValue {
+		t.Errorf("wrong attribute: got %+v", request.Attributes[2])
+	}
+}
+
+func TestTracer_ExportError(t *testing.T) {
+	exporter := &recordingExporter{err: errors.New("collector is down")}
+	var mutex sync.Mutex
+	var errs []error
+	tracer := NewTracer(exporter, WithErrorHandler(func(err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		errs = append(errs, err)
+	}))
+	_, span := tracer.Start(context.Background(), "request")
+	span.End()
+	_ = tracer.Close()
+	// Spans ended after Close are dropped
+	span.End()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(errs) != 1 || !errors.Is(errs[0], exporter.err) {
+		t.Errorf("wrong results: got %v, expected export error", errs)
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.json")
+	exporter, err := ParseExporter(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := exporter.(*FileExporter); !ok {
+		t.Fatalf("wrong results: got %T, expected *FileExporter", exporter)
+	}
+	for _, payload := range []string{`{"resourceSpans":[]}`, `{"resourceSpans":[{}]}`} {
+		if err = exporter.Export([]byte(payload)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err = exporter.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "{\"resourceSpans\":[]}\n{\"resourceSpans\":[{}]}\n"
+	if string(data) != expected {
+		t.Errorf("wrong results: got %q, expected %q", data, expected)
+	}
+}